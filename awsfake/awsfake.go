@@ -0,0 +1,49 @@
+// Package awsfake provides in-memory fakes of the SQS, Lambda and DynamoDB APIs used by the project,
+// so that the queue, consumer, store and pipeline manager code can be tested without AWS.
+// The fakes model the state of queues, functions, event source mappings and tables, only the methods the
+// project calls are implemented, calling any other method will panic.
+package awsfake
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"sync"
+)
+
+const (
+	region    = "eu-west-2"
+	accountID = "000000000000"
+)
+
+// failures holds errors to be returned by the next calls to the named API operations.
+type failures struct {
+	mu   sync.Mutex
+	errs map[string][]error
+}
+
+// FailNext makes the next call to the named API operation, eg "CreateFunction", return the error.
+// Calling FailNext multiple times for the same operation queues up the errors.
+func (f *failures) FailNext(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[string][]error)
+	}
+	f.errs[op] = append(f.errs[op], err)
+}
+
+// failure pops the next queued error for the operation.
+func (f *failures) failure(op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	errs := f.errs[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	f.errs[op] = errs[1:]
+	return errs[0]
+}
+
+func awsErr(code, format string, args ...interface{}) error {
+	return awserr.New(code, fmt.Sprintf(format, args...), nil)
+}
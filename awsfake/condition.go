@@ -0,0 +1,243 @@
+package awsfake
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"math/big"
+	"strings"
+	"unicode"
+)
+
+// checkCondition evaluates the condition expression against the existing item, which is nil when
+// there is no existing item, and returns a ConditionalCheckFailedException if it does not hold.
+// The supported grammar is the subset used by the project: comparisons (= <> < <= > >=),
+// BETWEEN, attribute_exists, attribute_not_exists, AND, OR, NOT and parentheses.
+func checkCondition(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) error {
+	if expr == nil || *expr == "" {
+		return nil
+	}
+	p := &condParser{tokens: tokenize(*expr), names: names, values: values, item: item}
+	ok, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = awsErr("ValidationException", "invalid condition expression: unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return awsErr(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed")
+	}
+	return nil
+}
+
+type condParser struct {
+	tokens []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	item   map[string]*dynamodb.AttributeValue
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *condParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *condParser) expect(tok string) error {
+	if t := p.next(); t != tok {
+		return awsErr("ValidationException", "invalid condition expression: expected %q, got %q", tok, t)
+	}
+	return nil
+}
+
+func (p *condParser) parseOr() (bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return false, err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return false, err
+		}
+		left = left || right
+	}
+	return left, nil
+}
+
+func (p *condParser) parseAnd() (bool, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return false, err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return false, err
+		}
+		left = left && right
+	}
+	return left, nil
+}
+
+func (p *condParser) parseNot() (bool, error) {
+	if strings.EqualFold(p.peek(), "NOT") {
+		p.next()
+		ok, err := p.parseNot()
+		return !ok, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *condParser) parsePrimary() (bool, error) {
+	switch tok := p.next(); {
+	case tok == "(":
+		ok, err := p.parseOr()
+		if err != nil {
+			return false, err
+		}
+		return ok, p.expect(")")
+	case tok == "attribute_exists" || tok == "attribute_not_exists":
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		v, err := p.operand(p.next())
+		if err != nil {
+			return false, err
+		}
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		return (v != nil) == (tok == "attribute_exists"), nil
+	default:
+		left, err := p.operand(tok)
+		if err != nil {
+			return false, err
+		}
+		op := p.next()
+		right, err := p.operand(p.next())
+		if err != nil {
+			return false, err
+		}
+		if !strings.EqualFold(op, "BETWEEN") {
+			return compare(left, op, right)
+		}
+		if err := p.expect("AND"); err != nil {
+			return false, err
+		}
+		high, err := p.operand(p.next())
+		if err != nil {
+			return false, err
+		}
+		above, err := compare(left, ">=", right)
+		if err != nil {
+			return false, err
+		}
+		below, err := compare(left, "<=", high)
+		return above && below, err
+	}
+}
+
+// operand resolves a placeholder or attribute name to its value, missing attributes are nil.
+func (p *condParser) operand(tok string) (*dynamodb.AttributeValue, error) {
+	switch {
+	case strings.HasPrefix(tok, ":"):
+		v, ok := p.values[tok]
+		if !ok {
+			return nil, awsErr("ValidationException", "undefined expression attribute value %s", tok)
+		}
+		return v, nil
+	case strings.HasPrefix(tok, "#"):
+		name, ok := p.names[tok]
+		if !ok {
+			return nil, awsErr("ValidationException", "undefined expression attribute name %s", tok)
+		}
+		return p.item[aws.StringValue(name)], nil
+	case tok == "" || tok == "(" || tok == ")":
+		return nil, awsErr("ValidationException", "invalid condition expression: expected operand, got %q", tok)
+	default:
+		return p.item[tok], nil
+	}
+}
+
+// compare compares two number or string values, comparisons with missing values are false.
+func compare(left *dynamodb.AttributeValue, op string, right *dynamodb.AttributeValue) (bool, error) {
+	if left == nil || right == nil {
+		return op == "<>" && (left != nil || right != nil), nil
+	}
+	var c int
+	switch {
+	case left.N != nil && right.N != nil:
+		l, lok := new(big.Float).SetString(*left.N)
+		r, rok := new(big.Float).SetString(*right.N)
+		if !lok || !rok {
+			return false, awsErr("ValidationException", "invalid number")
+		}
+		c = l.Cmp(r)
+	case left.S != nil && right.S != nil:
+		c = strings.Compare(*left.S, *right.S)
+	default:
+		return op == "<>", nil
+	}
+	switch op {
+	case "=":
+		return c == 0, nil
+	case "<>":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	}
+	return false, awsErr("ValidationException", "invalid condition expression: unknown operator %q", op)
+}
+
+func tokenize(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		r := rune(expr[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == '=' || r == ',':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '<' || r == '>':
+			j := i + 1
+			if j < len(expr) && (expr[j] == '=' || (r == '<' && expr[j] == '>')) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t\n()=<>,", rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// isConditionFailed reports whether err is the ConditionalCheckFailedException returned by checkCondition.
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,49 @@
+package awsfake
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckCondition(t *testing.T) {
+	names := map[string]*string{"#version": aws.String("version")}
+	values := map[string]*dynamodb.AttributeValue{
+		":version": {N: aws.String("2")},
+		":id":      {S: aws.String("b")},
+		":high":    {N: aws.String("12")},
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"id":      {S: aws.String("b")},
+		"version": {N: aws.String("10")},
+	}
+	tests := []struct {
+		expr string
+		item map[string]*dynamodb.AttributeValue
+		want bool
+	}{
+		{"attribute_not_exists(#version)", nil, true},
+		{"attribute_not_exists(#version)", item, false},
+		{"attribute_exists(id)", item, true},
+		{"#version = :version", item, false},
+		{"#version > :version", item, true}, // compared as numbers, not strings
+		{"attribute_not_exists(#version) OR #version <= :version", item, false},
+		{"attribute_not_exists(#version) OR #version <= :version", nil, true},
+		{"id = :id AND NOT (#version < :version)", item, true},
+		{"id <> :id", item, false},
+		{"#version BETWEEN :version AND :high", item, true},
+		{"#version BETWEEN :high AND :high AND id = :id", item, false},
+	}
+	for _, tt := range tests {
+		err := checkCondition(aws.String(tt.expr), names, values, tt.item)
+		if tt.want {
+			assert.NoError(t, err, tt.expr)
+			continue
+		}
+		if aerr, ok := err.(awserr.Error); assert.True(t, ok, tt.expr) {
+			assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, aerr.Code(), tt.expr)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package awsfake
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DynamoDB is an in-memory fake of the DynamoDB API.
+// Tables must be created, with CreateTable or CreateTableWithContext, before items can be written to them.
+type DynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	failures
+
+	mu     sync.Mutex
+	tables map[string]*table
+}
+
+type table struct {
+	keys  []string // hash key name followed by the optional range key name
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+// NewDynamoDB returns a new DynamoDB fake with no tables.
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{tables: make(map[string]*table)}
+}
+
+// CreateTable creates a table with the given hash key and optional range key, key attributes may be
+// strings or numbers.
+// Creating a table that already exists leaves the existing table untouched.
+func (d *DynamoDB) CreateTable(name string, keys ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.tables[name]; !ok {
+		d.tables[name] = &table{keys: keys, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	}
+}
+
+// TableNames returns the names of all the tables.
+func (d *DynamoDB) TableNames() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var names []string
+	for name := range d.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CreateTableWithContext creates a table from the key schema of the input.
+func (d *DynamoDB) CreateTableWithContext(ctx aws.Context, in *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	if err := d.failure("CreateTable"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(in.TableName)
+	d.mu.Lock()
+	_, exists := d.tables[name]
+	d.mu.Unlock()
+	if exists {
+		return nil, awsErr(dynamodb.ErrCodeResourceInUseException, "table already exists: %s", name)
+	}
+	var keys []string
+	for _, k := range in.KeySchema {
+		if aws.StringValue(k.KeyType) == dynamodb.KeyTypeHash {
+			keys = append([]string{aws.StringValue(k.AttributeName)}, keys...)
+		} else {
+			keys = append(keys, aws.StringValue(k.AttributeName))
+		}
+	}
+	d.CreateTable(name, keys...)
+	return &dynamodb.CreateTableOutput{TableDescription: &dynamodb.TableDescription{
+		TableName:   aws.String(name),
+		KeySchema:   in.KeySchema,
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+	}}, nil
+}
+
+// GetItemWithContext gets the item with the given key, the output item is nil if there is no such item.
+func (d *DynamoDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := d.failure("GetItem"); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(aws.StringValue(in.TableName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: t.items[key]}, nil
+}
+
+// PutItemWithContext puts the item if the condition expression, if any, holds for the existing item.
+func (d *DynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := d.failure("PutItem"); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(aws.StringValue(in.TableName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(in.Item)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCondition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues, t.items[key]); err != nil {
+		return nil, err
+	}
+	t.items[key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// DeleteItemWithContext deletes the item if the condition expression, if any, holds for the existing item.
+func (d *DynamoDB) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := d.failure("DeleteItem"); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(aws.StringValue(in.TableName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCondition(in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues, t.items[key]); err != nil {
+		return nil, err
+	}
+	delete(t.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// ScanWithContext scans the table in key order, honouring Limit and ExclusiveStartKey.
+func (d *DynamoDB) ScanWithContext(ctx aws.Context, in *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	if err := d.failure("Scan"); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(aws.StringValue(in.TableName))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if in.ExclusiveStartKey != nil {
+		start, err := t.key(in.ExclusiveStartKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > start }):]
+	}
+	out := &dynamodb.ScanOutput{}
+	limit := int(aws.Int64Value(in.Limit))
+	for i, k := range keys {
+		if limit > 0 && i == limit {
+			last := out.Items[len(out.Items)-1]
+			out.LastEvaluatedKey = make(map[string]*dynamodb.AttributeValue)
+			for _, name := range t.keys {
+				out.LastEvaluatedKey[name] = last[name]
+			}
+			break
+		}
+		out.Items = append(out.Items, t.items[k])
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	out.ScannedCount = out.Count
+	return out, nil
+}
+
+// QueryWithContext returns the items matching the key condition expression in range key order, or
+// key order for tables without one, reversed when ScanIndexForward is false, honouring Limit and ExclusiveStartKey. The key condition
+// is evaluated like a condition expression against every item in the table.
+func (d *DynamoDB) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	if err := d.failure("Query"); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, err := d.table(aws.StringValue(in.TableName))
+	if err != nil {
+		return nil, err
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	for _, item := range t.items {
+		err := checkCondition(in.KeyConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues, item)
+		if isConditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		ki, _ := t.key(items[i])
+		kj, _ := t.key(items[j])
+		return ki < kj
+	})
+	if len(t.keys) > 1 {
+		rangeKey := t.keys[1]
+		sort.SliceStable(items, func(i, j int) bool {
+			less, _ := compare(items[i][rangeKey], "<", items[j][rangeKey])
+			return less
+		})
+	}
+	if in.ScanIndexForward != nil && !*in.ScanIndexForward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if in.ExclusiveStartKey != nil {
+		start, err := t.key(in.ExclusiveStartKey)
+		if err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			if k, _ := t.key(item); k == start {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+	out := &dynamodb.QueryOutput{}
+	limit := int(aws.Int64Value(in.Limit))
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+		out.LastEvaluatedKey = make(map[string]*dynamodb.AttributeValue)
+		for _, name := range t.keys {
+			out.LastEvaluatedKey[name] = items[limit-1][name]
+		}
+	}
+	out.Items = items
+	out.Count = aws.Int64(int64(len(out.Items)))
+	out.ScannedCount = out.Count
+	return out, nil
+}
+
+func (d *DynamoDB) table(name string) (*table, error) {
+	t, ok := d.tables[name]
+	if !ok {
+		return nil, awsErr(dynamodb.ErrCodeResourceNotFoundException, "requested resource not found: table %s", name)
+	}
+	return t, nil
+}
+
+// key returns the table key of the item, the key attributes must be strings or numbers.
+func (t *table) key(item map[string]*dynamodb.AttributeValue) (string, error) {
+	var parts []string
+	for _, name := range t.keys {
+		v, ok := item[name]
+		switch {
+		case ok && v.S != nil:
+			parts = append(parts, *v.S)
+		case ok && v.N != nil:
+			parts = append(parts, *v.N)
+		default:
+			return "", awsErr("ValidationException", "missing key attribute %s", name)
+		}
+	}
+	return strings.Join(parts, "\x00"), nil
+}
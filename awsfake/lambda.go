@@ -0,0 +1,371 @@
+package awsfake
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"sync"
+)
+
+// Function is the state of a fake Lambda function.
+type Function struct {
+	Name        string
+	ARN         string
+	Timeout     int64
+	Concurrency *int64 // reserved concurrency, nil if not reserved
+	S3Bucket    string
+	S3Key       string
+	Role        string
+	State       string
+	LastUpdate  string // status of the last configuration update
+	Environment map[string]string
+}
+
+// Mapping is the state of a fake event source mapping.
+type Mapping struct {
+	UUID                  string
+	FunctionName          string
+	EventSourceARN        string
+	BatchSize             int64
+	Enabled               bool
+	FunctionResponseTypes []string
+}
+
+// Lambda is an in-memory fake of the Lambda API.
+type Lambda struct {
+	lambdaiface.LambdaAPI
+	failures
+
+	// PendingPolls is the number of times a new function reports the Pending state before it becomes Active.
+	PendingPolls int
+
+	// UpdatePolls is the number of times an updated function reports its update InProgress before it is Successful,
+	// updating the configuration while an update is in progress is a ResourceConflictException, as with Lambda.
+	UpdatePolls int
+
+	mu        sync.Mutex
+	functions map[string]*Function
+	polls     map[string]int
+	updates   map[string]int
+	mappings  []*Mapping
+	nextUUID  int
+}
+
+// NewLambda returns a new Lambda fake with no functions.
+func NewLambda() *Lambda {
+	return &Lambda{
+		functions: make(map[string]*Function),
+		polls:     make(map[string]int),
+		updates:   make(map[string]int),
+	}
+}
+
+// Function returns a copy of the function with the given name, and whether it exists.
+func (l *Lambda) Function(name string) (Function, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.functions[name]
+	if !ok {
+		return Function{}, false
+	}
+	c := *f
+	if f.Concurrency != nil {
+		c.Concurrency = aws.Int64(*f.Concurrency)
+	}
+	return c, true
+}
+
+// FunctionNames returns the names of all the functions.
+func (l *Lambda) FunctionNames() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var names []string
+	for name := range l.functions {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Mappings returns copies of all the event source mappings.
+func (l *Lambda) Mappings() []Mapping {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var mappings []Mapping
+	for _, m := range l.mappings {
+		mappings = append(mappings, *m)
+	}
+	return mappings
+}
+
+// CreateFunctionWithContext creates a function in the Pending state.
+func (l *Lambda) CreateFunctionWithContext(ctx aws.Context, in *lambda.CreateFunctionInput, opts ...request.Option) (*lambda.FunctionConfiguration, error) {
+	if err := l.failure("CreateFunction"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name := aws.StringValue(in.FunctionName)
+	if _, ok := l.functions[name]; ok {
+		return nil, awsErr(lambda.ErrCodeResourceConflictException, "function %s already exist", name)
+	}
+	f := &Function{
+		Name:       name,
+		ARN:        fmt.Sprintf("arn:aws:lambda:%s:%s:function:%s", region, accountID, name),
+		Timeout:    aws.Int64Value(in.Timeout),
+		Role:       aws.StringValue(in.Role),
+		State:      lambda.StatePending,
+		LastUpdate: lambda.LastUpdateStatusSuccessful,
+	}
+	if in.Code != nil {
+		f.S3Bucket = aws.StringValue(in.Code.S3Bucket)
+		f.S3Key = aws.StringValue(in.Code.S3Key)
+	}
+	if in.Environment != nil {
+		f.Environment = aws.StringValueMap(in.Environment.Variables)
+	}
+	l.functions[name] = f
+	l.polls[name] = 0
+	return l.configuration(f), nil
+}
+
+// GetFunctionConfigurationWithContext returns the function configuration, new functions become
+// Active once they have been polled PendingPolls times, and updates complete once they have been
+// polled UpdatePolls times.
+func (l *Lambda) GetFunctionConfigurationWithContext(ctx aws.Context, in *lambda.GetFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error) {
+	if err := l.failure("GetFunctionConfiguration"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	if f.State == lambda.StatePending {
+		if l.polls[f.Name] >= l.PendingPolls {
+			f.State = lambda.StateActive
+		}
+		l.polls[f.Name]++
+	}
+	if f.LastUpdate == lambda.LastUpdateStatusInProgress {
+		if l.updates[f.Name] >= l.UpdatePolls {
+			f.LastUpdate = lambda.LastUpdateStatusSuccessful
+		}
+		l.updates[f.Name]++
+	}
+	return l.configuration(f), nil
+}
+
+// PutFunctionConcurrencyWithContext sets the reserved concurrency of the function.
+func (l *Lambda) PutFunctionConcurrencyWithContext(ctx aws.Context, in *lambda.PutFunctionConcurrencyInput, opts ...request.Option) (*lambda.PutFunctionConcurrencyOutput, error) {
+	if err := l.failure("PutFunctionConcurrency"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	f.Concurrency = aws.Int64(aws.Int64Value(in.ReservedConcurrentExecutions))
+	return &lambda.PutFunctionConcurrencyOutput{ReservedConcurrentExecutions: f.Concurrency}, nil
+}
+
+// DeleteFunctionConcurrencyWithContext removes the reserved concurrency of the function.
+func (l *Lambda) DeleteFunctionConcurrencyWithContext(ctx aws.Context, in *lambda.DeleteFunctionConcurrencyInput, opts ...request.Option) (*lambda.DeleteFunctionConcurrencyOutput, error) {
+	if err := l.failure("DeleteFunctionConcurrency"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	f.Concurrency = nil
+	return &lambda.DeleteFunctionConcurrencyOutput{}, nil
+}
+
+// GetFunctionConcurrencyWithContext returns the reserved concurrency of the function, which is nil if not reserved.
+func (l *Lambda) GetFunctionConcurrencyWithContext(ctx aws.Context, in *lambda.GetFunctionConcurrencyInput, opts ...request.Option) (*lambda.GetFunctionConcurrencyOutput, error) {
+	if err := l.failure("GetFunctionConcurrency"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	out := &lambda.GetFunctionConcurrencyOutput{}
+	if f.Concurrency != nil {
+		out.ReservedConcurrentExecutions = aws.Int64(*f.Concurrency)
+	}
+	return out, nil
+}
+
+// UpdateFunctionConfigurationWithContext updates the function timeout and environment, starting an
+// update which is in progress until polled UpdatePolls times.
+func (l *Lambda) UpdateFunctionConfigurationWithContext(ctx aws.Context, in *lambda.UpdateFunctionConfigurationInput, opts ...request.Option) (*lambda.FunctionConfiguration, error) {
+	if err := l.failure("UpdateFunctionConfiguration"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	if f.LastUpdate == lambda.LastUpdateStatusInProgress {
+		return nil, awsErr(lambda.ErrCodeResourceConflictException, "The operation cannot be performed at this time. An update is in progress for resource: %s", f.ARN)
+	}
+	if in.Timeout != nil {
+		f.Timeout = *in.Timeout
+	}
+	if in.Environment != nil {
+		f.Environment = aws.StringValueMap(in.Environment.Variables)
+	}
+	f.LastUpdate = lambda.LastUpdateStatusInProgress
+	l.updates[f.Name] = 0
+	return l.configuration(f), nil
+}
+
+// CreateEventSourceMappingWithContext maps the event source to the function, mapping the same
+// event source to the same function twice is a conflict.
+func (l *Lambda) CreateEventSourceMappingWithContext(ctx aws.Context, in *lambda.CreateEventSourceMappingInput, opts ...request.Option) (*lambda.EventSourceMappingConfiguration, error) {
+	if err := l.failure("CreateEventSourceMapping"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	source := aws.StringValue(in.EventSourceArn)
+	for _, m := range l.mappings {
+		if m.FunctionName == f.Name && m.EventSourceARN == source {
+			return nil, awsErr(lambda.ErrCodeResourceConflictException, "mapping %s already exists", m.UUID)
+		}
+	}
+	l.nextUUID++
+	m := &Mapping{
+		UUID:                  fmt.Sprintf("mapping-%d", l.nextUUID),
+		FunctionName:          f.Name,
+		EventSourceARN:        source,
+		BatchSize:             aws.Int64Value(in.BatchSize),
+		Enabled:               aws.BoolValue(in.Enabled),
+		FunctionResponseTypes: aws.StringValueSlice(in.FunctionResponseTypes),
+	}
+	l.mappings = append(l.mappings, m)
+	return l.mapping(m), nil
+}
+
+// UpdateEventSourceMappingWithContext updates the batch size, enabled state and FunctionResponseTypes
+// of the mapping which are set, an empty list of FunctionResponseTypes clears them.
+func (l *Lambda) UpdateEventSourceMappingWithContext(ctx aws.Context, in *lambda.UpdateEventSourceMappingInput, opts ...request.Option) (*lambda.EventSourceMappingConfiguration, error) {
+	if err := l.failure("UpdateEventSourceMapping"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.mappings {
+		if m.UUID != aws.StringValue(in.UUID) {
+			continue
+		}
+		if in.BatchSize != nil {
+			m.BatchSize = *in.BatchSize
+		}
+		if in.Enabled != nil {
+			m.Enabled = *in.Enabled
+		}
+		if in.FunctionResponseTypes != nil {
+			m.FunctionResponseTypes = aws.StringValueSlice(in.FunctionResponseTypes)
+		}
+		return l.mapping(m), nil
+	}
+	return nil, awsErr(lambda.ErrCodeResourceNotFoundException, "mapping %s not found", aws.StringValue(in.UUID))
+}
+
+// ListEventSourceMappingsWithContext lists the event source mappings, filtered by function name and event source.
+// All the matching mappings are returned in a single page.
+func (l *Lambda) ListEventSourceMappingsWithContext(ctx aws.Context, in *lambda.ListEventSourceMappingsInput, opts ...request.Option) (*lambda.ListEventSourceMappingsOutput, error) {
+	if err := l.failure("ListEventSourceMappings"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := &lambda.ListEventSourceMappingsOutput{EventSourceMappings: []*lambda.EventSourceMappingConfiguration{}}
+	for _, m := range l.mappings {
+		if in.FunctionName != nil && m.FunctionName != *in.FunctionName {
+			continue
+		}
+		if in.EventSourceArn != nil && m.EventSourceARN != *in.EventSourceArn {
+			continue
+		}
+		out.EventSourceMappings = append(out.EventSourceMappings, l.mapping(m))
+	}
+	return out, nil
+}
+
+// mapping returns the configuration of a mapping, the caller must hold the lock.
+func (l *Lambda) mapping(m *Mapping) *lambda.EventSourceMappingConfiguration {
+	c := &lambda.EventSourceMappingConfiguration{
+		UUID:           aws.String(m.UUID),
+		FunctionArn:    aws.String(l.functions[m.FunctionName].ARN),
+		EventSourceArn: aws.String(m.EventSourceARN),
+		BatchSize:      aws.Int64(m.BatchSize),
+	}
+	if len(m.FunctionResponseTypes) > 0 {
+		c.FunctionResponseTypes = aws.StringSlice(m.FunctionResponseTypes)
+	}
+	return c
+}
+
+// DeleteFunctionWithContext deletes the function along with its event source mappings.
+func (l *Lambda) DeleteFunctionWithContext(ctx aws.Context, in *lambda.DeleteFunctionInput, opts ...request.Option) (*lambda.DeleteFunctionOutput, error) {
+	if err := l.failure("DeleteFunction"); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.function(aws.StringValue(in.FunctionName))
+	if err != nil {
+		return nil, err
+	}
+	delete(l.functions, f.Name)
+	delete(l.polls, f.Name)
+	var mappings []*Mapping
+	for _, m := range l.mappings {
+		if m.FunctionName != f.Name {
+			mappings = append(mappings, m)
+		}
+	}
+	l.mappings = mappings
+	return &lambda.DeleteFunctionOutput{}, nil
+}
+
+func (l *Lambda) function(name string) (*Function, error) {
+	f, ok := l.functions[name]
+	if !ok {
+		return nil, awsErr(lambda.ErrCodeResourceNotFoundException, "function not found: %s", name)
+	}
+	return f, nil
+}
+
+func (l *Lambda) configuration(f *Function) *lambda.FunctionConfiguration {
+	c := &lambda.FunctionConfiguration{
+		FunctionName:     aws.String(f.Name),
+		FunctionArn:      aws.String(f.ARN),
+		Timeout:          aws.Int64(f.Timeout),
+		Role:             aws.String(f.Role),
+		State:            aws.String(f.State),
+		LastUpdateStatus: aws.String(f.LastUpdate),
+	}
+	if f.Environment != nil {
+		c.Environment = &lambda.EnvironmentResponse{Variables: aws.StringMap(f.Environment)}
+	}
+	return c
+}
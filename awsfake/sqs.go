@@ -0,0 +1,152 @@
+package awsfake
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"sync"
+)
+
+// Queue is the state of a fake SQS queue.
+type Queue struct {
+	Name       string
+	URL        string
+	ARN        string
+	Attributes map[string]string
+}
+
+// SQS is an in-memory fake of the SQS API.
+type SQS struct {
+	sqsiface.SQSAPI
+	failures
+
+	mu     sync.Mutex
+	queues map[string]*Queue // keyed by URL
+}
+
+// NewSQS returns a new SQS fake with no queues.
+func NewSQS() *SQS {
+	return &SQS{queues: make(map[string]*Queue)}
+}
+
+// Queue returns a copy of the queue with the given name, and whether it exists.
+func (s *SQS) Queue(name string) (Queue, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[queueURL(name)]
+	if !ok {
+		return Queue{}, false
+	}
+	return copyQueue(q), true
+}
+
+// QueueNames returns the names of all the queues.
+func (s *SQS) QueueNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, q := range s.queues {
+		names = append(names, q.Name)
+	}
+	return names
+}
+
+// CreateQueueWithContext creates a queue, creating a queue that already exists returns the existing queue.
+func (s *SQS) CreateQueueWithContext(ctx aws.Context, in *sqs.CreateQueueInput, opts ...request.Option) (*sqs.CreateQueueOutput, error) {
+	if err := s.failure("CreateQueue"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := aws.StringValue(in.QueueName)
+	url := queueURL(name)
+	if _, ok := s.queues[url]; !ok {
+		q := &Queue{
+			Name:       name,
+			URL:        url,
+			ARN:        fmt.Sprintf("arn:aws:sqs:%s:%s:%s", region, accountID, name),
+			Attributes: map[string]string{sqs.QueueAttributeNameVisibilityTimeout: "30"},
+		}
+		for k, v := range in.Attributes {
+			q.Attributes[k] = aws.StringValue(v)
+		}
+		q.Attributes[sqs.QueueAttributeNameQueueArn] = q.ARN
+		s.queues[url] = q
+	}
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String(url)}, nil
+}
+
+// GetQueueAttributesWithContext returns the requested queue attributes.
+func (s *SQS) GetQueueAttributesWithContext(ctx aws.Context, in *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	if err := s.failure("GetQueueAttributes"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue(aws.StringValue(in.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]*string)
+	for _, name := range in.AttributeNames {
+		if v, ok := q.Attributes[aws.StringValue(name)]; ok {
+			attrs[aws.StringValue(name)] = aws.String(v)
+		}
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: attrs}, nil
+}
+
+// SetQueueAttributesWithContext sets the given queue attributes.
+func (s *SQS) SetQueueAttributesWithContext(ctx aws.Context, in *sqs.SetQueueAttributesInput, opts ...request.Option) (*sqs.SetQueueAttributesOutput, error) {
+	if err := s.failure("SetQueueAttributes"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue(aws.StringValue(in.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range in.Attributes {
+		q.Attributes[k] = aws.StringValue(v)
+	}
+	return &sqs.SetQueueAttributesOutput{}, nil
+}
+
+// DeleteQueueWithContext deletes the queue.
+func (s *SQS) DeleteQueueWithContext(ctx aws.Context, in *sqs.DeleteQueueInput, opts ...request.Option) (*sqs.DeleteQueueOutput, error) {
+	if err := s.failure("DeleteQueue"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	url := aws.StringValue(in.QueueUrl)
+	if _, err := s.queue(url); err != nil {
+		return nil, err
+	}
+	delete(s.queues, url)
+	return &sqs.DeleteQueueOutput{}, nil
+}
+
+func (s *SQS) queue(url string) (*Queue, error) {
+	q, ok := s.queues[url]
+	if !ok {
+		return nil, awsErr(sqs.ErrCodeQueueDoesNotExist, "queue %s does not exist", url)
+	}
+	return q, nil
+}
+
+func queueURL(name string) string {
+	return fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", region, accountID, name)
+}
+
+func copyQueue(q *Queue) Queue {
+	c := *q
+	c.Attributes = make(map[string]string, len(q.Attributes))
+	for k, v := range q.Attributes {
+		c.Attributes[k] = v
+	}
+	return c
+}
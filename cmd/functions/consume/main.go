@@ -1,26 +1,45 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/pkg/errors"
-	"time"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/consume/taskprocessor"
+	"github.com/kinluek/serverless-controlled-batch-processing/consumerenv"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/kinluek/serverless-controlled-batch-processing/ratelimit"
+	"github.com/kinluek/serverless-controlled-batch-processing/taskrunner"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
 )
 
-// handle is the task processor which consumes the queue.
-// For now all it will do is sleep for a second and then print the SQS message.
-func handle(event events.SQSEvent) error {
-	time.Sleep(time.Second)
-	buf, err := json.Marshal(event.Records[0])
-	if err != nil {
-		return errors.Wrap(err, "failed to marshal event")
+// getRateLimit returns the rate limit middleware when the function has a rate, nil otherwise. The
+// function's tasks share a bucket named after the function in the rate limit table, a function
+// without a table only limits each of its instances.
+func getRateLimit(log *logrus.Logger, sess *session.Session, deferrer taskrunner.Deferrer) taskrunner.Middleware {
+	rate, _ := strconv.ParseFloat(env.GetEnvDefault(consumerenv.RatePerSecond, ""), 64)
+	if rate <= 0 {
+		return nil
 	}
-	fmt.Println(string(buf))
-	return nil
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter()
+	if table := env.GetEnvDefault(consumerenv.RateLimitTable, ""); table != "" {
+		limiter = ratelimit.NewDynamoLimiter(dynamodb.New(sess), table)
+	} else {
+		log.Warnf("no %s set, the rate limit of %v per second applies to each instance", consumerenv.RateLimitTable, rate)
+	}
+	rates := taskrunner.FixedRate(lambdacontext.FunctionName, rate)
+	return taskrunner.RateLimit(limiter, rates, deferrer)
 }
 
 func main() {
-	lambda.Start(handle)
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(os.Stdout)
+	emitter := metrics.New(os.Stdout, metrics.DefaultNamespace)
+	sess := session.Must(session.NewSession())
+	deferrer := taskrunner.NewSQSDeferrer(sqs.New(sess))
+	taskrunner.Start(taskprocessor.NewRegistry(logger, emitter, getRateLimit(logger, sess, deferrer), deferrer))
 }
@@ -0,0 +1,69 @@
+// Package taskprocessor holds the task handlers run by the consumer functions, it is kept out of
+// the main package so that it can also be run locally by the localrun package.
+package taskprocessor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/kinluek/serverless-controlled-batch-processing/taskrunner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// TaskSleep is the type of the demo task, which sleeps and then prints the task.
+const TaskSleep = "sleep"
+
+// Sleep is the payload of a sleep task.
+type Sleep struct {
+	Seconds  float64 `json:"seconds"` // how long to sleep for, a second when left out
+	Message  string  `json:"message"`
+	Throttle bool    `json:"throttle"` // be throttled by a downstream API after sleeping, to try adaptive concurrency
+}
+
+// NewRegistry returns the registry of the consumer's task handlers, with logging, panic recovery
+// and, when given, a rate limit, the deferral of throttled tasks and the metrics of each task and
+// batch. Tasks deferred by the rate limit are left out of the task metrics, throttled tasks are
+// counted before being deferred.
+func NewRegistry(log *logrus.Logger, emitter *metrics.Emitter, rateLimit taskrunner.Middleware, deferrer taskrunner.Deferrer) *taskrunner.Registry {
+	r := taskrunner.NewRegistry()
+	r.Use(taskrunner.Log(log))
+	if rateLimit != nil {
+		r.Use(rateLimit)
+	}
+	if deferrer != nil {
+		r.Use(taskrunner.DeferThrottled(deferrer))
+	}
+	if emitter != nil {
+		r.Use(taskrunner.Metrics(emitter))
+		r.MeasureBatches(emitter)
+	}
+	r.Use(taskrunner.Recover(log))
+	r.MustRegister(TaskSleep, handleSleep)
+	return r
+}
+
+// handleSleep sleeps for the task's duration and then prints the task, or reports it throttled.
+func handleSleep(ctx context.Context, sleep Sleep) error {
+	d := time.Second
+	if sleep.Seconds > 0 {
+		d = time.Duration(sleep.Seconds * float64(time.Second))
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if sleep.Throttle {
+		return taskrunner.Throttled(errors.New("downstream responded 429 Too Many Requests"))
+	}
+	task, _ := taskrunner.TaskFromContext(ctx)
+	buf, err := json.Marshal(task)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal task")
+	}
+	fmt.Println(string(buf))
+	return nil
+}
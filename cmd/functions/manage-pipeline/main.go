@@ -4,65 +4,164 @@ import (
 	"context"
 	"github.com/aws/aws-lambda-go/events"
 	lambdaHandler "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
 	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/kinluek/serverless-controlled-batch-processing/notify"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/tracing"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 // getConstants loads constants from the environment.
 func getConstants() pipelinemanager.Constants {
 	const (
-		EnvarEnvName          = "ENV_NAME"
-		EnvarConsumerRole     = "CONSUMER_ROLE"
-		EnvarConsumerBucket   = "CONSUMER_BUCKET"
-		EnvarConsumerKey      = "CONSUMER_KEY"
-		EnvarIdentifiersTable = "IDENTIFIERS_TABLE"
+		EnvarEnvName        = "ENV_NAME"
+		EnvarConsumerRole   = "CONSUMER_ROLE"
+		EnvarConsumerBucket = "CONSUMER_BUCKET"
+		EnvarConsumerKey    = "CONSUMER_KEY"
+		EnvarRateLimitTable = "RATE_LIMIT_TABLE"
 	)
 	return pipelinemanager.Constants{
-		EnvName:          getEnv(EnvarEnvName),
-		ConsumerRole:     getEnv(EnvarConsumerRole),
-		ConsumerBucket:   getEnv(EnvarConsumerBucket),
-		ConsumerKey:      getEnv(EnvarConsumerKey),
-		IdentifiersTable: getEnv(EnvarIdentifiersTable),
+		EnvName:        getEnv(EnvarEnvName),
+		ConsumerRole:   getEnv(EnvarConsumerRole),
+		ConsumerBucket: getEnv(EnvarConsumerBucket),
+		ConsumerKey:    getEnv(EnvarConsumerKey),
+		RateLimitTable: getEnv(EnvarRateLimitTable),
+	}
+}
+
+// getTables loads the pipeline table names from the environment.
+func getTables() pipeline.Tables {
+	const (
+		EnvarConfigTable      = "CONFIG_TABLE"
+		EnvarProfilesTable    = "PROFILES_TABLE"
+		EnvarIdentifiersTable = "IDENTIFIERS_TABLE"
+		EnvarStatusTable      = "STATUS_TABLE"
+		EnvarJournalTable     = "JOURNAL_TABLE"
+		EnvarHistoryTable     = "HISTORY_TABLE"
+		EnvarAuditTable       = "AUDIT_TABLE"
+		EnvarEventsTable      = "EVENTS_TABLE"
+	)
+	return pipeline.Tables{
+		Configs:     getEnv(EnvarConfigTable),
+		Profiles:    getEnv(EnvarProfilesTable),
+		Identifiers: getEnv(EnvarIdentifiersTable),
+		Statuses:    getEnv(EnvarStatusTable),
+		Journal:     getEnv(EnvarJournalTable),
+		History:     getEnv(EnvarHistoryTable),
+		Audit:       getEnv(EnvarAuditTable),
+		Events:      getEnv(EnvarEventsTable),
+	}
+}
+
+// getAWSConfig returns the AWS config, the endpoint can be overridden to point at a local stand-in such as cmd/localaws.
+func getAWSConfig() *aws.Config {
+	const EnvarLocalEndpoint = "LOCAL_AWS_ENDPOINT"
+	config := aws.NewConfig()
+	if endpoint := env.GetEnvDefault(EnvarLocalEndpoint, ""); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return config
+}
+
+// getNotifyRouter returns the router publishing lifecycle events, to the target in the NOTIFY_TARGET
+// envar unless a pipeline's config sets its own, no events are published when neither is set.
+func getNotifyRouter(sess *session.Session) *notify.Router {
+	const EnvarNotifyTarget = "NOTIFY_TARGET"
+	return &notify.Router{
+		Default:     env.GetEnvDefault(EnvarNotifyTarget, ""),
+		SNS:         sns.New(sess),
+		EventBridge: eventbridge.New(sess),
+		HTTP:        &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// getTracer returns the tracer exporting spans to the X-Ray daemon, Lambda sets the daemon's address
+// in the AWS_XRAY_DAEMON_ADDRESS envar when active tracing is on. Tracing is off, and nil returned,
+// when it is not set.
+func getTracer(log *logrus.Logger) *tracing.Tracer {
+	const EnvarXRayDaemonAddress = "AWS_XRAY_DAEMON_ADDRESS"
+	address := env.GetEnvDefault(EnvarXRayDaemonAddress, "")
+	if address == "" {
+		return nil
+	}
+	exporter, err := tracing.NewXRayExporter(address)
+	if err != nil {
+		log.Errorf("tracing is off: %v", err)
+		return nil
 	}
+	return tracing.NewTracer(exporter, log)
 }
 
+// EnvarMetricsNamespace names the envar holding the CloudWatch namespace to put the metrics under.
+const EnvarMetricsNamespace = "METRICS_NAMESPACE"
+
 var (
 	constants pipelinemanager.Constants
+	tables    pipeline.Tables
 	sess      *session.Session
 	sqsSvc    *sqs.SQS
 	lambdaSvc *lambda.Lambda
-	db        *dynamodb.DynamoDB
+	store     pipeline.Store
+	notifier  *notify.Router
+	emitter   *metrics.Emitter
+	tracer    *tracing.Tracer
 	logger    *logrus.Logger
 )
 
 // use init function to save on reinitialisation costs on lambda warm starts.
 func init() {
-	constants = getConstants()
-	sess = session.Must(session.NewSession())
-	sqsSvc = sqs.New(sess)
-	lambdaSvc = lambda.New(sess)
-	db = dynamodb.New(sess)
 	logger = logrus.New()
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetOutput(os.Stdout)
+	constants = getConstants()
+	sess = session.Must(session.NewSession(getAWSConfig()))
+	tracing.Instrument(&sess.Handlers, logger)
+	tracer = getTracer(logger)
+	sqsSvc = sqs.New(sess)
+	lambdaSvc = lambda.New(sess)
+	tables = getTables()
+	store = pipeline.NewDynamoStore(dynamodb.New(sess), tables)
+	notifier = getNotifyRouter(sess)
+	emitter = metrics.New(os.Stdout, env.GetEnvDefault(EnvarMetricsNamespace, metrics.DefaultNamespace))
 }
 
-// The Lambda function to be triggered when changes happen on the pipeline configuration DynamoDB table.
+// The Lambda function to be triggered when changes happen on the pipeline configuration and profiles
+// DynamoDB tables, the table is told apart by the ARN of the stream the record came from.
 func handle(ctx context.Context, event events.DynamoDBEvent) error {
-	instruction, err := pipelinemanager.MakeInstruction(event.Records[0], constants)
+	record := event.Records[0]
+	makeInstruction := pipelinemanager.MakeInstruction
+	if isTableStream(record.EventSourceArn, tables.Profiles) {
+		makeInstruction = pipelinemanager.MakeProfileInstruction
+	}
+	instruction, err := makeInstruction(record, constants)
 	if err != nil {
 		return errors.Wrap(err, "failed to make instruction from event event")
 	}
-	h := pipelinemanager.New(sqsSvc, lambdaSvc, db, constants.EnvName)
+	h := pipelinemanager.New(sqsSvc, lambdaSvc, store, constants.EnvName)
 	h.Use(pipelinemanager.CatchPanic(logger))
+	h.Use(pipelinemanager.Correlate())
+	h.Use(pipelinemanager.Trace(tracer))
+	h.Use(pipelinemanager.Idempotent(store, logger))
+	h.Use(pipelinemanager.Metrics(emitter, logger))
+	h.Use(pipelinemanager.Audit(store, store))
+	h.Use(pipelinemanager.Notify(notifier, store, logger))
 	h.Use(pipelinemanager.Log(logger))
+	h.Use(pipelinemanager.Retry(logger, pipelinemanager.RetryPolicy{}))
 	return h.Handle(ctx, instruction)
 }
 
@@ -70,6 +169,17 @@ func main() {
 	lambdaHandler.Start(handle)
 }
 
+// isTableStream reports whether the stream ARN belongs to the table, stream ARNs have the form
+// arn:aws:dynamodb:region:account:table/name/stream/label.
+func isTableStream(streamArn, table string) bool {
+	parsed, err := arn.Parse(streamArn)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(parsed.Resource, "/")
+	return len(parts) == 4 && parts[0] == "table" && parts[1] == table && parts[2] == "stream"
+}
+
 func getEnv(name string) string {
 	val, err := env.GetEnvRequired(name)
 	if err != nil {
@@ -0,0 +1,142 @@
+package pipelinemanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// AuditSink receives the audit record of every instruction handled, a pipeline.AuditStore is an
+// AuditSink backed by the audit table.
+type AuditSink interface {
+	PutAudit(ctx context.Context, record pipeline.AuditRecord) error
+}
+
+// Audit takes a sink and the store of the pipelines' identifiers and returns a middleware which
+// writes an audit record of every instruction handled, whether it succeeded or not. The record holds
+// the config settings the instruction changes, the pipeline's identifiers once handled, read from the
+// store, and the error and duration of the handling. A panic is recorded as a failure and then re-raised.
+//
+// A record which can not be written fails the instruction, so that the stream record is retried and
+// audited rather than the operation going unrecorded.
+func Audit(sink AuditSink, store pipeline.IdentifierStore) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) (err error) {
+			start := time.Now()
+			defer func() {
+				r := recover()
+				herr := err
+				if r != nil {
+					herr = fmt.Errorf("panic occurred: %v", r)
+				}
+				record := newAuditRecord(ctx, instruction, start, herr)
+				record.Identifier = auditIdentifier(ctx, store, instruction)
+				perr := sink.PutAudit(ctx, record)
+				if r != nil {
+					panic(r)
+				}
+				if err == nil && perr != nil {
+					err = errors.Wrapf(perr, "failed to audit %s of %s", instruction.Operation, record.ID)
+				}
+			}()
+			return before(ctx, instruction)
+		}
+	}
+}
+
+// newAuditRecord makes the record of the instruction handled from start with the given result.
+func newAuditRecord(ctx context.Context, instruction Instruction, start time.Time, err error) pipeline.AuditRecord {
+	record := pipeline.AuditRecord{
+		ID:             instruction.Config.ID,
+		Key:            pipeline.AuditKey(start, instruction.SequenceNumber),
+		Operation:      string(instruction.Operation),
+		SequenceNumber: instruction.SequenceNumber,
+		Result:         pipeline.AuditSuccess,
+		StartedAt:      start.UTC(),
+		DurationMillis: time.Since(start).Milliseconds(),
+		ChangedBy:      instruction.Config.ChangedBy,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		record.RequestID = lc.AwsRequestID
+	}
+	switch instruction.Operation {
+	case Reapply:
+		record.ID = pipeline.AuditProfilePrefix + instruction.Profile
+	case Delete:
+		record.Changes = diffConfig(instruction.Previous, ConfigParams{})
+	default:
+		record.Changes = diffConfig(instruction.Previous, instruction.Config)
+	}
+	if err != nil {
+		record.Result = pipeline.AuditFailure
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// auditIdentifier reads the pipeline's identifiers after the instruction was handled, nil when it
+// has none. Re-applies touch many pipelines so they are left without.
+func auditIdentifier(ctx context.Context, store pipeline.IdentifierStore, instruction Instruction) *pipeline.Identifier {
+	if store == nil || instruction.Operation == Reapply {
+		return nil
+	}
+	ident, err := store.GetIdentifier(ctx, instruction.Config.ID)
+	if err != nil {
+		return nil
+	}
+	return &ident
+}
+
+// diffConfig lists the settings which differ between the configs, unset settings are empty.
+func diffConfig(from, to ConfigParams) []pipeline.AuditChange {
+	fields := []struct {
+		name     string
+		from, to string
+	}{
+		{"concurrency_limit", intString(from.LambdaConcurrencyLimit), intString(to.LambdaConcurrencyLimit)},
+		{"lambda_timeout_secs", intString(from.LambdaTimeoutSecs), intString(to.LambdaTimeoutSecs)},
+		{"sqs_visibility_timeout_secs", intString(from.SQSVisibilityTimeoutSecs), intString(to.SQSVisibilityTimeoutSecs)},
+		{"profile", from.Profile, to.Profile},
+		{"notify", from.Notify, to.Notify},
+		{"rate_per_second", floatString(from.RatePerSecond), floatString(to.RatePerSecond)},
+		{"target_rate_per_second", floatString(from.TargetRatePerSecond), floatString(to.TargetRatePerSecond)},
+		{"min_concurrency", intString(from.MinConcurrency), intString(to.MinConcurrency)},
+		{"max_concurrency", intString(from.MaxConcurrency), intString(to.MaxConcurrency)},
+		{"adaptive_concurrency", boolString(from.AdaptiveConcurrency), boolString(to.AdaptiveConcurrency)},
+	}
+	var changes []pipeline.AuditChange
+	for _, f := range fields {
+		if f.from != f.to {
+			changes = append(changes, pipeline.AuditChange{Field: f.name, From: f.from, To: f.to})
+		}
+	}
+	return changes
+}
+
+func intString(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return fmt.Sprint(*i)
+}
+
+func floatString(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return fmt.Sprint(*f)
+}
+
+func boolString(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprint(*b)
+}
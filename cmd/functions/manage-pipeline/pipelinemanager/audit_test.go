@@ -0,0 +1,94 @@
+package pipelinemanager_test
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAuditRecordsInstructions(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+	m, f := newManager()
+	m.Use(pipelinemanager.Audit(f.store, f.store))
+
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	f.lambda.FailNext("UpdateFunctionConfiguration", awserr.New("ServiceException", "boom", nil))
+	update := pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Update,
+		Config:         pipelinemanager.ConfigParams{ID: "id", LambdaTimeoutSecs: aws.Int(20), SQSVisibilityTimeoutSecs: aws.Int(20), ChangedBy: "bob", Version: 2},
+		Previous:       addInstruction("id").Config,
+		SequenceNumber: "200",
+	}
+	assert.Error(t, m.Handle(ctx, update))
+
+	page, err := f.store.ListAudit(ctx, "id", pipeline.AuditInput{})
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+	if !assert.Len(t, page.Records, 2) {
+		return
+	}
+	added, failed := page.Records[0], page.Records[1]
+	assert.Equal(t, "add", added.Operation)
+	assert.Equal(t, pipeline.AuditSuccess, added.Result)
+	assert.Equal(t, "request-1", added.RequestID)
+	assert.Equal(t, []pipeline.AuditChange{
+		{Field: "concurrency_limit", To: "5"},
+		{Field: "lambda_timeout_secs", To: "10"},
+		{Field: "sqs_visibility_timeout_secs", To: "15"},
+	}, added.Changes)
+	if assert.NotNil(t, added.Identifier) {
+		assert.Equal(t, "id-test-consumer", added.Identifier.ConsumerName)
+	}
+
+	assert.Equal(t, "update", failed.Operation)
+	assert.Equal(t, "200", failed.SequenceNumber)
+	assert.Equal(t, "bob", failed.ChangedBy)
+	assert.Equal(t, pipeline.AuditFailure, failed.Result)
+	assert.Contains(t, failed.Error, "boom")
+	assert.Equal(t, []pipeline.AuditChange{
+		{Field: "concurrency_limit", From: "5"},
+		{Field: "lambda_timeout_secs", From: "10", To: "20"},
+		{Field: "sqs_visibility_timeout_secs", From: "15", To: "20"},
+	}, failed.Changes)
+}
+
+type failingSink struct{}
+
+func (failingSink) PutAudit(context.Context, pipeline.AuditRecord) error {
+	return errors.New("sink down")
+}
+
+func TestAuditFailsInstructionWhenRecordNotWritten(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	m.Use(pipelinemanager.Audit(failingSink{}, f.store))
+
+	err := m.Handle(ctx, addInstruction("id"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sink down")
+	}
+}
+
+func TestAuditRecordsPanics(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	audit := pipelinemanager.Audit(store, store)
+	h := audit(func(context.Context, pipelinemanager.Instruction) error { panic("boom") })
+
+	assert.Panics(t, func() { h(ctx, addInstruction("id")) })
+	page, _ := store.ListAudit(ctx, "id", pipeline.AuditInput{})
+	if assert.Len(t, page.Records, 1) {
+		assert.Equal(t, pipeline.AuditFailure, page.Records[0].Result)
+		assert.Equal(t, "panic occurred: boom", page.Records[0].Error)
+		assert.Nil(t, page.Records[0].Identifier)
+	}
+}
@@ -0,0 +1,95 @@
+package pipelinemanager
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// DefaultEventLease is how long an event is claimed for when the context has no deadline, the
+// most a Lambda invocation can run for.
+const DefaultEventLease = 15 * time.Minute
+
+// Idempotent takes the store and a logger and returns a middleware which handles each stream event
+// at most once, so that redelivered records are not applied again even where a step is not
+// idempotent itself. Instructions without an event ID are handled as they are.
+//
+// The event is claimed before it is handled, with a lease lasting until the context deadline, and
+// marked done once handled. A redelivered event already done is skipped. An event still claimed by
+// another invocation fails, so that the record is retried once that invocation is over. A failed
+// handling releases the claim so that the retried record is handled again, and a claim left by an
+// invocation that died can be taken over once its lease runs out.
+func Idempotent(store pipeline.EventStore, log *logrus.Logger) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) error {
+			if instruction.Event.ID == "" {
+				return before(ctx, instruction)
+			}
+			now := time.Now().UTC()
+			event := pipeline.ProcessedEvent{
+				ID:             instruction.Event.ID,
+				SequenceNumber: instruction.SequenceNumber,
+				PipelineID:     instruction.Config.ID,
+				State:          pipeline.EventInProgress,
+				LeaseExpiresAt: leaseExpiry(ctx, now).Unix(),
+			}
+			if instruction.Operation == Reapply {
+				event.PipelineID = pipeline.AuditProfilePrefix + instruction.Profile
+			}
+			event.Touch(now)
+			err := store.ClaimEvent(ctx, event, now)
+			if pipeline.IsConflict(err) {
+				return claimedEvent(ctx, store, log, instruction)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to claim event %s", event.ID)
+			}
+
+			if err := before(ctx, instruction); err != nil {
+				if rerr := store.DeleteEvent(ctx, event.ID); rerr != nil {
+					log.WithFields(getLogFields(instruction, statusFail)).Errorf("failed to release event %s: %v", event.ID, rerr)
+				}
+				return err
+			}
+
+			// the instruction has been applied, failing now would only get it applied again, so a
+			// failure to mark the event done is logged and left to the lease.
+			event.State = pipeline.EventDone
+			event.LeaseExpiresAt = 0
+			event.Touch(time.Now().UTC())
+			if err := store.PutEvent(ctx, event); err != nil {
+				log.WithFields(getLogFields(instruction, statusSuccess)).Errorf("failed to mark event %s done: %v", event.ID, err)
+			}
+			return nil
+		}
+	}
+}
+
+// claimedEvent handles an event which could not be claimed, skipping it when it is done and
+// failing when another invocation is handling it.
+func claimedEvent(ctx context.Context, store pipeline.EventStore, log *logrus.Logger, instruction Instruction) error {
+	stored, err := store.GetEvent(ctx, instruction.Event.ID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get claimed event %s", instruction.Event.ID)
+	}
+	if stored.State == pipeline.EventDone {
+		log.WithFields(getLogFields(instruction, statusSuccess)).Infof("skipping event %s, it has already been handled", stored.ID)
+		return nil
+	}
+	return errors.Errorf("event %s is being handled by another invocation until %s", stored.ID,
+		time.Unix(stored.LeaseExpiresAt, 0).UTC().Format(time.RFC3339))
+}
+
+// leaseExpiry returns when a claim made now runs out, the context deadline if there is one.
+func leaseExpiry(ctx context.Context, now time.Time) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return now.Add(DefaultEventLease)
+}
@@ -0,0 +1,86 @@
+package pipelinemanager_test
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIdempotentHandlesEventsOnce(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	log, _ := test.NewNullLogger()
+	calls := 0
+	fail := false
+	h := pipelinemanager.Idempotent(store, log)(func(context.Context, pipelinemanager.Instruction) error {
+		calls++
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	instruction := addInstruction("id")
+	instruction.Event = pipelinemanager.EventMetadata{ID: "event-1"}
+
+	// a failed handling releases the event so that the retry is handled.
+	fail = true
+	assert.Error(t, h(ctx, instruction))
+	_, err := store.GetEvent(ctx, "event-1")
+	assert.True(t, pipeline.IsNotFound(err), "failed event should be released, got %v", err)
+
+	fail = false
+	assert.NoError(t, h(ctx, instruction))
+	assert.NoError(t, h(ctx, instruction), "redelivered event should be skipped")
+	assert.Equal(t, 2, calls)
+	event, err := store.GetEvent(ctx, "event-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, pipeline.EventDone, event.State)
+		assert.Equal(t, "100", event.SequenceNumber)
+		assert.Equal(t, "id", event.PipelineID)
+		assert.True(t, event.ExpiresAt > time.Now().Unix())
+	}
+
+	// instructions without an event are always handled.
+	instruction.Event = pipelinemanager.EventMetadata{}
+	assert.NoError(t, h(ctx, instruction))
+	assert.NoError(t, h(ctx, instruction))
+	assert.Equal(t, 4, calls)
+}
+
+func TestIdempotentClaimedEvents(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	log, _ := test.NewNullLogger()
+	calls := 0
+	h := pipelinemanager.Idempotent(store, log)(func(context.Context, pipelinemanager.Instruction) error {
+		calls++
+		return nil
+	})
+	now := time.Now()
+	claim := func(id string, lease time.Time) {
+		event := pipeline.ProcessedEvent{ID: id, State: pipeline.EventInProgress, LeaseExpiresAt: lease.Unix()}
+		if err := store.ClaimEvent(ctx, event, now); err != nil {
+			t.Fatalf("failed to claim event: %v", err)
+		}
+	}
+
+	claim("live", now.Add(time.Minute))
+	instruction := addInstruction("id")
+	instruction.Event = pipelinemanager.EventMetadata{ID: "live"}
+	err := h(ctx, instruction)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "being handled by another invocation")
+	}
+	assert.Equal(t, 0, calls)
+
+	// the claim of an invocation which died is taken over once its lease has run out.
+	claim("dead", now.Add(-time.Minute))
+	instruction.Event = pipelinemanager.EventMetadata{ID: "dead"}
+	assert.NoError(t, h(ctx, instruction))
+	assert.Equal(t, 1, calls)
+}
@@ -2,41 +2,77 @@ package pipelinemanager
 
 import (
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/kinluek/serverless-controlled-batch-processing/eventutil"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
 	"github.com/pkg/errors"
+	"time"
 )
 
 type operation string
 
 const (
 	// Available operations.
-	Add    operation = "add"
-	Update operation = "update"
-	Delete operation = "delete"
+	Add     operation = "add"
+	Update  operation = "update"
+	Delete  operation = "delete"
+	Reapply operation = "reapply" // re-apply the pipelines referencing a changed profile
 )
 
 // Instruction tells the PipelineManager how to mange the pipeline.
 type Instruction struct {
-	Operation operation
-	Config    ConfigParams
-	Constants Constants
+	Operation      operation
+	Config         ConfigParams
+	Previous       ConfigParams // config being replaced or removed, only set for updates and deletes
+	Profile        string       // ID of the changed profile, only set for reapplies
+	Constants      Constants
+	SequenceNumber string // sequence number of the stream record
+	Event          EventMetadata
+	CorrelationID  string // ties the logs of the instruction together, set by the Correlate middleware
 }
 
-// ConfigParams represents pipeline configuration parameters, pointer fields are optional.
+// EventMetadata identifies the stream event an Instruction was made from.
+type EventMetadata struct {
+	ID        string    // stream event ID, unique to the record across redeliveries
+	Name      string    // INSERT, MODIFY or REMOVE
+	SourceARN string    // ARN of the stream
+	CreatedAt time.Time // approximate time the change was made
+}
+
+func eventMetadata(record events.DynamoDBEventRecord) EventMetadata {
+	return EventMetadata{
+		ID:        record.EventID,
+		Name:      record.EventName,
+		SourceARN: record.EventSourceArn,
+		CreatedAt: record.Change.ApproximateCreationDateTime.UTC(),
+	}
+}
+
+// ConfigParams represents pipeline configuration parameters, pointer fields are optional. A missing
+// field, including one removed from an existing config, means the setting's default, see pipeline.Config.
 type ConfigParams struct {
-	ID                       string `json:"id" required:"true"`
-	LambdaConcurrencyLimit   *int   `json:"concurrency_limit,omitempty"`
-	LambdaTimeoutSecs        *int   `json:"lambda_timeout_secs,omitempty"`
-	SQSVisibilityTimeoutSecs *int   `json:"sqs_visibility_timeout_secs,omitempty"`
+	ID                       string   `json:"id" required:"true"`
+	LambdaConcurrencyLimit   *int     `json:"concurrency_limit,omitempty"`
+	LambdaTimeoutSecs        *int     `json:"lambda_timeout_secs,omitempty"`
+	SQSVisibilityTimeoutSecs *int     `json:"sqs_visibility_timeout_secs,omitempty"`
+	Profile                  string   `json:"profile,omitempty"`
+	Notify                   string   `json:"notify,omitempty"`
+	RatePerSecond            *float64 `json:"rate_per_second,omitempty"`
+	TargetRatePerSecond      *float64 `json:"target_rate_per_second,omitempty"`
+	MinConcurrency           *int     `json:"min_concurrency,omitempty"`
+	MaxConcurrency           *int     `json:"max_concurrency,omitempty"`
+	AdaptiveConcurrency      *bool    `json:"adaptive_concurrency,omitempty"`
+	ChangedBy                string   `json:"changed_by,omitempty"`
+	Version                  int64    `json:"version,omitempty"`
 }
 
 // Constants are the application constant parameters.
 type Constants struct {
-	ConsumerBucket   string
-	ConsumerKey      string
-	ConsumerRole     string
-	IdentifiersTable string
-	EnvName          string
+	ConsumerBucket string
+	ConsumerKey    string
+	ConsumerRole   string
+	EnvName        string
+	RateLimitTable string // DynamoDB table of the consumers' rate limit buckets
 }
 
 // MakeInstruction takes a DynamoDBEventRecord and a Constants object and makes an Instruction from it
@@ -45,16 +81,47 @@ func MakeInstruction(record events.DynamoDBEventRecord, constants Constants) (In
 	newImage := record.Change.NewImage
 	oldImage := record.Change.OldImage
 	op := getOperationFromImages(newImage, oldImage)
+	var instruction Instruction
+	var err error
 	switch op {
 	case Add:
-		return makeInstructionAdd(newImage, constants)
+		instruction, err = makeInstructionAdd(newImage, constants)
 	case Update:
-		return makeInstructionUpdate(newImage, oldImage, constants)
+		instruction, err = makeInstructionUpdate(newImage, oldImage, constants)
 	case Delete:
-		return makeInstructionDelete(oldImage, constants)
+		instruction, err = makeInstructionDelete(oldImage, constants)
 	default:
 		return makeInstructionError()
 	}
+	if err != nil {
+		return Instruction{}, err
+	}
+	instruction.SequenceNumber = record.Change.SequenceNumber
+	instruction.Event = eventMetadata(record)
+	return instruction, nil
+}
+
+// MakeProfileInstruction takes a DynamoDBEventRecord from the profiles table and makes a Reapply
+// Instruction for the changed profile, whether it was added, updated or removed.
+func MakeProfileInstruction(record events.DynamoDBEventRecord, constants Constants) (Instruction, error) {
+	image := record.Change.NewImage
+	if image == nil {
+		image = record.Change.OldImage
+	}
+	var profile pipeline.Profile
+	if err := eventutil.UnmarshalDynamoAttrMap(image, &profile); err != nil {
+		return Instruction{}, err
+	}
+	if profile.ID == "" {
+		return makeInstructionError()
+	}
+	return Instruction{
+		Operation:      Reapply,
+		Profile:        profile.ID,
+		Constants:      constants,
+		SequenceNumber: record.Change.SequenceNumber,
+		Event:          eventMetadata(record),
+	}, nil
 }
 
 func makeInstructionAdd(newImage map[string]events.DynamoDBAttributeValue, constants Constants) (Instruction, error) {
@@ -65,6 +132,8 @@ func makeInstructionAdd(newImage map[string]events.DynamoDBAttributeValue, const
 	return Instruction{Operation: Add, Config: config, Constants: constants}, nil
 }
 
+// makeInstructionUpdate makes an update carrying the whole new config and the config it replaces,
+// fields missing from the new image revert to their defaults.
 func makeInstructionUpdate(newImage, oldImage map[string]events.DynamoDBAttributeValue, constants Constants) (Instruction, error) {
 	var nc ConfigParams
 	if err := eventutil.UnmarshalDynamoAttrMap(newImage, &nc); err != nil {
@@ -74,12 +143,7 @@ func makeInstructionUpdate(newImage, oldImage map[string]events.DynamoDBAttribut
 	if err := eventutil.UnmarshalDynamoAttrMap(oldImage, &oc); err != nil {
 		return Instruction{}, err
 	}
-	var uc ConfigParams
-	uc.ID = nc.ID
-	uc.LambdaConcurrencyLimit = getUpdatedInt(nc.LambdaConcurrencyLimit, oc.LambdaConcurrencyLimit)
-	uc.LambdaTimeoutSecs = getUpdatedInt(nc.LambdaTimeoutSecs, oc.LambdaTimeoutSecs)
-	uc.SQSVisibilityTimeoutSecs = getUpdatedInt(nc.SQSVisibilityTimeoutSecs, oc.SQSVisibilityTimeoutSecs)
-	return Instruction{Operation: Update, Config: uc, Constants: constants}, nil
+	return Instruction{Operation: Update, Config: nc, Previous: oc, Constants: constants}, nil
 }
 
 func makeInstructionDelete(oldImage map[string]events.DynamoDBAttributeValue, constants Constants) (Instruction, error) {
@@ -87,8 +151,8 @@ func makeInstructionDelete(oldImage map[string]events.DynamoDBAttributeValue, co
 	if err := eventutil.UnmarshalDynamoAttrMap(oldImage, &oc); err != nil {
 		return Instruction{}, err
 	}
-	dc := ConfigParams{ID: oc.ID}
-	return Instruction{Operation: Delete, Config: dc, Constants: constants}, nil
+	dc := ConfigParams{ID: oc.ID, Version: oc.Version}
+	return Instruction{Operation: Delete, Config: dc, Previous: oc, Constants: constants}, nil
 }
 
 func makeInstructionError() (Instruction, error) {
@@ -105,15 +169,84 @@ func getOperationFromImages(newImage, oldImage map[string]events.DynamoDBAttribu
 	return Delete
 }
 
-func getUpdatedInt(newInt, oldInt *int) *int {
-	if newInt == nil {
-		return nil
+// withDefaults returns the params with the missing timeouts set to their defaults, a missing
+// concurrency limit stays missing as it means no reserved concurrency.
+func (c ConfigParams) withDefaults() ConfigParams {
+	if c.LambdaTimeoutSecs == nil {
+		c.LambdaTimeoutSecs = aws.Int(pipeline.DefaultLambdaTimeoutSecs)
+	}
+	if c.SQSVisibilityTimeoutSecs == nil {
+		c.SQSVisibilityTimeoutSecs = aws.Int(pipeline.DefaultSQSVisibilityTimeoutSecs)
 	}
-	if oldInt == nil {
-		return newInt
+	return c
+}
+
+// pipelineConfig converts the params to a pipeline.Config, missing timeouts are zero.
+func (c ConfigParams) pipelineConfig() pipeline.Config {
+	return pipeline.Config{
+		ID:                       c.ID,
+		LambdaConcurrencyLimit:   c.LambdaConcurrencyLimit,
+		LambdaTimeoutSes:         intValue(c.LambdaTimeoutSecs),
+		SQSVisibilityTimeoutSecs: intValue(c.SQSVisibilityTimeoutSecs),
+		Profile:                  c.Profile,
+		Notify:                   c.Notify,
+		RatePerSecond:            floatValue(c.RatePerSecond),
+		TargetRatePerSecond:      floatValue(c.TargetRatePerSecond),
+		MinConcurrency:           intValue(c.MinConcurrency),
+		MaxConcurrency:           intValue(c.MaxConcurrency),
+		AdaptiveConcurrency:      c.AdaptiveConcurrency,
+		ChangedBy:                c.ChangedBy,
+		Version:                  c.Version,
 	}
-	if *newInt != *oldInt {
-		return newInt
+}
+
+// configParams converts a pipeline.Config to params, unset timeouts, rates and bounds are missing.
+func configParams(c pipeline.Config) ConfigParams {
+	params := ConfigParams{
+		ID:                     c.ID,
+		LambdaConcurrencyLimit: c.LambdaConcurrencyLimit,
+		Profile:                c.Profile,
+		Notify:                 c.Notify,
+		AdaptiveConcurrency:    c.AdaptiveConcurrency,
+		ChangedBy:              c.ChangedBy,
+		Version:                c.Version,
+	}
+	if c.LambdaTimeoutSes != 0 {
+		params.LambdaTimeoutSecs = aws.Int(c.LambdaTimeoutSes)
+	}
+	if c.SQSVisibilityTimeoutSecs != 0 {
+		params.SQSVisibilityTimeoutSecs = aws.Int(c.SQSVisibilityTimeoutSecs)
+	}
+	if c.RatePerSecond != 0 {
+		params.RatePerSecond = aws.Float64(c.RatePerSecond)
+	}
+	if c.TargetRatePerSecond != 0 {
+		params.TargetRatePerSecond = aws.Float64(c.TargetRatePerSecond)
+	}
+	if c.MinConcurrency != 0 {
+		params.MinConcurrency = aws.Int(c.MinConcurrency)
+	}
+	if c.MaxConcurrency != 0 {
+		params.MaxConcurrency = aws.Int(c.MaxConcurrency)
+	}
+	return params
+}
+
+// validateConfig checks the params, with the defaults applied, pass the pipeline config rules.
+func validateConfig(config ConfigParams) error {
+	return config.pipelineConfig().Validate()
+}
+
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+func floatValue(f *float64) float64 {
+	if f == nil {
+		return 0
 	}
-	return nil
+	return *f
 }
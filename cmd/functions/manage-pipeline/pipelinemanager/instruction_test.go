@@ -3,10 +3,12 @@ package pipelinemanager_test
 import (
 	"encoding/json"
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMakeInstructionFromStreamRecord(t *testing.T) {
@@ -22,10 +24,12 @@ func TestMakeInstructionFromStreamRecord(t *testing.T) {
 				Operation: pipelinemanager.Add,
 				Config: pipelinemanager.ConfigParams{
 					ID:                       "new-config-id",
-					LambdaConcurrencyLimit:   pInt(5),
-					LambdaTimeoutSecs:        pInt(10),
-					SQSVisibilityTimeoutSecs: pInt(15),
+					LambdaConcurrencyLimit:   aws.Int(5),
+					LambdaTimeoutSecs:        aws.Int(10),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
 				},
+				SequenceNumber: "200000000000091008510",
+				Event:          streamEvent("c8d449fb685da84e8d6f97b4d2c933e4", "INSERT", "pipeline-configs-dev", 1589723065),
 			},
 		},
 		{
@@ -34,10 +38,19 @@ func TestMakeInstructionFromStreamRecord(t *testing.T) {
 			want: pipelinemanager.Instruction{
 				Operation: pipelinemanager.Update,
 				Config: pipelinemanager.ConfigParams{
-					ID:                     "update-config-id",
-					LambdaConcurrencyLimit: pInt(12),
-					LambdaTimeoutSecs:      pInt(5),
+					ID:                       "update-config-id",
+					LambdaConcurrencyLimit:   aws.Int(12),
+					LambdaTimeoutSecs:        aws.Int(5),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
 				},
+				Previous: pipelinemanager.ConfigParams{
+					ID:                       "update-config-id",
+					LambdaConcurrencyLimit:   aws.Int(5),
+					LambdaTimeoutSecs:        aws.Int(10),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
+				},
+				SequenceNumber: "300000000000091034806",
+				Event:          streamEvent("fcc6d92516a0aec46931d4397c9c4b71", "MODIFY", "pipeline-configs-dev", 1589723214),
 			},
 		},
 		{
@@ -48,17 +61,53 @@ func TestMakeInstructionFromStreamRecord(t *testing.T) {
 				Config: pipelinemanager.ConfigParams{
 					ID: "delete-config-id",
 				},
+				Previous: pipelinemanager.ConfigParams{
+					ID:                       "delete-config-id",
+					LambdaConcurrencyLimit:   aws.Int(12),
+					LambdaTimeoutSecs:        aws.Int(5),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
+				},
+				SequenceNumber: "400000000000091076153",
+				Event:          streamEvent("8691df584a2292953ec31bb97b173d0f", "REMOVE", "pipeline-configs-dev", 1589723447),
 			},
 		},
 		{
+			// a removed field is missing from the update so it reverts to its default.
 			name: "update with missing field",
 			file: "../../../../testdata/lambda-events/dynamodb-event-update-missing-field.json",
 			want: pipelinemanager.Instruction{
 				Operation: pipelinemanager.Update,
 				Config: pipelinemanager.ConfigParams{
-					ID:                "update-config-id",
-					LambdaTimeoutSecs: pInt(5),
+					ID:                       "update-config-id",
+					LambdaTimeoutSecs:        aws.Int(5),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
+				},
+				Previous: pipelinemanager.ConfigParams{
+					ID:                       "update-config-id",
+					LambdaConcurrencyLimit:   aws.Int(5),
+					LambdaTimeoutSecs:        aws.Int(10),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
+				},
+				SequenceNumber: "300000000000091034806",
+				Event:          streamEvent("fcc6d92516a0aec46931d4397c9c4b71", "MODIFY", "pipeline-configs-dev", 1589723214),
+			},
+		},
+		{
+			name: "update with all optional fields removed",
+			file: "../../../../testdata/lambda-events/dynamodb-event-update-remove-fields.json",
+			want: pipelinemanager.Instruction{
+				Operation: pipelinemanager.Update,
+				Config: pipelinemanager.ConfigParams{
+					ID: "update-config-id",
 				},
+				Previous: pipelinemanager.ConfigParams{
+					ID:                       "update-config-id",
+					LambdaConcurrencyLimit:   aws.Int(5),
+					LambdaTimeoutSecs:        aws.Int(10),
+					SQSVisibilityTimeoutSecs: aws.Int(15),
+				},
+				SequenceNumber: "500000000000091103422",
+				Event:          streamEvent("0b2f5c1d94e8a7361c2d4e5f60718293", "MODIFY", "pipeline-configs-dev", 1589723490),
 			},
 		},
 	}
@@ -74,6 +123,29 @@ func TestMakeInstructionFromStreamRecord(t *testing.T) {
 	}
 }
 
+func TestMakeProfileInstructionFromStreamRecord(t *testing.T) {
+	record := getRecordFromFile(t, "../../../../testdata/lambda-events/dynamodb-event-update-profile.json")
+	instruction, err := pipelinemanager.MakeProfileInstruction(record, pipelinemanager.Constants{})
+	if err != nil {
+		t.Fatalf("could not parse instruction from record: %v", err)
+	}
+	assert.Equal(t, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Reapply,
+		Profile:        "http-scraper",
+		SequenceNumber: "600000000000091127385",
+		Event:          streamEvent("5d1c0e9a8b7f46e2a3c4d5e6f7081923", "MODIFY", "pipeline-profiles-dev", 1589723712),
+	}, instruction)
+}
+
+func streamEvent(id, name, table string, created int64) pipelinemanager.EventMetadata {
+	return pipelinemanager.EventMetadata{
+		ID:        id,
+		Name:      name,
+		SourceARN: "arn:aws:dynamodb:eu-west-2:999999999999:table/" + table + "/stream/2020-05-17T13:22:12.477",
+		CreatedAt: time.Unix(created, 0).UTC(),
+	}
+}
+
 func getRecordFromFile(t *testing.T, filePath string) events.DynamoDBEventRecord {
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -86,7 +158,3 @@ func getRecordFromFile(t *testing.T, filePath string) events.DynamoDBEventRecord
 	}
 	return e.Records[0]
 }
-
-func pInt(i int) *int {
-	return &i
-}
@@ -0,0 +1,75 @@
+package pipelinemanager
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/tracing"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// stepFunc is a single step of a pipeline operation, steps record the resources they create or
+// find on the identifier so that later steps, and later invocations, can use them.
+type stepFunc func(ctx context.Context, ident *pipeline.Identifier) error
+
+// journalRunner runs the steps of a pipeline operation, skipping the steps completed by previous
+// invocations handling the same stream record and journaling each step as it completes.
+type journalRunner struct {
+	store   pipeline.JournalStore
+	journal pipeline.Journal
+	status  *statusRecorder
+	state   pipeline.State
+}
+
+// loadJournal returns a journalRunner for the operation started by the stream record with the given sequence number.
+// Operations which have not been started yet get a new empty journal.
+func loadJournal(ctx context.Context, store pipeline.JournalStore, id, sequenceNumber string, op operation) (*journalRunner, error) {
+	journal, err := store.GetJournal(ctx, id, sequenceNumber)
+	if pipeline.IsNotFound(err) {
+		journal, err = pipeline.Journal{ID: id, SequenceNumber: sequenceNumber, Operation: string(op)}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load journal for pipeline %s", id)
+	}
+	return &journalRunner{store: store, journal: journal}, nil
+}
+
+// done reports whether a previous invocation has already completed the whole operation.
+func (r *journalRunner) done() bool {
+	return r.journal.Done
+}
+
+// track sets the status recorder and the state to record as each step is run.
+func (r *journalRunner) track(status *statusRecorder, state pipeline.State) {
+	r.status = status
+	r.state = state
+}
+
+// run runs the step unless it has already been completed.
+func (r *journalRunner) run(ctx context.Context, step string, fn stepFunc) error {
+	if r.journal.Completed(step) {
+		return nil
+	}
+	if err := r.status.set(ctx, r.state, step); err != nil {
+		return err
+	}
+	start := time.Now()
+	sctx, span := tracing.Start(ctx, step)
+	err := fn(sctx, &r.journal.Identifier)
+	span.End(err)
+	recordStep(ctx, step, time.Since(start))
+	if err != nil {
+		return errors.Wrapf(err, "failed on step %q", step)
+	}
+	r.journal.Complete(step, time.Now().UTC())
+	if err := r.store.PutJournal(ctx, r.journal); err != nil {
+		return errors.Wrapf(err, "failed to journal step %q", step)
+	}
+	return nil
+}
+
+// finish marks the whole operation as done.
+func (r *journalRunner) finish(ctx context.Context) error {
+	r.journal.Finish(time.Now().UTC())
+	return r.store.PutJournal(ctx, r.journal)
+}
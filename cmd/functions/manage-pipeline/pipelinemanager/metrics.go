@@ -0,0 +1,136 @@
+package pipelinemanager
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Metric names emitted by the Metrics middleware.
+const (
+	MetricInstructions = "Instructions"
+	MetricDuration     = "Duration"
+	MetricStepDuration = "StepDuration"
+)
+
+// Metrics takes an emitter and a logger and returns a middleware which emits the metrics of every
+// instruction handled: a count and the duration of the handling by environment, operation and
+// status, and the duration of each step run, such as creating the queue or waiting for a new consumer
+// to become active, by environment, operation and step. Steps completed by a previous invocation are
+// not run again and so have no duration. A panic is counted as a failure and then re-raised.
+//
+// Metrics are best effort, a failure to emit them is logged rather than failing the instruction.
+func Metrics(emitter *metrics.Emitter, log *logrus.Logger) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) (err error) {
+			start := time.Now()
+			steps := &stepTimer{}
+			defer func() {
+				r := recover()
+				status := statusSuccess
+				if err != nil || r != nil {
+					status = statusFail
+				}
+				entries := instructionMetrics(instruction, status, time.Since(start), steps.durations())
+				if eerr := emitter.Emit(entries...); eerr != nil {
+					log.WithFields(getLogFields(instruction, status)).Errorf("failed to emit metrics: %v", eerr)
+				}
+				if r != nil {
+					panic(r)
+				}
+			}()
+			return before(withStepTimer(ctx, steps), instruction)
+		}
+	}
+}
+
+// instructionMetrics returns the entries for an instruction handled with the given status, duration
+// and step durations.
+func instructionMetrics(instruction Instruction, status string, took time.Duration, steps []stepDuration) []metrics.Entry {
+	properties := map[string]interface{}{
+		"pipeline_id":     instruction.Config.ID,
+		"sequence_number": instruction.SequenceNumber,
+	}
+	if instruction.Operation == Reapply {
+		properties["profile"] = instruction.Profile
+	}
+	if instruction.CorrelationID != "" {
+		properties["correlation_id"] = instruction.CorrelationID
+	}
+	entries := []metrics.Entry{{
+		Dimensions: map[string]string{
+			"Environment": instruction.Constants.EnvName,
+			"Operation":   string(instruction.Operation),
+			"Status":      status,
+		},
+		Metrics: []metrics.Metric{
+			{Name: MetricInstructions, Unit: metrics.Count, Value: 1},
+			{Name: MetricDuration, Unit: metrics.Milliseconds, Value: metrics.Millis(took)},
+		},
+		Properties: properties,
+	}}
+	for _, step := range steps {
+		entries = append(entries, metrics.Entry{
+			Dimensions: map[string]string{
+				"Environment": instruction.Constants.EnvName,
+				"Operation":   string(instruction.Operation),
+				"Step":        step.name,
+			},
+			Metrics: []metrics.Metric{
+				{Name: MetricStepDuration, Unit: metrics.Milliseconds, Value: metrics.Millis(step.took)},
+			},
+			Properties: properties,
+		})
+	}
+	return entries
+}
+
+type stepTimerKey struct{}
+
+// stepDuration is how long a step took to run.
+type stepDuration struct {
+	name string
+	took time.Duration
+}
+
+// stepTimer collects the durations of the steps run while handling an instruction, steps run more
+// than once, by retries or by the re-applies of a profile, add up.
+type stepTimer struct {
+	mu    sync.Mutex
+	steps []stepDuration
+}
+
+// withStepTimer returns a context carrying the timer for the journal runner to record steps on.
+func withStepTimer(ctx context.Context, timer *stepTimer) context.Context {
+	return context.WithValue(ctx, stepTimerKey{}, timer)
+}
+
+// recordStep records the duration of a step on the timer in the context, if there is one.
+func recordStep(ctx context.Context, step string, took time.Duration) {
+	timer, ok := ctx.Value(stepTimerKey{}).(*stepTimer)
+	if !ok {
+		return
+	}
+	timer.mu.Lock()
+	defer timer.mu.Unlock()
+	for i := range timer.steps {
+		if timer.steps[i].name == step {
+			timer.steps[i].took += took
+			return
+		}
+	}
+	timer.steps = append(timer.steps, stepDuration{name: step, took: took})
+}
+
+// durations returns the step durations in the order the steps were first run.
+func (t *stepTimer) durations() []stepDuration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]stepDuration(nil), t.steps...)
+}
@@ -0,0 +1,79 @@
+package pipelinemanager_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// emittedLines decodes the EMF lines written to the buffer.
+func emittedLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("failed to unmarshal %q: %v", line, err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestMetricsEmitsInstructionAndStepMetrics(t *testing.T) {
+	ctx := context.Background()
+	log, _ := test.NewNullLogger()
+	var buf bytes.Buffer
+	m, _ := newManager()
+	m.Use(pipelinemanager.Metrics(metrics.New(&buf, "Test"), log))
+
+	add := addInstruction("id")
+	add.Constants.EnvName = envName
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	lines := emittedLines(t, &buf)
+	if !assert.True(t, len(lines) > 1) {
+		return
+	}
+	instruction := lines[0]
+	assert.Equal(t, "add", instruction["Operation"])
+	assert.Equal(t, "success", instruction["Status"])
+	assert.Equal(t, envName, instruction["Environment"])
+	assert.Equal(t, 1.0, instruction[pipelinemanager.MetricInstructions])
+	assert.Contains(t, instruction, pipelinemanager.MetricDuration)
+	assert.Equal(t, "id", instruction["pipeline_id"])
+
+	var steps []string
+	for _, line := range lines[1:] {
+		assert.Contains(t, line, pipelinemanager.MetricStepDuration)
+		steps = append(steps, line["Step"].(string))
+	}
+	assert.Equal(t, []string{"create queue", "create consumer", "wait for consumer", "set concurrency", "attach queue", "put identifier"}, steps)
+}
+
+func TestMetricsCountsFailures(t *testing.T) {
+	ctx := context.Background()
+	log, _ := test.NewNullLogger()
+	var buf bytes.Buffer
+	m, f := newManager()
+	m.Use(pipelinemanager.Metrics(metrics.New(&buf, "Test"), log))
+
+	f.lambda.FailNext("CreateFunction", awserr.New("ServiceException", "boom", nil))
+	assert.Error(t, m.Handle(ctx, addInstruction("id")))
+
+	lines := emittedLines(t, &buf)
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+	assert.Equal(t, "fail", lines[0]["Status"])
+	assert.Equal(t, "create queue", lines[1]["Step"])
+	assert.Equal(t, "create consumer", lines[2]["Step"])
+}
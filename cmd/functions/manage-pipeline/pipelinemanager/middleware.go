@@ -78,8 +78,12 @@ func CatchPanic(log *logrus.Logger) Middleware {
 }
 
 func getLogFields(instruction Instruction, status string) logrus.Fields {
-	return logrus.Fields{
+	fields := logrus.Fields{
 		"instruction": instruction,
 		"status":      status,
 	}
+	if instruction.CorrelationID != "" {
+		fields["correlation_id"] = instruction.CorrelationID
+	}
+	return fields
 }
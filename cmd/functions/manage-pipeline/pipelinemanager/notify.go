@@ -0,0 +1,141 @@
+package pipelinemanager
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/notify"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// lifecycleEvents maps the operations to the event published when they succeed.
+var lifecycleEvents = map[operation]string{
+	Add:    notify.PipelineCreated,
+	Update: notify.PipelineUpdated,
+	Delete: notify.PipelineDeleted,
+}
+
+// failureNotificationPrefix prefixes the IDs of the events recording that a failure to apply a
+// record to a pipeline has been published, which share the events table with stream events.
+const failureNotificationPrefix = "failure-notified/"
+
+// NotifyStore is the store Notify reads the pipelines' configs and identifiers from and records the
+// failures published in, a pipeline.Store is a NotifyStore.
+type NotifyStore interface {
+	pipeline.ConfigStore
+	pipeline.IdentifierStore
+	pipeline.EventStore
+}
+
+// Notify takes a publisher, the store the manager writes to and a logger and returns a middleware
+// which publishes a lifecycle event once an add, update or delete has been handled, or a failed
+// event when it fails. A profile re-apply publishes an updated or failed event for each pipeline
+// referencing the profile. Created and updated events carry the pipeline's identifiers, read from
+// the store, and every event carries the pipeline's notify target, the previous config's for a
+// delete or a failed update, which did not apply the new one.
+//
+// A failed record is retried by the stream until it succeeds or expires, its failure is only
+// published the first time, recorded in the events table against the record's sequence number.
+//
+// Notifications are best effort, a failure to publish is logged rather than failing the instruction,
+// which would only get it applied again.
+func Notify(pub notify.Publisher, store NotifyStore, log *logrus.Logger) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) error {
+			err := before(ctx, instruction)
+			if instruction.Operation == Reapply {
+				notifyReapply(ctx, pub, store, log, instruction, err)
+				return err
+			}
+			eventType, ok := lifecycleEvents[instruction.Operation]
+			if !ok {
+				return err
+			}
+			target := instruction.Config.Notify
+			if instruction.Operation == Delete || (instruction.Operation == Update && err != nil) {
+				target = instruction.Previous.Notify
+			}
+			publish(ctx, pub, store, log, instruction, eventType, instruction.Config.ID, target, err)
+			return err
+		}
+	}
+}
+
+// notifyReapply publishes the outcome of re-applying a profile to each pipeline referencing it, a
+// failed event for the pipelines the error records as failed and an updated event for the others.
+// An error which does not record the pipelines, such as failing to list them, failed them all.
+func notifyReapply(ctx context.Context, pub notify.Publisher, store NotifyStore, log *logrus.Logger, instruction Instruction, err error) {
+	failed, perPipeline := reapplyFailures(err)
+	configs, lerr := pipeline.ListAllConfigsByProfile(ctx, store, instruction.Profile)
+	if lerr != nil {
+		log.WithFields(getLogFields(instruction, statusFail)).Errorf("failed to list configs of profile %s to notify: %v", instruction.Profile, lerr)
+		return
+	}
+	for _, c := range configs {
+		if _, gerr := store.GetIdentifier(ctx, c.ID); pipeline.IsNotFound(gerr) {
+			continue
+		}
+		perr := err
+		if perPipeline {
+			perr = failed[c.ID]
+		}
+		publish(ctx, pub, store, log, instruction, notify.PipelineUpdated, c.ID, c.Notify, perr)
+	}
+}
+
+// publish publishes the event of the given type for the pipeline, or a failed event when the
+// handling failed, unless the failure of the record has already been published.
+func publish(ctx context.Context, pub notify.Publisher, store NotifyStore, log *logrus.Logger, instruction Instruction, eventType, pipelineID, target string, err error) {
+	event := notify.Event{
+		Type:           eventType,
+		PipelineID:     pipelineID,
+		Environment:    instruction.Constants.EnvName,
+		Operation:      string(instruction.Operation),
+		SequenceNumber: instruction.SequenceNumber,
+		Time:           time.Now().UTC(),
+		Target:         target,
+	}
+	if err != nil {
+		event.Type = notify.PipelineFailed
+		event.Error = err.Error()
+		if notified, cerr := claimFailureNotification(ctx, store, event); cerr != nil {
+			log.WithFields(getLogFields(instruction, statusFail)).Errorf("failed to record failure notification: %v", cerr)
+		} else if notified {
+			return
+		}
+	}
+	if event.Type == notify.PipelineCreated || event.Type == notify.PipelineUpdated {
+		if ident, gerr := store.GetIdentifier(ctx, pipelineID); gerr == nil {
+			event.Identifier = &ident
+		}
+	}
+	if perr := pub.Publish(ctx, event); perr != nil {
+		log.WithFields(getLogFields(instruction, statusFail)).Errorf("failed to publish %s: %v", event.Type, perr)
+	}
+}
+
+// claimFailureNotification records that the failed event is being published, returning true when
+// the failure of the same record to apply to the pipeline has already been published. Events
+// without a sequence number cannot be told apart and are always published.
+func claimFailureNotification(ctx context.Context, store pipeline.EventStore, event notify.Event) (bool, error) {
+	if event.SequenceNumber == "" {
+		return false, nil
+	}
+	claim := pipeline.ProcessedEvent{
+		ID:             failureNotificationPrefix + event.SequenceNumber + "/" + event.PipelineID,
+		SequenceNumber: event.SequenceNumber,
+		PipelineID:     event.PipelineID,
+		State:          pipeline.EventDone,
+	}
+	claim.Touch(event.Time)
+	err := store.ClaimEvent(ctx, claim, event.Time)
+	if pipeline.IsConflict(err) {
+		return true, nil
+	}
+	return false, errors.Wrapf(err, "failed to claim %s", claim.ID)
+}
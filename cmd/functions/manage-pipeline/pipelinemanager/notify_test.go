@@ -0,0 +1,152 @@
+package pipelinemanager_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/notify"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNotifyPublishesLifecycleEvents(t *testing.T) {
+	ctx := context.Background()
+	log, _ := test.NewNullLogger()
+	m, f := newManager()
+	rec := &notify.Recorder{}
+	m.Use(pipelinemanager.Notify(rec, f.store, log))
+
+	add := addInstruction("id")
+	add.Config.Notify = "https://hooks.example.com/team-a"
+	add.Constants.EnvName = envName
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	f.lambda.FailNext("UpdateFunctionConfiguration", awserr.New("ServiceException", "boom", nil))
+	update := pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Update,
+		Config:         pipelinemanager.ConfigParams{ID: "id", LambdaTimeoutSecs: aws.Int(20), SQSVisibilityTimeoutSecs: aws.Int(20), Version: 2},
+		Previous:       add.Config,
+		SequenceNumber: "200",
+	}
+	assert.Error(t, m.Handle(ctx, update))
+	f.lambda.FailNext("UpdateFunctionConfiguration", awserr.New("ServiceException", "boom", nil))
+	assert.Error(t, m.Handle(ctx, update), "the stream retries the failed record")
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Delete,
+		Config:         pipelinemanager.ConfigParams{ID: "id", Version: 2},
+		Previous:       add.Config,
+		SequenceNumber: "300",
+	})
+	if err != nil {
+		t.Fatalf("failed to delete pipeline: %v", err)
+	}
+
+	events := rec.Events()
+	if !assert.Len(t, events, 3, "a retried record's failure should only be published once") {
+		return
+	}
+	created, failed, deleted := events[0], events[1], events[2]
+	assert.Equal(t, notify.PipelineCreated, created.Type)
+	assert.Equal(t, "id", created.PipelineID)
+	assert.Equal(t, envName, created.Environment)
+	assert.Equal(t, "https://hooks.example.com/team-a", created.Target)
+	if assert.NotNil(t, created.Identifier) {
+		assert.Equal(t, "id-test-consumer", created.Identifier.ConsumerName)
+	}
+	assert.Equal(t, notify.PipelineFailed, failed.Type)
+	assert.Equal(t, "update", failed.Operation)
+	assert.Contains(t, failed.Error, "boom")
+	assert.Nil(t, failed.Identifier)
+	assert.Equal(t, "https://hooks.example.com/team-a", failed.Target, "failed updates go to the previous config's target")
+	assert.Equal(t, notify.PipelineDeleted, deleted.Type)
+	assert.Equal(t, "https://hooks.example.com/team-a", deleted.Target, "deletes go to the removed config's target")
+}
+
+func TestNotifyFailuresDoNotFailInstruction(t *testing.T) {
+	ctx := context.Background()
+	log, hook := test.NewNullLogger()
+	m, f := newManager()
+	pub := notify.PublisherFunc(func(context.Context, notify.Event) error { return errors.New("webhook down") })
+	m.Use(pipelinemanager.Notify(pub, f.store, log))
+
+	assert.NoError(t, m.Handle(ctx, addInstruction("id")))
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Contains(t, hook.LastEntry().Message, "webhook down")
+	}
+}
+
+func TestNotifyPublishesReapplies(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   bool     // fail the update of the first pipeline re-applied
+		events []string // events published for pipelines a and b
+	}{
+		{
+			name:   "all updated",
+			events: []string{notify.PipelineUpdated, notify.PipelineUpdated},
+		},
+		{
+			name:   "one failed",
+			fail:   true,
+			events: []string{notify.PipelineFailed, notify.PipelineUpdated},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			log, _ := test.NewNullLogger()
+			m, f := newManager()
+			rec := &notify.Recorder{}
+			m.Use(pipelinemanager.Notify(rec, f.store, log))
+
+			profile, err := f.store.PutProfileIfVersion(ctx, pipeline.Profile{ID: "scraper", LambdaTimeoutSes: 10})
+			if err != nil {
+				t.Fatalf("failed to put profile: %v", err)
+			}
+			for _, id := range []string{"a", "b"} {
+				config, err := f.store.PutConfigIfVersion(ctx, pipeline.Config{ID: id, Profile: "scraper", Notify: "events:" + id})
+				if err != nil {
+					t.Fatalf("failed to put config: %v", err)
+				}
+				add := addInstruction(id)
+				add.Config = pipelinemanager.ConfigParams{ID: id, Profile: "scraper", Notify: config.Notify, Version: config.Version}
+				if err := m.Handle(ctx, add); err != nil {
+					t.Fatalf("failed to add pipeline %s: %v", id, err)
+				}
+			}
+
+			profile.LambdaTimeoutSes = 20
+			if _, err := f.store.PutProfileIfVersion(ctx, profile); err != nil {
+				t.Fatalf("failed to update profile: %v", err)
+			}
+			if tt.fail {
+				f.lambda.FailNext("UpdateFunctionConfiguration", awserr.New("ServiceException", "boom", nil))
+			}
+			err = m.Handle(ctx, pipelinemanager.Instruction{Operation: pipelinemanager.Reapply, Profile: "scraper", SequenceNumber: "50"})
+			assert.Equal(t, tt.fail, err != nil, "reapply error: %v", err)
+
+			events := rec.Events()
+			if !assert.Len(t, events, 4) {
+				return
+			}
+			for i, id := range []string{"a", "b"} {
+				event := events[2+i]
+				assert.Equal(t, tt.events[i], event.Type)
+				assert.Equal(t, id, event.PipelineID)
+				assert.Equal(t, "reapply", event.Operation)
+				assert.Equal(t, "events:"+id, event.Target)
+				if event.Type == notify.PipelineFailed {
+					assert.Contains(t, event.Error, "boom")
+					assert.Nil(t, event.Identifier)
+				} else {
+					assert.NotNil(t, event.Identifier)
+				}
+			}
+		})
+	}
+}
@@ -3,9 +3,9 @@ package pipelinemanager
 import (
 	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/lambda"
-	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/queue"
@@ -14,89 +14,156 @@ import (
 
 // pipelineAdder is responsible for adding pipelines
 type pipelineAdder struct {
-	lambdaSvc *lambda.Lambda
-	sqsSvc    *sqs.SQS
-	db        *dynamodb.DynamoDB
+	lambdaSvc lambdaiface.LambdaAPI
+	sqsSvc    sqsiface.SQSAPI
+	store     stepStore
 	envName   string
 }
 
-func newAdder(lamSvc *lambda.Lambda, sqsSvc *sqs.SQS, db *dynamodb.DynamoDB, envName string) *pipelineAdder {
+func newAdder(lamSvc lambdaiface.LambdaAPI, sqsSvc sqsiface.SQSAPI, store stepStore, envName string) *pipelineAdder {
 	return &pipelineAdder{
 		lambdaSvc: lamSvc,
 		sqsSvc:    sqsSvc,
-		db:        db,
+		store:     store,
 		envName:   envName,
 	}
 }
 
-func (a *pipelineAdder) add(ctx context.Context, config ConfigParams, constants Constants) error {
-	if err := validateAddConfig(config); err != nil {
-		return errors.Wrapf(err, "failed to validate config %s", config.ID)
-	}
-	queueOut, err := a.addQueue(ctx, config)
+func (a *pipelineAdder) add(ctx context.Context, config ConfigParams, constants Constants, sequenceNumber string) error {
+	journal, err := loadJournal(ctx, a.store, config.ID, sequenceNumber, Add)
 	if err != nil {
-		return errors.Wrapf(err, "failed to add queue for config %s", config.ID)
+		return err
 	}
-	consumerOut, err := a.addConsumer(ctx, config, constants, queueOut.Main.ARN)
+	status, err := loadStatus(ctx, a.store, config, sequenceNumber)
 	if err != nil {
-		return errors.Wrapf(err, "failed to add consumer for config %s and queue arn %s", config.ID, queueOut.Main.ARN)
+		return err
+	}
+	if journal.done() {
+		return status.settle(ctx, pipeline.StateActive)
+	}
+	if err := status.set(ctx, pipeline.StatePending, stepValidate); err != nil {
+		return errors.Wrapf(err, "failed to set pipeline %s pending", config.ID)
 	}
-	if err := a.addIdentifier(ctx, config, constants, queueOut, consumerOut); err != nil {
-		return errors.Wrapf(err, "failed to add pipeline identifier for pipeline %s to table %s", config.ID, constants.IdentifiersTable)
+	journal.track(status, pipeline.StateCreating)
+	if err := a.addSteps(ctx, config, constants, journal); err != nil {
+		return status.fail(ctx, err)
+	}
+	if err := journal.finish(ctx); err != nil {
+		return errors.Wrapf(err, "failed to finish journal for pipeline %s", config.ID)
+	}
+	if err := status.set(ctx, pipeline.StateActive, ""); err != nil {
+		return errors.Wrapf(err, "failed to set pipeline %s active", config.ID)
 	}
 	return nil
 }
 
-func (a *pipelineAdder) addQueue(ctx context.Context, config ConfigParams) (queue.IdentifierPair, error) {
-	return queue.CreateWithDLQ(ctx, a.sqsSvc, a.makeQueueName(config.ID), *config.SQSVisibilityTimeoutSecs)
+func (a *pipelineAdder) addSteps(ctx context.Context, config ConfigParams, constants Constants, journal *journalRunner) error {
+	if err := validateConfig(config); err != nil {
+		return errors.Wrapf(err, "failed to validate config %s", config.ID)
+	}
+	config = config.withDefaults()
+	steps := []struct {
+		name string
+		fn   stepFunc
+	}{
+		{stepCreateQueue, a.addQueue(config)},
+		{stepCreateConsumer, a.addConsumer(config, constants)},
+		{stepWaitConsumer, a.waitConsumer()},
+		{stepSetConcurrency, a.setConcurrency(config)},
+		{stepAttachQueue, a.attachQueue()},
+		{stepPutIdentifier, a.addIdentifier(config)},
+	}
+	for _, step := range steps {
+		if err := journal.run(ctx, step.name, step.fn); err != nil {
+			return errors.Wrapf(err, "failed to add pipeline %s", config.ID)
+		}
+	}
+	return nil
 }
 
-func (a *pipelineAdder) addConsumer(ctx context.Context, config ConfigParams, constants Constants, queueArn string) (consumer.Identifier, error) {
-	return consumer.Add(ctx, a.lambdaSvc, consumer.AddParams{
-		Bucket:      constants.ConsumerBucket,
-		Key:         constants.ConsumerKey,
-		Name:        a.makeConsumerName(config.ID),
-		Concurrency: int64(*config.LambdaConcurrencyLimit),
-		Timeout:     int64(*config.LambdaTimeoutSecs),
-		RoleArn:     constants.ConsumerRole,
-		QueueARN:    queueArn,
-	})
+func (a *pipelineAdder) addQueue(config ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		qIdent, err := queue.CreateWithDLQ(ctx, a.sqsSvc, a.makeQueueName(config.ID), *config.SQSVisibilityTimeoutSecs)
+		if err != nil {
+			return err
+		}
+		ident.QueueURL, ident.QueueARN = qIdent.Main.URL, qIdent.Main.ARN
+		ident.DeadLetterQueueURL, ident.DeadLetterQueueARN = qIdent.DLQ.URL, qIdent.DLQ.ARN
+		return nil
+	}
 }
 
-func (a *pipelineAdder) addIdentifier(ctx context.Context, config ConfigParams, constants Constants, qIdent queue.IdentifierPair, cIdent consumer.Identifier) error {
-	ident := makePipelineIdentifier(config.ID, qIdent, cIdent)
-	return pipeline.PutIdentifier(ctx, a.db, constants.IdentifiersTable, ident)
-}
+// addConsumer creates the consumer function, if the function already exists because a previous
+// invocation created it before it could journal the step, then the existing function is used.
+func (a *pipelineAdder) addConsumer(config ConfigParams, constants Constants) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		name := a.makeConsumerName(config.ID)
+		cIdent, err := consumer.CreateFunction(ctx, a.lambdaSvc, consumer.AddParams{
+			Bucket:  constants.ConsumerBucket,
+			Key:     constants.ConsumerKey,
+			Name:    name,
+			Timeout: int64(*config.LambdaTimeoutSecs),
+			RoleArn: constants.ConsumerRole,
 
-func (a *pipelineAdder) makeQueueName(id string) string {
-	return fmt.Sprintf("%s-%s-queue", id, a.envName)
+			RatePerSecond:  floatValue(config.RatePerSecond),
+			RateLimitTable: constants.RateLimitTable,
+		})
+		if pipeline.IsAWSErrCode(err, lambda.ErrCodeResourceConflictException) {
+			cIdent, err = consumer.Get(ctx, a.lambdaSvc, name)
+		}
+		if err != nil {
+			return err
+		}
+		ident.ConsumerName, ident.ConsumerARN = cIdent.Name, cIdent.Arn
+		return nil
+	}
 }
 
-func (a *pipelineAdder) makeConsumerName(id string) string {
-	return fmt.Sprintf("%s-%s-consumer", id, a.envName)
+func (a *pipelineAdder) waitConsumer() stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		return consumer.WaitTillActive(ctx, a.lambdaSvc, ident.ConsumerName)
+	}
 }
 
-func validateAddConfig(config ConfigParams) error {
-	if config.SQSVisibilityTimeoutSecs == nil {
-		return errors.New("invalid add config: missing sqs visibility timeout")
-	}
-	if config.LambdaTimeoutSecs == nil {
-		return errors.New("invalid add config: missing lambda timeout")
+// setConcurrency reserves the concurrency limit, consumers without a limit are left with no
+// reserved concurrency. Consumers with a target rate start at their lower bound until tuned, and
+// consumers with adaptive concurrency at their limit until throttled.
+func (a *pipelineAdder) setConcurrency(config ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		if c := config.pipelineConfig(); c.Controlled() {
+			return consumer.SetConcurrency(ctx, a.lambdaSvc, ident.ConsumerName, int64(c.ClampConcurrency(nil)))
+		}
+		if config.LambdaConcurrencyLimit == nil {
+			return nil
+		}
+		return consumer.SetConcurrency(ctx, a.lambdaSvc, ident.ConsumerName, int64(*config.LambdaConcurrencyLimit))
 	}
-	if config.LambdaConcurrencyLimit == nil {
-		return errors.New("invalid add config: missing lambda concurrency")
+}
+
+// attachQueue attaches the queue to the consumer, a conflict, other than with an update still in
+// progress, means a previous invocation already attached the queue before it could journal the step.
+func (a *pipelineAdder) attachQueue() stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		err := consumer.AttachQueue(ctx, a.lambdaSvc, ident.ConsumerName, ident.QueueARN)
+		if pipeline.IsAWSErrCode(err, lambda.ErrCodeResourceConflictException) && !isLambdaInProgress(err) {
+			return nil
+		}
+		return err
 	}
-	return nil
 }
 
-func makePipelineIdentifier(id string, qi queue.IdentifierPair, ci consumer.Identifier) pipeline.Identifier {
-	return pipeline.Identifier{
-		ID:                 id,
-		QueueURL:           qi.Main.URL,
-		QueueARN:           qi.Main.ARN,
-		DeadLetterQueueURL: qi.DLQ.URL,
-		DeadLetterQueueARN: qi.DLQ.ARN,
-		ConsumerName:       ci.Name,
-		ConsumerARN:        ci.Arn,
+func (a *pipelineAdder) addIdentifier(config ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		ident.ID = config.ID
+		ident.Version = config.Version
+		return a.store.PutIdentifierIfNotStale(ctx, *ident)
 	}
 }
+
+func (a *pipelineAdder) makeQueueName(id string) string {
+	return fmt.Sprintf("%s-%s-queue", id, a.envName)
+}
+
+func (a *pipelineAdder) makeConsumerName(id string) string {
+	return fmt.Sprintf("%s-%s-consumer", id, a.envName)
+}
@@ -2,30 +2,51 @@ package pipelinemanager
 
 import (
 	"context"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/lambda"
-	"github.com/aws/aws-sdk-go/service/sqs"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
 	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
 )
 
 // HandlerFunc is a function that can handle a PipelineConfig.
 type HandlerFunc func(ctx context.Context, instruction Instruction) error
 
+// Store is the store the PipelineManager reads the configs and profiles from and records the
+// pipelines' history in, a pipeline.Store is a Store.
+type Store interface {
+	pipeline.ConfigStore
+	pipeline.ProfileStore
+	pipeline.HistoryStore
+	stepStore
+}
+
+// stepStore is the store the pipelines' identifiers, statuses and operation journals are recorded in
+// as their resources are added, updated and removed.
+type stepStore interface {
+	pipeline.IdentifierStore
+	pipeline.StatusStore
+	pipeline.JournalStore
+}
+
 // PipelineManager handles the creation, configuration, updating and removal of pipelines.
 type PipelineManager struct {
-	sqsSvc    *sqs.SQS
-	lambdaSvc *lambda.Lambda
-	db        *dynamodb.DynamoDB
+	sqsSvc    sqsiface.SQSAPI
+	lambdaSvc lambdaiface.LambdaAPI
+	store     Store
 	envName   string
 	mids      []Middleware
 }
 
 // New returns a new instance of PipelineManager.
-func New(sqsSvc *sqs.SQS, lambdaSvc *lambda.Lambda, db *dynamodb.DynamoDB, envName string) *PipelineManager {
+func New(sqsSvc sqsiface.SQSAPI, lambdaSvc lambdaiface.LambdaAPI, store Store, envName string) *PipelineManager {
 	return &PipelineManager{
 		sqsSvc:    sqsSvc,
 		lambdaSvc: lambdaSvc,
-		db:        db,
+		store:     store,
 		envName:   envName,
 	}
 }
@@ -42,38 +63,190 @@ func (h *PipelineManager) Handle(ctx context.Context, instruction Instruction) e
 }
 
 func (h *PipelineManager) handle(ctx context.Context, instruction Instruction) error {
+	if instruction.Operation == Reapply {
+		return h.reapply(ctx, instruction)
+	}
+	stale, err := h.isStale(ctx, instruction)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check if instruction for pipeline %s is stale", instruction.Config.ID)
+	}
+	if stale {
+		return nil
+	}
+	var applied ConfigParams
 	switch instruction.Operation {
 	case Add:
-		return h.add(ctx, instruction)
+		applied, err = h.add(ctx, instruction)
 	case Update:
-		return h.update(ctx, instruction)
+		applied, err = h.update(ctx, instruction)
 	case Delete:
-		return h.delete(ctx, instruction)
+		applied, err = h.delete(ctx, instruction)
 	default:
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	return h.recordHistory(ctx, instruction, applied)
 }
 
-func (h *PipelineManager) add(ctx context.Context, instruction Instruction) error {
-	adder := newAdder(h.lambdaSvc, h.sqsSvc, h.db, h.envName)
-	if err := adder.add(ctx, instruction.Config, instruction.Constants); err != nil {
-		return errors.Wrapf(err, "failed to add pipeline")
+// recordHistory records the config applied, or removed, by the instruction in the config history,
+// both as the item the instruction came from and as it was resolved against its profile. The entry
+// is keyed by the stream record, so recording it again when the record is retried overwrites the
+// same entry.
+func (h *PipelineManager) recordHistory(ctx context.Context, instruction Instruction, config ConfigParams) error {
+	deleted := instruction.Operation == Delete
+	item := instruction.Config
+	if deleted {
+		item = instruction.Previous
+		item.ID = instruction.Config.ID
+	}
+	entry := pipeline.NewHistoryEntry(item.pipelineConfig(), config.pipelineConfig(), instruction.SequenceNumber, instruction.Event.CreatedAt, time.Now().UTC(), deleted)
+	if err := h.store.PutHistory(ctx, entry); err != nil {
+		return errors.Wrapf(err, "failed to record history of pipeline %s", config.ID)
 	}
 	return nil
 }
 
-func (h *PipelineManager) update(ctx context.Context, instruction Instruction) error {
-	updater := newUpdater(h.lambdaSvc, h.sqsSvc, h.db)
-	if err := updater.update(ctx, instruction.Config, instruction.Constants); err != nil {
-		return errors.Wrapf(err, "failed to update pipeline")
+// isStale reports whether the pipeline resources have already been set up from a newer config version
+// than the instruction's, or removed by a later stream record, in which case the instruction came
+// from a delayed or retried stream record and is skipped so that it can not clobber the newer state.
+// Versions restart when a pipeline is added again, so a removed pipeline is compared by its
+// tombstone's sequence number instead.
+func (h *PipelineManager) isStale(ctx context.Context, instruction Instruction) (bool, error) {
+	tombstone, err := h.store.GetTombstone(ctx, instruction.Config.ID)
+	if err == nil {
+		return tombstone.After(instruction.SequenceNumber), nil
 	}
-	return nil
+	if !pipeline.IsNotFound(err) {
+		return false, err
+	}
+	ident, err := h.store.GetIdentifier(ctx, instruction.Config.ID)
+	if pipeline.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ident.Version > instruction.Config.Version, nil
+}
+
+// add creates the pipeline, returning the config it was created from.
+func (h *PipelineManager) add(ctx context.Context, instruction Instruction) (ConfigParams, error) {
+	config, err := h.resolve(ctx, instruction.Config)
+	if err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to add pipeline")
+	}
+	adder := newAdder(h.lambdaSvc, h.sqsSvc, h.store, h.envName)
+	if err := adder.add(ctx, config, instruction.Constants, instruction.SequenceNumber); err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to add pipeline")
+	}
+	return config, nil
+}
+
+// update updates the pipeline, returning the config it was updated to.
+func (h *PipelineManager) update(ctx context.Context, instruction Instruction) (ConfigParams, error) {
+	config, err := h.resolve(ctx, instruction.Config)
+	if err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to update pipeline")
+	}
+	previous, err := h.resolve(ctx, instruction.Previous)
+	if err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to update pipeline")
+	}
+	updater := newUpdater(h.lambdaSvc, h.sqsSvc, h.store)
+	if err := updater.update(ctx, config, previous, instruction.Constants, instruction.SequenceNumber); err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to update pipeline")
+	}
+	return config, nil
 }
 
-func (h *PipelineManager) delete(ctx context.Context, instruction Instruction) error {
-	remover := newRemover(h.lambdaSvc, h.sqsSvc, h.db)
-	if err := remover.remove(ctx, instruction.Config, instruction.Constants); err != nil {
-		return errors.Wrapf(err, "failed to remove pipeline")
+// delete removes the pipeline, returning the config that was removed.
+func (h *PipelineManager) delete(ctx context.Context, instruction Instruction) (ConfigParams, error) {
+	previous, err := h.resolve(ctx, instruction.Previous)
+	if err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to remove pipeline")
+	}
+	previous.ID = instruction.Config.ID
+	remover := newRemover(h.lambdaSvc, h.sqsSvc, h.store)
+	if err := remover.remove(ctx, instruction.Config, instruction.Constants, instruction.SequenceNumber); err != nil {
+		return ConfigParams{}, errors.Wrapf(err, "failed to remove pipeline")
+	}
+	return previous, nil
+}
+
+// ReapplyError is returned when re-applying a profile failed for some of the pipelines referencing
+// it, the others were updated.
+type ReapplyError struct {
+	Profile string
+	Failed  map[string]error // failure of each pipeline which was not updated, by pipeline ID
+}
+
+func (e *ReapplyError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf("%s: %v", id, e.Failed[id])
+	}
+	return fmt.Sprintf("failed to reapply profile %s to %d pipelines: %s", e.Profile, len(ids), strings.Join(msgs, "; "))
+}
+
+// reapplyFailures returns the failure of each pipeline when the cause of the error is a
+// ReapplyError, false otherwise.
+func reapplyFailures(err error) (map[string]error, bool) {
+	rerr, ok := errors.Cause(err).(*ReapplyError)
+	if !ok {
+		return nil, false
+	}
+	return rerr.Failed, true
+}
+
+// reapply updates every created pipeline whose config references the changed profile, each update
+// resolves the config against the profile as it is now. All the pipelines are attempted, the ones
+// which failed are returned in a *ReapplyError.
+func (h *PipelineManager) reapply(ctx context.Context, instruction Instruction) error {
+	configs, err := pipeline.ListAllConfigsByProfile(ctx, h.store, instruction.Profile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list configs for profile %s", instruction.Profile)
+	}
+	failed := make(map[string]error)
+	for _, c := range configs {
+		if _, err := h.store.GetIdentifier(ctx, c.ID); pipeline.IsNotFound(err) {
+			continue
+		}
+		params := configParams(c)
+		err := h.handle(ctx, Instruction{
+			Operation:      Update,
+			Config:         params,
+			Previous:       params,
+			Constants:      instruction.Constants,
+			SequenceNumber: instruction.SequenceNumber,
+			Event:          instruction.Event,
+		})
+		if err != nil {
+			failed[c.ID] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &ReapplyError{Profile: instruction.Profile, Failed: failed}
 	}
 	return nil
 }
+
+// resolve takes the fields missing from the config from the profile it references. A profile which
+// has been deleted resolves nothing, leaving the missing fields to their defaults, as retrying would
+// never find it.
+func (h *PipelineManager) resolve(ctx context.Context, config ConfigParams) (ConfigParams, error) {
+	if config.Profile == "" {
+		return config, nil
+	}
+	profile, err := h.store.GetProfile(ctx, config.Profile)
+	if err != nil && !pipeline.IsNotFound(err) {
+		return ConfigParams{}, errors.Wrapf(err, "failed to resolve profile of config %s", config.ID)
+	}
+	return configParams(config.pipelineConfig().Resolve(profile)), nil
+}
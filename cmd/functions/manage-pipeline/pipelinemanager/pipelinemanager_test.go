@@ -0,0 +1,636 @@
+package pipelinemanager_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/kinluek/serverless-controlled-batch-processing/awsfake"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/consumerenv"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const envName = "test"
+
+type fakes struct {
+	sqs    *awsfake.SQS
+	lambda *awsfake.Lambda
+	store  *pipeline.MemoryStore
+}
+
+func newManager() (*pipelinemanager.PipelineManager, fakes) {
+	f := fakes{sqs: awsfake.NewSQS(), lambda: awsfake.NewLambda(), store: pipeline.NewMemoryStore()}
+	return pipelinemanager.New(f.sqs, f.lambda, f.store, envName), f
+}
+
+func addInstruction(id string) pipelinemanager.Instruction {
+	return pipelinemanager.Instruction{
+		Operation: pipelinemanager.Add,
+		Config: pipelinemanager.ConfigParams{
+			ID:                       id,
+			LambdaConcurrencyLimit:   aws.Int(5),
+			LambdaTimeoutSecs:        aws.Int(10),
+			SQSVisibilityTimeoutSecs: aws.Int(15),
+			Version:                  1,
+		},
+		Constants:      pipelinemanager.Constants{ConsumerBucket: "bucket", ConsumerKey: "key", ConsumerRole: "role"},
+		SequenceNumber: "100",
+	}
+}
+
+func TestPipelineManagerAdd(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	q, ok := f.sqs.Queue("id-test-queue")
+	if !ok {
+		t.Fatalf("queue was not created")
+	}
+	dlq, ok := f.sqs.Queue("id-test-queue-dlq")
+	if !ok {
+		t.Fatalf("dead letter queue was not created")
+	}
+	assert.Equal(t, "15", q.Attributes["VisibilityTimeout"])
+	assert.Contains(t, q.Attributes["RedrivePolicy"], dlq.ARN)
+
+	fn, ok := f.lambda.Function("id-test-consumer")
+	if !ok {
+		t.Fatalf("consumer was not created")
+	}
+	assert.Equal(t, int64(10), fn.Timeout)
+	assert.Equal(t, int64(5), *fn.Concurrency)
+	assert.Equal(t, "bucket", fn.S3Bucket)
+	if mappings := f.lambda.Mappings(); assert.Len(t, mappings, 1) {
+		assert.Equal(t, q.ARN, mappings[0].EventSourceARN)
+		assert.Equal(t, []string{lambda.FunctionResponseTypeReportBatchItemFailures}, mappings[0].FunctionResponseTypes)
+	}
+
+	ident, err := f.store.GetIdentifier(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get identifier: %v", err)
+	}
+	assert.Equal(t, pipeline.Identifier{
+		ID:                 "id",
+		QueueURL:           q.URL,
+		QueueARN:           q.ARN,
+		DeadLetterQueueURL: dlq.URL,
+		DeadLetterQueueARN: dlq.ARN,
+		ConsumerName:       fn.Name,
+		ConsumerARN:        fn.ARN,
+		Version:            1,
+	}, ident)
+
+	status, err := f.store.GetStatus(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	assert.Equal(t, pipeline.StateActive, status.State)
+}
+
+func TestPipelineManagerAddResumesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	f.lambda.FailNext("CreateEventSourceMapping", awserr.New("ServiceException", "boom", nil))
+
+	err := m.Handle(ctx, addInstruction("id"))
+	assert.Error(t, err)
+	status, _ := f.store.GetStatus(ctx, "id")
+	assert.Equal(t, pipeline.StateFailed, status.State)
+	assert.Equal(t, "attach queue", status.Step)
+	assert.Contains(t, status.LastError, "boom")
+
+	// the retried stream record carries the same sequence number and picks up from the failed step.
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to resume adding pipeline: %v", err)
+	}
+	assert.Len(t, f.lambda.FunctionNames(), 1)
+	assert.Len(t, f.lambda.Mappings(), 1)
+	status, _ = f.store.GetStatus(ctx, "id")
+	assert.Equal(t, pipeline.StateActive, status.State)
+	assert.Empty(t, status.LastError)
+}
+
+func TestPipelineManagerUpdate(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation: pipelinemanager.Update,
+		Config: pipelinemanager.ConfigParams{
+			ID:                       "id",
+			LambdaConcurrencyLimit:   aws.Int(8),
+			LambdaTimeoutSecs:        aws.Int(20),
+			SQSVisibilityTimeoutSecs: aws.Int(30),
+			Version:                  2,
+		},
+		SequenceNumber: "200",
+	})
+	if err != nil {
+		t.Fatalf("failed to update pipeline: %v", err)
+	}
+
+	fn, _ := f.lambda.Function("id-test-consumer")
+	assert.Equal(t, int64(20), fn.Timeout)
+	assert.Equal(t, int64(8), *fn.Concurrency)
+	q, _ := f.sqs.Queue("id-test-queue")
+	assert.Equal(t, "30", q.Attributes["VisibilityTimeout"])
+	ident, _ := f.store.GetIdentifier(ctx, "id")
+	assert.Equal(t, int64(2), ident.Version)
+	status, _ := f.store.GetStatus(ctx, "id")
+	assert.Equal(t, pipeline.StateActive, status.State)
+}
+
+func TestPipelineManagerUpdateRevertsRemovedFields(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	add := addInstruction("id")
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Update,
+		Config:         pipelinemanager.ConfigParams{ID: "id", Version: 2},
+		Previous:       add.Config,
+		SequenceNumber: "200",
+	})
+	if err != nil {
+		t.Fatalf("failed to update pipeline: %v", err)
+	}
+
+	fn, _ := f.lambda.Function("id-test-consumer")
+	assert.Equal(t, int64(pipeline.DefaultLambdaTimeoutSecs), fn.Timeout)
+	assert.Nil(t, fn.Concurrency, "concurrency should no longer be reserved")
+	q, _ := f.sqs.Queue("id-test-queue")
+	assert.Equal(t, "30", q.Attributes["VisibilityTimeout"])
+	dlq, _ := f.sqs.Queue("id-test-queue-dlq")
+	assert.Equal(t, "30", dlq.Attributes["VisibilityTimeout"])
+}
+
+func TestPipelineManagerRateLimit(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	add := addInstruction("id")
+	add.Config.RatePerSecond = aws.Float64(2.5)
+	add.Constants.RateLimitTable = "rate-limits"
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	fn, _ := f.lambda.Function("id-test-consumer")
+	assert.Equal(t, map[string]string{
+		consumerenv.ReportBatchItemFailures: "true",
+		consumerenv.RatePerSecond:           "2.5",
+		consumerenv.RateLimitTable:          "rate-limits",
+	}, fn.Environment)
+
+	update := func(seq string, version int64, rate *float64, previous pipelinemanager.ConfigParams) pipelinemanager.ConfigParams {
+		config := add.Config
+		config.RatePerSecond, config.Version = rate, version
+		err := m.Handle(ctx, pipelinemanager.Instruction{
+			Operation:      pipelinemanager.Update,
+			Config:         config,
+			Previous:       previous,
+			Constants:      add.Constants,
+			SequenceNumber: seq,
+		})
+		if err != nil {
+			t.Fatalf("failed to update pipeline: %v", err)
+		}
+		return config
+	}
+
+	previous := update("200", 2, aws.Float64(10), add.Config)
+	fn, _ = f.lambda.Function("id-test-consumer")
+	assert.Equal(t, "10", fn.Environment[consumerenv.RatePerSecond])
+	assert.Equal(t, "true", fn.Environment[consumerenv.ReportBatchItemFailures], "other envars are kept")
+
+	update("300", 3, nil, previous)
+	fn, _ = f.lambda.Function("id-test-consumer")
+	assert.NotContains(t, fn.Environment, consumerenv.RatePerSecond)
+	assert.Equal(t, "true", fn.Environment[consumerenv.ReportBatchItemFailures])
+}
+
+func TestPipelineManagerEnablesBatchItemFailures(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	add := addInstruction("id")
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	// make the consumer look like one created before partial batch failures were reported.
+	mapping := f.lambda.Mappings()[0]
+	_, err := f.lambda.UpdateEventSourceMappingWithContext(ctx, &lambda.UpdateEventSourceMappingInput{UUID: aws.String(mapping.UUID), FunctionResponseTypes: []*string{}})
+	if err != nil {
+		t.Fatalf("failed to update mapping: %v", err)
+	}
+	_, err = f.lambda.UpdateFunctionConfigurationWithContext(ctx, &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: aws.String("id-test-consumer"),
+		Environment:  &lambda.Environment{Variables: map[string]*string{"OTHER": aws.String("kept")}},
+	})
+	if err != nil {
+		t.Fatalf("failed to update function: %v", err)
+	}
+
+	update := add
+	update.Operation, update.Previous, update.SequenceNumber = pipelinemanager.Update, add.Config, "200"
+	update.Config.Version = 2
+	if err := m.Handle(ctx, update); err != nil {
+		t.Fatalf("failed to update pipeline: %v", err)
+	}
+	if mappings := f.lambda.Mappings(); assert.Len(t, mappings, 1) {
+		assert.Equal(t, []string{lambda.FunctionResponseTypeReportBatchItemFailures}, mappings[0].FunctionResponseTypes)
+	}
+	fn, _ := f.lambda.Function("id-test-consumer")
+	assert.Equal(t, map[string]string{consumerenv.ReportBatchItemFailures: "true", "OTHER": "kept"}, fn.Environment)
+}
+
+func TestPipelineManagerControlledConcurrency(t *testing.T) {
+	type update struct {
+		change func(c *pipelinemanager.ConfigParams)
+		want   int64
+		msg    string
+	}
+	timeout := func(c *pipelinemanager.ConfigParams) { c.LambdaTimeoutSecs = aws.Int(12) }
+	tests := []struct {
+		name    string
+		config  func(c *pipelinemanager.ConfigParams)
+		start   int64 // concurrency a new consumer starts at
+		tuned   int64 // concurrency the tuner sets in between the manager's updates
+		updates []update
+	}{
+		{
+			name: "target rate",
+			config: func(c *pipelinemanager.ConfigParams) {
+				c.LambdaConcurrencyLimit = nil
+				c.TargetRatePerSecond = aws.Float64(10)
+				c.MinConcurrency = aws.Int(2)
+			},
+			start: 2,
+			tuned: 6,
+			updates: []update{
+				{change: timeout, want: 6, msg: "tuned concurrency is kept"},
+				{change: func(c *pipelinemanager.ConfigParams) { c.MaxConcurrency = aws.Int(4) }, want: 4, msg: "held to the new max"},
+			},
+		},
+		{
+			name:   "adaptive",
+			config: func(c *pipelinemanager.ConfigParams) { c.AdaptiveConcurrency = aws.Bool(true) },
+			start:  5,
+			tuned:  2,
+			updates: []update{
+				{change: timeout, want: 2, msg: "adapted concurrency is kept"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			m, f := newManager()
+			add := addInstruction("id")
+			tt.config(&add.Config)
+			if err := m.Handle(ctx, add); err != nil {
+				t.Fatalf("failed to add pipeline: %v", err)
+			}
+			concurrency := func() int64 {
+				fn, _ := f.lambda.Function("id-test-consumer")
+				return *fn.Concurrency
+			}
+			assert.Equal(t, tt.start, concurrency(), "new consumer's concurrency")
+
+			assert.NoError(t, consumer.SetConcurrency(ctx, f.lambda, "id-test-consumer", tt.tuned))
+
+			previous := add.Config
+			for i, u := range tt.updates {
+				config := previous
+				config.Version = int64(i + 2)
+				u.change(&config)
+				err := m.Handle(ctx, pipelinemanager.Instruction{
+					Operation:      pipelinemanager.Update,
+					Config:         config,
+					Previous:       previous,
+					Constants:      add.Constants,
+					SequenceNumber: strconv.Itoa(200 + 100*i),
+				})
+				if err != nil {
+					t.Fatalf("failed to update pipeline: %v", err)
+				}
+				assert.Equal(t, u.want, concurrency(), u.msg)
+				previous = config
+			}
+		})
+	}
+}
+
+func TestPipelineManagerProfiles(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	profile, err := f.store.PutProfileIfVersion(ctx, pipeline.Profile{ID: "scraper", LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 30})
+	if err != nil {
+		t.Fatalf("failed to put profile: %v", err)
+	}
+	for _, c := range []pipeline.Config{
+		{ID: "a", Profile: "scraper", LambdaConcurrencyLimit: aws.Int(2)},
+		{ID: "b", Profile: "scraper", LambdaTimeoutSes: 5},
+		{ID: "c", LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 30},
+	} {
+		c, err := f.store.PutConfigIfVersion(ctx, c)
+		if err != nil {
+			t.Fatalf("failed to put config: %v", err)
+		}
+		add := pipelinemanager.Instruction{
+			Operation: pipelinemanager.Add,
+			Config: pipelinemanager.ConfigParams{
+				ID:                     c.ID,
+				LambdaConcurrencyLimit: c.LambdaConcurrencyLimit,
+				Profile:                c.Profile,
+				Version:                c.Version,
+			},
+			Constants:      pipelinemanager.Constants{ConsumerBucket: "bucket", ConsumerKey: "key", ConsumerRole: "role"},
+			SequenceNumber: "100",
+		}
+		if c.LambdaTimeoutSes != 0 {
+			add.Config.LambdaTimeoutSecs = aws.Int(c.LambdaTimeoutSes)
+		}
+		if c.SQSVisibilityTimeoutSecs != 0 {
+			add.Config.SQSVisibilityTimeoutSecs = aws.Int(c.SQSVisibilityTimeoutSecs)
+		}
+		if err := m.Handle(ctx, add); err != nil {
+			t.Fatalf("failed to add pipeline %s: %v", c.ID, err)
+		}
+	}
+	fn, _ := f.lambda.Function("a-test-consumer")
+	assert.Equal(t, int64(10), fn.Timeout, "timeout should come from the profile")
+	assert.Equal(t, int64(2), *fn.Concurrency)
+	fn, _ = f.lambda.Function("b-test-consumer")
+	assert.Equal(t, int64(5), fn.Timeout, "config should override the profile")
+
+	profile.LambdaTimeoutSes, profile.SQSVisibilityTimeoutSecs = 20, 60
+	if _, err := f.store.PutProfileIfVersion(ctx, profile); err != nil {
+		t.Fatalf("failed to update profile: %v", err)
+	}
+	err = m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Reapply,
+		Profile:        "scraper",
+		SequenceNumber: "200",
+	})
+	if err != nil {
+		t.Fatalf("failed to reapply profile: %v", err)
+	}
+
+	fn, _ = f.lambda.Function("a-test-consumer")
+	assert.Equal(t, int64(20), fn.Timeout)
+	assert.Equal(t, int64(2), *fn.Concurrency)
+	q, _ := f.sqs.Queue("a-test-queue")
+	assert.Equal(t, "60", q.Attributes["VisibilityTimeout"])
+	fn, _ = f.lambda.Function("b-test-consumer")
+	assert.Equal(t, int64(5), fn.Timeout)
+	q, _ = f.sqs.Queue("b-test-queue")
+	assert.Equal(t, "60", q.Attributes["VisibilityTimeout"])
+	q, _ = f.sqs.Queue("c-test-queue")
+	assert.Equal(t, "30", q.Attributes["VisibilityTimeout"], "pipelines without the profile are untouched")
+}
+
+func TestPipelineManagerOverridesAdaptiveProfile(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	_, err := f.store.PutProfileIfVersion(ctx, pipeline.Profile{ID: "adaptive", LambdaConcurrencyLimit: aws.Int(8), AdaptiveConcurrency: true})
+	if err != nil {
+		t.Fatalf("failed to put profile: %v", err)
+	}
+	for id, adaptive := range map[string]*bool{"inherited": nil, "fixed": aws.Bool(false)} {
+		add := addInstruction(id)
+		add.Config.LambdaConcurrencyLimit = nil
+		add.Config.Profile = "adaptive"
+		add.Config.AdaptiveConcurrency = adaptive
+		if err := m.Handle(ctx, add); err != nil {
+			t.Fatalf("failed to add pipeline %s: %v", id, err)
+		}
+		// the tuner backs off in between the manager's updates.
+		assert.NoError(t, consumer.SetConcurrency(ctx, f.lambda, id+"-test-consumer", 3))
+		update := add
+		update.Operation, update.Previous, update.SequenceNumber = pipelinemanager.Update, add.Config, "200"
+		update.Config.LambdaTimeoutSecs, update.Config.Version = aws.Int(12), 2
+		if err := m.Handle(ctx, update); err != nil {
+			t.Fatalf("failed to update pipeline %s: %v", id, err)
+		}
+	}
+	fn, _ := f.lambda.Function("inherited-test-consumer")
+	assert.Equal(t, int64(3), *fn.Concurrency, "adaptive concurrency from the profile is kept")
+	fn, _ = f.lambda.Function("fixed-test-consumer")
+	assert.Equal(t, int64(8), *fn.Concurrency, "an explicit false should override the profile and set the limit")
+}
+
+func TestPipelineManagerMissingProfile(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	add := addInstruction("id")
+	add.Config.Profile = "deleted"
+	add.Config.LambdaTimeoutSecs = nil
+
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline with a missing profile: %v", err)
+	}
+	fn, _ := f.lambda.Function("id-test-consumer")
+	assert.Equal(t, int64(pipeline.DefaultLambdaTimeoutSecs), fn.Timeout, "missing profile should leave the default")
+}
+
+func TestPipelineManagerDelete(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Delete,
+		Config:         pipelinemanager.ConfigParams{ID: "id", Version: 1},
+		SequenceNumber: "200",
+	})
+	if err != nil {
+		t.Fatalf("failed to delete pipeline: %v", err)
+	}
+
+	assert.Empty(t, f.sqs.QueueNames())
+	assert.Empty(t, f.lambda.FunctionNames())
+	assert.Empty(t, f.lambda.Mappings())
+	_, err = f.store.GetIdentifier(ctx, "id")
+	assert.True(t, pipeline.IsNotFound(err))
+	_, err = f.store.GetStatus(ctx, "id")
+	assert.True(t, pipeline.IsNotFound(err))
+}
+
+func TestPipelineManagerSkipsStaleInstruction(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	if err := f.store.PutIdentifier(ctx, pipeline.Identifier{ID: "id", Version: 2}); err != nil {
+		t.Fatalf("failed to put identifier: %v", err)
+	}
+
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("stale instruction returned error: %v", err)
+	}
+	assert.Empty(t, f.sqs.QueueNames())
+	assert.Empty(t, f.lambda.FunctionNames())
+	history, _ := f.store.ListHistory(ctx, "id", pipeline.ListInput{})
+	assert.Empty(t, history.Entries, "skipped instructions should not be recorded")
+}
+
+func TestPipelineManagerSkipsInstructionFromBeforeDelete(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Delete,
+		Config:         pipelinemanager.ConfigParams{ID: "id", Version: 1},
+		SequenceNumber: "300",
+	})
+	if err != nil {
+		t.Fatalf("failed to delete pipeline: %v", err)
+	}
+	tombstone, err := f.store.GetTombstone(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get tombstone: %v", err)
+	}
+	assert.Equal(t, "300", tombstone.SequenceNumber)
+
+	// a delayed update from before the delete must not recreate the pipeline.
+	delayed := addInstruction("id")
+	delayed.Operation = pipelinemanager.Update
+	delayed.Previous = delayed.Config
+	delayed.SequenceNumber = "200"
+	if err := m.Handle(ctx, delayed); err != nil {
+		t.Fatalf("stale instruction returned error: %v", err)
+	}
+	assert.Empty(t, f.sqs.QueueNames())
+	assert.Empty(t, f.lambda.FunctionNames())
+
+	// the pipeline added again starts over from version 1.
+	again := addInstruction("id")
+	again.SequenceNumber = "400"
+	if err := m.Handle(ctx, again); err != nil {
+		t.Fatalf("failed to add pipeline again: %v", err)
+	}
+	assert.Len(t, f.lambda.FunctionNames(), 1)
+	ident, err := f.store.GetIdentifier(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get identifier: %v", err)
+	}
+	assert.Equal(t, int64(1), ident.Version)
+	_, err = f.store.GetTombstone(ctx, "id")
+	assert.True(t, pipeline.IsNotFound(err), "tombstone should be replaced by the identifier")
+}
+
+func TestPipelineManagerRecordsHistory(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	add := addInstruction("id")
+	add.Config.ChangedBy = "alice"
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	updated := pipelinemanager.ConfigParams{ID: "id", LambdaTimeoutSecs: aws.Int(20), SQSVisibilityTimeoutSecs: aws.Int(30), ChangedBy: "bob", Version: 2}
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Update,
+		Config:         updated,
+		Previous:       add.Config,
+		SequenceNumber: "200",
+	})
+	if err != nil {
+		t.Fatalf("failed to update pipeline: %v", err)
+	}
+	err = m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Delete,
+		Config:         pipelinemanager.ConfigParams{ID: "id", Version: 2},
+		Previous:       updated,
+		SequenceNumber: "300",
+	})
+	if err != nil {
+		t.Fatalf("failed to delete pipeline: %v", err)
+	}
+
+	history, err := f.store.ListHistory(ctx, "id", pipeline.ListInput{})
+	if err != nil {
+		t.Fatalf("failed to list history: %v", err)
+	}
+	if !assert.Len(t, history.Entries, 3) {
+		return
+	}
+	var sequenceNumbers []string
+	for _, e := range history.Entries {
+		sequenceNumbers = append(sequenceNumbers, e.SequenceNumber)
+		assert.False(t, e.AppliedAt.IsZero())
+	}
+	assert.Equal(t, []string{"300", "200", "100"}, sequenceNumbers)
+	assert.True(t, history.Entries[0].Deleted)
+	assert.Equal(t, 20, history.Entries[0].Config.LambdaTimeoutSes, "removal should record the removed config")
+	assert.Equal(t, 20, history.Entries[0].Item.LambdaTimeoutSes)
+	assert.Equal(t, "bob", history.Entries[1].ChangedBy)
+	assert.Equal(t, int64(2), history.Entries[1].Config.Version)
+	assert.Equal(t, "alice", history.Entries[2].ChangedBy)
+	assert.Equal(t, aws.Int(5), history.Entries[2].Config.LambdaConcurrencyLimit)
+}
+
+func TestPipelineManagerRecordsResolvedHistory(t *testing.T) {
+	ctx := context.Background()
+	m, f := newManager()
+	at := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	profile, err := f.store.PutProfileIfVersion(ctx, pipeline.Profile{ID: "scraper", LambdaTimeoutSes: 10})
+	if err != nil {
+		t.Fatalf("failed to put profile: %v", err)
+	}
+	config, err := f.store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id", Profile: "scraper"})
+	if err != nil {
+		t.Fatalf("failed to put config: %v", err)
+	}
+	add := addInstruction("id")
+	add.Config = pipelinemanager.ConfigParams{ID: "id", Profile: "scraper", Version: config.Version}
+	add.SequenceNumber = "9000"
+	add.Event.CreatedAt = at
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	profile.LambdaTimeoutSes = 20
+	if _, err := f.store.PutProfileIfVersion(ctx, profile); err != nil {
+		t.Fatalf("failed to update profile: %v", err)
+	}
+	// the profiles stream's sequence numbers do not compare with the configs stream's.
+	err = m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Reapply,
+		Profile:        "scraper",
+		SequenceNumber: "50",
+		Event:          pipelinemanager.EventMetadata{CreatedAt: at.Add(time.Minute)},
+	})
+	if err != nil {
+		t.Fatalf("failed to reapply profile: %v", err)
+	}
+
+	history, err := f.store.ListHistory(ctx, "id", pipeline.ListInput{})
+	if err != nil {
+		t.Fatalf("failed to list history: %v", err)
+	}
+	if assert.Len(t, history.Entries, 2) {
+		assert.Equal(t, "50", history.Entries[0].SequenceNumber, "the re-apply is the newest entry")
+		assert.Equal(t, 20, history.Entries[0].Config.LambdaTimeoutSes, "the config should be recorded as resolved")
+		assert.Equal(t, 10, history.Entries[1].Config.LambdaTimeoutSes)
+		assert.Equal(t, "scraper", history.Entries[1].Config.Profile)
+		for _, e := range history.Entries {
+			assert.Equal(t, pipeline.Config{ID: "id", Profile: "scraper", Version: config.Version}, e.Item, "the item should be recorded unresolved")
+		}
+	}
+}
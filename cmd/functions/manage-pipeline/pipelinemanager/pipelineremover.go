@@ -2,9 +2,10 @@ package pipelinemanager
 
 import (
 	"context"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/queue"
@@ -13,54 +14,117 @@ import (
 
 // pipelineRemover is responsible for removing pipelines
 type pipelineRemover struct {
-	lambdaSvc *lambda.Lambda
-	sqsSvc    *sqs.SQS
-	db        *dynamodb.DynamoDB
+	lambdaSvc lambdaiface.LambdaAPI
+	sqsSvc    sqsiface.SQSAPI
+	store     stepStore
 }
 
-func newRemover(lamSvc *lambda.Lambda, sqsSvc *sqs.SQS, db *dynamodb.DynamoDB) *pipelineRemover {
+func newRemover(lamSvc lambdaiface.LambdaAPI, sqsSvc sqsiface.SQSAPI, store stepStore) *pipelineRemover {
 	return &pipelineRemover{
 		lambdaSvc: lamSvc,
 		sqsSvc:    sqsSvc,
-		db:        db,
+		store:     store,
 	}
 }
 
-func (r *pipelineRemover) remove(ctx context.Context, config ConfigParams, constants Constants) error {
-	ident, err := r.getIdentifiers(ctx, config, constants)
+func (r *pipelineRemover) remove(ctx context.Context, config ConfigParams, constants Constants, sequenceNumber string) error {
+	journal, err := loadJournal(ctx, r.store, config.ID, sequenceNumber, Delete)
 	if err != nil {
-		return errors.Wrapf(err, "failed to get identifiers for pipeline %s", config.ID)
+		return err
 	}
-	if err := r.removeConsumer(ctx, ident); err != nil {
-		return errors.Wrapf(err, "failed to remove consumer for pipeline %s", config.ID)
+	status, err := loadStatus(ctx, r.store, config, sequenceNumber)
+	if err != nil {
+		return err
 	}
-	if err := r.removeQueue(ctx, ident); err != nil {
-		return errors.Wrapf(err, "failed to remove queue for pipeline %s", config.ID)
+	if !journal.done() {
+		journal.track(status, pipeline.StateDeleting)
+		if err := r.removeSteps(ctx, config, constants, sequenceNumber, journal); err != nil {
+			return status.fail(ctx, err)
+		}
+		if err := journal.finish(ctx); err != nil {
+			return errors.Wrapf(err, "failed to finish journal for pipeline %s", config.ID)
+		}
 	}
-	if err := r.removeIdentifier(ctx, constants, ident); err != nil {
-		return errors.Wrapf(err, "failed to remove identifier for pipeline %s", config.ID)
+	if err := status.remove(ctx); err != nil {
+		return errors.Wrapf(err, "failed to remove status for pipeline %s", config.ID)
 	}
 	return nil
 }
 
-func (r *pipelineRemover) getIdentifiers(ctx context.Context, config ConfigParams, constants Constants) (pipeline.Identifier, error) {
-	return pipeline.GetIdentifier(ctx, r.db, constants.IdentifiersTable, config.ID)
+func (r *pipelineRemover) removeSteps(ctx context.Context, config ConfigParams, constants Constants, sequenceNumber string, journal *journalRunner) error {
+	steps := []struct {
+		name string
+		fn   stepFunc
+	}{
+		{stepGetIdentifier, r.getIdentifiers(config)},
+		{stepRemoveConsumer, r.removeConsumer()},
+		{stepRemoveQueue, r.removeQueue()},
+		{stepRemoveDLQ, r.removeDLQ()},
+		{stepRemoveIdentifier, r.removeIdentifier(config, sequenceNumber)},
+	}
+	for _, step := range steps {
+		if err := journal.run(ctx, step.name, step.fn); err != nil {
+			return errors.Wrapf(err, "failed to remove pipeline %s", config.ID)
+		}
+	}
+	return nil
 }
 
-func (r *pipelineRemover) removeConsumer(ctx context.Context, identifier pipeline.Identifier) error {
-	return consumer.Delete(ctx, r.lambdaSvc, identifier.ConsumerName)
+func (r *pipelineRemover) getIdentifiers(config ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		i, err := r.store.GetIdentifier(ctx, config.ID)
+		if err != nil {
+			return err
+		}
+		*ident = i
+		return nil
+	}
 }
 
-func (r *pipelineRemover) removeQueue(ctx context.Context, identifier pipeline.Identifier) error {
-	if err := queue.Delete(ctx, r.sqsSvc, identifier.QueueURL); err != nil {
-		return errors.Wrap(err, "failed to delete main queue")
+// removeConsumer deletes the consumer function, a missing function means a previous invocation
+// already deleted it before it could journal the step.
+func (r *pipelineRemover) removeConsumer() stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		err := consumer.Delete(ctx, r.lambdaSvc, ident.ConsumerName)
+		if pipeline.IsAWSErrCode(err, lambda.ErrCodeResourceNotFoundException) {
+			return nil
+		}
+		return err
 	}
-	if err := queue.Delete(ctx, r.sqsSvc, identifier.DeadLetterQueueURL); err != nil {
-		return errors.Wrap(err, "failed to delete dead letter queue")
+}
+
+func (r *pipelineRemover) removeQueue() stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		if err := deleteQueue(ctx, r.sqsSvc, ident.QueueURL); err != nil {
+			return errors.Wrap(err, "failed to delete main queue")
+		}
+		return nil
 	}
-	return nil
 }
 
-func (r *pipelineRemover) removeIdentifier(ctx context.Context, constants Constants, identifier pipeline.Identifier) error {
-	return pipeline.DeleteItem(ctx, r.db, constants.IdentifiersTable, identifier.ID)
+func (r *pipelineRemover) removeDLQ() stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		if err := deleteQueue(ctx, r.sqsSvc, ident.DeadLetterQueueURL); err != nil {
+			return errors.Wrap(err, "failed to delete dead letter queue")
+		}
+		return nil
+	}
+}
+
+// removeIdentifier leaves a tombstone in place of the identifier, recording the stream record that
+// removed the pipeline so that older records are skipped as stale.
+func (r *pipelineRemover) removeIdentifier(config ConfigParams, sequenceNumber string) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		tombstone := pipeline.Tombstone{ID: ident.ID, SequenceNumber: sequenceNumber, Version: config.Version}
+		return r.store.DeleteIdentifierIfNotStale(ctx, tombstone)
+	}
+}
+
+// deleteQueue deletes the queue, treating a queue that no longer exists as deleted.
+func deleteQueue(ctx context.Context, svc sqsiface.SQSAPI, url string) error {
+	err := queue.Delete(ctx, svc, url)
+	if pipeline.IsAWSErrCode(err, sqs.ErrCodeQueueDoesNotExist) {
+		return nil
+	}
+	return err
 }
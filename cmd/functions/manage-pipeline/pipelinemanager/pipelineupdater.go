@@ -2,67 +2,180 @@ package pipelinemanager
 
 import (
 	"context"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/lambda"
-	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/plan"
 	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/queue"
 	"github.com/pkg/errors"
+	"strconv"
+	"strings"
 )
 
 // pipelineUpdater is responsible for updating pipelines
 type pipelineUpdater struct {
-	lambdaSvc *lambda.Lambda
-	sqsSvc    *sqs.SQS
-	db        *dynamodb.DynamoDB
+	lambdaSvc lambdaiface.LambdaAPI
+	sqsSvc    sqsiface.SQSAPI
+	store     stepStore
 }
 
-func newUpdater(lamSvc *lambda.Lambda, sqsSvc *sqs.SQS, db *dynamodb.DynamoDB) *pipelineUpdater {
+func newUpdater(lamSvc lambdaiface.LambdaAPI, sqsSvc sqsiface.SQSAPI, store stepStore) *pipelineUpdater {
 	return &pipelineUpdater{
 		lambdaSvc: lamSvc,
 		sqsSvc:    sqsSvc,
-		db:        db,
+		store:     store,
 	}
 }
 
-func (u *pipelineUpdater) update(ctx context.Context, config ConfigParams, constants Constants) error {
-	ident, err := u.getIdentifiers(ctx, config, constants)
+func (u *pipelineUpdater) update(ctx context.Context, config, previous ConfigParams, constants Constants, sequenceNumber string) error {
+	journal, err := loadJournal(ctx, u.store, config.ID, sequenceNumber, Update)
 	if err != nil {
-		return errors.Wrapf(err, "failed to get identifiers for pipeline %s", config.ID)
+		return err
 	}
-	if err := u.updateConsumer(ctx, config, ident); err != nil {
-		return errors.Wrapf(err, "failed to update consumer for pipeline %s", config.ID)
+	status, err := loadStatus(ctx, u.store, config, sequenceNumber)
+	if err != nil {
+		return err
+	}
+	if journal.done() {
+		return status.settle(ctx, pipeline.StateActive)
+	}
+	journal.track(status, pipeline.StateUpdating)
+	if err := u.updateSteps(ctx, config, previous, constants, journal); err != nil {
+		return status.fail(ctx, err)
+	}
+	if err := journal.finish(ctx); err != nil {
+		return errors.Wrapf(err, "failed to finish journal for pipeline %s", config.ID)
+	}
+	if err := status.set(ctx, pipeline.StateActive, ""); err != nil {
+		return errors.Wrapf(err, "failed to set pipeline %s active", config.ID)
+	}
+	return nil
+}
+
+// updateSteps applies the plan made from the previous and new configs. The consumer and queue steps
+// each make the plan again from the live state of the resources, so a step resumed after a partial
+// failure only applies the changes still to do.
+func (u *pipelineUpdater) updateSteps(ctx context.Context, config, previous ConfigParams, constants Constants, journal *journalRunner) error {
+	if err := validateConfig(config); err != nil {
+		return errors.Wrapf(err, "failed to validate config %s", config.ID)
 	}
-	if err := u.updateQueue(ctx, config, ident); err != nil {
-		return errors.Wrapf(err, "failed to update queue for pipeline %s", config.ID)
+	config = config.withDefaults()
+	steps := []struct {
+		name string
+		fn   stepFunc
+	}{
+		{stepGetIdentifier, u.getIdentifiers(config)},
+		{stepUpdateConsumer, u.updateConsumer(config, previous, constants)},
+		{stepUpdateQueue, u.updateQueue(config, previous)},
+		{stepEnableFailures, u.enableBatchItemFailures()},
+		{stepPutIdentifier, u.updateIdentifier(config)},
+	}
+	for _, step := range steps {
+		if err := journal.run(ctx, step.name, step.fn); err != nil {
+			return errors.Wrapf(err, "failed to update pipeline %s", config.ID)
+		}
 	}
 	return nil
 }
 
-func (u *pipelineUpdater) updateConsumer(ctx context.Context, config ConfigParams, ident pipeline.Identifier) error {
-	return consumer.Update(ctx, u.lambdaSvc, consumer.UpdateParams{
-		Name:        ident.ConsumerName,
-		Concurrency: pInt64(config.LambdaConcurrencyLimit),
-		Timeout:     pInt64(config.LambdaTimeoutSecs),
-	})
+func (u *pipelineUpdater) updateConsumer(config, previous ConfigParams, constants Constants) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		p, err := u.plan(ctx, config, previous, *ident)
+		if err != nil {
+			return err
+		}
+		params := consumer.UpdateParams{Name: ident.ConsumerName}
+		for _, c := range p.For(plan.Consumer) {
+			switch c.Setting {
+			case plan.SettingTimeout:
+				params.Timeout = pInt64(config.LambdaTimeoutSecs)
+			case plan.SettingReservedConcurrency:
+				params.Concurrency = pInt64(config.LambdaConcurrencyLimit)
+				params.RemoveConcurrency = config.LambdaConcurrencyLimit == nil
+				if config.pipelineConfig().Controlled() {
+					// the plan moves a tuned or adapted concurrency within its bounds, from the live concurrency.
+					n, err := strconv.Atoi(c.To)
+					if err != nil {
+						return errors.Wrapf(err, "invalid tuned concurrency %q", c.To)
+					}
+					params.Concurrency, params.RemoveConcurrency = pInt64(&n), false
+				}
+			case plan.SettingRatePerSecond:
+				params.RatePerSecond = aws.Float64(floatValue(config.RatePerSecond))
+				params.RateLimitTable = constants.RateLimitTable
+			}
+		}
+		if err := consumer.Update(ctx, u.lambdaSvc, params); err != nil {
+			return err
+		}
+		if len(p.For(plan.Mapping)) > 0 {
+			return consumer.AttachQueue(ctx, u.lambdaSvc, ident.ConsumerName, ident.QueueARN)
+		}
+		return nil
+	}
 }
 
-func (u *pipelineUpdater) updateQueue(ctx context.Context, config ConfigParams, ident pipeline.Identifier) error {
-	if config.SQSVisibilityTimeoutSecs == nil {
+func (u *pipelineUpdater) updateQueue(config, previous ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		p, err := u.plan(ctx, config, previous, *ident)
+		if err != nil {
+			return err
+		}
+		if len(p.For(plan.Queue)) > 0 {
+			if err := queue.UpdateVisibilityTimeout(ctx, u.sqsSvc, ident.QueueURL, *config.SQSVisibilityTimeoutSecs); err != nil {
+				return errors.Wrap(err, "failed updating main queue")
+			}
+		}
+		if len(p.For(plan.DeadLetterQueue)) > 0 {
+			if err := queue.UpdateVisibilityTimeout(ctx, u.sqsSvc, ident.DeadLetterQueueURL, *config.SQSVisibilityTimeoutSecs); err != nil {
+				return errors.Wrap(err, "failed updating dead letter queue")
+			}
+		}
 		return nil
 	}
-	if err := queue.UpdateVisibilityTimeout(ctx, u.sqsSvc, ident.QueueURL, *config.SQSVisibilityTimeoutSecs); err != nil {
-		return errors.Wrap(err, "failed updating main queue")
+}
+
+// enableBatchItemFailures makes consumers created before partial batch failures were reported
+// report them, so that an update brings them in line with new pipelines.
+func (u *pipelineUpdater) enableBatchItemFailures() stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		return consumer.EnableBatchItemFailures(ctx, u.lambdaSvc, ident.ConsumerName, ident.QueueARN, consumer.Waiter{})
 	}
-	if err := queue.UpdateVisibilityTimeout(ctx, u.sqsSvc, ident.DeadLetterQueueURL, *config.SQSVisibilityTimeoutSecs); err != nil {
-		return errors.Wrap(err, "failed updating dead letter queue")
+}
+
+// plan observes the pipeline resources and plans the changes to them, pipelines with missing
+// resources can not be updated.
+func (u *pipelineUpdater) plan(ctx context.Context, config, previous ConfigParams, ident pipeline.Identifier) (plan.Plan, error) {
+	live, err := plan.Observe(ctx, u.sqsSvc, u.lambdaSvc, ident)
+	if err != nil {
+		return plan.Plan{}, err
+	}
+	p := plan.Make(previous.pipelineConfig(), config.pipelineConfig(), ident, live)
+	if p.Recreate {
+		return plan.Plan{}, errors.Errorf("pipeline %s must be recreated: %s", config.ID, strings.Join(p.Reasons, ", "))
+	}
+	return p, nil
+}
+
+// updateIdentifier records the config version now applied to the pipeline resources.
+func (u *pipelineUpdater) updateIdentifier(config ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		ident.Version = config.Version
+		return u.store.PutIdentifierIfNotStale(ctx, *ident)
 	}
-	return nil
 }
 
-func (u *pipelineUpdater) getIdentifiers(ctx context.Context, config ConfigParams, constants Constants) (pipeline.Identifier, error) {
-	return pipeline.GetIdentifier(ctx, u.db, constants.IdentifiersTable, config.ID)
+func (u *pipelineUpdater) getIdentifiers(config ConfigParams) stepFunc {
+	return func(ctx context.Context, ident *pipeline.Identifier) error {
+		i, err := u.store.GetIdentifier(ctx, config.ID)
+		if err != nil {
+			return err
+		}
+		*ident = i
+		return nil
+	}
 }
 
 func pInt64(i *int) *int64 {
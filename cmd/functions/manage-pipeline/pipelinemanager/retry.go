@@ -0,0 +1,144 @@
+package pipelinemanager
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy configures the Retry middleware, zero fields take the defaults.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first, defaults to 5
+	BaseDelay   time.Duration // delay cap of the first retry, doubled for each retry after, defaults to 200ms
+	MaxDelay    time.Duration // most a single delay can be capped at, defaults to 10s
+	Reserve     time.Duration // time that must be left before the context deadline to start another attempt, defaults to 10s
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 200 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 10 * time.Second
+	}
+	if p.Reserve <= 0 {
+		p.Reserve = 10 * time.Second
+	}
+	return p
+}
+
+// delay returns the delay before the given retry, counted from 1, with full jitter: a random
+// duration up to the exponentially growing cap, so that throttled invocations spread out.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	limit := p.MaxDelay
+	if retry < 32 {
+		if d := p.BaseDelay << uint(retry-1); d > 0 && d < limit {
+			limit = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// retryableCodes are the AWS error codes worth retrying besides the ones the SDK retries itself,
+// which it gives up on after a few attempts.
+var retryableCodes = map[string]bool{
+	"ServiceException":   true, // Lambda internal error
+	"ServiceUnavailable": true,
+	"InternalFailure":    true,
+}
+
+// inProgressMessages are the messages Lambda conflicts are returned with while the function or
+// event source mapping is still being created or updated, other conflicts, such as a function or
+// mapping which already exists, will not go away by retrying.
+var inProgressMessages = []string{
+	"An update is in progress for resource",
+	"The function is currently in the following state: Pending",
+	"The resource you requested is currently in use",
+}
+
+// isRetryable reports whether the cause of the error is a throttling or transient AWS error, or for
+// a profile re-apply, whether the failure of any of its pipelines is.
+func isRetryable(err error) bool {
+	if failed, ok := reapplyFailures(err); ok {
+		for _, ferr := range failed {
+			if isRetryable(ferr) {
+				return true
+			}
+		}
+		return false
+	}
+	cause := errors.Cause(err)
+	if request.IsErrorThrottle(cause) || request.IsErrorRetryable(cause) || isLambdaInProgress(cause) {
+		return true
+	}
+	if aerr, ok := cause.(awserr.Error); ok {
+		return retryableCodes[aerr.Code()]
+	}
+	return false
+}
+
+// isLambdaInProgress reports whether the cause of the error is a Lambda conflict with a create or
+// update of the resource which is still in progress.
+func isLambdaInProgress(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	if !ok {
+		return false
+	}
+	if aerr.Code() != lambda.ErrCodeResourceConflictException && aerr.Code() != lambda.ErrCodeResourceInUseException {
+		return false
+	}
+	for _, msg := range inProgressMessages {
+		if strings.Contains(aerr.Message(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry takes a logger and a policy and returns a middleware which handles the instruction again
+// when it fails with a throttling or transient AWS error, backing off with jitter between attempts.
+// Steps are journaled, so a retry resumes from the step which failed. No attempt is started unless
+// the delay and the policy's reserve fit before the context deadline, which for the Lambda is the
+// invocation's remaining time, leaving the stream record to be retried instead.
+func Retry(log *logrus.Logger, policy RetryPolicy) Middleware {
+	policy = policy.withDefaults()
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) error {
+			for attempt := 1; ; attempt++ {
+				err := before(ctx, instruction)
+				if err == nil || !isRetryable(err) {
+					return err
+				}
+				fields := logrus.Fields{"instruction": instruction, "attempt": attempt}
+				if attempt == policy.MaxAttempts {
+					log.WithFields(fields).Errorf("giving up after %d attempts: %v", attempt, err)
+					return errors.Wrapf(err, "failed after %d attempts", attempt)
+				}
+				delay := policy.delay(attempt)
+				if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay+policy.Reserve {
+					log.WithFields(fields).Errorf("not enough time left to retry after %d attempts: %v", attempt, err)
+					return errors.Wrapf(err, "failed after %d attempts", attempt)
+				}
+				log.WithFields(fields).Warnf("retrying in %s: %v", delay, err)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return errors.Wrapf(err, "failed after %d attempts", attempt)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package pipelinemanager_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryResumesThrottledInstruction(t *testing.T) {
+	ctx := context.Background()
+	log, hook := test.NewNullLogger()
+	m, f := newManager()
+	m.Use(pipelinemanager.Retry(log, pipelinemanager.RetryPolicy{BaseDelay: time.Millisecond}))
+	f.lambda.FailNext("CreateFunction", awserr.New("TooManyRequestsException", "rate exceeded", nil))
+	f.sqs.FailNext("CreateQueue", awserr.New("RequestThrottled", "slow down", nil))
+
+	if err := m.Handle(ctx, addInstruction("id")); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	assert.Len(t, f.sqs.QueueNames(), 2)
+	assert.Len(t, f.lambda.FunctionNames(), 1)
+	if assert.Len(t, hook.AllEntries(), 2) {
+		assert.Equal(t, 1, hook.AllEntries()[0].Data["attempt"])
+		assert.Equal(t, 2, hook.AllEntries()[1].Data["attempt"])
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	throttled := awserr.New("TooManyRequestsException", "rate exceeded", nil)
+	tests := []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		err      error
+		attempts int
+	}{
+		{
+			name:     "after max attempts",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			err:      throttled,
+			attempts: 3,
+		},
+		{
+			name:     "non retryable error",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			err:      awserr.New("InvalidParameterValueException", "bad", nil),
+			attempts: 1,
+		},
+		{
+			name:     "conflict with an existing resource",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			err:      awserr.New("ResourceConflictException", "The resource already exists.", nil),
+			attempts: 1,
+		},
+		{
+			name:     "update still in progress",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			err:      awserr.New("ResourceConflictException", "The operation cannot be performed at this time. An update is in progress for resource: arn:aws:lambda:eu-west-2:000000000000:function:id-test-consumer", nil),
+			attempts: 3,
+		},
+		{
+			name: "reapply with a throttled pipeline",
+			ctx:  func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			err: &pipelinemanager.ReapplyError{Profile: "scraper", Failed: map[string]error{
+				"a": awserr.New("InvalidParameterValueException", "bad", nil),
+				"b": errors.Wrap(throttled, "failed to update pipeline"),
+			}},
+			attempts: 3,
+		},
+		{
+			name: "reapply without a retryable failure",
+			ctx:  func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			err: &pipelinemanager.ReapplyError{Profile: "scraper", Failed: map[string]error{
+				"a": awserr.New("InvalidParameterValueException", "bad", nil),
+			}},
+			attempts: 1,
+		},
+		{
+			name: "not enough time left",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 5*time.Second)
+			},
+			err:      throttled,
+			attempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			log, _ := test.NewNullLogger()
+			retry := pipelinemanager.Retry(log, pipelinemanager.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+			attempts := 0
+			h := retry(func(context.Context, pipelinemanager.Instruction) error {
+				attempts++
+				return errors.Wrap(tt.err, "failed on step")
+			})
+
+			err := h(ctx, addInstruction("id"))
+			assert.Equal(t, tt.err, errors.Cause(err))
+			assert.Equal(t, tt.attempts, attempts)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package pipelinemanager
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Steps recorded against the pipeline status.
+const (
+	stepValidate         = "validate config"
+	stepCreateQueue      = "create queue"
+	stepCreateConsumer   = "create consumer"
+	stepWaitConsumer     = "wait for consumer"
+	stepSetConcurrency   = "set concurrency"
+	stepAttachQueue      = "attach queue"
+	stepPutIdentifier    = "put identifier"
+	stepGetIdentifier    = "get identifier"
+	stepUpdateConsumer   = "update consumer"
+	stepUpdateQueue      = "update queue"
+	stepEnableFailures   = "enable batch item failures"
+	stepRemoveConsumer   = "remove consumer"
+	stepRemoveQueue      = "remove queue"
+	stepRemoveDLQ        = "remove dead letter queue"
+	stepRemoveIdentifier = "remove identifier"
+)
+
+// statusRecorder records the lifecycle status of a single pipeline as the manager works through it.
+type statusRecorder struct {
+	store          pipeline.StatusStore
+	version        int64
+	sequenceNumber string
+	status         pipeline.Status
+}
+
+// loadStatus returns a statusRecorder for the pipeline, loaded with the currently recorded status.
+// Pipelines with no recorded status start with an empty state.
+func loadStatus(ctx context.Context, store pipeline.StatusStore, config ConfigParams, sequenceNumber string) (*statusRecorder, error) {
+	status, err := store.GetStatus(ctx, config.ID)
+	if pipeline.IsNotFound(err) {
+		status, err = pipeline.Status{ID: config.ID}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load status for pipeline %s", config.ID)
+	}
+	return &statusRecorder{store: store, version: config.Version, sequenceNumber: sequenceNumber, status: status}, nil
+}
+
+// set moves the pipeline to the given state and step and records it in the store.
+func (r *statusRecorder) set(ctx context.Context, state pipeline.State, step string) error {
+	status, err := r.status.Transition(state, step, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	status.ConfigVersion = r.version
+	status.SequenceNumber = r.sequenceNumber
+	if err := r.store.PutStatus(ctx, status); err != nil {
+		return errors.Wrapf(err, "failed to record state %s for pipeline %s", state, status.ID)
+	}
+	r.status = status
+	return nil
+}
+
+// settle makes sure the pipeline has ended up in the given state, used when a previous invocation
+// completed the operation but stopped before it could record the final state.
+func (r *statusRecorder) settle(ctx context.Context, state pipeline.State) error {
+	if r.status.State == state {
+		return nil
+	}
+	return r.set(ctx, state, "")
+}
+
+// fail moves the pipeline to the FAILED state, keeping the step it failed on along with the cause.
+// The cause is always returned, so that failures to record the status do not hide the original error.
+func (r *statusRecorder) fail(ctx context.Context, cause error) error {
+	status, err := r.status.Transition(pipeline.StateFailed, r.status.Step, time.Now().UTC())
+	if err != nil {
+		return errors.Wrapf(cause, "failed to record failure (%v)", err)
+	}
+	status.LastError = cause.Error()
+	if err := r.store.PutStatus(ctx, status); err != nil {
+		return errors.Wrapf(cause, "failed to record failure (%v)", err)
+	}
+	r.status = status
+	return cause
+}
+
+// remove deletes the status record, used once all the pipeline resources have been removed.
+func (r *statusRecorder) remove(ctx context.Context) error {
+	return r.store.DeleteStatus(ctx, r.status.ID)
+}
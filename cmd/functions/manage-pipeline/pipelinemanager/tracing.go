@@ -0,0 +1,62 @@
+package pipelinemanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/kinluek/serverless-controlled-batch-processing/tracing"
+)
+
+// Correlate returns a middleware which gives the instruction a correlation ID, made from the
+// stream event ID and the Lambda request ID. The ID is set on the instruction, so that it is in the
+// log fields of the middleware after this one, and carried by the context, so that it is in the log
+// fields and spans of the AWS calls made while handling the instruction. Use it first, only after
+// CatchPanic, so that a panic anywhere is still recovered.
+func Correlate() Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) error {
+			var requestID string
+			if lc, ok := lambdacontext.FromContext(ctx); ok {
+				requestID = lc.AwsRequestID
+			}
+			instruction.CorrelationID = tracing.NewCorrelationID(instruction.Event.ID, requestID)
+			return before(tracing.WithCorrelationID(ctx, instruction.CorrelationID), instruction)
+		}
+	}
+}
+
+// Trace takes a tracer and returns a middleware which traces the handling of every instruction,
+// with a span for the instruction and, within it, a span for each step run and each AWS call made.
+// A nil tracer turns tracing off. A panic is recorded on the span and then re-raised.
+func Trace(tracer *tracing.Tracer) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+		if tracer == nil {
+			return before
+		}
+
+		// Handler to return.
+		return func(ctx context.Context, instruction Instruction) (err error) {
+			ctx, span := tracing.Start(tracing.WithTracer(ctx, tracer), fmt.Sprintf("%s pipeline", instruction.Operation))
+			span.SetAttribute("pipeline_id", instruction.Config.ID)
+			span.SetAttribute("operation", string(instruction.Operation))
+			span.SetAttribute("sequence_number", instruction.SequenceNumber)
+			if instruction.Operation == Reapply {
+				span.SetAttribute("profile", instruction.Profile)
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					span.End(fmt.Errorf("panic occurred: %v", r))
+					panic(r)
+				}
+				span.End(err)
+			}()
+			return before(ctx, instruction)
+		}
+	}
+}
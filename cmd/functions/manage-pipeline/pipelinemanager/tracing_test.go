@@ -0,0 +1,64 @@
+package pipelinemanager_test
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/tracing"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCorrelateAddsIDToLogs(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+	log, hook := test.NewNullLogger()
+	m, _ := newManager()
+	m.Use(pipelinemanager.Correlate())
+	m.Use(pipelinemanager.Log(log))
+
+	add := addInstruction("id")
+	add.Event.ID = "event-1"
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, "request-1/event-1", entry.Data["correlation_id"])
+	}
+}
+
+func TestTraceRecordsStepSpans(t *testing.T) {
+	ctx := context.Background()
+	rec := &tracing.Recorder{}
+	m, _ := newManager()
+	m.Use(pipelinemanager.Correlate())
+	m.Use(pipelinemanager.Trace(tracing.NewTracer(rec, nil)))
+
+	add := addInstruction("id")
+	add.Event.ID = "event-1"
+	if err := m.Handle(ctx, add); err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+
+	spans := rec.Spans()
+	if !assert.Len(t, spans, 7) {
+		return
+	}
+	root := spans[len(spans)-1]
+	assert.Equal(t, "add pipeline", root.Name)
+	assert.Equal(t, "id", root.Attributes["pipeline_id"])
+	assert.Equal(t, "event-1", root.Attributes["correlation_id"])
+	var steps []string
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, root.TraceID, span.TraceID)
+		assert.Equal(t, root.ID, span.ParentID)
+		steps = append(steps, span.Name)
+	}
+	assert.Equal(t, []string{"create queue", "create consumer", "wait for consumer", "set concurrency", "attach queue", "put identifier"}, steps)
+}
+
+func TestTraceWithoutTracer(t *testing.T) {
+	m, _ := newManager()
+	m.Use(pipelinemanager.Trace(nil))
+	assert.NoError(t, m.Handle(context.Background(), addInstruction("id")))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	lambdaHandler "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/tuner"
+	"github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// window is how far back the consumers' metrics are read, the rate the function is scheduled at so
+// that each run sees the task outcomes since the last.
+const window = 5 * time.Minute
+
+// getTables loads the pipeline table names the tuner reads from the environment.
+func getTables() pipeline.Tables {
+	const (
+		EnvarConfigTable      = "CONFIG_TABLE"
+		EnvarProfilesTable    = "PROFILES_TABLE"
+		EnvarIdentifiersTable = "IDENTIFIERS_TABLE"
+		EnvarStatusTable      = "STATUS_TABLE"
+	)
+	return pipeline.Tables{
+		Configs:     getEnv(EnvarConfigTable),
+		Profiles:    getEnv(EnvarProfilesTable),
+		Identifiers: getEnv(EnvarIdentifiersTable),
+		Statuses:    getEnv(EnvarStatusTable),
+	}
+}
+
+var (
+	t      *tuner.Tuner
+	logger *logrus.Logger
+)
+
+// use init function to save on reinitialisation costs on lambda warm starts.
+func init() {
+	logger = logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(os.Stdout)
+	sess := session.Must(session.NewSession())
+	store := pipeline.NewDynamoStore(dynamodb.New(sess), getTables())
+	source := tuner.NewCloudWatchSource(cloudwatch.New(sess), metrics.DefaultNamespace, window)
+	t = tuner.New(lambda.New(sess), store, source, logger)
+}
+
+// The Lambda function to be triggered on a schedule, tuning the concurrency of the consumers of
+// pipelines with a target rate or adaptive concurrency.
+func handle(ctx context.Context, event events.CloudWatchEvent) error {
+	adjustments, err := t.Tune(ctx)
+	logger.Infof("tuned %d consumers", len(adjustments))
+	return err
+}
+
+func main() {
+	lambdaHandler.Start(handle)
+}
+
+func getEnv(name string) string {
+	val, err := env.GetEnvRequired(name)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
@@ -0,0 +1,47 @@
+// Command localaws runs a local stand-in for the SQS, Lambda and DynamoDB endpoints used by the project.
+//
+// Point an SDK session at it with the LOCAL_AWS_ENDPOINT envar, eg:
+//
+//	localaws -addr :4566 -table pipeline-identifiers-dev:id -table pipeline-journal-dev:id:sequence_number
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/localaws"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// tableFlags collects the repeated -table flags, each of the form name:hashKey[:rangeKey].
+type tableFlags [][]string
+
+func (t *tableFlags) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tableFlags) Set(v string) error {
+	parts := strings.Split(v, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("table %q must be of the form name:hashKey[:rangeKey]", v)
+	}
+	*t = append(*t, parts)
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", ":4566", "address to listen on")
+	var tables tableFlags
+	flag.Var(&tables, "table", "DynamoDB table to create, as name:hashKey[:rangeKey], may be repeated")
+	flag.Parse()
+
+	server := localaws.New()
+	for _, t := range tables {
+		server.DynamoDB.CreateTable(t[0], t[1:]...)
+	}
+	logrus.Infof("serving local aws on %s", *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		logrus.Fatal(err)
+	}
+}
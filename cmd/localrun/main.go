@@ -0,0 +1,116 @@
+// Command localrun runs the consumer task processor locally against in-memory queues, one per
+// pipeline config, with each pipeline's workers capped at its concurrency limit and its tasks
+// held to its rate per second.
+//
+//	localrun -configs testdata/localrun/configs.json -messages 20
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/consume/taskprocessor"
+	"github.com/kinluek/serverless-controlled-batch-processing/localrun"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/ratelimit"
+	"github.com/kinluek/serverless-controlled-batch-processing/taskrunner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+func main() {
+	configsPath := flag.String("configs", "", "path to a JSON array of pipeline configs")
+	messages := flag.Int("messages", 10, "number of messages to send to each pipeline")
+	timeout := flag.Duration("timeout", 5*time.Minute, "time to wait for the queues to drain")
+	flag.Parse()
+
+	if err := run(*configsPath, *messages, *timeout); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func run(configsPath string, messages int, timeout time.Duration) error {
+	configs, err := loadConfigs(configsPath)
+	if err != nil {
+		return err
+	}
+	var runtime *localrun.Runtime
+	rates := func(task taskrunner.Task) (string, float64) {
+		if p, ok := runtime.ByQueue(task.Source); ok {
+			return p.Config.ID, p.Config.RatePerSecond
+		}
+		return "", 0
+	}
+	deferrer := taskrunner.DeferrerFunc(func(ctx context.Context, task taskrunner.Task, delay time.Duration) error {
+		return runtime.Defer(task.Source, task.ReceiptHandle, delay, task.MessageAttributes)
+	})
+	rateLimit := taskrunner.RateLimit(ratelimit.NewMemoryLimiter(), rates, deferrer)
+	registry := taskprocessor.NewRegistry(logrus.StandardLogger(), nil, rateLimit, deferrer)
+	runtime, err = localrun.NewRuntime(configs, registry.HandleSQS)
+	if err != nil {
+		return errors.Wrap(err, "failed to create runtime")
+	}
+	for _, id := range runtime.IDs() {
+		for i := 0; i < messages; i++ {
+			body, err := taskrunner.Encode(taskprocessor.TaskSleep, fmt.Sprintf("%s-%d", id, i), taskprocessor.Sleep{
+				Message: fmt.Sprintf("task %d of pipeline %s", i, id),
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := runtime.Send(id, body); err != nil {
+				return err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		runtime.Run(ctx)
+		close(done)
+	}()
+	for !runtime.Drained() && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	for _, id := range runtime.IDs() {
+		p, _ := runtime.Pipeline(id)
+		stats := p.Stats()
+		var limit interface{} = "unreserved"
+		if p.Config.LambdaConcurrencyLimit != nil {
+			limit = *p.Config.LambdaConcurrencyLimit
+		}
+		logrus.WithFields(logrus.Fields{
+			"pipeline":          id,
+			"concurrency_limit": limit,
+			"rate_per_second":   p.Config.RatePerSecond,
+			"max_in_flight":     stats.MaxInFlight,
+			"processed":         stats.Processed,
+			"failed":            stats.Failed,
+			"dead_lettered":     stats.DeadLettered,
+			"elapsed":           time.Since(start).String(),
+		}).Info("pipeline stats")
+	}
+	return nil
+}
+
+func loadConfigs(path string) ([]pipeline.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open configs")
+	}
+	defer f.Close()
+	var configs []pipeline.Config
+	if err := json.NewDecoder(f).Decode(&configs); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode configs from %s", path)
+	}
+	return configs, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+// apply makes the config table match the definition file.
+func apply(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	file := fs.String("f", "pipelines.yaml", "pipeline definition file")
+	prune := fs.Bool("prune", false, "delete configs which are not in the definition file")
+	dryRun := fs.Bool("dry-run", false, "print the changes without writing them")
+	table := fs.String("table", env.GetEnvDefault(envarConfigTable, ""), "config table name")
+	profilesTable := fs.String("profiles-table", env.GetEnvDefault(envarProfilesTable, ""), "profiles table name")
+	changedBy := fs.String("changed-by", env.GetEnvDefault(envarUser, ""), "who the config writes are recorded as changed by")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireConfigTable(*table); err != nil {
+		return err
+	}
+	if *profilesTable == "" {
+		return errors.Errorf("no profiles table, set %s or -profiles-table", envarProfilesTable)
+	}
+
+	def, err := readDefinition(*file)
+	if err != nil {
+		return err
+	}
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+	store := newStore(sess, pipeline.Tables{Configs: *table, Profiles: *profilesTable})
+	return applyDefinition(ctx, store, def, *changedBy, *prune, *dryRun, out)
+}
+
+// definitionStore is the store a definition's configs and profiles are read from and written to.
+type definitionStore interface {
+	pipeline.ConfigStore
+	pipeline.ProfileStore
+}
+
+// applyDefinition writes the profile and config changes, profiles are created and updated before
+// the configs which may reference them, and deleted after the configs which referenced them. The
+// written configs are recorded as changed by changedBy.
+func applyDefinition(ctx context.Context, store definitionStore, def pipeline.Definition, changedBy string, prune, dryRun bool, out io.Writer) error {
+	stored, err := pipeline.ListAllConfigs(ctx, store)
+	if err != nil {
+		return errors.Wrap(err, "failed to list configs")
+	}
+	storedProfiles, err := pipeline.ListAllProfiles(ctx, store)
+	if err != nil {
+		return errors.Wrap(err, "failed to list profiles")
+	}
+	var profileWrites, profileDeletes []pipeline.ProfileChange
+	for _, ch := range pipeline.PlanProfiles(def.Profiles, storedProfiles, prune) {
+		if ch.Action == pipeline.ActionDelete {
+			profileDeletes = append(profileDeletes, ch)
+		} else {
+			profileWrites = append(profileWrites, ch)
+		}
+	}
+	changes := pipeline.Plan(def.Pipelines, stored, prune)
+	for i := range changes {
+		changes[i].Config.ChangedBy = changedBy
+	}
+	total := len(profileWrites) + len(changes) + len(profileDeletes)
+	if total == 0 {
+		fmt.Fprintln(out, "no changes")
+		return nil
+	}
+	for _, ch := range profileWrites {
+		fmt.Fprintf(out, "%s profile %s\n", ch.Action, ch.Profile.ID)
+	}
+	for _, ch := range changes {
+		fmt.Fprintf(out, "%s %s\n", ch.Action, ch.Config.ID)
+	}
+	for _, ch := range profileDeletes {
+		fmt.Fprintf(out, "%s profile %s\n", ch.Action, ch.Profile.ID)
+	}
+	if dryRun {
+		return nil
+	}
+	if err := pipeline.ApplyProfiles(ctx, store, profileWrites); err != nil {
+		return err
+	}
+	if err := pipeline.Apply(ctx, store, changes); err != nil {
+		return err
+	}
+	if err := pipeline.ApplyProfiles(ctx, store, profileDeletes); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "applied %d changes\n", total)
+	return nil
+}
+
+func readDefinition(path string) (pipeline.Definition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return pipeline.Definition{}, errors.Wrap(err, "failed to open definition")
+	}
+	defer f.Close()
+	def, err := pipeline.ParseDefinition(f)
+	return def, errors.Wrapf(err, "invalid definition %s", path)
+}
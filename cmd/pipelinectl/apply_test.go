@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestApplyDefinition(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	def, err := readDefinition("../../pipelines.yaml")
+	if err != nil {
+		t.Fatalf("failed to read definition: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := applyDefinition(ctx, store, def, "alice", false, true, &out); err != nil {
+		t.Fatalf("failed dry run: %v", err)
+	}
+	assert.Equal(t, "create profile http-scraper\ncreate group-a\ncreate group-b\ncreate group-c\n", out.String())
+	configs, _ := pipeline.ListAllConfigs(ctx, store)
+	assert.Empty(t, configs, "dry run should not write")
+
+	out.Reset()
+	if err := applyDefinition(ctx, store, def, "alice", false, false, &out); err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	assert.Contains(t, out.String(), "applied 4 changes")
+	configs, _ = pipeline.ListAllConfigs(ctx, store)
+	for _, c := range configs {
+		assert.Equal(t, "alice", c.ChangedBy, c.ID)
+	}
+
+	out.Reset()
+	if err := applyDefinition(ctx, store, def, "alice", false, false, &out); err != nil {
+		t.Fatalf("failed to re-apply: %v", err)
+	}
+	assert.Equal(t, "no changes\n", out.String())
+
+	def.Profiles[0].LambdaTimeoutSes = 20
+	out.Reset()
+	if err := applyDefinition(ctx, store, def, "alice", false, false, &out); err != nil {
+		t.Fatalf("failed to apply profile change: %v", err)
+	}
+	assert.Equal(t, "update profile http-scraper\napplied 1 changes\n", out.String())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// audit prints the audit records of the instructions the manager handled for a pipeline, oldest first.
+func audit(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	id := fs.String("id", "", "pipeline ID, or profile/ID for profile re-applies")
+	since := fs.Duration("since", 0, "only print records started this long ago or later, overrides -from")
+	from := fs.String("from", "", "only print records started at or after this RFC3339 time")
+	to := fs.String("to", "", "only print records started at or before this RFC3339 time")
+	auditTable := fs.String("audit-table", env.GetEnvDefault(envarAuditTable, ""), "audit table name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" {
+		return errors.New("no pipeline, set -id")
+	}
+	if *auditTable == "" {
+		return errors.Errorf("no audit table, set %s or -audit-table", envarAuditTable)
+	}
+	in, err := auditInput(*since, *from, *to, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+	store := newStore(sess, pipeline.Tables{Audit: *auditTable})
+	return printAudit(ctx, store, *id, in, out)
+}
+
+// auditInput makes the time range of the audit flags, since is relative to now.
+func auditInput(since time.Duration, from, to string, now time.Time) (pipeline.AuditInput, error) {
+	var in pipeline.AuditInput
+	var err error
+	if from != "" {
+		if in.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return in, errors.Wrap(err, "invalid -from")
+		}
+	}
+	if to != "" {
+		if in.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return in, errors.Wrap(err, "invalid -to")
+		}
+	}
+	if since > 0 {
+		in.From = now.Add(-since)
+	}
+	return in, nil
+}
+
+// printAudit prints every audit record of the pipeline in the input's time range.
+func printAudit(ctx context.Context, store pipeline.AuditStore, id string, in pipeline.AuditInput, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED AT\tOPERATION\tSEQUENCE NUMBER\tRESULT\tDURATION\tREQUEST ID\tCHANGES")
+	count := 0
+	for {
+		page, err := store.ListAudit(ctx, id, in)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list audit records of %s", id)
+		}
+		for _, r := range page.Records {
+			count++
+			changes := make([]string, 0, len(r.Changes))
+			for _, c := range r.Changes {
+				changes = append(changes, c.String())
+			}
+			result := r.Result
+			if r.Error != "" {
+				result += ": " + r.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%dms\t%s\t%s\n", r.StartedAt.Format(time.RFC3339), r.Operation,
+				r.SequenceNumber, result, r.DurationMillis, dash(r.RequestID), dash(strings.Join(changes, ", ")))
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		in.Cursor = page.NextCursor
+	}
+	if count == 0 {
+		fmt.Fprintf(out, "no audit records for %s\n", id)
+		return nil
+	}
+	return w.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintAudit(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	at := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	store.PutAudit(ctx, pipeline.AuditRecord{
+		ID: "group-a", Key: pipeline.AuditKey(at, "100"), Operation: "add", SequenceNumber: "100", RequestID: "req-1",
+		Changes: []pipeline.AuditChange{{Field: "lambda_timeout_secs", To: "10"}}, Result: pipeline.AuditSuccess, StartedAt: at, DurationMillis: 1200,
+	})
+	later := at.Add(time.Hour)
+	store.PutAudit(ctx, pipeline.AuditRecord{
+		ID: "group-a", Key: pipeline.AuditKey(later, "200"), Operation: "update", SequenceNumber: "200",
+		Result: pipeline.AuditFailure, Error: "boom", StartedAt: later, DurationMillis: 30,
+	})
+
+	in, err := auditInput(30*time.Minute, "", "", later.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to make audit input: %v", err)
+	}
+	var out bytes.Buffer
+	if err := printAudit(ctx, store, "group-a", in, &out); err != nil {
+		t.Fatalf("failed to print audit: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Regexp(t, `^2020-05-01T13:00:00Z\s+update\s+200\s+failure: boom\s+30ms\s+-\s+-$`, lines[1])
+	}
+
+	out.Reset()
+	in, _ = auditInput(0, "2020-05-01T11:00:00Z", "2020-05-01T12:30:00Z", time.Now())
+	if err := printAudit(ctx, store, "group-a", in, &out); err != nil {
+		t.Fatalf("failed to print audit: %v", err)
+	}
+	assert.Regexp(t, `2020-05-01T12:00:00Z\s+add\s+100\s+success\s+1200ms\s+req-1\s+lambda_timeout_secs: \(none\) -> 10\n$`, out.String())
+
+	_, err = auditInput(0, "yesterday", "", time.Now())
+	assert.Error(t, err)
+}
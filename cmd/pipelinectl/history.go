@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// history prints the config versions applied to a pipeline, newest first.
+func history(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	id := fs.String("id", "", "pipeline ID")
+	limit := fs.Int("limit", 20, "maximum number of entries to print, 0 for all")
+	historyTable := fs.String("history-table", env.GetEnvDefault(envarHistoryTable, ""), "history table name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" {
+		return errors.New("no pipeline, set -id")
+	}
+	if *historyTable == "" {
+		return errors.Errorf("no history table, set %s or -history-table", envarHistoryTable)
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+	store := newStore(sess, pipeline.Tables{History: *historyTable})
+	return printHistory(ctx, store, *id, *limit, out)
+}
+
+// printHistory prints up to limit of the pipeline's history entries, or all of them when limit is 0.
+func printHistory(ctx context.Context, store pipeline.HistoryStore, id string, limit int, out io.Writer) error {
+	var entries []pipeline.HistoryEntry
+	in := pipeline.ListInput{}
+	for limit == 0 || len(entries) < limit {
+		page, err := store.ListHistory(ctx, id, in)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list history of %s", id)
+		}
+		entries = append(entries, page.Entries...)
+		if page.NextCursor == "" {
+			break
+		}
+		in.Cursor = page.NextCursor
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(out, "no history for %s\n", id)
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED AT\tSEQUENCE NUMBER\tCHANGED BY\tSETTINGS")
+	for _, e := range entries {
+		changedBy := e.ChangedBy
+		if changedBy == "" {
+			changedBy = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", e.Config.Version, e.AppliedAt.Format(time.RFC3339), e.SequenceNumber, changedBy, e)
+	}
+	return w.Flush()
+}
+
+// rollback rewrites a pipeline's config with the settings of a version from its history.
+func rollback(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	id := fs.String("id", "", "pipeline ID")
+	version := fs.Int64("version", 0, "config version to roll back to")
+	dryRun := fs.Bool("dry-run", false, "print the config without writing it")
+	changedBy := fs.String("changed-by", env.GetEnvDefault(envarUser, ""), "who the config write is recorded as changed by")
+	table := fs.String("table", env.GetEnvDefault(envarConfigTable, ""), "config table name")
+	historyTable := fs.String("history-table", env.GetEnvDefault(envarHistoryTable, ""), "history table name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" || *version <= 0 {
+		return errors.New("no pipeline version, set -id and -version")
+	}
+	if err := requireConfigTable(*table); err != nil {
+		return err
+	}
+	if *historyTable == "" {
+		return errors.Errorf("no history table, set %s or -history-table", envarHistoryTable)
+	}
+
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+	store := newStore(sess, pipeline.Tables{Configs: *table, History: *historyTable})
+	return rollbackPipeline(ctx, store, *id, *version, *changedBy, *dryRun, out)
+}
+
+// rollbackPipeline prints the settings the pipeline is rolled back to and, unless it is a dry run,
+// writes them to the config item for the pipeline manager to apply.
+func rollbackPipeline(ctx context.Context, store pipeline.RollbackStore, id string, version int64, changedBy string, dryRun bool, out io.Writer) error {
+	entry, err := pipeline.FindHistory(ctx, store, id, version)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "roll back %s to version %d: %s\n", id, version, entry)
+	if dryRun {
+		return nil
+	}
+	config, err := pipeline.Rollback(ctx, store, id, version, changedBy)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "wrote %s version %d\n", id, config.Version)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryAndRollback(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	at := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	v1, _ := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "group-a", LambdaConcurrencyLimit: aws.Int(2), LambdaTimeoutSes: 10, ChangedBy: "alice"})
+	store.PutHistory(ctx, pipeline.NewHistoryEntry(v1, v1, "100", at, at, false))
+	v2, _ := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "group-a", Profile: "http-scraper", Version: v1.Version})
+	store.PutHistory(ctx, pipeline.NewHistoryEntry(v2, v2, "200", at.Add(time.Hour), at.Add(time.Hour), false))
+
+	var out bytes.Buffer
+	if err := printHistory(ctx, store, "group-a", 0, &out); err != nil {
+		t.Fatalf("failed to print history: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Regexp(t, `^2\s+2020-05-01T13:00:00Z\s+200\s+-\s+concurrency_limit=unreserved lambda_timeout_secs=default sqs_visibility_timeout_secs=default profile=http-scraper$`, lines[1])
+		assert.Regexp(t, `^1\s+2020-05-01T12:00:00Z\s+100\s+alice\s+concurrency_limit=2 lambda_timeout_secs=10 sqs_visibility_timeout_secs=default$`, lines[2])
+	}
+
+	out.Reset()
+	if err := rollbackPipeline(ctx, store, "group-a", 1, "bob", true, &out); err != nil {
+		t.Fatalf("failed dry run: %v", err)
+	}
+	assert.Equal(t, "roll back group-a to version 1: concurrency_limit=2 lambda_timeout_secs=10 sqs_visibility_timeout_secs=default\n", out.String())
+	stored, _ := store.GetConfig(ctx, "group-a")
+	assert.Equal(t, v2, stored, "dry run should not write")
+
+	out.Reset()
+	if err := rollbackPipeline(ctx, store, "group-a", 1, "bob", false, &out); err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	assert.Contains(t, out.String(), "wrote group-a version 3\n")
+	stored, _ = store.GetConfig(ctx, "group-a")
+	assert.Equal(t, pipeline.Config{ID: "group-a", LambdaConcurrencyLimit: aws.Int(2), LambdaTimeoutSes: 10, ChangedBy: "bob", Version: 3}, stored)
+
+	err := rollbackPipeline(ctx, store, "group-a", 5, "bob", false, &out)
+	assert.True(t, pipeline.IsNotFound(err), "expected not found, got %v", err)
+}
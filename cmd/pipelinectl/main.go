@@ -0,0 +1,100 @@
+// Command pipelinectl manages the pipeline configs in the config table.
+//
+//	pipelinectl apply -f pipelines.yaml [-prune] [-dry-run]
+//	pipelinectl plan -f pipelines.yaml [-prune] [-live=false]
+//	pipelinectl history -id group-a
+//	pipelinectl rollback -id group-a -version 3 [-dry-run]
+//	pipelinectl audit -id group-a [-since 24h]
+//
+// The config table, used by apply, plan and rollback, is read from the CONFIG_TABLE envar, or the
+// -table flag, the profiles table from the PROFILES_TABLE envar, or the -profiles-table flag,
+// the identifiers table, used by plan, from the IDENTIFIERS_TABLE envar, or the -identifiers-table
+// flag, the history table, used by history and rollback, from the HISTORY_TABLE envar, or the
+// -history-table flag, and the audit table, used by audit, from the AUDIT_TABLE envar, or the
+// -audit-table flag. Writes are recorded as changed by the -changed-by flag, which defaults to the
+// USER envar. The AWS endpoint can be overridden with the LOCAL_AWS_ENDPOINT envar to run against
+// cmd/localaws.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+const (
+	envarConfigTable      = "CONFIG_TABLE"
+	envarProfilesTable    = "PROFILES_TABLE"
+	envarIdentifiersTable = "IDENTIFIERS_TABLE"
+	envarHistoryTable     = "HISTORY_TABLE"
+	envarAuditTable       = "AUDIT_TABLE"
+	envarUser             = "USER"
+	envarLocalEndpoint    = "LOCAL_AWS_ENDPOINT"
+)
+
+// command is a pipelinectl sub command, it parses its own flags from args.
+type command func(ctx context.Context, args []string, out io.Writer) error
+
+var commands = map[string]command{
+	"apply":    apply,
+	"plan":     planCmd,
+	"history":  history,
+	"rollback": rollback,
+	"audit":    audit,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd(context.Background(), os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "pipelinectl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pipelinectl apply -f pipelines.yaml [-prune] [-dry-run] [-changed-by name] [-table name] [-profiles-table name]")
+	fmt.Fprintln(os.Stderr, "       pipelinectl plan -f pipelines.yaml [-prune] [-live=false] [-table name] [-profiles-table name] [-identifiers-table name]")
+	fmt.Fprintln(os.Stderr, "       pipelinectl history -id id [-limit n] [-history-table name]")
+	fmt.Fprintln(os.Stderr, "       pipelinectl rollback -id id -version n [-dry-run] [-changed-by name] [-table name] [-history-table name]")
+	fmt.Fprintln(os.Stderr, "       pipelinectl audit -id id [-since duration] [-from time] [-to time] [-audit-table name]")
+	os.Exit(2)
+}
+
+// newSession returns an AWS session, using the local endpoint if one is set.
+func newSession() (*session.Session, error) {
+	config := aws.NewConfig()
+	if endpoint := env.GetEnvDefault(envarLocalEndpoint, ""); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create session")
+	}
+	return sess, nil
+}
+
+// newStore returns a DynamoStore for the tables, commands check the tables they use themselves.
+func newStore(sess *session.Session, tables pipeline.Tables) pipeline.Store {
+	return pipeline.NewDynamoStore(dynamodb.New(sess), tables)
+}
+
+// requireConfigTable checks the config table is set, for the commands which read or write configs.
+func requireConfigTable(table string) error {
+	if table == "" {
+		return errors.Errorf("no config table, set %s or -table", envarConfigTable)
+	}
+	return nil
+}
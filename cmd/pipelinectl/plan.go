@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/kinluek/serverless-controlled-batch-processing/env"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/plan"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// observer reads the live state of a pipeline's resources.
+type observer func(ctx context.Context, ident pipeline.Identifier) (plan.Live, error)
+
+// planCmd prints the resource changes the pipeline manager will make when the definition file is applied.
+func planCmd(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	file := fs.String("f", "pipelines.yaml", "pipeline definition file")
+	prune := fs.Bool("prune", false, "include pipelines which are not in the definition file")
+	live := fs.Bool("live", true, "compare with the deployed resources rather than the stored configs")
+	table := fs.String("table", env.GetEnvDefault(envarConfigTable, ""), "config table name")
+	profilesTable := fs.String("profiles-table", env.GetEnvDefault(envarProfilesTable, ""), "profiles table name")
+	identsTable := fs.String("identifiers-table", env.GetEnvDefault(envarIdentifiersTable, ""), "identifiers table name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireConfigTable(*table); err != nil {
+		return err
+	}
+	if *profilesTable == "" {
+		return errors.Errorf("no profiles table, set %s or -profiles-table", envarProfilesTable)
+	}
+	if *identsTable == "" {
+		return errors.Errorf("no identifiers table, set %s or -identifiers-table", envarIdentifiersTable)
+	}
+
+	def, err := readDefinition(*file)
+	if err != nil {
+		return err
+	}
+	sess, err := newSession()
+	if err != nil {
+		return err
+	}
+	store := newStore(sess, pipeline.Tables{Configs: *table, Profiles: *profilesTable, Identifiers: *identsTable})
+	observe := func(context.Context, pipeline.Identifier) (plan.Live, error) { return plan.Live{}, nil }
+	if *live {
+		sqsSvc, lambdaSvc := sqs.New(sess), lambda.New(sess)
+		observe = func(ctx context.Context, ident pipeline.Identifier) (plan.Live, error) {
+			return plan.Observe(ctx, sqsSvc, lambdaSvc, ident)
+		}
+	}
+	return planDefinition(ctx, store, observe, def, *prune, out)
+}
+
+// planStore is the store a plan reads the configs, profiles and identifiers of the pipelines from.
+type planStore interface {
+	definitionStore
+	pipeline.IdentifierStore
+}
+
+// planDefinition prints a plan for every pipeline in the definition with something to do, and the
+// pipelines that would be deleted when pruning. The configs are compared resolved against their profiles.
+func planDefinition(ctx context.Context, store planStore, observe observer, def pipeline.Definition, prune bool, out io.Writer) error {
+	stored, err := pipeline.ListAllConfigs(ctx, store)
+	if err != nil {
+		return errors.Wrap(err, "failed to list configs")
+	}
+	storedProfiles, err := pipeline.ListAllProfiles(ctx, store)
+	if err != nil {
+		return errors.Wrap(err, "failed to list profiles")
+	}
+	current := make(map[string]pipeline.Config)
+	for _, c := range stored {
+		current[c.ID] = c.Resolve(profileByID(storedProfiles, c.Profile))
+	}
+	planned := 0
+	for _, c := range def.Pipelines {
+		ident, err := store.GetIdentifier(ctx, c.ID)
+		if err != nil && !pipeline.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get identifier %s", c.ID)
+		}
+		var live plan.Live
+		if ident.ID != "" {
+			if live, err = observe(ctx, ident); err != nil {
+				return errors.Wrapf(err, "failed to observe pipeline %s", c.ID)
+			}
+		}
+		p := plan.Make(current[c.ID], c.Resolve(profileByID(def.Profiles, c.Profile)), ident, live)
+		if p.Empty() {
+			continue
+		}
+		fmt.Fprintln(out, p)
+		planned++
+	}
+	for _, ch := range pipeline.Plan(def.Pipelines, stored, prune) {
+		if ch.Action == pipeline.ActionDelete {
+			fmt.Fprintf(out, "pipeline %s will be deleted\n", ch.Config.ID)
+			planned++
+		}
+	}
+	if planned == 0 {
+		fmt.Fprintln(out, "no changes")
+	}
+	return nil
+}
+
+// profileByID returns the profile with the ID, or an empty profile for an empty or unknown ID.
+func profileByID(profiles []pipeline.Profile, id string) pipeline.Profile {
+	for _, p := range profiles {
+		if id != "" && p.ID == id {
+			return p
+		}
+	}
+	return pipeline.Profile{}
+}
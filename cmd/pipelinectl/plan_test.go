@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/plan"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPlanDefinition(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	def, err := readDefinition("../../pipelines.yaml")
+	if err != nil {
+		t.Fatalf("failed to read definition: %v", err)
+	}
+	if err := pipeline.ApplyProfiles(ctx, store, pipeline.PlanProfiles(def.Profiles, nil, false)); err != nil {
+		t.Fatalf("failed to apply profiles: %v", err)
+	}
+	if err := pipeline.Apply(ctx, store, pipeline.Plan(def.Pipelines, nil, false)); err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	if err := store.PutIdentifier(ctx, pipeline.Identifier{ID: "group-a"}); err != nil {
+		t.Fatalf("failed to put identifier: %v", err)
+	}
+	if _, err := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "old"}); err != nil {
+		t.Fatalf("failed to put config: %v", err)
+	}
+	two := 2
+	observe := func(context.Context, pipeline.Identifier) (plan.Live, error) {
+		return plan.Live{
+			Observed:             true,
+			QueueExists:          true,
+			DLQExists:            true,
+			ConsumerExists:       true,
+			VisibilityTimeout:    30,
+			DLQVisibilityTimeout: 30,
+			Timeout:              5,
+			Concurrency:          &two,
+			Attached:             true,
+		}, nil
+	}
+
+	var out bytes.Buffer
+	if err := planDefinition(ctx, store, observe, def, true, &out); err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+	assert.Equal(t, "pipeline group-a will be updated\n"+
+		"  ~ consumer Timeout: 5 -> 10\n"+
+		"pipeline group-b will be created\n"+
+		"  ~ queue VisibilityTimeout: (none) -> 30\n"+
+		"  ~ dead letter queue VisibilityTimeout: (none) -> 30\n"+
+		"  ~ consumer Timeout: (none) -> 10\n"+
+		"  ~ consumer ReservedConcurrency: (none) -> 1\n"+
+		"pipeline group-c will be created\n"+
+		"  ~ queue VisibilityTimeout: (none) -> 30\n"+
+		"  ~ dead letter queue VisibilityTimeout: (none) -> 30\n"+
+		"  ~ consumer Timeout: (none) -> 10\n"+
+		"  ~ consumer ReservedConcurrency: (none) -> 2\n"+
+		"pipeline old will be deleted\n", out.String())
+}
@@ -0,0 +1,64 @@
+// Command simulate compares the shared queue and per group pipeline architectures for a workload.
+//
+//	simulate -workload testdata/simulate/readme-workload.json -configs testdata/simulate/readme-configs.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/simulate"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"text/tabwriter"
+)
+
+func main() {
+	workloadPath := flag.String("workload", "", "path to a JSON workload description")
+	configsPath := flag.String("configs", "", "path to a JSON array of pipeline configs, one per group")
+	flag.Parse()
+
+	if err := run(*workloadPath, *configsPath); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func run(workloadPath, configsPath string) error {
+	var workload simulate.Workload
+	if err := decodeFile(workloadPath, &workload); err != nil {
+		return err
+	}
+	var configs []pipeline.Config
+	if err := decodeFile(configsPath, &configs); err != nil {
+		return err
+	}
+	reports, err := simulate.Run(workload, configs)
+	if err != nil {
+		return errors.Wrap(err, "failed to run simulation")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARCHITECTURE\tGROUP\tRATE LIMIT\tCONCURRENCY\tTASKS\tTASKS/SEC\tMEAN LATENCY\tP95 LATENCY\tMAX LATENCY\tPEAK STARTS/SEC\tVIOLATIONS")
+	for _, r := range reports {
+		for _, g := range r.Groups {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%.2f\t%.2fs\t%.2fs\t%.2fs\t%d\t%d\n",
+				r.Architecture, g.ID, g.RateLimit, g.Concurrency, g.Tasks, g.Throughput,
+				g.MeanLatencySecs, g.P95LatencySecs, g.MaxLatencySecs, g.PeakStartsPerSec, g.Violations)
+		}
+	}
+	return w.Flush()
+}
+
+func decodeFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", path)
+	}
+	return nil
+}
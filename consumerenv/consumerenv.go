@@ -0,0 +1,11 @@
+// Package consumerenv names the envars the manager sets on the consumer functions, it is shared by
+// the consumer package, which sets them, and the taskrunner package, which reads them, so that
+// neither has to import the other.
+package consumerenv
+
+// Envars of the consumer functions, consumer.CreateFunction and consumer.Update set them.
+const (
+	ReportBatchItemFailures = "REPORT_BATCH_ITEM_FAILURES" // "true" when the event source mapping reads partial batch failures
+	RatePerSecond           = "RATE_PER_SECOND"            // most tasks started per second, unset for no limit
+	RateLimitTable          = "RATE_LIMIT_TABLE"           // DynamoDB table of the rate limit buckets
+)
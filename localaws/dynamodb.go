@@ -0,0 +1,74 @@
+package localaws
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"net/http"
+	"strings"
+)
+
+const (
+	dynamoDBTargetPrefix = "DynamoDB_20120810."
+	dynamoDBContentType  = "application/x-amz-json-1.0"
+	dynamoDBErrorPrefix  = "com.amazonaws.dynamodb.v20120810#"
+)
+
+// serveDynamoDB dispatches the JSON RPC request named by the X-Amz-Target header.
+func (s *Server) serveDynamoDB(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), dynamoDBTargetPrefix)
+	var out interface{}
+	var err error
+	switch op {
+	case "CreateTable":
+		in := &dynamodb.CreateTableInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.DynamoDB.CreateTableWithContext(ctx, in)
+		}
+	case "GetItem":
+		in := &dynamodb.GetItemInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.DynamoDB.GetItemWithContext(ctx, in)
+		}
+	case "PutItem":
+		in := &dynamodb.PutItemInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.DynamoDB.PutItemWithContext(ctx, in)
+		}
+	case "DeleteItem":
+		in := &dynamodb.DeleteItemInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.DynamoDB.DeleteItemWithContext(ctx, in)
+		}
+	case "Scan":
+		in := &dynamodb.ScanInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.DynamoDB.ScanWithContext(ctx, in)
+		}
+	case "Query":
+		in := &dynamodb.QueryInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.DynamoDB.QueryWithContext(ctx, in)
+		}
+	default:
+		writeDynamoDBError(w, "UnknownOperationException", "unsupported operation "+op)
+		return
+	}
+	if err != nil {
+		code, msg := errorCode(err)
+		writeDynamoDBError(w, code, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, dynamoDBContentType, out)
+}
+
+// writeDynamoDBError writes a JSON RPC error, the SDK reads the error code from the __type field.
+func writeDynamoDBError(w http.ResponseWriter, code, msg string) {
+	status := http.StatusBadRequest
+	if code == "InternalFailure" {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", dynamoDBContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": dynamoDBErrorPrefix + code, "message": msg})
+}
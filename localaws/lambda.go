@@ -0,0 +1,136 @@
+package localaws
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"net/http"
+	"strings"
+)
+
+var lambdaPathPrefixes = []string{"/2015-03-31/", "/2017-10-31/", "/2019-09-30/"}
+
+func isLambdaPath(path string) bool {
+	for _, prefix := range lambdaPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLambda routes the REST JSON requests by method and path, the path parameters are set on
+// the input after the body has been decoded.
+func (s *Server) serveLambda(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := r.Method + " " + strings.Join(parts[1:], "/")
+	var name string
+	if len(parts) > 2 && parts[1] == "functions" {
+		name = parts[2]
+		route = strings.Replace(route, "functions/"+name, "functions/{name}", 1)
+	}
+
+	var out interface{}
+	var err error
+	status := http.StatusOK
+	switch route {
+	case "POST functions":
+		in := &lambda.CreateFunctionInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.Lambda.CreateFunctionWithContext(ctx, in)
+			status = http.StatusCreated
+		}
+	case "GET functions/{name}/configuration":
+		out, err = s.Lambda.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{FunctionName: aws.String(name)})
+	case "PUT functions/{name}/configuration":
+		in := &lambda.UpdateFunctionConfigurationInput{}
+		if err = decodeJSON(r, in); err == nil {
+			in.FunctionName = aws.String(name)
+			out, err = s.Lambda.UpdateFunctionConfigurationWithContext(ctx, in)
+		}
+	case "DELETE functions/{name}":
+		_, err = s.Lambda.DeleteFunctionWithContext(ctx, &lambda.DeleteFunctionInput{FunctionName: aws.String(name)})
+		status = http.StatusNoContent
+	case "PUT functions/{name}/concurrency":
+		in := &lambda.PutFunctionConcurrencyInput{}
+		if err = decodeJSON(r, in); err == nil {
+			in.FunctionName = aws.String(name)
+			out, err = s.Lambda.PutFunctionConcurrencyWithContext(ctx, in)
+		}
+	case "DELETE functions/{name}/concurrency":
+		_, err = s.Lambda.DeleteFunctionConcurrencyWithContext(ctx, &lambda.DeleteFunctionConcurrencyInput{FunctionName: aws.String(name)})
+		status = http.StatusNoContent
+	case "GET functions/{name}/concurrency":
+		out, err = s.Lambda.GetFunctionConcurrencyWithContext(ctx, &lambda.GetFunctionConcurrencyInput{FunctionName: aws.String(name)})
+	case "GET event-source-mappings":
+		in := &lambda.ListEventSourceMappingsInput{}
+		if v := r.URL.Query().Get("FunctionName"); v != "" {
+			in.FunctionName = aws.String(v)
+		}
+		if v := r.URL.Query().Get("EventSourceArn"); v != "" {
+			in.EventSourceArn = aws.String(v)
+		}
+		out, err = s.Lambda.ListEventSourceMappingsWithContext(ctx, in)
+	case "POST event-source-mappings":
+		in := &lambda.CreateEventSourceMappingInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = s.Lambda.CreateEventSourceMappingWithContext(ctx, in)
+			status = http.StatusAccepted
+		}
+	default:
+		writeLambdaError(w, "InvalidRequestContentException", fmt.Sprintf("unsupported route %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err != nil {
+		code, msg := errorCode(err)
+		writeLambdaError(w, code, msg)
+		return
+	}
+	writeJSON(w, status, "application/json", out)
+}
+
+// writeLambdaError writes a REST JSON error, the SDK reads the error code from the X-Amzn-Errortype header.
+func writeLambdaError(w http.ResponseWriter, code, msg string) {
+	status := http.StatusBadRequest
+	switch code {
+	case lambda.ErrCodeResourceNotFoundException:
+		status = http.StatusNotFound
+	case lambda.ErrCodeResourceConflictException:
+		status = http.StatusConflict
+	case "InternalFailure":
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("X-Amzn-Errortype", code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"Type": "User", "message": msg})
+}
+
+// decodeJSON decodes the request body into an SDK input shape.
+func decodeJSON(r *http.Request, in interface{}) error {
+	if err := jsonutil.UnmarshalJSON(in, r.Body); err != nil {
+		return awserr.New("SerializationException", "failed to decode request body", err)
+	}
+	return nil
+}
+
+// writeJSON encodes an SDK output shape as the response body, a nil output writes no body.
+func writeJSON(w http.ResponseWriter, status int, contentType string, out interface{}) {
+	w.Header().Set("X-Amzn-Requestid", requestID())
+	if out == nil || status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	body, err := jsonutil.BuildJSON(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
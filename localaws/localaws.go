@@ -0,0 +1,60 @@
+// Package localaws serves the subset of the SQS, Lambda and DynamoDB HTTP APIs used by the project,
+// backed by the in-memory fakes from the awsfake package.
+// Pointing the endpoint of an AWS session at a Server lets the real SDK clients, and so the
+// real request and response handling, be exercised end to end without network access.
+package localaws
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/kinluek/serverless-controlled-batch-processing/awsfake"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var requestCount int64
+
+// requestID returns a unique ID for each response.
+func requestID() string {
+	return fmt.Sprintf("localaws-%d", atomic.AddInt64(&requestCount, 1))
+}
+
+// Server is an http.Handler which serves the SQS query API, the Lambda REST JSON API and the DynamoDB JSON API.
+// Requests are routed by protocol: DynamoDB requests carry an X-Amz-Target header, Lambda requests
+// have a versioned path and everything else is treated as an SQS query request.
+type Server struct {
+	SQS      *awsfake.SQS
+	Lambda   *awsfake.Lambda
+	DynamoDB *awsfake.DynamoDB
+}
+
+// New returns a new Server backed by empty fakes.
+func New() *Server {
+	return &Server{
+		SQS:      awsfake.NewSQS(),
+		Lambda:   awsfake.NewLambda(),
+		DynamoDB: awsfake.NewDynamoDB(),
+	}
+}
+
+// ServeHTTP routes the request to the service it is for.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.Header.Get("X-Amz-Target"), dynamoDBTargetPrefix):
+		s.serveDynamoDB(w, r)
+	case isLambdaPath(r.URL.Path):
+		s.serveLambda(w, r)
+	default:
+		s.serveSQS(w, r)
+	}
+}
+
+// errorCode returns the AWS error code and message of the error, errors which did not come from
+// the fakes are reported as internal failures.
+func errorCode(err error) (string, string) {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code(), aerr.Message()
+	}
+	return "InternalFailure", err.Error()
+}
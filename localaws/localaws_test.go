@@ -0,0 +1,247 @@
+package localaws_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/kinluek/serverless-controlled-batch-processing/cmd/functions/manage-pipeline/pipelinemanager"
+	"github.com/kinluek/serverless-controlled-batch-processing/consumerenv"
+	"github.com/kinluek/serverless-controlled-batch-processing/localaws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var tables = pipeline.Tables{
+	Configs:     "configs",
+	Identifiers: "identifiers",
+	Statuses:    "statuses",
+	Journal:     "journal",
+	History:     "history",
+	Audit:       "audit",
+	Events:      "events",
+}
+
+var changedAt = time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func newSession(t *testing.T, endpoint string) *session.Session {
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(endpoint).
+		WithRegion("eu-west-2").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	return sess
+}
+
+func TestManagePipelineEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	server := localaws.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	sess := newSession(t, ts.URL)
+
+	db := dynamodb.New(sess)
+	for _, name := range []string{tables.Configs, tables.Identifiers, tables.Statuses} {
+		createTable(t, db, name, "id")
+	}
+	createTable(t, db, tables.Journal, "id", "sequence_number")
+	createTable(t, db, tables.History, "id", "position")
+	createTable(t, db, tables.Audit, "id", "key")
+
+	store := pipeline.NewDynamoStore(db, tables)
+	m := pipelinemanager.New(sqs.New(sess), lambda.New(sess), store, "local")
+	m.Use(pipelinemanager.Audit(store, store))
+	started := time.Now()
+
+	err := m.Handle(ctx, pipelinemanager.Instruction{
+		Operation: pipelinemanager.Add,
+		Config: pipelinemanager.ConfigParams{
+			ID:                       "id",
+			LambdaConcurrencyLimit:   aws.Int(5),
+			LambdaTimeoutSecs:        aws.Int(10),
+			SQSVisibilityTimeoutSecs: aws.Int(15),
+			Version:                  1,
+		},
+		Constants:      pipelinemanager.Constants{ConsumerBucket: "bucket", ConsumerKey: "consumer.zip", ConsumerRole: "arn:aws:iam::000000000000:role/consumer"},
+		SequenceNumber: "100",
+		Event:          pipelinemanager.EventMetadata{CreatedAt: changedAt},
+	})
+	if err != nil {
+		t.Fatalf("failed to add pipeline: %v", err)
+	}
+	q, ok := server.SQS.Queue("id-local-queue")
+	if !ok {
+		t.Fatalf("queue was not created")
+	}
+	assert.Equal(t, "15", q.Attributes["VisibilityTimeout"])
+	fn, ok := server.Lambda.Function("id-local-consumer")
+	if !ok {
+		t.Fatalf("consumer was not created")
+	}
+	assert.Equal(t, int64(5), *fn.Concurrency)
+	assert.Equal(t, "true", fn.Environment[consumerenv.ReportBatchItemFailures])
+	if mappings := server.Lambda.Mappings(); assert.Len(t, mappings, 1) {
+		assert.Equal(t, []string{lambda.FunctionResponseTypeReportBatchItemFailures}, mappings[0].FunctionResponseTypes)
+	}
+	ident, err := store.GetIdentifier(ctx, "id")
+	if err != nil {
+		t.Fatalf("failed to get identifier: %v", err)
+	}
+	assert.Equal(t, q.URL, ident.QueueURL)
+	assert.Equal(t, fn.ARN, ident.ConsumerARN)
+
+	err = m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Update,
+		Config:         pipelinemanager.ConfigParams{ID: "id", LambdaTimeoutSecs: aws.Int(20), SQSVisibilityTimeoutSecs: aws.Int(20), Version: 2},
+		SequenceNumber: "200",
+		Event:          pipelinemanager.EventMetadata{CreatedAt: changedAt.Add(time.Minute)},
+	})
+	if err != nil {
+		t.Fatalf("failed to update pipeline: %v", err)
+	}
+	fn, _ = server.Lambda.Function("id-local-consumer")
+	assert.Equal(t, int64(20), fn.Timeout)
+	assert.Nil(t, fn.Concurrency, "removed concurrency limit should be deleted")
+
+	// a stale identifier write is rejected by the condition expression.
+	err = store.PutIdentifierIfNotStale(ctx, pipeline.Identifier{ID: "id", Version: 1})
+	assert.True(t, pipeline.IsConflict(err), "expected conflict, got %v", err)
+
+	err = m.Handle(ctx, pipelinemanager.Instruction{
+		Operation:      pipelinemanager.Delete,
+		Config:         pipelinemanager.ConfigParams{ID: "id", Version: 2},
+		SequenceNumber: "300",
+		Event:          pipelinemanager.EventMetadata{CreatedAt: changedAt.Add(2 * time.Minute)},
+	})
+	if err != nil {
+		t.Fatalf("failed to delete pipeline: %v", err)
+	}
+	assert.Empty(t, server.SQS.QueueNames())
+	assert.Empty(t, server.Lambda.FunctionNames())
+	_, err = store.GetStatus(ctx, "id")
+	assert.True(t, pipeline.IsNotFound(err))
+
+	// every operation is recorded in the history, newest first.
+	history, err := store.ListHistory(ctx, "id", pipeline.ListInput{Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to list history: %v", err)
+	}
+	if assert.Len(t, history.Entries, 2) {
+		assert.Equal(t, "300", history.Entries[0].SequenceNumber)
+		assert.True(t, history.Entries[0].Deleted)
+		assert.Equal(t, int64(2), history.Entries[1].Config.Version)
+		assert.Equal(t, 20, history.Entries[1].Config.LambdaTimeoutSes)
+	}
+	history, err = store.ListHistory(ctx, "id", pipeline.ListInput{Cursor: history.NextCursor})
+	if err != nil {
+		t.Fatalf("failed to list history: %v", err)
+	}
+	if assert.Len(t, history.Entries, 1) {
+		assert.Equal(t, "100", history.Entries[0].SequenceNumber)
+		assert.Equal(t, 10, history.Entries[0].Config.LambdaTimeoutSes)
+	}
+	assert.Empty(t, history.NextCursor)
+
+	// the audit records are listed oldest first within the time range.
+	audit, err := store.ListAudit(ctx, "id", pipeline.AuditInput{From: started, To: time.Now()})
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+	var operations []string
+	for _, r := range audit.Records {
+		operations = append(operations, r.Operation)
+	}
+	assert.Equal(t, []string{"add", "update", "delete"}, operations)
+	audit, err = store.ListAudit(ctx, "id", pipeline.AuditInput{To: started.Add(-time.Second)})
+	if err != nil {
+		t.Fatalf("failed to list audit records: %v", err)
+	}
+	assert.Empty(t, audit.Records)
+}
+
+func TestStoreListsThroughLocalDynamoDB(t *testing.T) {
+	ctx := context.Background()
+	server := localaws.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	server.DynamoDB.CreateTable(tables.Configs, "id")
+	store := pipeline.NewDynamoStore(dynamodb.New(newSession(t, ts.URL)), tables)
+
+	for _, id := range []string{"b", "a", "c"} {
+		if _, err := store.PutConfigIfVersion(ctx, pipeline.Config{ID: id}); err != nil {
+			t.Fatalf("failed to put config %s: %v", id, err)
+		}
+	}
+	_, err := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "a"})
+	assert.True(t, pipeline.IsConflict(err), "expected conflict, got %v", err)
+
+	page, err := store.ListConfigs(ctx, pipeline.ListInput{Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to list configs: %v", err)
+	}
+	if assert.Len(t, page.Configs, 2) {
+		assert.Equal(t, "a", page.Configs[0].ID)
+	}
+	page, err = store.ListConfigs(ctx, pipeline.ListInput{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("failed to list configs: %v", err)
+	}
+	if assert.Len(t, page.Configs, 1) {
+		assert.Equal(t, "c", page.Configs[0].ID)
+	}
+}
+
+func TestClaimEventThroughLocalDynamoDB(t *testing.T) {
+	ctx := context.Background()
+	server := localaws.New()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	server.DynamoDB.CreateTable(tables.Events, "id")
+	store := pipeline.NewDynamoStore(dynamodb.New(newSession(t, ts.URL)), tables)
+
+	now := time.Now()
+	event := pipeline.ProcessedEvent{ID: "event", State: pipeline.EventInProgress, LeaseExpiresAt: now.Add(time.Minute).Unix()}
+	if err := store.ClaimEvent(ctx, event, now); err != nil {
+		t.Fatalf("failed to claim event: %v", err)
+	}
+	err := store.ClaimEvent(ctx, event, now)
+	assert.True(t, pipeline.IsConflict(err), "expected conflict while the lease lasts, got %v", err)
+	if err := store.ClaimEvent(ctx, event, now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("failed to take over expired claim: %v", err)
+	}
+
+	event.State = pipeline.EventDone
+	if err := store.PutEvent(ctx, event); err != nil {
+		t.Fatalf("failed to mark event done: %v", err)
+	}
+	err = store.ClaimEvent(ctx, event, now.Add(time.Hour))
+	assert.True(t, pipeline.IsConflict(err), "expected conflict once done, got %v", err)
+	stored, err := store.GetEvent(ctx, "event")
+	if assert.NoError(t, err) {
+		assert.Equal(t, pipeline.EventDone, stored.State)
+	}
+}
+
+func createTable(t *testing.T, db *dynamodb.DynamoDB, name string, keys ...string) {
+	in := &dynamodb.CreateTableInput{TableName: aws.String(name), BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	for i, key := range keys {
+		keyType := dynamodb.KeyTypeHash
+		if i > 0 {
+			keyType = dynamodb.KeyTypeRange
+		}
+		in.KeySchema = append(in.KeySchema, &dynamodb.KeySchemaElement{AttributeName: aws.String(key), KeyType: aws.String(keyType)})
+		in.AttributeDefinitions = append(in.AttributeDefinitions, &dynamodb.AttributeDefinition{AttributeName: aws.String(key), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)})
+	}
+	if _, err := db.CreateTable(in); err != nil {
+		t.Fatalf("failed to create table %s: %v", name, err)
+	}
+}
@@ -0,0 +1,161 @@
+package localaws
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+const sqsNamespace = "http://queue.amazonaws.com/doc/2012-11-05/"
+
+type sqsAttribute struct {
+	Name  string
+	Value string
+}
+
+type sqsResponseMetadata struct {
+	RequestID string `xml:"RequestId"`
+}
+
+type sqsErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func (s *Server) serveSQS(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeSQSError(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+		return
+	}
+	ctx := r.Context()
+	form := r.Form
+	action := form.Get("Action")
+	var result interface{}
+	var err error
+	switch action {
+	case "CreateQueue":
+		var out *sqs.CreateQueueOutput
+		out, err = s.SQS.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{
+			QueueName:  aws.String(form.Get("QueueName")),
+			Attributes: formAttributes(form),
+		})
+		if err == nil {
+			result = struct {
+				QueueURL string `xml:"QueueUrl"`
+			}{aws.StringValue(out.QueueUrl)}
+		}
+	case "GetQueueAttributes":
+		var out *sqs.GetQueueAttributesOutput
+		out, err = s.SQS.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(form.Get("QueueUrl")),
+			AttributeNames: aws.StringSlice(formList(form, "AttributeName")),
+		})
+		if err == nil {
+			result = struct {
+				Attributes []sqsAttribute `xml:"Attribute"`
+			}{sortedAttributes(out.Attributes)}
+		}
+	case "SetQueueAttributes":
+		_, err = s.SQS.SetQueueAttributesWithContext(ctx, &sqs.SetQueueAttributesInput{
+			QueueUrl:   aws.String(form.Get("QueueUrl")),
+			Attributes: formAttributes(form),
+		})
+	case "DeleteQueue":
+		_, err = s.SQS.DeleteQueueWithContext(ctx, &sqs.DeleteQueueInput{
+			QueueUrl: aws.String(form.Get("QueueUrl")),
+		})
+	default:
+		writeSQSError(w, http.StatusBadRequest, "InvalidAction", fmt.Sprintf("unsupported action %q", action))
+		return
+	}
+	if err != nil {
+		code, msg := errorCode(err)
+		writeSQSError(w, http.StatusBadRequest, code, msg)
+		return
+	}
+	writeSQSResult(w, action, result)
+}
+
+// formAttributes reads the flattened Attribute.N.Name and Attribute.N.Value parameters.
+func formAttributes(form url.Values) map[string]*string {
+	attrs := make(map[string]*string)
+	for i := 1; ; i++ {
+		name := form.Get(fmt.Sprintf("Attribute.%d.Name", i))
+		if name == "" {
+			return attrs
+		}
+		attrs[name] = aws.String(form.Get(fmt.Sprintf("Attribute.%d.Value", i)))
+	}
+}
+
+// formList reads the flattened Name.N parameters.
+func formList(form url.Values, name string) []string {
+	var list []string
+	for i := 1; ; i++ {
+		v := form.Get(fmt.Sprintf("%s.%d", name, i))
+		if v == "" {
+			return list
+		}
+		list = append(list, v)
+	}
+}
+
+func sortedAttributes(attrs map[string]*string) []sqsAttribute {
+	var list []sqsAttribute
+	for name, v := range attrs {
+		list = append(list, sqsAttribute{Name: name, Value: aws.StringValue(v)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// writeSQSResult writes the <Action>Response document, wrapping the result in an <Action>Result element.
+func writeSQSResult(w http.ResponseWriter, action string, result interface{}) {
+	type response struct {
+		XMLName  xml.Name
+		Xmlns    string              `xml:"xmlns,attr"`
+		Result   interface{}         `xml:",omitempty"`
+		Metadata sqsResponseMetadata `xml:"ResponseMetadata"`
+	}
+	res := response{
+		XMLName:  xml.Name{Local: action + "Response"},
+		Xmlns:    sqsNamespace,
+		Metadata: sqsResponseMetadata{RequestID: requestID()},
+	}
+	if result != nil {
+		res.Result = wrapped{name: action + "Result", v: result}
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+func writeSQSError(w http.ResponseWriter, status int, code, msg string) {
+	writeXML(w, status, sqsErrorResponse{Type: "Sender", Code: code, Message: msg, RequestID: requestID()})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write(append([]byte(xml.Header), body...))
+}
+
+// wrapped marshals v as an element with the given name.
+type wrapped struct {
+	name string
+	v    interface{}
+}
+
+func (w wrapped) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(w.v, xml.StartElement{Name: xml.Name{Local: w.name}})
+}
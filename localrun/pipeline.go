@@ -0,0 +1,151 @@
+package localrun
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxReceiveCount matches the redrive policy the queue package gives deployed queues.
+	DefaultMaxReceiveCount = 2
+
+	// UnreservedConcurrency is the number of workers run for a config with no concurrency limit,
+	// standing in for the account's unreserved concurrency.
+	UnreservedConcurrency = 100
+
+	batchSize    = 1 // matches the event source mappings the consumer package creates
+	pollInterval = 10 * time.Millisecond
+)
+
+// Handler handles a batch of messages, it has the same signature as the consumer function handler.
+type Handler func(ctx context.Context, event events.SQSEvent) error
+
+// Stats are the counts of the messages handled by a Pipeline.
+type Stats struct {
+	Processed    int // messages handled and deleted
+	Failed       int // handler invocations which returned an error or timed out
+	DeadLettered int // messages in the dead letter queue
+	InFlight     int // handler invocations currently running
+	MaxInFlight  int // most handler invocations ever running at the same time
+}
+
+// Pipeline runs a handler against an in-process queue with a worker pool capped at the
+// configured concurrency limit, the local equivalent of a deployed queue and consumer function.
+type Pipeline struct {
+	Config          pipeline.Config
+	Queue           *Queue
+	DeadLetterQueue *Queue
+
+	handler Handler
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// NewPipeline returns a Pipeline for the config, its queue redrives to a dead letter queue after
+// DefaultMaxReceiveCount receives. Unset timeouts take their defaults.
+func NewPipeline(config pipeline.Config, handler Handler) *Pipeline {
+	config = config.WithDefaults()
+	visibility := time.Duration(config.SQSVisibilityTimeoutSecs) * time.Second
+	name := fmt.Sprintf("%s-local-queue", config.ID)
+	dlq := NewQueue(name+"-dlq", visibility)
+	q := NewQueue(name, visibility)
+	q.MaxReceiveCount = DefaultMaxReceiveCount
+	q.DeadLetterQueue = dlq
+	return &Pipeline{
+		Config:          config,
+		Queue:           q,
+		DeadLetterQueue: dlq,
+		handler:         handler,
+	}
+}
+
+// Run runs LambdaConcurrencyLimit workers, or UnreservedConcurrency workers when there is no
+// limit, until the context is done. A limit of zero throttles the pipeline completely, as a
+// reserved concurrency of zero does. Tuned configs run their most concurrency, there is no task
+// duration to tune to before the run.
+func (p *Pipeline) Run(ctx context.Context) {
+	workers := UnreservedConcurrency
+	if p.Config.LambdaConcurrencyLimit != nil {
+		workers = *p.Config.LambdaConcurrencyLimit
+	} else if p.Config.Tuned() {
+		workers = p.Config.WithDefaults().MaxConcurrency
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// Stats returns the current message counts.
+func (p *Pipeline) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.DeadLettered = p.DeadLetterQueue.Len()
+	return stats
+}
+
+func (p *Pipeline) work(ctx context.Context) {
+	for {
+		records := p.Queue.Receive(batchSize)
+		if len(records) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+				continue
+			}
+		}
+		p.invoke(ctx, records)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// invoke calls the handler with the timeout of the consumer function, a handler which returns
+// after its deadline is treated as failed, even if it returned no error. The messages of a failed
+// invocation are left on the queue to be received again once their visibility timeout expires.
+func (p *Pipeline) invoke(ctx context.Context, records []events.SQSMessage) {
+	timeout := time.Duration(p.Config.LambdaTimeoutSes) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	p.track(1)
+	err := p.handler(ctx, events.SQSEvent{Records: records})
+	if err == nil {
+		err = ctx.Err()
+	}
+	p.track(-1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.Failed++
+		return
+	}
+	for _, r := range records {
+		if p.Queue.Delete(r.ReceiptHandle) {
+			p.stats.Processed++
+		}
+	}
+}
+
+func (p *Pipeline) track(delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.InFlight += delta
+	if p.stats.InFlight > p.stats.MaxInFlight {
+		p.stats.MaxInFlight = p.stats.InFlight
+	}
+}
@@ -0,0 +1,81 @@
+package localrun_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/localrun"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPipelineConcurrencyLimit(t *testing.T) {
+	handler := func(ctx context.Context, event events.SQSEvent) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	runtime, err := localrun.NewRuntime([]pipeline.Config{
+		{ID: "a", LambdaConcurrencyLimit: aws.Int(2), LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 5},
+		{ID: "b", LambdaConcurrencyLimit: aws.Int(5), LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 5},
+	}, handler)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		for _, id := range runtime.IDs() {
+			if _, err := runtime.Send(id, strconv.Itoa(i)); err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runtime.Run(ctx)
+		close(done)
+	}()
+	waitFor(t, runtime.Drained)
+	cancel()
+	<-done
+
+	a, _ := runtime.Pipeline("a")
+	b, _ := runtime.Pipeline("b")
+	assert.Equal(t, localrun.Stats{Processed: 20, MaxInFlight: 2}, a.Stats())
+	assert.Equal(t, localrun.Stats{Processed: 20, MaxInFlight: 5}, b.Stats())
+}
+
+func TestPipelineDeadLettersFailingMessages(t *testing.T) {
+	handler := func(ctx context.Context, event events.SQSEvent) error {
+		return errors.New("failed")
+	}
+	p := localrun.NewPipeline(pipeline.Config{ID: "a", LambdaConcurrencyLimit: aws.Int(1), LambdaTimeoutSes: 1}, handler)
+	p.Queue.VisibilityTimeout = 10 * time.Millisecond
+	p.Queue.Send("poison")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	waitFor(t, func() bool { return p.Queue.Len() == 0 })
+	cancel()
+	<-done
+
+	assert.Equal(t, localrun.Stats{Failed: localrun.DefaultMaxReceiveCount, DeadLettered: 1, MaxInFlight: 1}, p.Stats())
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
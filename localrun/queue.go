@@ -0,0 +1,178 @@
+package localrun
+
+import (
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	region    = "eu-west-2"
+	accountID = "000000000000"
+)
+
+// message is a message held by a Queue.
+type message struct {
+	id            string
+	body          string
+	sentAt        time.Time
+	receiveCount  int
+	receiptHandle string    // handle of the latest receive, empty if never received
+	visibleAt     time.Time // message can not be received before this time
+	attributes    map[string]events.SQSMessageAttribute
+}
+
+// Queue is an in-memory queue with SQS visibility timeout and redrive semantics.
+// A received message is invisible to other receivers until its visibility timeout expires, if it
+// has not been deleted by then it becomes visible again. Once a message has been received
+// maxReceiveCount times, the next receive moves it to the dead letter queue instead.
+type Queue struct {
+	Name              string
+	ARN               string
+	VisibilityTimeout time.Duration
+	MaxReceiveCount   int    // zero means messages are never moved to a dead letter queue
+	DeadLetterQueue   *Queue // nil if there is no dead letter queue
+
+	now func() time.Time
+
+	mu       sync.Mutex
+	messages []*message
+	nextID   int
+	receipts int
+}
+
+// NewQueue returns a new empty Queue with no dead letter queue.
+func NewQueue(name string, visibilityTimeout time.Duration) *Queue {
+	return &Queue{
+		Name:              name,
+		ARN:               fmt.Sprintf("arn:aws:sqs:%s:%s:%s", region, accountID, name),
+		VisibilityTimeout: visibilityTimeout,
+		now:               time.Now,
+	}
+}
+
+// Send adds a message to the queue and returns its ID.
+func (q *Queue) Send(body string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nextID++
+	m := &message{
+		id:        fmt.Sprintf("%s-%d", q.Name, q.nextID),
+		body:      body,
+		sentAt:    q.now(),
+		visibleAt: q.now(),
+	}
+	q.messages = append(q.messages, m)
+	return m.id
+}
+
+// Receive receives up to max visible messages, oldest first, as SQS event records.
+func (q *Queue) Receive(max int) []events.SQSMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	var records []events.SQSMessage
+	var kept []*message
+	for _, m := range q.messages {
+		if len(records) == max || now.Before(m.visibleAt) {
+			kept = append(kept, m)
+			continue
+		}
+		if q.DeadLetterQueue != nil && q.MaxReceiveCount > 0 && m.receiveCount >= q.MaxReceiveCount {
+			q.DeadLetterQueue.redrive(m)
+			continue
+		}
+		m.receiveCount++
+		q.receipts++
+		m.receiptHandle = fmt.Sprintf("%s-receipt-%d", m.id, q.receipts)
+		m.visibleAt = now.Add(q.VisibilityTimeout)
+		records = append(records, q.record(m))
+		kept = append(kept, m)
+	}
+	q.messages = kept
+	return records
+}
+
+// Delete deletes the message received with the given receipt handle, it reports whether the
+// message was deleted. Handles from earlier receives of a message that has since been received
+// again are no longer valid.
+func (q *Queue) Delete(receiptHandle string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, m := range q.messages {
+		if m.receiptHandle == receiptHandle {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ChangeVisibility makes the message received with the given receipt handle visible again after
+// the timeout, it reports whether the message was found.
+func (q *Queue) ChangeVisibility(receiptHandle string, timeout time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range q.messages {
+		if m.receiptHandle == receiptHandle {
+			m.visibleAt = q.now().Add(timeout)
+			return true
+		}
+	}
+	return false
+}
+
+// Defer sends the body of the message received with the given receipt handle again as a new
+// message with the attributes, visible after the delay, and deletes the received message, as the
+// SQS deferrer of the taskrunner does. It reports whether the message was found.
+func (q *Queue) Defer(receiptHandle string, delay time.Duration, attributes map[string]events.SQSMessageAttribute) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, m := range q.messages {
+		if m.receiptHandle == receiptHandle {
+			q.nextID++
+			q.messages[i] = &message{
+				id:         fmt.Sprintf("%s-%d", q.Name, q.nextID),
+				body:       m.body,
+				sentAt:     q.now(),
+				visibleAt:  q.now().Add(delay),
+				attributes: attributes,
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of messages in the queue, both visible and in flight.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// redrive adds a message moved from a source queue, keeping its ID and body.
+func (q *Queue) redrive(m *message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, &message{id: m.id, body: m.body, sentAt: m.sentAt, visibleAt: q.now(), attributes: m.attributes})
+}
+
+func (q *Queue) record(m *message) events.SQSMessage {
+	return events.SQSMessage{
+		MessageId:     m.id,
+		ReceiptHandle: m.receiptHandle,
+		Body:          m.body,
+		Attributes: map[string]string{
+			"ApproximateReceiveCount":          strconv.Itoa(m.receiveCount),
+			"SentTimestamp":                    strconv.FormatInt(m.sentAt.UnixNano()/int64(time.Millisecond), 10),
+			"ApproximateFirstReceiveTimestamp": strconv.FormatInt(q.now().UnixNano()/int64(time.Millisecond), 10),
+		},
+		MessageAttributes: m.attributes,
+		EventSource:       "aws:sqs",
+		EventSourceARN:    q.ARN,
+		AWSRegion:         region,
+	}
+}
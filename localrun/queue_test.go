@@ -0,0 +1,95 @@
+package localrun
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestQueueVisibilityAndRedrive(t *testing.T) {
+	now := time.Now()
+	dlq := NewQueue("dlq", time.Minute)
+	q := NewQueue("queue", 30*time.Second)
+	q.MaxReceiveCount = 2
+	q.DeadLetterQueue = dlq
+	q.now = func() time.Time { return now }
+	dlq.now = q.now
+
+	id := q.Send("body")
+	first := q.Receive(1)
+	if assert.Len(t, first, 1) {
+		assert.Equal(t, id, first[0].MessageId)
+		assert.Equal(t, "1", first[0].Attributes["ApproximateReceiveCount"])
+	}
+	assert.Empty(t, q.Receive(1), "message should be invisible while in flight")
+
+	now = now.Add(31 * time.Second)
+	second := q.Receive(1)
+	if assert.Len(t, second, 1) {
+		assert.Equal(t, "2", second[0].Attributes["ApproximateReceiveCount"])
+	}
+	assert.False(t, q.Delete(first[0].ReceiptHandle), "stale receipt handle should not delete")
+
+	now = now.Add(31 * time.Second)
+	assert.Empty(t, q.Receive(1), "message should have been moved to the dlq")
+	assert.Equal(t, 0, q.Len())
+	if moved := dlq.Receive(1); assert.Len(t, moved, 1) {
+		assert.Equal(t, id, moved[0].MessageId)
+		assert.Equal(t, "body", moved[0].Body)
+	}
+}
+
+func TestQueueDelete(t *testing.T) {
+	q := NewQueue("queue", time.Minute)
+	q.Send("a")
+	q.Send("b")
+	records := q.Receive(10)
+	assert.Len(t, records, 2)
+	assert.True(t, q.Delete(records[0].ReceiptHandle))
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestQueueChangeVisibility(t *testing.T) {
+	now := time.Now()
+	q := NewQueue("queue", 30*time.Second)
+	q.now = func() time.Time { return now }
+	q.Send("a")
+	records := q.Receive(1)
+	if !assert.Len(t, records, 1) {
+		return
+	}
+	assert.True(t, q.ChangeVisibility(records[0].ReceiptHandle, 2*time.Second))
+	assert.False(t, q.ChangeVisibility("unknown", time.Second))
+
+	now = now.Add(time.Second)
+	assert.Empty(t, q.Receive(1), "message should be invisible until the new timeout")
+	now = now.Add(time.Second)
+	assert.Len(t, q.Receive(1), 1)
+}
+
+func TestQueueDefer(t *testing.T) {
+	now := time.Now()
+	q := NewQueue("queue", 30*time.Second)
+	q.now = func() time.Time { return now }
+	q.Send("a")
+	records := q.Receive(1)
+	if !assert.Len(t, records, 1) {
+		return
+	}
+	throttles := "1"
+	attributes := map[string]events.SQSMessageAttribute{"Throttles": {DataType: "Number", StringValue: &throttles}}
+	assert.True(t, q.Defer(records[0].ReceiptHandle, 2*time.Second, attributes))
+	assert.False(t, q.Defer(records[0].ReceiptHandle, time.Second, nil), "the received message should be deleted")
+	assert.Equal(t, 1, q.Len())
+
+	now = now.Add(time.Second)
+	assert.Empty(t, q.Receive(1), "message should be invisible until the delay is over")
+	now = now.Add(time.Second)
+	deferred := q.Receive(1)
+	if assert.Len(t, deferred, 1) {
+		assert.Equal(t, "a", deferred[0].Body)
+		assert.Equal(t, "1", deferred[0].Attributes["ApproximateReceiveCount"], "the deferral should not count as a receive")
+		assert.Equal(t, attributes, deferred[0].MessageAttributes)
+	}
+}
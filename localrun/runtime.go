@@ -0,0 +1,120 @@
+// Package localrun runs pipelines in process, each pipeline config gets an in-memory queue with
+// SQS visibility timeout and dead letter queue semantics, consumed by a pool of workers capped at
+// the config's concurrency limit. It lets consumer code be developed and throughput be tested
+// without deploying.
+package localrun
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Runtime runs a set of pipelines with the same handler.
+type Runtime struct {
+	pipelines map[string]*Pipeline
+}
+
+// NewRuntime returns a Runtime with a Pipeline for each of the configs.
+func NewRuntime(configs []pipeline.Config, handler Handler) (*Runtime, error) {
+	r := &Runtime{pipelines: make(map[string]*Pipeline)}
+	for _, config := range configs {
+		if config.ID == "" {
+			return nil, errors.New("pipeline config has no id")
+		}
+		if _, ok := r.pipelines[config.ID]; ok {
+			return nil, errors.Errorf("duplicate pipeline config %s", config.ID)
+		}
+		r.pipelines[config.ID] = NewPipeline(config, handler)
+	}
+	return r, nil
+}
+
+// Send sends a message to the queue of the pipeline with the given ID.
+func (r *Runtime) Send(id, body string) (string, error) {
+	p, ok := r.pipelines[id]
+	if !ok {
+		return "", errors.Errorf("no pipeline %s", id)
+	}
+	return p.Queue.Send(body), nil
+}
+
+// Pipeline returns the pipeline with the given ID, and whether it exists.
+func (r *Runtime) Pipeline(id string) (*Pipeline, bool) {
+	p, ok := r.pipelines[id]
+	return p, ok
+}
+
+// ByQueue returns the pipeline consuming the queue with the given ARN, and whether there is one.
+func (r *Runtime) ByQueue(queueArn string) (*Pipeline, bool) {
+	for _, p := range r.pipelines {
+		if p.Queue.ARN == queueArn {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// ChangeVisibility makes the message received with the given receipt handle from the queue with
+// the given ARN visible again after the timeout, as SQS ChangeMessageVisibility does.
+func (r *Runtime) ChangeVisibility(queueArn, receiptHandle string, timeout time.Duration) error {
+	p, ok := r.ByQueue(queueArn)
+	if !ok {
+		return errors.Errorf("no queue %s", queueArn)
+	}
+	if !p.Queue.ChangeVisibility(receiptHandle, timeout) {
+		return errors.Errorf("receipt handle %s is not valid", receiptHandle)
+	}
+	return nil
+}
+
+// Defer sends the message received with the given receipt handle from the queue with the given
+// ARN again with the attributes, visible after the delay, and deletes the received message, see
+// Queue.Defer.
+func (r *Runtime) Defer(queueArn, receiptHandle string, delay time.Duration, attributes map[string]events.SQSMessageAttribute) error {
+	p, ok := r.ByQueue(queueArn)
+	if !ok {
+		return errors.Errorf("no queue %s", queueArn)
+	}
+	if !p.Queue.Defer(receiptHandle, delay, attributes) {
+		return errors.Errorf("receipt handle %s is not valid", receiptHandle)
+	}
+	return nil
+}
+
+// IDs returns the IDs of the pipelines in order.
+func (r *Runtime) IDs() []string {
+	var ids []string
+	for id := range r.pipelines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Drained reports whether every pipeline queue is empty, messages moved to dead letter queues do not count.
+func (r *Runtime) Drained() bool {
+	for _, p := range r.pipelines {
+		if p.Queue.Len() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Run runs all the pipelines until the context is done.
+func (r *Runtime) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range r.pipelines {
+		wg.Add(1)
+		go func(p *Pipeline) {
+			defer wg.Done()
+			p.Run(ctx)
+		}(p)
+	}
+	wg.Wait()
+}
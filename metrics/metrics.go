@@ -0,0 +1,135 @@
+// Package metrics writes CloudWatch metrics in the Embedded Metric Format, JSON log lines which
+// CloudWatch Logs turns into metrics, so that the Lambda functions can be graphed and alarmed on
+// without calling PutMetricData. See
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+package metrics
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace is the CloudWatch namespace the metrics are put under when none is given.
+const DefaultNamespace = "ServerlessProcessing"
+
+// Unit is the unit of a metric.
+type Unit string
+
+// Metric units.
+const (
+	Count        Unit = "Count"
+	Milliseconds Unit = "Milliseconds"
+	None         Unit = "None"
+)
+
+// Metric is a single value of a metric.
+type Metric struct {
+	Name  string
+	Unit  Unit
+	Value float64
+}
+
+// Entry is a set of metrics sharing the same dimensions, written as one EMF line. Properties are
+// written alongside as log fields, searchable in CloudWatch Logs but not turned into metrics.
+// Rollups are further sets of the dimensions' names the metrics are also put under, so that they
+// can be read by fewer dimensions, such as by function across every task type.
+type Entry struct {
+	Dimensions map[string]string
+	Rollups    [][]string
+	Metrics    []Metric
+	Properties map[string]interface{}
+	Time       time.Time // defaults to now
+}
+
+// Emitter writes entries as EMF lines, it is safe for concurrent use.
+type Emitter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	namespace string
+}
+
+// New returns a new instance of Emitter writing to w, on Lambda this is stdout which goes to
+// CloudWatch Logs. An empty namespace uses DefaultNamespace.
+func New(w io.Writer, namespace string) *Emitter {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &Emitter{w: w, namespace: namespace}
+}
+
+// Emit writes the entries, one line each.
+func (e *Emitter) Emit(entries ...Entry) error {
+	for _, entry := range entries {
+		line, err := e.marshal(entry)
+		if err != nil {
+			return err
+		}
+		e.mu.Lock()
+		_, err = e.w.Write(append(line, '\n'))
+		e.mu.Unlock()
+		if err != nil {
+			return errors.Wrap(err, "failed to write metrics")
+		}
+	}
+	return nil
+}
+
+type (
+	emfRoot struct {
+		Timestamp         int64          `json:"Timestamp"`
+		CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+	}
+	emfDirective struct {
+		Namespace  string      `json:"Namespace"`
+		Dimensions [][]string  `json:"Dimensions"`
+		Metrics    []emfMetric `json:"Metrics"`
+	}
+	emfMetric struct {
+		Name string `json:"Name"`
+		Unit Unit   `json:"Unit,omitempty"`
+	}
+)
+
+// marshal returns the EMF line of the entry, the metadata goes under "_aws" and the dimension and
+// metric values are top level members.
+func (e *Emitter) marshal(entry Entry) ([]byte, error) {
+	at := entry.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	line := make(map[string]interface{}, len(entry.Properties)+len(entry.Dimensions)+len(entry.Metrics)+1)
+	for k, v := range entry.Properties {
+		line[k] = v
+	}
+	dimensions := make([]string, 0, len(entry.Dimensions))
+	for k, v := range entry.Dimensions {
+		dimensions = append(dimensions, k)
+		line[k] = v
+	}
+	sort.Strings(dimensions)
+	directive := emfDirective{Namespace: e.namespace, Dimensions: append([][]string{dimensions}, entry.Rollups...)}
+	for _, m := range entry.Metrics {
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: m.Name, Unit: m.Unit})
+		line[m.Name] = m.Value
+	}
+	line["_aws"] = emfRoot{
+		Timestamp:         at.UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfDirective{directive},
+	}
+	buf, err := json.Marshal(line)
+	return buf, errors.Wrap(err, "failed to marshal metrics")
+}
+
+// Since returns the milliseconds since start, as a metric value.
+func Since(start time.Time) float64 {
+	return Millis(time.Since(start))
+}
+
+// Millis returns the duration in milliseconds, as a metric value.
+func Millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,92 @@
+package metrics_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmitWritesEmbeddedMetricFormat(t *testing.T) {
+	var buf bytes.Buffer
+	emitter := metrics.New(&buf, "Test")
+	at := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	err := emitter.Emit(metrics.Entry{
+		Dimensions: map[string]string{"Status": "success", "Operation": "add"},
+		Metrics: []metrics.Metric{
+			{Name: "Instructions", Unit: metrics.Count, Value: 1},
+			{Name: "Duration", Unit: metrics.Milliseconds, Value: 12.5},
+		},
+		Properties: map[string]interface{}{"pipeline_id": "group-a"},
+		Time:       at,
+	}, metrics.Entry{
+		Metrics: []metrics.Metric{{Name: "Other", Value: 2}},
+	})
+	if err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+
+	want := `{
+		"_aws": {
+			"Timestamp": 1588334400000,
+			"CloudWatchMetrics": [{
+				"Namespace": "Test",
+				"Dimensions": [["Operation", "Status"]],
+				"Metrics": [{"Name": "Instructions", "Unit": "Count"}, {"Name": "Duration", "Unit": "Milliseconds"}]
+			}]
+		},
+		"Operation": "add",
+		"Status": "success",
+		"Instructions": 1,
+		"Duration": 12.5,
+		"pipeline_id": "group-a"
+	}`
+	assert.JSONEq(t, want, lines[0])
+
+	var second map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatalf("failed to unmarshal second line: %v", err)
+	}
+	assert.Equal(t, 2.0, second["Other"])
+}
+
+func TestEmitRollups(t *testing.T) {
+	var buf bytes.Buffer
+	emitter := metrics.New(&buf, "Test")
+
+	err := emitter.Emit(metrics.Entry{
+		Dimensions: map[string]string{"FunctionName": "fn", "TaskType": "sleep"},
+		Rollups:    [][]string{{"FunctionName"}},
+		Metrics:    []metrics.Metric{{Name: "Tasks", Unit: metrics.Count, Value: 1}},
+	})
+	if err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	var line struct {
+		AWS struct {
+			CloudWatchMetrics []struct {
+				Dimensions [][]string
+			}
+		} `json:"_aws"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed to unmarshal line: %v", err)
+	}
+	assert.Equal(t, [][]string{{"FunctionName", "TaskType"}, {"FunctionName"}}, line.AWS.CloudWatchMetrics[0].Dimensions)
+}
+
+func TestNewDefaultsNamespace(t *testing.T) {
+	var buf bytes.Buffer
+	if err := metrics.New(&buf, "").Emit(metrics.Entry{Metrics: []metrics.Metric{{Name: "M", Value: 1}}}); err != nil {
+		t.Fatalf("failed to emit: %v", err)
+	}
+	assert.Contains(t, buf.String(), `"Namespace":"`+metrics.DefaultNamespace+`"`)
+}
@@ -0,0 +1,69 @@
+// Package notify publishes pipeline lifecycle events, so that the teams owning pipelines hear when
+// they are ready or have failed without polling the statuses table. Events can be published to an
+// SNS topic, an EventBridge event bus or an HTTP webhook, chosen per pipeline by the config's
+// notify target or per environment by a default target.
+package notify
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	PipelineCreated = "pipeline.created"
+	PipelineUpdated = "pipeline.updated"
+	PipelineDeleted = "pipeline.deleted"
+	PipelineFailed  = "pipeline.failed"
+)
+
+// Event is a pipeline lifecycle event.
+type Event struct {
+	Type           string               `json:"type"`
+	PipelineID     string               `json:"pipeline_id"`
+	Environment    string               `json:"environment"`
+	Operation      string               `json:"operation"` // operation which failed, for pipeline.failed
+	SequenceNumber string               `json:"sequence_number"`
+	Identifier     *pipeline.Identifier `json:"identifier,omitempty"` // resources of created and updated pipelines
+	Error          string               `json:"error,omitempty"`
+	Time           time.Time            `json:"time"`
+	Target         string               `json:"-"` // pipeline's notify target, empty for the default
+}
+
+// Publisher publishes lifecycle events.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// PublisherFunc is a function that can be used as a Publisher.
+type PublisherFunc func(ctx context.Context, event Event) error
+
+// Publish calls f(ctx, event).
+func (f PublisherFunc) Publish(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+var _ Publisher = (*Recorder)(nil)
+
+// Recorder is a Publisher which keeps the events in memory, for use in tests and local runs.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Publish records the event.
+func (r *Recorder) Publish(ctx context.Context, event Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+// Events returns the events published so far, oldest first.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
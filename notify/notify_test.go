@@ -0,0 +1,88 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/notify"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type snsStub struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (s *snsStub) PublishWithContext(ctx aws.Context, in *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	s.published = append(s.published, in)
+	return &sns.PublishOutput{MessageId: aws.String("1")}, nil
+}
+
+type eventBridgeStub struct {
+	eventbridgeiface.EventBridgeAPI
+	entries []*eventbridge.PutEventsRequestEntry
+	failed  bool
+}
+
+func (s *eventBridgeStub) PutEventsWithContext(ctx aws.Context, in *eventbridge.PutEventsInput, opts ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	s.entries = append(s.entries, in.Entries...)
+	if s.failed {
+		return &eventbridge.PutEventsOutput{
+			FailedEntryCount: aws.Int64(1),
+			Entries:          []*eventbridge.PutEventsResultEntry{{ErrorMessage: aws.String("bus not found")}},
+		}, nil
+	}
+	return &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil
+}
+
+func TestRouterPublishesToTarget(t *testing.T) {
+	ctx := context.Background()
+	var posted []notify.Event
+	status := http.StatusOK
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		json.NewDecoder(r.Body).Decode(&e)
+		posted = append(posted, e)
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+	snsSvc, ebSvc := &snsStub{}, &eventBridgeStub{}
+	router := &notify.Router{Default: "sns:arn:aws:sns:eu-west-2:000000000000:pipelines", SNS: snsSvc, EventBridge: ebSvc}
+	ident := &pipeline.Identifier{QueueARN: "queue-arn", ConsumerARN: "consumer-arn"}
+
+	assert.NoError(t, router.Publish(ctx, notify.Event{Type: notify.PipelineCreated, PipelineID: "a", Identifier: ident}))
+	if assert.Len(t, snsSvc.published, 1) {
+		assert.Equal(t, "arn:aws:sns:eu-west-2:000000000000:pipelines", *snsSvc.published[0].TopicArn)
+		assert.Equal(t, notify.PipelineCreated, *snsSvc.published[0].MessageAttributes["type"].StringValue)
+		assert.Contains(t, *snsSvc.published[0].Message, `"queue_arn":"queue-arn"`)
+	}
+
+	assert.NoError(t, router.Publish(ctx, notify.Event{Type: notify.PipelineFailed, PipelineID: "b", Error: "boom", Target: "events:team-b"}))
+	if assert.Len(t, ebSvc.entries, 1) {
+		assert.Equal(t, "team-b", *ebSvc.entries[0].EventBusName)
+		assert.Equal(t, notify.EventSource, *ebSvc.entries[0].Source)
+		assert.Equal(t, notify.PipelineFailed, *ebSvc.entries[0].DetailType)
+	}
+	ebSvc.failed = true
+	assert.Error(t, router.Publish(ctx, notify.Event{Type: notify.PipelineFailed, PipelineID: "b", Target: "events:team-b"}))
+
+	assert.NoError(t, router.Publish(ctx, notify.Event{Type: notify.PipelineDeleted, PipelineID: "c", Target: hook.URL}))
+	if assert.Len(t, posted, 1) {
+		assert.Equal(t, notify.PipelineDeleted, posted[0].Type)
+		assert.Equal(t, "c", posted[0].PipelineID)
+	}
+	status = http.StatusInternalServerError
+	assert.Error(t, router.Publish(ctx, notify.Event{Type: notify.PipelineDeleted, PipelineID: "c", Target: hook.URL}))
+
+	assert.Error(t, router.Publish(ctx, notify.Event{PipelineID: "d", Target: "carrier-pigeon"}))
+	assert.NoError(t, (&notify.Router{}).Publish(ctx, notify.Event{PipelineID: "e"}), "events without a target are dropped")
+}
@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// EventSource is the source of the events put on EventBridge.
+const EventSource = "serverless-processing.pipeline-manager"
+
+// SNSPublisher publishes events as JSON messages to an SNS topic, with the event type as the
+// "type" message attribute so that subscriptions can filter on it.
+type SNSPublisher struct {
+	svc      snsiface.SNSAPI
+	topicArn string
+}
+
+// NewSNSPublisher returns a new instance of SNSPublisher.
+func NewSNSPublisher(svc snsiface.SNSAPI, topicArn string) *SNSPublisher {
+	return &SNSPublisher{svc: svc, topicArn: topicArn}
+}
+
+// Publish publishes the event to the topic.
+func (p *SNSPublisher) Publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	_, err = p.svc.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(p.topicArn),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"type": {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+		},
+	})
+	return errors.Wrapf(err, "failed to publish %s of %s to %s", event.Type, event.PipelineID, p.topicArn)
+}
+
+// EventBridgePublisher puts events on an EventBridge event bus, with the event type as the detail
+// type and the event as the detail.
+type EventBridgePublisher struct {
+	svc eventbridgeiface.EventBridgeAPI
+	bus string
+}
+
+// NewEventBridgePublisher returns a new instance of EventBridgePublisher.
+func NewEventBridgePublisher(svc eventbridgeiface.EventBridgeAPI, bus string) *EventBridgePublisher {
+	return &EventBridgePublisher{svc: svc, bus: bus}
+}
+
+// Publish puts the event on the event bus.
+func (p *EventBridgePublisher) Publish(ctx context.Context, event Event) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	res, err := p.svc.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			EventBusName: aws.String(p.bus),
+			Source:       aws.String(EventSource),
+			DetailType:   aws.String(event.Type),
+			Detail:       aws.String(string(detail)),
+			Resources:    identifierARNs(event.Identifier),
+		}},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to put %s of %s on %s", event.Type, event.PipelineID, p.bus)
+	}
+	if aws.Int64Value(res.FailedEntryCount) > 0 && len(res.Entries) > 0 {
+		return errors.Errorf("failed to put %s of %s on %s: %s", event.Type, event.PipelineID, p.bus,
+			aws.StringValue(res.Entries[0].ErrorMessage))
+	}
+	return nil
+}
+
+func identifierARNs(ident *pipeline.Identifier) []*string {
+	if ident == nil {
+		return nil
+	}
+	var arns []*string
+	for _, arn := range []string{ident.QueueARN, ident.ConsumerARN} {
+		if arn != "" {
+			arns = append(arns, aws.String(arn))
+		}
+	}
+	return arns
+}
+
+// WebhookPublisher posts events as JSON to an HTTP webhook, any status other than 2xx fails.
+type WebhookPublisher struct {
+	client *http.Client
+	url    string
+}
+
+// NewWebhookPublisher returns a new instance of WebhookPublisher, a nil client uses http.DefaultClient.
+func NewWebhookPublisher(client *http.Client, url string) *WebhookPublisher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebhookPublisher{client: client, url: url}
+}
+
+// Publish posts the event to the webhook.
+func (p *WebhookPublisher) Publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to make request to %s", p.url)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to post %s of %s to %s", event.Type, event.PipelineID, p.url)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("failed to post %s of %s to %s: %s", event.Type, event.PipelineID, p.url, res.Status)
+	}
+	return nil
+}
+
+// Router publishes each event to the publisher for the event's target, or for the default target
+// when the event has none. Events are dropped when neither is set.
+type Router struct {
+	Default     string // target of events without one, empty for none
+	SNS         snsiface.SNSAPI
+	EventBridge eventbridgeiface.EventBridgeAPI
+	HTTP        *http.Client
+}
+
+// Publish publishes the event to its target.
+func (r *Router) Publish(ctx context.Context, event Event) error {
+	target := event.Target
+	if target == "" {
+		target = r.Default
+	}
+	if target == "" {
+		return nil
+	}
+	p, err := r.publisher(target)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, event)
+}
+
+// publisher returns the publisher for the target, see pipeline.ValidateNotifyTarget.
+func (r *Router) publisher(target string) (Publisher, error) {
+	if err := pipeline.ValidateNotifyTarget(target); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(target, pipeline.NotifySNS):
+		if r.SNS == nil {
+			return nil, errors.Errorf("no SNS client for target %s", target)
+		}
+		return NewSNSPublisher(r.SNS, strings.TrimPrefix(target, pipeline.NotifySNS)), nil
+	case strings.HasPrefix(target, pipeline.NotifyEventBridge):
+		if r.EventBridge == nil {
+			return nil, errors.Errorf("no EventBridge client for target %s", target)
+		}
+		return NewEventBridgePublisher(r.EventBridge, strings.TrimPrefix(target, pipeline.NotifyEventBridge)), nil
+	default:
+		return NewWebhookPublisher(r.HTTP, target), nil
+	}
+}
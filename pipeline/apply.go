@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// Action is the write needed to bring a stored Config in line with its definition.
+type Action string
+
+// Actions of a Change.
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Change is a single write planned by Plan. Config is the desired Config, or for deletes the stored
+// Config, and carries the stored version the write is conditioned on.
+type Change struct {
+	Action Action
+	Config Config
+}
+
+// Plan compares the desired Configs with the stored Configs and returns the changes needed to
+// apply them, in ID order. Stored Configs missing from the desired Configs are only deleted when prune is set.
+func Plan(desired, stored []Config, prune bool) []Change {
+	current := make(map[string]Config)
+	for _, c := range stored {
+		current[c.ID] = c
+	}
+	wanted := make(map[string]bool)
+	var changes []Change
+	for _, c := range desired {
+		wanted[c.ID] = true
+		existing, ok := current[c.ID]
+		switch {
+		case !ok:
+			c.Version = 0
+			changes = append(changes, Change{Action: ActionCreate, Config: c})
+		case !sameSettings(c, existing):
+			c.Version = existing.Version
+			changes = append(changes, Change{Action: ActionUpdate, Config: c})
+		}
+	}
+	if prune {
+		for _, c := range stored {
+			if !wanted[c.ID] {
+				changes = append(changes, Change{Action: ActionDelete, Config: c})
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Config.ID < changes[j].Config.ID })
+	return changes
+}
+
+// Apply writes the changes to the store with conditional writes, so that a Config changed since it
+// was read for planning is not overwritten. It stops at the first failed write.
+func Apply(ctx context.Context, store ConfigStore, changes []Change) error {
+	for _, ch := range changes {
+		var err error
+		switch ch.Action {
+		case ActionCreate, ActionUpdate:
+			_, err = store.PutConfigIfVersion(ctx, ch.Config)
+		case ActionDelete:
+			err = store.DeleteConfigIfVersion(ctx, ch.Config.ID, ch.Config.Version)
+		default:
+			err = errors.Errorf("unknown action %q", ch.Action)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to %s config %s", ch.Action, ch.Config.ID)
+		}
+	}
+	return nil
+}
+
+// ProfileChange is a single Profile write planned by PlanProfiles, in the same way as a Change.
+type ProfileChange struct {
+	Action  Action
+	Profile Profile
+}
+
+// PlanProfiles compares the desired Profiles with the stored Profiles in the same way Plan
+// compares Configs.
+func PlanProfiles(desired, stored []Profile, prune bool) []ProfileChange {
+	current := make(map[string]Profile)
+	for _, p := range stored {
+		current[p.ID] = p
+	}
+	wanted := make(map[string]bool)
+	var changes []ProfileChange
+	for _, p := range desired {
+		wanted[p.ID] = true
+		existing, ok := current[p.ID]
+		switch {
+		case !ok:
+			p.Version = 0
+			changes = append(changes, ProfileChange{Action: ActionCreate, Profile: p})
+		case !sameProfile(p, existing):
+			p.Version = existing.Version
+			changes = append(changes, ProfileChange{Action: ActionUpdate, Profile: p})
+		}
+	}
+	if prune {
+		for _, p := range stored {
+			if !wanted[p.ID] {
+				changes = append(changes, ProfileChange{Action: ActionDelete, Profile: p})
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Profile.ID < changes[j].Profile.ID })
+	return changes
+}
+
+// ApplyProfiles writes the Profile changes to the store in the same way Apply writes Config changes.
+func ApplyProfiles(ctx context.Context, store ProfileStore, changes []ProfileChange) error {
+	for _, ch := range changes {
+		var err error
+		switch ch.Action {
+		case ActionCreate, ActionUpdate:
+			_, err = store.PutProfileIfVersion(ctx, ch.Profile)
+		case ActionDelete:
+			err = store.DeleteProfileIfVersion(ctx, ch.Profile.ID, ch.Profile.Version)
+		default:
+			err = errors.Errorf("unknown action %q", ch.Action)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to %s profile %s", ch.Action, ch.Profile.ID)
+		}
+	}
+	return nil
+}
+
+// ListAllConfigs lists every Config in the store, following the pages.
+func ListAllConfigs(ctx context.Context, store ConfigStore) ([]Config, error) {
+	var configs []Config
+	in := ListInput{}
+	for {
+		page, err := store.ListConfigs(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, page.Configs...)
+		if page.NextCursor == "" {
+			return configs, nil
+		}
+		in.Cursor = page.NextCursor
+	}
+}
+
+// ListAllConfigsByProfile lists every Config referencing the Profile, following the pages.
+func ListAllConfigsByProfile(ctx context.Context, store ConfigStore, profile string) ([]Config, error) {
+	var configs []Config
+	in := ListInput{}
+	for {
+		page, err := store.ListConfigsByProfile(ctx, profile, in)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, page.Configs...)
+		if page.NextCursor == "" {
+			return configs, nil
+		}
+		in.Cursor = page.NextCursor
+	}
+}
+
+// ListAllProfiles lists every Profile in the store, following the pages.
+func ListAllProfiles(ctx context.Context, store ProfileStore) ([]Profile, error) {
+	var profiles []Profile
+	in := ListInput{}
+	for {
+		page, err := store.ListProfiles(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, page.Profiles...)
+		if page.NextCursor == "" {
+			return profiles, nil
+		}
+		in.Cursor = page.NextCursor
+	}
+}
+
+// sameSettings reports whether the configs have the same settings, ignoring their versions. Configs
+// without a profile are compared once defaulted, unset settings of configs with a profile come
+// from the profile so they are compared as they are.
+func sameSettings(a, b Config) bool {
+	if a.Profile == "" && b.Profile == "" {
+		a, b = a.WithDefaults(), b.WithDefaults()
+	}
+	return a.ID == b.ID && a.Profile == b.Profile && a.Notify == b.Notify && sameInt(a.LambdaConcurrencyLimit, b.LambdaConcurrencyLimit) &&
+		a.LambdaTimeoutSes == b.LambdaTimeoutSes && a.SQSVisibilityTimeoutSecs == b.SQSVisibilityTimeoutSecs &&
+		a.RatePerSecond == b.RatePerSecond && a.TargetRatePerSecond == b.TargetRatePerSecond &&
+		a.MinConcurrency == b.MinConcurrency && a.MaxConcurrency == b.MaxConcurrency &&
+		sameBool(a.AdaptiveConcurrency, b.AdaptiveConcurrency)
+}
+
+func sameBool(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameInt(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sameProfile reports whether the profiles have the same settings, ignoring their versions.
+func sameProfile(a, b Profile) bool {
+	return a.ID == b.ID && sameInt(a.LambdaConcurrencyLimit, b.LambdaConcurrencyLimit) &&
+		a.LambdaTimeoutSes == b.LambdaTimeoutSes && a.SQSVisibilityTimeoutSecs == b.SQSVisibilityTimeoutSecs &&
+		a.RatePerSecond == b.RatePerSecond && a.TargetRatePerSecond == b.TargetRatePerSecond &&
+		a.MinConcurrency == b.MinConcurrency && a.MaxConcurrency == b.MaxConcurrency &&
+		a.AdaptiveConcurrency == b.AdaptiveConcurrency
+}
@@ -0,0 +1,51 @@
+package pipeline_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	for _, c := range []pipeline.Config{
+		{ID: "keep", LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1},
+		{ID: "change", LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1},
+		{ID: "remove", LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1},
+	} {
+		if _, err := store.PutConfigIfVersion(ctx, c); err != nil {
+			t.Fatalf("failed to put config: %v", err)
+		}
+	}
+	desired := []pipeline.Config{
+		{ID: "keep", LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1},
+		{ID: "change", LambdaConcurrencyLimit: aws.Int(3), LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1},
+		{ID: "new", LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1},
+	}
+	stored, err := pipeline.ListAllConfigs(ctx, store)
+	if err != nil {
+		t.Fatalf("failed to list configs: %v", err)
+	}
+
+	assert.Equal(t, []pipeline.Change{
+		{Action: pipeline.ActionUpdate, Config: pipeline.Config{ID: "change", LambdaConcurrencyLimit: aws.Int(3), LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1, Version: 1}},
+		{Action: pipeline.ActionCreate, Config: pipeline.Config{ID: "new", LambdaTimeoutSes: 1, SQSVisibilityTimeoutSecs: 1}},
+	}, pipeline.Plan(desired, stored, false))
+
+	changes := pipeline.Plan(desired, stored, true)
+	assert.Len(t, changes, 3)
+	if err := pipeline.Apply(ctx, store, changes); err != nil {
+		t.Fatalf("failed to apply changes: %v", err)
+	}
+	stored, _ = pipeline.ListAllConfigs(ctx, store)
+	assert.Empty(t, pipeline.Plan(desired, stored, true), "applied changes should leave nothing to do")
+	changed, _ := store.GetConfig(ctx, "change")
+	assert.Equal(t, int64(2), changed.Version)
+
+	// applying a stale plan conflicts rather than overwriting the newer config.
+	err = pipeline.Apply(ctx, store, changes[:1])
+	assert.True(t, pipeline.IsConflict(err))
+}
@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+)
+
+// auditTimeFormat is a fixed width RFC3339 layout, so that audit keys sort in time order.
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// Audit results.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditRecord is a durable record of an instruction handled by the pipeline manager, there is one
+// record per handling, including retries of the same stream record. Records of profile re-applies
+// are kept under the ID of the profile prefixed with AuditProfilePrefix.
+type AuditRecord struct {
+	ID             string        `json:"id"                     dynamodbav:"id"`
+	Key            string        `json:"key"                    dynamodbav:"key"` // handling time and sequence number, sorts in time order
+	Operation      string        `json:"operation"              dynamodbav:"operation"`
+	SequenceNumber string        `json:"sequence_number"        dynamodbav:"sequence_number"`
+	RequestID      string        `json:"request_id,omitempty"   dynamodbav:"request_id,omitempty"` // Lambda invocation request ID
+	Changes        []AuditChange `json:"changes,omitempty"      dynamodbav:"changes,omitempty"`
+	Identifier     *Identifier   `json:"identifier,omitempty"   dynamodbav:"identifier,omitempty"` // identifiers after handling, nil when the pipeline has none
+	Result         string        `json:"result"                 dynamodbav:"result"`
+	Error          string        `json:"error,omitempty"        dynamodbav:"error,omitempty"`
+	StartedAt      time.Time     `json:"started_at"             dynamodbav:"started_at"`
+	DurationMillis int64         `json:"duration_millis"        dynamodbav:"duration_millis"`
+	ChangedBy      string        `json:"changed_by,omitempty"   dynamodbav:"changed_by,omitempty"`
+}
+
+// AuditProfilePrefix prefixes the profile ID that profile re-apply records are kept under.
+const AuditProfilePrefix = "profile/"
+
+// AuditChange is a config setting changed by an instruction, unset values are empty.
+type AuditChange struct {
+	Field string `json:"field" dynamodbav:"field"`
+	From  string `json:"from"  dynamodbav:"from"`
+	To    string `json:"to"    dynamodbav:"to"`
+}
+
+// String returns the change as field: from -> to.
+func (c AuditChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, unsetString(c.From), unsetString(c.To))
+}
+
+func unsetString(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
+}
+
+// AuditKey returns the key of a record started at the given time, for the given stream record.
+func AuditKey(startedAt time.Time, sequenceNumber string) string {
+	return startedAt.UTC().Format(auditTimeFormat) + "#" + sequenceNumber
+}
+
+// AuditInput specifies the page of a pipeline's audit records to list, records started between
+// From and To inclusive are listed oldest first. A zero From or To leaves that end open.
+type AuditInput struct {
+	From   time.Time
+	To     time.Time
+	Limit  int    // maximum number of records to return, defaults to 100
+	Cursor string // cursor returned with the previous page, empty for the first page
+}
+
+// AuditPage is a page of AuditRecords, NextCursor is empty when there are no more pages.
+type AuditPage struct {
+	Records    []AuditRecord
+	NextCursor string
+}
+
+// auditRange returns the lowest and highest keys of the records in the input's time range.
+func auditRange(in AuditInput) (string, string) {
+	from, to := "0", "~"
+	if !in.From.IsZero() {
+		from = in.From.UTC().Format(auditTimeFormat)
+	}
+	if !in.To.IsZero() {
+		to = in.To.UTC().Format(auditTimeFormat) + "#~"
+	}
+	return from, to
+}
@@ -0,0 +1,45 @@
+package pipeline_test
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreListAuditTimeRange(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, seq := range []string{"100", "200", "300", "400"} {
+		at := start.Add(time.Duration(i) * time.Hour)
+		record := pipeline.AuditRecord{ID: "id", Key: pipeline.AuditKey(at, seq), SequenceNumber: seq, StartedAt: at}
+		if err := store.PutAudit(ctx, record); err != nil {
+			t.Fatalf("failed to put audit record: %v", err)
+		}
+	}
+
+	list := func(in pipeline.AuditInput) [][]string {
+		var pages [][]string
+		for {
+			page, err := store.ListAudit(ctx, "id", in)
+			if err != nil {
+				t.Fatalf("failed to list audit records: %v", err)
+			}
+			var seqs []string
+			for _, r := range page.Records {
+				seqs = append(seqs, r.SequenceNumber)
+			}
+			pages = append(pages, seqs)
+			if page.NextCursor == "" {
+				return pages
+			}
+			in.Cursor = page.NextCursor
+		}
+	}
+	assert.Equal(t, [][]string{{"100", "200", "300", "400"}}, list(pipeline.AuditInput{}))
+	assert.Equal(t, [][]string{{"200", "300"}}, list(pipeline.AuditInput{From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}))
+	assert.Equal(t, [][]string{{"300", "400"}}, list(pipeline.AuditInput{From: start.Add(90 * time.Minute)}))
+	assert.Equal(t, [][]string{{"100", "200"}, {"300"}}, list(pipeline.AuditInput{To: start.Add(2 * time.Hour), Limit: 2}))
+}
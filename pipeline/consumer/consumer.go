@@ -5,8 +5,10 @@ import (
 	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/consumerenv"
 	"github.com/pkg/errors"
-	"time"
+	"strconv"
 )
 
 const (
@@ -15,8 +17,6 @@ const (
 	defaultRuntime   = "go1.x"
 	defaultHandler   = "consume"
 	defaultEnabled   = true
-
-	waitSecs = 20
 )
 
 // Identifier holds the consumer identifiers, the lambda function name and ARN.
@@ -34,63 +34,225 @@ type AddParams struct {
 	Timeout     int64  // function timeout in seconds
 	RoleArn     string // ARN of the Lambda execution role
 	QueueARN    string // ARN of the queue to consume
+
+	RatePerSecond  float64 // most tasks started per second, zero for no limit
+	RateLimitTable string  // DynamoDB table of the rate limit buckets, needed when there is a rate
 }
 
 // Add adds a new consumer to an existing queue.
-func Add(ctx context.Context, svc *lambda.Lambda, p AddParams) (Identifier, error) {
-	ident, err := createFunction(ctx, svc, p.Bucket, p.Key, p.Name, p.RoleArn, p.Timeout)
+// Add is made up of the CreateFunction, WaitTillActive, SetConcurrency and AttachQueue steps,
+// callers that need to resume a partially completed Add can call the steps individually.
+func Add(ctx context.Context, svc lambdaiface.LambdaAPI, p AddParams) (Identifier, error) {
+	ident, err := CreateFunction(ctx, svc, p)
 	if err != nil {
-		return Identifier{}, errors.Wrapf(err, "failed to create function %s", p.Name)
+		return Identifier{}, err
 	}
-	if err := waitTillActive(ctx, svc, p.Name, waitSecs); err != nil {
-		return Identifier{}, errors.Wrapf(err, "failed to wait for function %s to be active", p.Name)
+	if err := WaitTillActive(ctx, svc, p.Name); err != nil {
+		return Identifier{}, err
+	}
+	if err := SetConcurrency(ctx, svc, p.Name, p.Concurrency); err != nil {
+		return Identifier{}, err
 	}
-	if err := setConcurrency(ctx, svc, p.Name, p.Concurrency); err != nil {
-		return Identifier{}, errors.Wrapf(err, "failed to set function %s concurrency", p.Name)
+	if err := AttachQueue(ctx, svc, p.Name, p.QueueARN); err != nil {
+		return Identifier{}, err
 	}
-	if err := attachQueue(ctx, svc, p.Name, p.QueueARN); err != nil {
-		return Identifier{}, errors.Wrapf(err, "failed to attach consumer function %s to queue %s", p.Name, p.QueueARN)
+	return ident, nil
+}
+
+// CreateFunction creates the consumer function from the AddParams. The function is told to report
+// partial batch failures, which the event source mapping made by AttachQueue reads, and given its
+// rate limit.
+func CreateFunction(ctx context.Context, svc lambdaiface.LambdaAPI, p AddParams) (Identifier, error) {
+	ident, err := createFunction(ctx, svc, p)
+	if err != nil {
+		return Identifier{}, errors.Wrapf(err, "failed to create function %s", p.Name)
 	}
 	return ident, nil
 }
 
+// Get gets the Identifier of an existing consumer function.
+func Get(ctx context.Context, svc lambdaiface.LambdaAPI, name string) (Identifier, error) {
+	c, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(name),
+	})
+	if err != nil {
+		return Identifier{}, errors.Wrapf(err, "failed to get function %s", name)
+	}
+	return Identifier{*c.FunctionName, *c.FunctionArn}, nil
+}
+
+// WaitTillActive waits for a newly created consumer function to become active, with the default Waiter.
+func WaitTillActive(ctx context.Context, svc lambdaiface.LambdaAPI, name string) error {
+	return Waiter{}.WaitTillActive(ctx, svc, name)
+}
+
+// SetConcurrency sets the reserved concurrency of the consumer function.
+func SetConcurrency(ctx context.Context, svc lambdaiface.LambdaAPI, name string, concurrency int64) error {
+	if err := setConcurrency(ctx, svc, name, concurrency); err != nil {
+		return errors.Wrapf(err, "failed to set function %s concurrency", name)
+	}
+	return nil
+}
+
+// AttachQueue attaches the queue to the consumer function as its event source, with the function
+// reporting the failed messages of each batch rather than failing the whole batch.
+func AttachQueue(ctx context.Context, svc lambdaiface.LambdaAPI, name, queueArn string) error {
+	if err := attachQueue(ctx, svc, name, queueArn); err != nil {
+		return errors.Wrapf(err, "failed to attach consumer function %s to queue %s", name, queueArn)
+	}
+	return nil
+}
+
+// EnableBatchItemFailures makes a consumer created before partial batch failures were reported
+// report them, consumers created since are left as they are. The queue's mappings are updated to
+// read the failed messages before the function is told to report them, as a function reporting
+// them to a mapping which does not read them would have the failed messages deleted. The function
+// is waited on with the waiter before its environment is updated, the rest of it is kept.
+func EnableBatchItemFailures(ctx context.Context, svc lambdaiface.LambdaAPI, name, queueArn string, waiter Waiter) error {
+	c, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(name),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get function %s", name)
+	}
+	env := make(map[string]*string)
+	if c.Environment != nil {
+		for k, v := range c.Environment.Variables {
+			env[k] = v
+		}
+	}
+	if aws.StringValue(env[consumerenv.ReportBatchItemFailures]) == "true" {
+		return nil
+	}
+	out, err := svc.ListEventSourceMappingsWithContext(ctx, &lambda.ListEventSourceMappingsInput{
+		FunctionName:   aws.String(name),
+		EventSourceArn: aws.String(queueArn),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list event source mappings of function %s", name)
+	}
+	for _, m := range out.EventSourceMappings {
+		_, err := svc.UpdateEventSourceMappingWithContext(ctx, &lambda.UpdateEventSourceMappingInput{
+			UUID:                  m.UUID,
+			FunctionResponseTypes: aws.StringSlice([]string{lambda.FunctionResponseTypeReportBatchItemFailures}),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update event source mapping %s of function %s", aws.StringValue(m.UUID), name)
+		}
+	}
+	if err := waiter.WaitTillUpdatable(ctx, svc, name); err != nil {
+		return err
+	}
+	env[consumerenv.ReportBatchItemFailures] = aws.String("true")
+	_, err = svc.UpdateFunctionConfigurationWithContext(ctx, &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: aws.String(name),
+		Environment:  &lambda.Environment{Variables: env},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to update function %s environment", name)
+	}
+	return nil
+}
+
+// Settings are the configurable settings of a consumer function.
+type Settings struct {
+	Timeout       int64   // function timeout in seconds
+	Concurrency   *int64  // reserved concurrency, nil if the function has none reserved
+	RatePerSecond float64 // most tasks started per second, zero for no limit
+}
+
+// GetSettings gets the current settings of the consumer function.
+func GetSettings(ctx context.Context, svc lambdaiface.LambdaAPI, name string) (Settings, error) {
+	c, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(name),
+	})
+	if err != nil {
+		return Settings{}, errors.Wrapf(err, "failed to get function %s", name)
+	}
+	conc, err := svc.GetFunctionConcurrencyWithContext(ctx, &lambda.GetFunctionConcurrencyInput{
+		FunctionName: aws.String(name),
+	})
+	if err != nil {
+		return Settings{}, errors.Wrapf(err, "failed to get function %s concurrency", name)
+	}
+	settings := Settings{Timeout: aws.Int64Value(c.Timeout), Concurrency: conc.ReservedConcurrentExecutions}
+	if c.Environment != nil {
+		settings.RatePerSecond, _ = strconv.ParseFloat(aws.StringValue(c.Environment.Variables[consumerenv.RatePerSecond]), 64)
+	}
+	return settings, nil
+}
+
+// IsAttached reports whether the queue is attached to the consumer function as an event source.
+func IsAttached(ctx context.Context, svc lambdaiface.LambdaAPI, name, queueArn string) (bool, error) {
+	out, err := svc.ListEventSourceMappingsWithContext(ctx, &lambda.ListEventSourceMappingsInput{
+		FunctionName:   aws.String(name),
+		EventSourceArn: aws.String(queueArn),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to list event source mappings of function %s", name)
+	}
+	return len(out.EventSourceMappings) > 0, nil
+}
+
 // UpdateParams specify the configurations to update for a consumer.
 type UpdateParams struct {
-	Name        string // lambda function name
-	Concurrency *int64 // concurrency limit of the function (optional)
-	Timeout     *int64 // function timeout in seconds (optional)
+	Name              string // lambda function name
+	Concurrency       *int64 // concurrency limit of the function (optional)
+	RemoveConcurrency bool   // remove the reserved concurrency of the function, Concurrency is ignored
+	Timeout           *int64 // function timeout in seconds (optional)
+	Waiter            Waiter // waits for any update in progress before each change (optional)
+
+	RatePerSecond  *float64 // most tasks started per second, zero removes the limit (optional)
+	RateLimitTable string   // DynamoDB table of the rate limit buckets, set along with the rate
 }
 
-// Update updates the consumer with the provided UpdateParams
-func Update(ctx context.Context, svc *lambda.Lambda, p UpdateParams) error {
+// Update updates the consumer with the provided UpdateParams, waiting for any update in progress
+// to complete before each change. The timeout and rate limit are updated together, the rest of the
+// function's environment is kept.
+func Update(ctx context.Context, svc lambdaiface.LambdaAPI, p UpdateParams) error {
+	if err := p.Waiter.WaitTillUpdatable(ctx, svc, p.Name); err != nil {
+		return err
+	}
 	if err := updateConcurrency(ctx, svc, p); err != nil {
-		return errors.Wrapf(err, "failed to update consumer %s concurrency tp %s", p.Name, *p.Concurrency)
+		if p.RemoveConcurrency {
+			return errors.Wrapf(err, "failed to remove consumer %s concurrency", p.Name)
+		}
+		return errors.Wrapf(err, "failed to update consumer %s concurrency to %d", p.Name, *p.Concurrency)
 	}
-	if err := updateTimeout(ctx, svc, p); err != nil {
-		return errors.Wrapf(err, "failed to update consumer %s timeout tp %s seconds", p.Name, *p.Timeout)
+	if p.Timeout == nil && p.RatePerSecond == nil {
+		return nil
+	}
+	if err := p.Waiter.WaitTillUpdatable(ctx, svc, p.Name); err != nil {
+		return err
+	}
+	if err := updateConfiguration(ctx, svc, p); err != nil {
+		return errors.Wrapf(err, "failed to update consumer %s configuration", p.Name)
 	}
 	return nil
 }
 
 // Delete takes a function name and deletes it.
-func Delete(ctx context.Context, svc *lambda.Lambda, name string) error {
+func Delete(ctx context.Context, svc lambdaiface.LambdaAPI, name string) error {
 	if _, err := svc.DeleteFunctionWithContext(ctx, &lambda.DeleteFunctionInput{FunctionName: aws.String(name)}); err != nil {
 		return errors.Wrapf(err, "failed to delete function %s", name)
 	}
 	return nil
 }
 
-func createFunction(ctx context.Context, svc *lambda.Lambda, bucket, key, name, roleArn string, timeout int64) (Identifier, error) {
+func createFunction(ctx context.Context, svc lambdaiface.LambdaAPI, p AddParams) (Identifier, error) {
+	env := map[string]*string{consumerenv.ReportBatchItemFailures: aws.String("true")}
+	setRateLimit(env, p.RatePerSecond, p.RateLimitTable)
 	output, err := svc.CreateFunctionWithContext(ctx, &lambda.CreateFunctionInput{
 		Code: &lambda.FunctionCode{
-			S3Bucket: aws.String(bucket),
-			S3Key:    aws.String(key),
+			S3Bucket: aws.String(p.Bucket),
+			S3Key:    aws.String(p.Key),
 		},
-		FunctionName: aws.String(name),
+		FunctionName: aws.String(p.Name),
 		Handler:      aws.String(defaultHandler),
-		Role:         aws.String(roleArn),
+		Role:         aws.String(p.RoleArn),
 		Runtime:      aws.String(defaultRuntime),
-		Timeout:      aws.Int64(timeout),
+		Timeout:      aws.Int64(p.Timeout),
+		Environment:  &lambda.Environment{Variables: env},
 	})
 	if err != nil {
 		return Identifier{}, err
@@ -98,25 +260,7 @@ func createFunction(ctx context.Context, svc *lambda.Lambda, bucket, key, name,
 	return Identifier{*output.FunctionName, *output.FunctionArn}, nil
 }
 
-func waitTillActive(ctx context.Context, svc *lambda.Lambda, name string, waitSecs int) error {
-	var state string
-	for i := 0; i < waitSecs; i++ {
-		c, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
-			FunctionName: aws.String(name),
-		})
-		if err != nil {
-			return err
-		}
-		if *c.State == lambda.StateActive {
-			return nil
-		}
-		state = *c.State
-		time.Sleep(time.Second)
-	}
-	return errors.Errorf("function is %s after %v", state, waitSecs)
-}
-
-func setConcurrency(ctx context.Context, svc *lambda.Lambda, funcName string, concurrency int64) error {
+func setConcurrency(ctx context.Context, svc lambdaiface.LambdaAPI, funcName string, concurrency int64) error {
 	_, err := svc.PutFunctionConcurrencyWithContext(ctx, &lambda.PutFunctionConcurrencyInput{
 		FunctionName:                 aws.String(funcName),
 		ReservedConcurrentExecutions: aws.Int64(concurrency),
@@ -124,17 +268,24 @@ func setConcurrency(ctx context.Context, svc *lambda.Lambda, funcName string, co
 	return err
 }
 
-func attachQueue(ctx context.Context, svc *lambda.Lambda, funcName, queueArn string) error {
+func attachQueue(ctx context.Context, svc lambdaiface.LambdaAPI, funcName, queueArn string) error {
 	_, err := svc.CreateEventSourceMappingWithContext(ctx, &lambda.CreateEventSourceMappingInput{
-		BatchSize:      aws.Int64(defaultBatchSize),
-		Enabled:        aws.Bool(defaultEnabled),
-		EventSourceArn: aws.String(queueArn),
-		FunctionName:   aws.String(funcName),
+		BatchSize:             aws.Int64(defaultBatchSize),
+		Enabled:               aws.Bool(defaultEnabled),
+		EventSourceArn:        aws.String(queueArn),
+		FunctionName:          aws.String(funcName),
+		FunctionResponseTypes: aws.StringSlice([]string{lambda.FunctionResponseTypeReportBatchItemFailures}),
 	})
 	return err
 }
 
-func updateConcurrency(ctx context.Context, svc *lambda.Lambda, p UpdateParams) error {
+func updateConcurrency(ctx context.Context, svc lambdaiface.LambdaAPI, p UpdateParams) error {
+	if p.RemoveConcurrency {
+		_, err := svc.DeleteFunctionConcurrencyWithContext(ctx, &lambda.DeleteFunctionConcurrencyInput{
+			FunctionName: aws.String(p.Name),
+		})
+		return err
+	}
 	if p.Concurrency == nil {
 		return nil
 	}
@@ -145,13 +296,41 @@ func updateConcurrency(ctx context.Context, svc *lambda.Lambda, p UpdateParams)
 	return err
 }
 
-func updateTimeout(ctx context.Context, svc *lambda.Lambda, p UpdateParams) error {
-	if p.Timeout == nil {
-		return nil
-	}
-	_, err := svc.UpdateFunctionConfigurationWithContext(ctx, &lambda.UpdateFunctionConfigurationInput{
+// updateConfiguration updates the timeout and the rate limit, the environment is replaced as a
+// whole so the variables the rate limit does not own are read back first and kept.
+func updateConfiguration(ctx context.Context, svc lambdaiface.LambdaAPI, p UpdateParams) error {
+	in := &lambda.UpdateFunctionConfigurationInput{
 		FunctionName: aws.String(p.Name),
 		Timeout:      p.Timeout,
-	})
+	}
+	if p.RatePerSecond != nil {
+		c, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+			FunctionName: aws.String(p.Name),
+		})
+		if err != nil {
+			return err
+		}
+		env := make(map[string]*string)
+		if c.Environment != nil {
+			for k, v := range c.Environment.Variables {
+				env[k] = v
+			}
+		}
+		setRateLimit(env, *p.RatePerSecond, p.RateLimitTable)
+		in.Environment = &lambda.Environment{Variables: env}
+	}
+	_, err := svc.UpdateFunctionConfigurationWithContext(ctx, in)
 	return err
 }
+
+// setRateLimit sets the rate limit envars read by the taskrunner, a rate of zero removes them.
+func setRateLimit(env map[string]*string, perSecond float64, table string) {
+	if perSecond <= 0 {
+		delete(env, consumerenv.RatePerSecond)
+		return
+	}
+	env[consumerenv.RatePerSecond] = aws.String(strconv.FormatFloat(perSecond, 'f', -1, 64))
+	if table != "" {
+		env[consumerenv.RateLimitTable] = aws.String(table)
+	}
+}
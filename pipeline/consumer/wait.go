@@ -0,0 +1,107 @@
+package consumer
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Waiter defaults.
+const (
+	DefaultWaitTimeout  = 2 * time.Minute
+	DefaultWaitMinDelay = 250 * time.Millisecond
+	DefaultWaitMaxDelay = 5 * time.Second
+)
+
+// Waiter polls a consumer function until it is ready for what comes next, backing off between
+// polls. Waiting stops at the earlier of the Deadline and the context deadline, or when the context
+// is cancelled. The zero value uses the defaults.
+type Waiter struct {
+	Deadline time.Time     // when to give up, defaults to DefaultWaitTimeout from when waiting starts
+	MinDelay time.Duration // delay before the second poll, doubled after each poll
+	MaxDelay time.Duration // most to delay between polls
+}
+
+// WaitTillActive waits for the function to be Active with no update in progress, as a newly
+// created function must be before it is configured further.
+func (w Waiter) WaitTillActive(ctx context.Context, svc lambdaiface.LambdaAPI, name string) error {
+	err := w.wait(ctx, svc, name, func(c *lambda.FunctionConfiguration) bool {
+		return aws.StringValue(c.State) == lambda.StateActive && !updating(c)
+	})
+	return errors.Wrapf(err, "failed to wait for function %s to be active", name)
+}
+
+// WaitTillUpdatable waits for the function to have finished being created and for any update in
+// progress to complete, so that a new update is not rejected with a ResourceConflictException.
+// Inactive functions can be updated, so unlike WaitTillActive it does not wait for them.
+func (w Waiter) WaitTillUpdatable(ctx context.Context, svc lambdaiface.LambdaAPI, name string) error {
+	err := w.wait(ctx, svc, name, func(c *lambda.FunctionConfiguration) bool {
+		return aws.StringValue(c.State) != lambda.StatePending && !updating(c)
+	})
+	return errors.Wrapf(err, "failed to wait for function %s to be updatable", name)
+}
+
+// wait polls the function until it is ready, a Failed function is never ready.
+func (w Waiter) wait(ctx context.Context, svc lambdaiface.LambdaAPI, name string, ready func(c *lambda.FunctionConfiguration) bool) error {
+	w = w.withDefaults(time.Now())
+	ctx, cancel := context.WithDeadline(ctx, w.Deadline)
+	defer cancel()
+
+	delay := w.MinDelay
+	for polls := 1; ; polls++ {
+		c, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+			FunctionName: aws.String(name),
+		})
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(c.State) == lambda.StateFailed {
+			return errors.Errorf("function failed: %s", aws.StringValue(c.StateReason))
+		}
+		if ready(c) {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(ctx.Err(), "function is %s after %d polls", describe(c), polls)
+		case <-timer.C:
+		}
+		if delay *= 2; delay > w.MaxDelay {
+			delay = w.MaxDelay
+		}
+	}
+}
+
+func (w Waiter) withDefaults(now time.Time) Waiter {
+	if w.Deadline.IsZero() {
+		w.Deadline = now.Add(DefaultWaitTimeout)
+	}
+	if w.MinDelay <= 0 {
+		w.MinDelay = DefaultWaitMinDelay
+	}
+	if w.MaxDelay <= 0 {
+		w.MaxDelay = DefaultWaitMaxDelay
+	}
+	if w.MaxDelay < w.MinDelay {
+		w.MaxDelay = w.MinDelay
+	}
+	return w
+}
+
+// updating reports whether an update of the function is in progress.
+func updating(c *lambda.FunctionConfiguration) bool {
+	return aws.StringValue(c.LastUpdateStatus) == lambda.LastUpdateStatusInProgress
+}
+
+// describe returns the state of the function, and the status of its last update if it is in progress.
+func describe(c *lambda.FunctionConfiguration) string {
+	if updating(c) {
+		return aws.StringValue(c.State) + " with an update in progress"
+	}
+	return aws.StringValue(c.State)
+}
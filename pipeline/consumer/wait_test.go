@@ -0,0 +1,79 @@
+package consumer_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/kinluek/serverless-controlled-batch-processing/awsfake"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var fastWaiter = consumer.Waiter{MinDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func createFunction(t *testing.T, svc *awsfake.Lambda, name string) {
+	if _, err := consumer.CreateFunction(context.Background(), svc, consumer.AddParams{Name: name, Timeout: 3}); err != nil {
+		t.Fatalf("failed to create function: %v", err)
+	}
+}
+
+func TestWaitTillActive(t *testing.T) {
+	svc := awsfake.NewLambda()
+	svc.PendingPolls = 3
+	createFunction(t, svc, "fn")
+
+	assert.NoError(t, fastWaiter.WaitTillActive(context.Background(), svc, "fn"))
+	f, _ := svc.Function("fn")
+	assert.Equal(t, lambda.StateActive, f.State)
+}
+
+func TestWaitTillActiveStopsAtDeadline(t *testing.T) {
+	svc := awsfake.NewLambda()
+	svc.PendingPolls = 1000
+	createFunction(t, svc, "fn")
+
+	w := fastWaiter
+	w.Deadline = time.Now().Add(20 * time.Millisecond)
+	err := w.WaitTillActive(context.Background(), svc, "fn")
+	if assert.Error(t, err) {
+		assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+		assert.Contains(t, err.Error(), "function is Pending")
+	}
+}
+
+func TestWaitTillActiveStopsWhenCancelled(t *testing.T) {
+	svc := awsfake.NewLambda()
+	svc.PendingPolls = 1000
+	createFunction(t, svc, "fn")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := fastWaiter.WaitTillActive(ctx, svc, "fn")
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+}
+
+func TestUpdateWaitsForUpdateInProgress(t *testing.T) {
+	ctx := context.Background()
+	svc := awsfake.NewLambda()
+	svc.UpdatePolls = 3
+	createFunction(t, svc, "fn")
+
+	// updating the configuration directly while an update is in progress conflicts.
+	in := &lambda.UpdateFunctionConfigurationInput{FunctionName: aws.String("fn"), Timeout: aws.Int64(5)}
+	if _, err := svc.UpdateFunctionConfigurationWithContext(ctx, in); err != nil {
+		t.Fatalf("failed to update function: %v", err)
+	}
+	_, err := svc.UpdateFunctionConfigurationWithContext(ctx, in)
+	if aerr, ok := err.(interface{ Code() string }); assert.True(t, ok) {
+		assert.Equal(t, lambda.ErrCodeResourceConflictException, aerr.Code())
+	}
+
+	err = consumer.Update(ctx, svc, consumer.UpdateParams{Name: "fn", Concurrency: aws.Int64(2), Timeout: aws.Int64(10), Waiter: fastWaiter})
+	assert.NoError(t, err)
+	f, _ := svc.Function("fn")
+	assert.Equal(t, int64(10), f.Timeout)
+	assert.Equal(t, int64(2), aws.Int64Value(f.Concurrency))
+}
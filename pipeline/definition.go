@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+)
+
+// Definition is the declarative list of every profile and pipeline that should exist, as kept in
+// a pipelines.yaml file:
+//
+//	profiles:
+//	  - id: http-scraper
+//	    lambda_timeout_secs: 10
+//	    sqs_visibility_timeout_secs: 30
+//	pipelines:
+//	  - id: group-a
+//	    profile: http-scraper
+//	    concurrency_limit: 2
+//
+// Settings left out of a pipeline are taken from its profile, or take their defaults, see Config.
+type Definition struct {
+	Profiles  []Profile `yaml:"profiles"`
+	Pipelines []Config  `yaml:"pipelines"`
+}
+
+// ParseDefinition reads a YAML Definition and validates every Config in it, unknown fields and
+// duplicate IDs are rejected.
+func ParseDefinition(r io.Reader) (Definition, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Definition{}, errors.Wrap(err, "failed to read definition")
+	}
+	var def Definition
+	if err := yaml.UnmarshalStrict(data, &def); err != nil {
+		return Definition{}, errors.Wrap(err, "failed to parse definition")
+	}
+	if err := def.Validate(); err != nil {
+		return Definition{}, err
+	}
+	return def, nil
+}
+
+// Validate validates every Config, resolved against its Profile, and checks the IDs are unique and
+// the referenced Profiles are defined.
+func (d Definition) Validate() error {
+	profiles := make(map[string]Profile)
+	for _, p := range d.Profiles {
+		if p.ID == "" {
+			return errors.New("invalid definition: profile missing id")
+		}
+		if _, ok := profiles[p.ID]; ok {
+			return errors.Errorf("invalid definition: duplicate profile %s", p.ID)
+		}
+		profiles[p.ID] = p
+	}
+	seen := make(map[string]bool)
+	for _, c := range d.Pipelines {
+		profile, ok := profiles[c.Profile]
+		if c.Profile != "" && !ok {
+			return errors.Errorf("invalid config %s: unknown profile %s", c.ID, c.Profile)
+		}
+		if err := c.Resolve(profile).Validate(); err != nil {
+			return err
+		}
+		if seen[c.ID] {
+			return errors.Errorf("invalid definition: duplicate pipeline %s", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
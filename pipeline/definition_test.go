@@ -0,0 +1,76 @@
+package pipeline_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseDefinition(t *testing.T) {
+	def, err := pipeline.ParseDefinition(strings.NewReader(`
+pipelines:
+  - id: group-a
+    concurrency_limit: 2
+    lambda_timeout_secs: 10
+    sqs_visibility_timeout_secs: 30
+`))
+	if err != nil {
+		t.Fatalf("failed to parse definition: %v", err)
+	}
+	assert.Equal(t, []pipeline.Config{
+		{ID: "group-a", LambdaConcurrencyLimit: aws.Int(2), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 30},
+	}, def.Pipelines)
+}
+
+func TestParseDefinitionWithProfiles(t *testing.T) {
+	def, err := pipeline.ParseDefinition(strings.NewReader(`
+profiles:
+  - id: slow
+    lambda_timeout_secs: 60
+    sqs_visibility_timeout_secs: 120
+pipelines:
+  - id: group-a
+    profile: slow
+    concurrency_limit: 2
+  - id: group-b
+    profile: slow
+    sqs_visibility_timeout_secs: 90
+`))
+	if err != nil {
+		t.Fatalf("failed to parse definition: %v", err)
+	}
+	assert.Equal(t, pipeline.Config{ID: "group-b", LambdaTimeoutSes: 60, SQSVisibilityTimeoutSecs: 90, Profile: "slow"},
+		def.Pipelines[1].Resolve(def.Profiles[0]))
+}
+
+func TestParseDefinitionInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"unknown field", "pipelines:\n  - id: a\n    concurrency: 2\n"},
+		{"missing id", "pipelines:\n  - lambda_timeout_secs: 10\n    sqs_visibility_timeout_secs: 30\n"},
+		{"visibility below timeout", "pipelines:\n  - id: a\n    lambda_timeout_secs: 10\n    sqs_visibility_timeout_secs: 5\n"},
+		{"invalid notify target", "pipelines:\n  - {id: a, notify: 'mailto:team@example.com'}\n"},
+		{"notify webhook without host", "pipelines:\n  - {id: a, notify: 'https://'}\n"},
+		{"unknown profile", "pipelines:\n  - {id: a, profile: missing}\n"},
+		{"profile visibility below config timeout", "profiles:\n  - {id: p, sqs_visibility_timeout_secs: 30}\npipelines:\n  - {id: a, profile: p, lambda_timeout_secs: 60}\n"},
+		{"concurrency limit with target rate", "pipelines:\n  - {id: a, concurrency_limit: 2, target_rate_per_second: 5}\n"},
+		{"concurrency bounds without target rate", "pipelines:\n  - {id: a, max_concurrency: 5}\n"},
+		{"concurrency bounds out of order", "pipelines:\n  - {id: a, target_rate_per_second: 5, min_concurrency: 10, max_concurrency: 5}\n"},
+		{"adaptive without concurrency limit", "pipelines:\n  - {id: a, adaptive_concurrency: true}\n"},
+		{"adaptive with target rate", "pipelines:\n  - {id: a, concurrency_limit: 5, adaptive_concurrency: true, target_rate_per_second: 5}\n"},
+		{"adaptive with max concurrency", "pipelines:\n  - {id: a, concurrency_limit: 5, adaptive_concurrency: true, max_concurrency: 4}\n"},
+		{"adaptive min above limit", "pipelines:\n  - {id: a, concurrency_limit: 5, adaptive_concurrency: true, min_concurrency: 6}\n"},
+		{"duplicate profile", "profiles:\n  - {id: p}\n  - {id: p}\npipelines: []\n"},
+		{"duplicate id", "pipelines:\n  - {id: a, lambda_timeout_secs: 1, sqs_visibility_timeout_secs: 1}\n  - {id: a, lambda_timeout_secs: 1, sqs_visibility_timeout_secs: 1}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pipeline.ParseDefinition(strings.NewReader(tt.yaml))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Tables holds the names of the DynamoDB tables backing a DynamoStore. Tables that a caller does
+// not use can be left empty.
+type Tables struct {
+	Configs     string
+	Profiles    string
+	Identifiers string
+	Statuses    string
+	Journal     string
+	History     string
+	Audit       string
+	Events      string
+}
+
+var _ Store = (*DynamoStore)(nil)
+
+// ConfigsProfileIndex is the name of the configs table's global secondary index keyed by the
+// profile attribute, configs without a profile are left out of it.
+const ConfigsProfileIndex = "profile-index"
+
+// DynamoStore is a Store backed by DynamoDB tables.
+type DynamoStore struct {
+	db     dynamodbiface.DynamoDBAPI
+	tables Tables
+}
+
+// NewDynamoStore returns a new instance of DynamoStore.
+func NewDynamoStore(db dynamodbiface.DynamoDBAPI, tables Tables) *DynamoStore {
+	return &DynamoStore{db: db, tables: tables}
+}
+
+// GetConfig gets a Config from the configs table.
+func (s *DynamoStore) GetConfig(ctx context.Context, id string) (Config, error) {
+	var config Config
+	err := s.getItem(ctx, s.tables.Configs, makeKey(id), &config)
+	return config, errors.Wrapf(err, "failed to get config %s", id)
+}
+
+// ListConfigs lists a page of Configs from the configs table.
+func (s *DynamoStore) ListConfigs(ctx context.Context, in ListInput) (ConfigPage, error) {
+	var page ConfigPage
+	next, err := s.scanPage(ctx, s.tables.Configs, in, &page.Configs)
+	page.NextCursor = next
+	return page, errors.Wrap(err, "failed to list configs")
+}
+
+// ListConfigsByProfile lists a page of the Configs referencing the Profile from the configs table's
+// ConfigsProfileIndex, rather than scanning the whole table. The cursor is the ID of the last
+// Config of the previous page.
+func (s *DynamoStore) ListConfigsByProfile(ctx context.Context, profile string, in ListInput) (ConfigPage, error) {
+	query := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tables.Configs),
+		IndexName:                 aws.String(ConfigsProfileIndex),
+		KeyConditionExpression:    aws.String("#profile = :profile"),
+		ExpressionAttributeNames:  map[string]*string{"#profile": aws.String("profile")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":profile": {S: aws.String(profile)}},
+		Limit:                     aws.Int64(int64(listLimit(in))),
+	}
+	if in.Cursor != "" {
+		query.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"id":      {S: aws.String(in.Cursor)},
+			"profile": {S: aws.String(profile)},
+		}
+	}
+	var page ConfigPage
+	res, err := s.db.QueryWithContext(ctx, query)
+	if err != nil {
+		return page, errors.Wrapf(err, "failed to list configs of profile %s", profile)
+	}
+	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, &page.Configs); err != nil {
+		return page, errors.Wrapf(err, "failed to unmarshal configs of profile %s", profile)
+	}
+	if id, ok := res.LastEvaluatedKey["id"]; ok && id.S != nil {
+		page.NextCursor = *id.S
+	}
+	return page, nil
+}
+
+// PutConfig puts a Config into the configs table.
+func (s *DynamoStore) PutConfig(ctx context.Context, config Config) error {
+	err := s.putItem(ctx, s.tables.Configs, config, nil)
+	return errors.Wrapf(err, "failed to put config %s", config.ID)
+}
+
+// PutConfigIfVersion puts a Config into the configs table as long as the stored Config is still
+// at the version the caller last read, a version of 0 means the Config is expected to be new.
+// The Config is written with its version incremented and the written Config is returned.
+func (s *DynamoStore) PutConfigIfVersion(ctx context.Context, config Config) (Config, error) {
+	expected := config.Version
+	config.Version++
+	if err := s.putItem(ctx, s.tables.Configs, config, versionEquals(expected)); err != nil {
+		return Config{}, conditionalErr(err, s.tables.Configs, config.ID, expected)
+	}
+	return config, nil
+}
+
+// DeleteConfig deletes a Config from the configs table.
+func (s *DynamoStore) DeleteConfig(ctx context.Context, id string) error {
+	err := s.deleteItem(ctx, s.tables.Configs, makeKey(id), nil)
+	return errors.Wrapf(err, "failed to delete config %s", id)
+}
+
+// DeleteConfigIfVersion deletes a Config from the configs table as long as the stored Config is
+// still at the given version.
+func (s *DynamoStore) DeleteConfigIfVersion(ctx context.Context, id string, version int64) error {
+	if err := s.deleteItem(ctx, s.tables.Configs, makeKey(id), versionEquals(version)); err != nil {
+		return conditionalErr(err, s.tables.Configs, id, version)
+	}
+	return nil
+}
+
+// GetProfile gets a Profile from the profiles table.
+func (s *DynamoStore) GetProfile(ctx context.Context, id string) (Profile, error) {
+	var profile Profile
+	err := s.getItem(ctx, s.tables.Profiles, makeKey(id), &profile)
+	return profile, errors.Wrapf(err, "failed to get profile %s", id)
+}
+
+// ListProfiles lists a page of Profiles from the profiles table.
+func (s *DynamoStore) ListProfiles(ctx context.Context, in ListInput) (ProfilePage, error) {
+	var page ProfilePage
+	next, err := s.scanPage(ctx, s.tables.Profiles, in, &page.Profiles)
+	page.NextCursor = next
+	return page, errors.Wrap(err, "failed to list profiles")
+}
+
+// PutProfileIfVersion puts a Profile into the profiles table as long as the stored Profile is
+// still at the version the caller last read, see PutConfigIfVersion.
+func (s *DynamoStore) PutProfileIfVersion(ctx context.Context, profile Profile) (Profile, error) {
+	expected := profile.Version
+	profile.Version++
+	if err := s.putItem(ctx, s.tables.Profiles, profile, versionEquals(expected)); err != nil {
+		return Profile{}, conditionalErr(err, s.tables.Profiles, profile.ID, expected)
+	}
+	return profile, nil
+}
+
+// DeleteProfileIfVersion deletes a Profile from the profiles table as long as the stored Profile
+// is still at the given version.
+func (s *DynamoStore) DeleteProfileIfVersion(ctx context.Context, id string, version int64) error {
+	if err := s.deleteItem(ctx, s.tables.Profiles, makeKey(id), versionEquals(version)); err != nil {
+		return conditionalErr(err, s.tables.Profiles, id, version)
+	}
+	return nil
+}
+
+// identifierItem is an item of the identifiers table, either an Identifier or, when DeletedBy is
+// set, a Tombstone.
+type identifierItem struct {
+	Identifier
+	DeletedBy string `dynamodbav:"deleted_by,omitempty"`
+}
+
+// GetIdentifier gets an Identifier from the identifiers table, a Tombstone is not found.
+func (s *DynamoStore) GetIdentifier(ctx context.Context, id string) (Identifier, error) {
+	var item identifierItem
+	err := s.getItem(ctx, s.tables.Identifiers, makeKey(id), &item)
+	if err == nil && item.DeletedBy != "" {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return Identifier{}, errors.Wrapf(err, "failed to get identifier %s", id)
+	}
+	return item.Identifier, nil
+}
+
+// ListIdentifiers lists a page of Identifiers from the identifiers table, Tombstones are left out
+// so a page may be short of the limit.
+func (s *DynamoStore) ListIdentifiers(ctx context.Context, in ListInput) (IdentifierPage, error) {
+	var items []identifierItem
+	next, err := s.scanPage(ctx, s.tables.Identifiers, in, &items)
+	if err != nil {
+		return IdentifierPage{}, errors.Wrap(err, "failed to list identifiers")
+	}
+	page := IdentifierPage{NextCursor: next}
+	for _, item := range items {
+		if item.DeletedBy == "" {
+			page.Identifiers = append(page.Identifiers, item.Identifier)
+		}
+	}
+	return page, nil
+}
+
+// PutIdentifier puts an Identifier into the identifiers table.
+func (s *DynamoStore) PutIdentifier(ctx context.Context, ident Identifier) error {
+	err := s.putItem(ctx, s.tables.Identifiers, ident, nil)
+	return errors.Wrapf(err, "failed to put identifier %s", ident.ID)
+}
+
+// PutIdentifierIfNotStale puts an Identifier into the identifiers table unless the stored
+// Identifier was written for a newer Config version, so that delayed or retried stream records
+// can not overwrite the identifiers of newer resources. A Tombstone is replaced whatever its
+// version, as a pipeline added again starts from version 1.
+func (s *DynamoStore) PutIdentifierIfNotStale(ctx context.Context, ident Identifier) error {
+	cond := versionNotNewer(ident.Version)
+	cond.expression += " OR attribute_exists(#deleted_by)"
+	cond.names["#deleted_by"] = aws.String(attrNameDeletedBy)
+	if err := s.putItem(ctx, s.tables.Identifiers, ident, cond); err != nil {
+		return conditionalErr(err, s.tables.Identifiers, ident.ID, ident.Version)
+	}
+	return nil
+}
+
+// DeleteIdentifier deletes an Identifier from the identifiers table.
+func (s *DynamoStore) DeleteIdentifier(ctx context.Context, id string) error {
+	err := s.deleteItem(ctx, s.tables.Identifiers, makeKey(id), nil)
+	return errors.Wrapf(err, "failed to delete identifier %s", id)
+}
+
+// DeleteIdentifierIfNotStale replaces an Identifier in the identifiers table with the Tombstone
+// unless the stored Identifier was written for a Config version newer than the Tombstone's.
+func (s *DynamoStore) DeleteIdentifierIfNotStale(ctx context.Context, tombstone Tombstone) error {
+	if err := s.putItem(ctx, s.tables.Identifiers, tombstone, versionNotNewer(tombstone.Version)); err != nil {
+		return conditionalErr(err, s.tables.Identifiers, tombstone.ID, tombstone.Version)
+	}
+	return nil
+}
+
+// GetTombstone gets the Tombstone of a removed pipeline from the identifiers table, an Identifier
+// is not found.
+func (s *DynamoStore) GetTombstone(ctx context.Context, id string) (Tombstone, error) {
+	var tombstone Tombstone
+	err := s.getItem(ctx, s.tables.Identifiers, makeKey(id), &tombstone)
+	if err == nil && tombstone.SequenceNumber == "" {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return Tombstone{}, errors.Wrapf(err, "failed to get tombstone %s", id)
+	}
+	return tombstone, nil
+}
+
+// GetStatus gets a Status from the statuses table.
+func (s *DynamoStore) GetStatus(ctx context.Context, id string) (Status, error) {
+	var status Status
+	err := s.getItem(ctx, s.tables.Statuses, makeKey(id), &status)
+	return status, errors.Wrapf(err, "failed to get status %s", id)
+}
+
+// ListStatuses lists a page of Statuses from the statuses table.
+func (s *DynamoStore) ListStatuses(ctx context.Context, in ListInput) (StatusPage, error) {
+	var page StatusPage
+	next, err := s.scanPage(ctx, s.tables.Statuses, in, &page.Statuses)
+	page.NextCursor = next
+	return page, errors.Wrap(err, "failed to list statuses")
+}
+
+// PutStatus puts a Status into the statuses table.
+func (s *DynamoStore) PutStatus(ctx context.Context, status Status) error {
+	err := s.putItem(ctx, s.tables.Statuses, status, nil)
+	return errors.Wrapf(err, "failed to put status %s", status.ID)
+}
+
+// PutStatusIfUnchanged puts a Status into the statuses table as long as the stored Status is still
+// in the state, at the config version and last updated at the time of the given one, so that a
+// Status read before a slow change is not written back over one the manager recorded since.
+func (s *DynamoStore) PutStatusIfUnchanged(ctx context.Context, status Status) error {
+	if err := s.putItem(ctx, s.tables.Statuses, status, statusUnchanged(status)); err != nil {
+		return conditionalErr(err, s.tables.Statuses, status.ID, status.ConfigVersion)
+	}
+	return nil
+}
+
+// DeleteStatus deletes a Status from the statuses table.
+func (s *DynamoStore) DeleteStatus(ctx context.Context, id string) error {
+	err := s.deleteItem(ctx, s.tables.Statuses, makeKey(id), nil)
+	return errors.Wrapf(err, "failed to delete status %s", id)
+}
+
+// GetJournal gets the Journal for the pipeline operation started by the stream record with the
+// given sequence number from the journal table.
+func (s *DynamoStore) GetJournal(ctx context.Context, id, sequenceNumber string) (Journal, error) {
+	var journal Journal
+	key := map[string]*dynamodb.AttributeValue{
+		"id":              {S: aws.String(id)},
+		"sequence_number": {S: aws.String(sequenceNumber)},
+	}
+	err := s.getItem(ctx, s.tables.Journal, key, &journal)
+	return journal, errors.Wrapf(err, "failed to get journal %s/%s", id, sequenceNumber)
+}
+
+// PutJournal puts a Journal into the journal table.
+func (s *DynamoStore) PutJournal(ctx context.Context, journal Journal) error {
+	err := s.putItem(ctx, s.tables.Journal, journal, nil)
+	return errors.Wrapf(err, "failed to put journal %s/%s", journal.ID, journal.SequenceNumber)
+}
+
+// ListHistory lists a page of a pipeline's HistoryEntries from the history table, newest first.
+// The cursor is the position of the last entry of the previous page.
+func (s *DynamoStore) ListHistory(ctx context.Context, id string, in ListInput) (HistoryPage, error) {
+	query := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tables.History),
+		KeyConditionExpression:    aws.String("#id = :id"),
+		ExpressionAttributeNames:  map[string]*string{"#id": aws.String("id")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":id": {S: aws.String(id)}},
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int64(int64(listLimit(in))),
+		ConsistentRead:            aws.Bool(true),
+	}
+	if in.Cursor != "" {
+		query.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String(id)},
+			"position": {S: aws.String(in.Cursor)},
+		}
+	}
+	var page HistoryPage
+	res, err := s.db.QueryWithContext(ctx, query)
+	if err != nil {
+		return page, errors.Wrapf(err, "failed to list history of %s", id)
+	}
+	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, &page.Entries); err != nil {
+		return page, errors.Wrapf(err, "failed to unmarshal history of %s", id)
+	}
+	if pos, ok := res.LastEvaluatedKey["position"]; ok && pos.S != nil {
+		page.NextCursor = *pos.S
+	}
+	return page, nil
+}
+
+// PutHistory puts a HistoryEntry into the history table.
+func (s *DynamoStore) PutHistory(ctx context.Context, entry HistoryEntry) error {
+	err := s.putItem(ctx, s.tables.History, entry, nil)
+	return errors.Wrapf(err, "failed to put history %s/%s", entry.ID, entry.SequenceNumber)
+}
+
+// ListAudit lists a page of a pipeline's AuditRecords in the input's time range from the audit
+// table, oldest first. The cursor is the key of the last record of the previous page.
+func (s *DynamoStore) ListAudit(ctx context.Context, id string, in AuditInput) (AuditPage, error) {
+	from, to := auditRange(in)
+	query := &dynamodb.QueryInput{
+		TableName:                aws.String(s.tables.Audit),
+		KeyConditionExpression:   aws.String("#id = :id AND #key BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("id"), "#key": aws.String("key")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":   {S: aws.String(id)},
+			":from": {S: aws.String(from)},
+			":to":   {S: aws.String(to)},
+		},
+		Limit:          aws.Int64(int64(listLimit(ListInput{Limit: in.Limit}))),
+		ConsistentRead: aws.Bool(true),
+	}
+	if in.Cursor != "" {
+		query.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"id":  {S: aws.String(id)},
+			"key": {S: aws.String(in.Cursor)},
+		}
+	}
+	var page AuditPage
+	res, err := s.db.QueryWithContext(ctx, query)
+	if err != nil {
+		return page, errors.Wrapf(err, "failed to list audit records of %s", id)
+	}
+	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, &page.Records); err != nil {
+		return page, errors.Wrapf(err, "failed to unmarshal audit records of %s", id)
+	}
+	if key, ok := res.LastEvaluatedKey["key"]; ok && key.S != nil {
+		page.NextCursor = *key.S
+	}
+	return page, nil
+}
+
+// PutAudit puts an AuditRecord into the audit table.
+func (s *DynamoStore) PutAudit(ctx context.Context, record AuditRecord) error {
+	err := s.putItem(ctx, s.tables.Audit, record, nil)
+	return errors.Wrapf(err, "failed to put audit record %s/%s", record.ID, record.Key)
+}
+
+// GetEvent gets a ProcessedEvent from the events table.
+func (s *DynamoStore) GetEvent(ctx context.Context, id string) (ProcessedEvent, error) {
+	var event ProcessedEvent
+	err := s.getItem(ctx, s.tables.Events, makeKey(id), &event)
+	return event, errors.Wrapf(err, "failed to get event %s", id)
+}
+
+// ClaimEvent puts a ProcessedEvent into the events table as long as the event has not been
+// claimed yet, or its claim is still in progress with a lease which ran out before now. A
+// *ConflictError is returned when the event is done or claimed by someone else.
+func (s *DynamoStore) ClaimEvent(ctx context.Context, event ProcessedEvent, now time.Time) error {
+	if err := s.putItem(ctx, s.tables.Events, event, claimable(now)); err != nil {
+		return conditionalErr(err, s.tables.Events, event.ID, 0)
+	}
+	return nil
+}
+
+// PutEvent puts a ProcessedEvent into the events table.
+func (s *DynamoStore) PutEvent(ctx context.Context, event ProcessedEvent) error {
+	err := s.putItem(ctx, s.tables.Events, event, nil)
+	return errors.Wrapf(err, "failed to put event %s", event.ID)
+}
+
+// DeleteEvent deletes a ProcessedEvent from the events table.
+func (s *DynamoStore) DeleteEvent(ctx context.Context, id string) error {
+	err := s.deleteItem(ctx, s.tables.Events, makeKey(id), nil)
+	return errors.Wrapf(err, "failed to delete event %s", id)
+}
+
+// condition is a condition expression along with its attribute names and values.
+type condition struct {
+	expression string
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+}
+
+func (s *DynamoStore) getItem(ctx context.Context, tableName string, key map[string]*dynamodb.AttributeValue, out interface{}) error {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            key,
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get item from %s", tableName)
+	}
+	if res.Item == nil {
+		return ErrNotFound
+	}
+	if err := dynamodbattribute.UnmarshalMap(res.Item, out); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal item from %s", tableName)
+	}
+	return nil
+}
+
+func (s *DynamoStore) putItem(ctx context.Context, tableName string, item interface{}, cond *condition) error {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item")
+	}
+	in := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(tableName),
+	}
+	if cond != nil {
+		in.ConditionExpression = aws.String(cond.expression)
+		in.ExpressionAttributeNames = cond.names
+		in.ExpressionAttributeValues = cond.values
+	}
+	_, err = s.db.PutItemWithContext(ctx, in)
+	return err
+}
+
+func (s *DynamoStore) deleteItem(ctx context.Context, tableName string, key map[string]*dynamodb.AttributeValue, cond *condition) error {
+	in := &dynamodb.DeleteItemInput{
+		Key:       key,
+		TableName: aws.String(tableName),
+	}
+	if cond != nil {
+		in.ConditionExpression = aws.String(cond.expression)
+		in.ExpressionAttributeNames = cond.names
+		in.ExpressionAttributeValues = cond.values
+	}
+	_, err := s.db.DeleteItemWithContext(ctx, in)
+	return err
+}
+
+// scanPage scans a page of items keyed by "id" into out, which must be a pointer to a slice.
+// The returned cursor is the ID of the last item evaluated, or empty when the scan is complete.
+func (s *DynamoStore) scanPage(ctx context.Context, tableName string, in ListInput, out interface{}) (string, error) {
+	scan := &dynamodb.ScanInput{
+		TableName:      aws.String(tableName),
+		Limit:          aws.Int64(int64(listLimit(in))),
+		ConsistentRead: aws.Bool(true),
+	}
+	if in.Cursor != "" {
+		scan.ExclusiveStartKey = makeKey(in.Cursor)
+	}
+	res, err := s.db.ScanWithContext(ctx, scan)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to scan %s", tableName)
+	}
+	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, out); err != nil {
+		return "", errors.Wrapf(err, "failed to unmarshal items from %s", tableName)
+	}
+	if id, ok := res.LastEvaluatedKey["id"]; ok && id.S != nil {
+		return *id.S, nil
+	}
+	return "", nil
+}
+
+func makeKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(id)},
+	}
+}
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"strconv"
+	"time"
+)
+
+// EventTTL is how long a ProcessedEvent is kept for after it was last written, a week is well
+// beyond the stream's 24 hour retention, after which Lambda stops retrying a stream record, so an
+// event is never forgotten while its record can still be redelivered.
+const EventTTL = 7 * 24 * time.Hour
+
+// Event states.
+const (
+	EventInProgress = "IN_PROGRESS"
+	EventDone       = "DONE"
+)
+
+// ProcessedEvent records the handling of a stream event, so that a redelivered event can be told
+// apart from a new one. An event is claimed IN_PROGRESS for the length of a lease before it is
+// handled and marked DONE once handled, a claim whose lease ran out was left by an invocation that
+// died and can be taken over.
+type ProcessedEvent struct {
+	ID             string    `json:"id"               dynamodbav:"id"` // stream event ID
+	SequenceNumber string    `json:"sequence_number"  dynamodbav:"sequence_number"`
+	PipelineID     string    `json:"pipeline_id"      dynamodbav:"pipeline_id"`
+	State          string    `json:"state"            dynamodbav:"state"`
+	LeaseExpiresAt int64     `json:"lease_expires_at" dynamodbav:"lease_expires_at"` // unix seconds, only meaningful IN_PROGRESS
+	UpdatedAt      time.Time `json:"updated_at"       dynamodbav:"updated_at"`
+	ExpiresAt      int64     `json:"expires_at"       dynamodbav:"expires_at"` // unix seconds, used as the table TTL attribute
+}
+
+// Touch sets the time the event was written at, and from it when the item expires.
+func (e *ProcessedEvent) Touch(at time.Time) {
+	e.UpdatedAt = at
+	e.ExpiresAt = at.Add(EventTTL).Unix()
+}
+
+// claimable returns a condition which matches a missing event, or an event still in progress
+// whose lease ran out before the given time.
+func claimable(now time.Time) *condition {
+	return &condition{
+		expression: "attribute_not_exists(#id) OR (#state = :inProgress AND #lease < :now)",
+		names: map[string]*string{
+			"#id":    aws.String("id"),
+			"#state": aws.String("state"),
+			"#lease": aws.String("lease_expires_at"),
+		},
+		values: map[string]*dynamodb.AttributeValue{
+			":inProgress": {S: aws.String(EventInProgress)},
+			":now":        {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	}
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// positionWidth is the width sequence numbers are padded to, DynamoDB stream sequence numbers are
+// at most 40 digits long.
+const positionWidth = 40
+
+// positionTimeLayout formats the change time at a fixed width, so positions sort in time order.
+const positionTimeLayout = "20060102T150405.000000000Z"
+
+// HistoryEntry records a Config version applied by the pipeline manager, there is one entry per
+// pipeline ID and stream record. Entries are ordered by the time the change was made, then by the
+// Config version. Sequence numbers can not order them, as profile re-applies come from the profiles
+// stream whose sequence numbers do not compare with the configs stream's, and the version alone can
+// not either, as versions restart from 1 when a pipeline is deleted and added again.
+type HistoryEntry struct {
+	ID             string    `json:"id"                   dynamodbav:"id"`
+	Position       string    `json:"position"             dynamodbav:"position"` // change time, version and sequence number, so entries sort in the order they were made
+	SequenceNumber string    `json:"sequence_number"      dynamodbav:"sequence_number"`
+	Config         Config    `json:"config"               dynamodbav:"config"` // the Config as applied, with its profile resolved, for display
+	Item           Config    `json:"item"                 dynamodbav:"item"`   // the Config item as written, with the profile unresolved, which a rollback restores
+	ChangedAt      time.Time `json:"changed_at"           dynamodbav:"changed_at"`
+	AppliedAt      time.Time `json:"applied_at"           dynamodbav:"applied_at"`
+	ChangedBy      string    `json:"changed_by,omitempty" dynamodbav:"changed_by,omitempty"`
+	Deleted        bool      `json:"deleted,omitempty"    dynamodbav:"deleted,omitempty"` // the pipeline was removed, Config is the removed Config
+}
+
+// NewHistoryEntry returns the entry recording that the Config item was applied as the resolved
+// Config, or removed, at the given time by the stream record with the given sequence number and
+// change time. A retried record makes an entry at the same position, which replaces the first.
+func NewHistoryEntry(item, config Config, sequenceNumber string, changedAt, appliedAt time.Time, deleted bool) HistoryEntry {
+	return HistoryEntry{
+		ID:             config.ID,
+		Position:       historyPosition(changedAt, config.Version, sequenceNumber),
+		SequenceNumber: sequenceNumber,
+		Config:         config,
+		Item:           item,
+		ChangedAt:      changedAt,
+		AppliedAt:      appliedAt,
+		ChangedBy:      config.ChangedBy,
+		Deleted:        deleted,
+	}
+}
+
+func historyPosition(changedAt time.Time, version int64, sequenceNumber string) string {
+	if len(sequenceNumber) < positionWidth {
+		sequenceNumber = strings.Repeat("0", positionWidth-len(sequenceNumber)) + sequenceNumber
+	}
+	return fmt.Sprintf("%s/%020d/%s", changedAt.UTC().Format(positionTimeLayout), version, sequenceNumber)
+}
+
+// FindHistory returns the most recent entry which applied the given version of the pipeline's
+// Config, entries for removals are skipped. It returns ErrNotFound when there is no such entry.
+func FindHistory(ctx context.Context, store HistoryStore, id string, version int64) (HistoryEntry, error) {
+	in := ListInput{}
+	for {
+		page, err := store.ListHistory(ctx, id, in)
+		if err != nil {
+			return HistoryEntry{}, err
+		}
+		for _, entry := range page.Entries {
+			if !entry.Deleted && entry.Config.Version == version {
+				return entry, nil
+			}
+		}
+		if page.NextCursor == "" {
+			return HistoryEntry{}, errors.Wrapf(ErrNotFound, "version %d of pipeline %s is not in the history", version, id)
+		}
+		in.Cursor = page.NextCursor
+	}
+}
+
+// RollbackStore is the Store a Rollback reads the history from and rewrites the Config item in.
+type RollbackStore interface {
+	ConfigStore
+	HistoryStore
+}
+
+// Rollback rewrites the pipeline's Config item with the item of the given version from its history,
+// so a config referencing a profile goes back to referencing it rather than to the values it was
+// resolved to. The pipeline manager then applies it like any other update, or as an add when the
+// pipeline has since been removed. The write is conditioned on the Config read, so a concurrent
+// change is not overwritten. The written Config is returned, with a new version.
+func Rollback(ctx context.Context, store RollbackStore, id string, version int64, changedBy string) (Config, error) {
+	entry, err := FindHistory(ctx, store, id, version)
+	if err != nil {
+		return Config{}, errors.Wrapf(err, "failed to roll back pipeline %s", id)
+	}
+	current, err := store.GetConfig(ctx, id)
+	if err != nil && !IsNotFound(err) {
+		return Config{}, errors.Wrapf(err, "failed to roll back pipeline %s", id)
+	}
+	config := entry.Item
+	config.Version = current.Version
+	config.ChangedBy = changedBy
+	written, err := store.PutConfigIfVersion(ctx, config)
+	if err != nil {
+		return Config{}, errors.Wrapf(err, "failed to roll back pipeline %s", id)
+	}
+	return written, nil
+}
+
+// String returns a one line summary of the entry's settings.
+func (e HistoryEntry) String() string {
+	if e.Deleted {
+		return "deleted"
+	}
+	c := e.Config
+	concurrency := "unreserved"
+	if c.LambdaConcurrencyLimit != nil {
+		concurrency = fmt.Sprint(*c.LambdaConcurrencyLimit)
+	}
+	if c.Tuned() {
+		d := c.WithDefaults()
+		concurrency = fmt.Sprintf("tuned(%v/s,%d-%d)", c.TargetRatePerSecond, d.MinConcurrency, d.MaxConcurrency)
+	}
+	if c.Adaptive() {
+		min, max := c.ConcurrencyBounds()
+		concurrency = fmt.Sprintf("adaptive(%d-%d)", min, max)
+	}
+	s := fmt.Sprintf("concurrency_limit=%s lambda_timeout_secs=%s sqs_visibility_timeout_secs=%s",
+		concurrency, settingString(c.LambdaTimeoutSes), settingString(c.SQSVisibilityTimeoutSecs))
+	if c.RatePerSecond != 0 {
+		s += fmt.Sprintf(" rate_per_second=%v", c.RatePerSecond)
+	}
+	if c.Profile != "" {
+		s += " profile=" + c.Profile
+	}
+	return s
+}
+
+func settingString(v int) string {
+	if v == 0 {
+		return "default"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,109 @@
+package pipeline_test
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var changedAt = time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// putHistory puts the entry of a stream record made the given number of seconds after changedAt.
+func putHistory(t *testing.T, store pipeline.Store, config pipeline.Config, sequenceNumber string, secs int, deleted bool) {
+	entry := pipeline.NewHistoryEntry(config, config, sequenceNumber, changedAt.Add(time.Duration(secs)*time.Second), time.Now(), deleted)
+	if err := store.PutHistory(context.Background(), entry); err != nil {
+		t.Fatalf("failed to put history: %v", err)
+	}
+}
+
+func TestMemoryStoreListHistoryPages(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	putHistory(t, store, pipeline.Config{ID: "id", Version: 1}, "100", 0, false)
+	putHistory(t, store, pipeline.Config{ID: "id", Version: 2}, "900", 10, false)
+	// a profile re-apply, its sequence number is from the profiles stream.
+	putHistory(t, store, pipeline.Config{ID: "id", Version: 2}, "50", 20, false)
+	// changes made in the same second are ordered by version.
+	putHistory(t, store, pipeline.Config{ID: "id", Version: 4}, "20000", 30, false)
+	putHistory(t, store, pipeline.Config{ID: "id", Version: 3}, "1000", 30, false)
+	putHistory(t, store, pipeline.Config{ID: "other"}, "500", 0, false)
+	putHistory(t, store, pipeline.Config{ID: "id", Version: 2, LambdaTimeoutSes: 5}, "900", 10, false) // retried record replaces its entry
+
+	var pages [][]string
+	in := pipeline.ListInput{Limit: 2}
+	for {
+		page, err := store.ListHistory(ctx, "id", in)
+		if err != nil {
+			t.Fatalf("failed to list history: %v", err)
+		}
+		var seqs []string
+		for _, e := range page.Entries {
+			seqs = append(seqs, e.SequenceNumber)
+		}
+		pages = append(pages, seqs)
+		if page.NextCursor == "" {
+			break
+		}
+		in.Cursor = page.NextCursor
+	}
+	assert.Equal(t, [][]string{{"20000", "1000"}, {"50", "900"}, {"100"}}, pages)
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	v1, _ := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id", LambdaTimeoutSes: 10, ChangedBy: "alice"})
+	putHistory(t, store, v1, "100", 1, false)
+	v2, _ := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id", LambdaTimeoutSes: 20, Profile: "p", Version: v1.Version})
+	putHistory(t, store, v2, "200", 2, false)
+
+	config, err := pipeline.Rollback(ctx, store, "id", 1, "bob")
+	if err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	assert.Equal(t, pipeline.Config{ID: "id", LambdaTimeoutSes: 10, ChangedBy: "bob", Version: 3}, config)
+	stored, _ := store.GetConfig(ctx, "id")
+	assert.Equal(t, config, stored)
+
+	_, err = pipeline.Rollback(ctx, store, "id", 7, "bob")
+	assert.True(t, pipeline.IsNotFound(err), "expected not found, got %v", err)
+}
+
+func TestRollbackKeepsProfileReference(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	v1, _ := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id", Profile: "p", SQSVisibilityTimeoutSecs: 30})
+	resolved := v1
+	resolved.LambdaTimeoutSes = 10
+	store.PutHistory(ctx, pipeline.NewHistoryEntry(v1, resolved, "100", changedAt, changedAt, false))
+	// the profile changed and was re-applied, resolving version 1 to other values.
+	resolved.LambdaTimeoutSes = 20
+	store.PutHistory(ctx, pipeline.NewHistoryEntry(v1, resolved, "50", changedAt.Add(time.Minute), changedAt, false))
+	v2, _ := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id", LambdaTimeoutSes: 60, Version: v1.Version})
+	putHistory(t, store, v2, "200", 120, false)
+
+	config, err := pipeline.Rollback(ctx, store, "id", 1, "bob")
+	if err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	assert.Equal(t, pipeline.Config{ID: "id", Profile: "p", SQSVisibilityTimeoutSecs: 30, ChangedBy: "bob", Version: 3}, config,
+		"the profile's values should be resolved again when applied rather than frozen on the item")
+}
+
+func TestRollbackRecreatesDeletedPipeline(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	// versions restart after a removal, the latest entry for a version wins.
+	putHistory(t, store, pipeline.Config{ID: "id", LambdaTimeoutSes: 10, Version: 1}, "100", 1, false)
+	putHistory(t, store, pipeline.Config{ID: "id", LambdaTimeoutSes: 10, Version: 1}, "200", 2, true)
+	putHistory(t, store, pipeline.Config{ID: "id", LambdaTimeoutSes: 30, Version: 1}, "300", 3, false)
+	putHistory(t, store, pipeline.Config{ID: "id", LambdaTimeoutSes: 30, Version: 1}, "400", 4, true)
+
+	config, err := pipeline.Rollback(ctx, store, "id", 1, "")
+	if err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	assert.Equal(t, pipeline.Config{ID: "id", LambdaTimeoutSes: 30, Version: 1}, config)
+}
@@ -0,0 +1,51 @@
+package pipeline
+
+import "time"
+
+// JournalTTL is how long a Journal is kept for after it was last written, journals are only
+// needed while the stream record they belong to can still be retried.
+const JournalTTL = 7 * 24 * time.Hour
+
+// Journal records the progress of a single operation on a pipeline, there is one Journal per
+// pipeline ID and stream sequence number. Steps are recorded as they complete, along with the
+// resource identifiers gathered so far, so that an invocation retrying the same stream record can
+// resume from the last completed step.
+type Journal struct {
+	ID             string     `json:"id"              dynamodbav:"id"`
+	SequenceNumber string     `json:"sequence_number" dynamodbav:"sequence_number"`
+	Operation      string     `json:"operation"       dynamodbav:"operation"`
+	CompletedSteps []string   `json:"completed_steps" dynamodbav:"completed_steps"`
+	Identifier     Identifier `json:"identifier"      dynamodbav:"identifier"`
+	Done           bool       `json:"done"            dynamodbav:"done"`
+	UpdatedAt      time.Time  `json:"updated_at"      dynamodbav:"updated_at"`
+	ExpiresAt      int64      `json:"expires_at"      dynamodbav:"expires_at"` // unix seconds, used as the table TTL attribute
+}
+
+// Completed reports whether the step has been completed.
+func (j Journal) Completed(step string) bool {
+	for _, s := range j.CompletedSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete marks the step as completed at the given time.
+func (j *Journal) Complete(step string, at time.Time) {
+	if !j.Completed(step) {
+		j.CompletedSteps = append(j.CompletedSteps, step)
+	}
+	j.touch(at)
+}
+
+// Finish marks the whole operation as done at the given time.
+func (j *Journal) Finish(at time.Time) {
+	j.Done = true
+	j.touch(at)
+}
+
+func (j *Journal) touch(at time.Time) {
+	j.UpdatedAt = at
+	j.ExpiresAt = at.Add(JournalTTL).Unix()
+}
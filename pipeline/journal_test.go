@@ -0,0 +1,26 @@
+package pipeline_test
+
+import (
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestJournalComplete(t *testing.T) {
+	at := time.Date(2020, 5, 17, 13, 0, 0, 0, time.UTC)
+	j := pipeline.Journal{ID: "id", SequenceNumber: "100", Operation: "add"}
+
+	j.Complete("create queue", at)
+	j.Complete("create queue", at)
+	j.Complete("create consumer", at)
+
+	assert.Equal(t, []string{"create queue", "create consumer"}, j.CompletedSteps)
+	assert.True(t, j.Completed("create queue"))
+	assert.False(t, j.Completed("attach queue"))
+	assert.False(t, j.Done)
+	assert.Equal(t, at.Add(pipeline.JournalTTL).Unix(), j.ExpiresAt)
+
+	j.Finish(at)
+	assert.True(t, j.Done)
+}
@@ -0,0 +1,492 @@
+package pipeline
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store which keeps everything in memory, for use in tests and local runs.
+// Items are listed in ID order and the cursor is the ID of the last item of the previous page.
+type MemoryStore struct {
+	mu          sync.Mutex
+	configs     map[string]Config
+	profiles    map[string]Profile
+	identifiers map[string]Identifier
+	tombstones  map[string]Tombstone
+	statuses    map[string]Status
+	journals    map[journalKey]Journal
+	history     map[string][]HistoryEntry // oldest first
+	audit       map[string][]AuditRecord  // oldest first
+	events      map[string]ProcessedEvent
+}
+
+type journalKey struct {
+	id             string
+	sequenceNumber string
+}
+
+// NewMemoryStore returns a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		configs:     make(map[string]Config),
+		profiles:    make(map[string]Profile),
+		identifiers: make(map[string]Identifier),
+		tombstones:  make(map[string]Tombstone),
+		statuses:    make(map[string]Status),
+		journals:    make(map[journalKey]Journal),
+		history:     make(map[string][]HistoryEntry),
+		audit:       make(map[string][]AuditRecord),
+		events:      make(map[string]ProcessedEvent),
+	}
+}
+
+// GetConfig gets a Config.
+func (s *MemoryStore) GetConfig(ctx context.Context, id string) (Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, ok := s.configs[id]
+	if !ok {
+		return Config{}, ErrNotFound
+	}
+	return config, nil
+}
+
+// ListConfigs lists a page of Configs.
+func (s *MemoryStore) ListConfigs(ctx context.Context, in ListInput) (ConfigPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page ConfigPage
+	ids, next := pageIDs(configIDs(s.configs), in)
+	for _, id := range ids {
+		page.Configs = append(page.Configs, s.configs[id])
+	}
+	page.NextCursor = next
+	return page, nil
+}
+
+// ListConfigsByProfile lists a page of the Configs referencing the Profile.
+func (s *MemoryStore) ListConfigsByProfile(ctx context.Context, profile string, in ListInput) (ConfigPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, config := range s.configs {
+		if config.Profile == profile {
+			ids = append(ids, id)
+		}
+	}
+	var page ConfigPage
+	ids, next := pageIDs(ids, in)
+	for _, id := range ids {
+		page.Configs = append(page.Configs, s.configs[id])
+	}
+	page.NextCursor = next
+	return page, nil
+}
+
+// PutConfig puts a Config.
+func (s *MemoryStore) PutConfig(ctx context.Context, config Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configs[config.ID] = config
+	return nil
+}
+
+// PutConfigIfVersion puts a Config as long as the stored Config is still at the version the
+// caller last read, the Config is written with its version incremented.
+func (s *MemoryStore) PutConfigIfVersion(ctx context.Context, config Config) (Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.configs[config.ID]; stored.Version != config.Version {
+		return Config{}, &ConflictError{TableName: "configs", ID: config.ID, Version: config.Version}
+	}
+	config.Version++
+	s.configs[config.ID] = config
+	return config, nil
+}
+
+// DeleteConfig deletes a Config.
+func (s *MemoryStore) DeleteConfig(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.configs, id)
+	return nil
+}
+
+// DeleteConfigIfVersion deletes a Config as long as the stored Config is still at the given version.
+func (s *MemoryStore) DeleteConfigIfVersion(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.configs[id]; stored.Version != version {
+		return &ConflictError{TableName: "configs", ID: id, Version: version}
+	}
+	delete(s.configs, id)
+	return nil
+}
+
+// GetProfile gets a Profile.
+func (s *MemoryStore) GetProfile(ctx context.Context, id string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profile, ok := s.profiles[id]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return profile, nil
+}
+
+// ListProfiles lists a page of Profiles.
+func (s *MemoryStore) ListProfiles(ctx context.Context, in ListInput) (ProfilePage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page ProfilePage
+	ids, next := pageIDs(profileIDs(s.profiles), in)
+	for _, id := range ids {
+		page.Profiles = append(page.Profiles, s.profiles[id])
+	}
+	page.NextCursor = next
+	return page, nil
+}
+
+// PutProfileIfVersion puts a Profile as long as the stored Profile is still at the version the
+// caller last read, the Profile is written with its version incremented.
+func (s *MemoryStore) PutProfileIfVersion(ctx context.Context, profile Profile) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.profiles[profile.ID]; stored.Version != profile.Version {
+		return Profile{}, &ConflictError{TableName: "profiles", ID: profile.ID, Version: profile.Version}
+	}
+	profile.Version++
+	s.profiles[profile.ID] = profile
+	return profile, nil
+}
+
+// DeleteProfileIfVersion deletes a Profile as long as the stored Profile is still at the given version.
+func (s *MemoryStore) DeleteProfileIfVersion(ctx context.Context, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.profiles[id]; stored.Version != version {
+		return &ConflictError{TableName: "profiles", ID: id, Version: version}
+	}
+	delete(s.profiles, id)
+	return nil
+}
+
+// GetIdentifier gets an Identifier.
+func (s *MemoryStore) GetIdentifier(ctx context.Context, id string) (Identifier, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ident, ok := s.identifiers[id]
+	if !ok {
+		return Identifier{}, ErrNotFound
+	}
+	return ident, nil
+}
+
+// ListIdentifiers lists a page of Identifiers.
+func (s *MemoryStore) ListIdentifiers(ctx context.Context, in ListInput) (IdentifierPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page IdentifierPage
+	ids, next := pageIDs(identifierIDs(s.identifiers), in)
+	for _, id := range ids {
+		page.Identifiers = append(page.Identifiers, s.identifiers[id])
+	}
+	page.NextCursor = next
+	return page, nil
+}
+
+// PutIdentifier puts an Identifier.
+func (s *MemoryStore) PutIdentifier(ctx context.Context, ident Identifier) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identifiers[ident.ID] = ident
+	delete(s.tombstones, ident.ID)
+	return nil
+}
+
+// PutIdentifierIfNotStale puts an Identifier unless the stored Identifier was written for a newer
+// Config version, it replaces a Tombstone whatever its version.
+func (s *MemoryStore) PutIdentifierIfNotStale(ctx context.Context, ident Identifier) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.identifiers[ident.ID]; stored.Version > ident.Version {
+		return &ConflictError{TableName: "identifiers", ID: ident.ID, Version: ident.Version}
+	}
+	s.identifiers[ident.ID] = ident
+	delete(s.tombstones, ident.ID)
+	return nil
+}
+
+// DeleteIdentifier deletes an Identifier.
+func (s *MemoryStore) DeleteIdentifier(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.identifiers, id)
+	delete(s.tombstones, id)
+	return nil
+}
+
+// DeleteIdentifierIfNotStale replaces an Identifier with the Tombstone unless it was written for a
+// Config version newer than the Tombstone's.
+func (s *MemoryStore) DeleteIdentifierIfNotStale(ctx context.Context, tombstone Tombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.identifiers[tombstone.ID]
+	if !ok {
+		stored.Version = s.tombstones[tombstone.ID].Version
+	}
+	if stored.Version > tombstone.Version {
+		return &ConflictError{TableName: "identifiers", ID: tombstone.ID, Version: tombstone.Version}
+	}
+	delete(s.identifiers, tombstone.ID)
+	s.tombstones[tombstone.ID] = tombstone
+	return nil
+}
+
+// GetTombstone gets the Tombstone of a removed pipeline.
+func (s *MemoryStore) GetTombstone(ctx context.Context, id string) (Tombstone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tombstone, ok := s.tombstones[id]
+	if !ok {
+		return Tombstone{}, ErrNotFound
+	}
+	return tombstone, nil
+}
+
+// GetStatus gets a Status.
+func (s *MemoryStore) GetStatus(ctx context.Context, id string) (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	if !ok {
+		return Status{}, ErrNotFound
+	}
+	return status, nil
+}
+
+// ListStatuses lists a page of Statuses.
+func (s *MemoryStore) ListStatuses(ctx context.Context, in ListInput) (StatusPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page StatusPage
+	ids, next := pageIDs(statusIDs(s.statuses), in)
+	for _, id := range ids {
+		page.Statuses = append(page.Statuses, s.statuses[id])
+	}
+	page.NextCursor = next
+	return page, nil
+}
+
+// PutStatus puts a Status.
+func (s *MemoryStore) PutStatus(ctx context.Context, status Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status.ID] = status
+	return nil
+}
+
+// PutStatusIfUnchanged puts a Status as long as the stored Status is still in the state, at the
+// config version and last updated at the time of the given one.
+func (s *MemoryStore) PutStatusIfUnchanged(ctx context.Context, status Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.statuses[status.ID]
+	if !ok || stored.State != status.State || stored.ConfigVersion != status.ConfigVersion || !stored.UpdatedAt.Equal(status.UpdatedAt) {
+		return &ConflictError{TableName: "statuses", ID: status.ID, Version: status.ConfigVersion}
+	}
+	s.statuses[status.ID] = status
+	return nil
+}
+
+// DeleteStatus deletes a Status.
+func (s *MemoryStore) DeleteStatus(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.statuses, id)
+	return nil
+}
+
+// GetJournal gets a Journal.
+func (s *MemoryStore) GetJournal(ctx context.Context, id, sequenceNumber string) (Journal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	journal, ok := s.journals[journalKey{id, sequenceNumber}]
+	if !ok {
+		return Journal{}, ErrNotFound
+	}
+	journal.CompletedSteps = append([]string(nil), journal.CompletedSteps...)
+	return journal, nil
+}
+
+// PutJournal puts a Journal.
+func (s *MemoryStore) PutJournal(ctx context.Context, journal Journal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	journal.CompletedSteps = append([]string(nil), journal.CompletedSteps...)
+	s.journals[journalKey{journal.ID, journal.SequenceNumber}] = journal
+	return nil
+}
+
+// ListHistory lists a page of a pipeline's HistoryEntries, newest first, the cursor is the
+// position of the last entry of the previous page.
+func (s *MemoryStore) ListHistory(ctx context.Context, id string, in ListInput) (HistoryPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page HistoryPage
+	entries := s.history[id]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if in.Cursor != "" && entries[i].Position >= in.Cursor {
+			continue
+		}
+		if len(page.Entries) == listLimit(in) {
+			page.NextCursor = page.Entries[len(page.Entries)-1].Position
+			break
+		}
+		page.Entries = append(page.Entries, entries[i])
+	}
+	return page, nil
+}
+
+// PutHistory puts a HistoryEntry, replacing the entry at the same position.
+func (s *MemoryStore) PutHistory(ctx context.Context, entry HistoryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.history[entry.ID]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Position >= entry.Position })
+	if i < len(entries) && entries[i].Position == entry.Position {
+		entries[i] = entry
+		return nil
+	}
+	entries = append(entries, HistoryEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	s.history[entry.ID] = entries
+	return nil
+}
+
+// ListAudit lists a page of a pipeline's AuditRecords in the input's time range, oldest first,
+// the cursor is the key of the last record of the previous page.
+func (s *MemoryStore) ListAudit(ctx context.Context, id string, in AuditInput) (AuditPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page AuditPage
+	from, to := auditRange(in)
+	for _, r := range s.audit[id] {
+		if r.Key < from || r.Key > to || r.Key <= in.Cursor {
+			continue
+		}
+		if len(page.Records) == listLimit(ListInput{Limit: in.Limit}) {
+			page.NextCursor = page.Records[len(page.Records)-1].Key
+			break
+		}
+		page.Records = append(page.Records, r)
+	}
+	return page, nil
+}
+
+// PutAudit puts an AuditRecord, replacing the record with the same key.
+func (s *MemoryStore) PutAudit(ctx context.Context, record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := s.audit[record.ID]
+	i := sort.Search(len(records), func(i int) bool { return records[i].Key >= record.Key })
+	if i < len(records) && records[i].Key == record.Key {
+		records[i] = record
+		return nil
+	}
+	records = append(records, AuditRecord{})
+	copy(records[i+1:], records[i:])
+	records[i] = record
+	s.audit[record.ID] = records
+	return nil
+}
+
+// GetEvent gets a ProcessedEvent.
+func (s *MemoryStore) GetEvent(ctx context.Context, id string) (ProcessedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event, ok := s.events[id]
+	if !ok {
+		return ProcessedEvent{}, ErrNotFound
+	}
+	return event, nil
+}
+
+// ClaimEvent puts a ProcessedEvent as long as the event has not been claimed yet, or its claim is
+// still in progress with a lease which ran out before now.
+func (s *MemoryStore) ClaimEvent(ctx context.Context, event ProcessedEvent, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.events[event.ID]; ok && (stored.State != EventInProgress || stored.LeaseExpiresAt >= now.Unix()) {
+		return &ConflictError{TableName: "events", ID: event.ID}
+	}
+	s.events[event.ID] = event
+	return nil
+}
+
+// PutEvent puts a ProcessedEvent.
+func (s *MemoryStore) PutEvent(ctx context.Context, event ProcessedEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[event.ID] = event
+	return nil
+}
+
+// DeleteEvent deletes a ProcessedEvent.
+func (s *MemoryStore) DeleteEvent(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, id)
+	return nil
+}
+
+// pageIDs sorts the IDs and returns the page of them after the cursor, along with the next cursor.
+func pageIDs(ids []string, in ListInput) ([]string, string) {
+	sort.Strings(ids)
+	start := sort.SearchStrings(ids, in.Cursor)
+	if start < len(ids) && ids[start] == in.Cursor {
+		start++
+	}
+	end := start + listLimit(in)
+	if end >= len(ids) {
+		return ids[start:], ""
+	}
+	return ids[start:end], ids[end-1]
+}
+
+func configIDs(m map[string]Config) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func profileIDs(m map[string]Profile) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func identifierIDs(m map[string]Identifier) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func statusIDs(m map[string]Status) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
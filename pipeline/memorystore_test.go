@@ -0,0 +1,51 @@
+package pipeline_test
+
+import (
+	"context"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryStoreListConfigsPages(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	for _, id := range []string{"c", "a", "e", "b", "d"} {
+		if err := store.PutConfig(ctx, pipeline.Config{ID: id}); err != nil {
+			t.Fatalf("failed to put config %s: %v", id, err)
+		}
+	}
+
+	var pages [][]string
+	in := pipeline.ListInput{Limit: 2}
+	for {
+		page, err := store.ListConfigs(ctx, in)
+		if err != nil {
+			t.Fatalf("failed to list configs: %v", err)
+		}
+		var ids []string
+		for _, c := range page.Configs {
+			ids = append(ids, c.ID)
+		}
+		pages = append(pages, ids)
+		if page.NextCursor == "" {
+			break
+		}
+		in.Cursor = page.NextCursor
+	}
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, pages)
+}
+
+func TestMemoryStoreNotFound(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+
+	_, err := store.GetConfig(ctx, "missing")
+	assert.True(t, pipeline.IsNotFound(err))
+	_, err = store.GetIdentifier(ctx, "missing")
+	assert.True(t, pipeline.IsNotFound(err))
+	_, err = store.GetStatus(ctx, "missing")
+	assert.True(t, pipeline.IsNotFound(err))
+	_, err = store.GetJournal(ctx, "missing", "1")
+	assert.True(t, pipeline.IsNotFound(err))
+}
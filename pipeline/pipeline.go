@@ -1,23 +1,51 @@
-// Package pipeline holds the pipeline configuration and identifier types
-// Config and Identifier pairs should have the same ID.
+// Package pipeline holds the pipeline configuration, identifier and status types, and the Store
+// they are persisted in. Config, Identifier and Status items for the same pipeline should have the same ID.
 package pipeline
 
-import (
-	"context"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/pkg/errors"
-)
-
 // Config holds the configurations for how the task processing pipeline should be set up.
 // For simplicity, we will limit the configurable parameters to just these values. There are many more
 // Parameters that could be added to the configuration.
+//
+// Every setting is optional, leaving a setting out, or removing it from an existing config, reverts
+// the resource to its default:
+//
+//	concurrency_limit            reserved concurrency of the consumer, unset leaves the consumer no
+//	                             reserved concurrency so it draws on the account's unreserved pool.
+//	                             Zero throttles the pipeline completely.
+//	lambda_timeout_secs          consumer timeout, 1 to 900, defaults to 3 as Lambda does.
+//	sqs_visibility_timeout_secs  visibility timeout of the queue and dead letter queue, at least the
+//	                             consumer timeout and at most 43200, defaults to 30 as SQS does.
+//	profile                      ID of a Profile to take the unset settings from before the
+//	                             defaults apply.
+//	notify                       target the pipeline's lifecycle events are published to, see
+//	                             ValidateNotifyTarget, unset uses the environment's target.
+//	rate_per_second              most tasks the consumer starts per second, across all its
+//	                             instances, unset or zero for no limit besides the concurrency.
+//	target_rate_per_second       tasks per second the concurrency is tuned to handle, from the
+//	                             measured task duration, instead of setting concurrency_limit.
+//	min_concurrency              least concurrency a target rate, or adaptive concurrency, is
+//	                             tuned to, defaults to 1.
+//	max_concurrency              most concurrency a target rate is tuned to, defaults to 100.
+//	adaptive_concurrency         whether the concurrency backs off when tasks are throttled by
+//	                             the downstream API and grows back when they are not, up to
+//	                             concurrency_limit which must be set.
+//
+// ChangedBy is not a setting, it names who last wrote the item when the writer knows, and is
+// carried into the config history.
 type Config struct {
-	ID                       string `json:"id"                          dynamodbav:"id"`
-	LambdaConcurrencyLimit   int    `json:"concurrency_limit"           dynamodbav:"concurrency_limit"`
-	LambdaTimeoutSes         int    `json:"lambda_timeout_secs"         dynamodbav:"lambda_timeout_secs"`
-	SQSVisibilityTimeoutSecs int    `json:"sqs_visibility_timeout_secs" dynamodbav:"sqs_visibility_timeout_secs"`
+	ID                       string  `json:"id"                                    dynamodbav:"id"                                    yaml:"id"`
+	LambdaConcurrencyLimit   *int    `json:"concurrency_limit,omitempty"           dynamodbav:"concurrency_limit,omitempty"           yaml:"concurrency_limit,omitempty"`           // nil for no reserved concurrency
+	LambdaTimeoutSes         int     `json:"lambda_timeout_secs,omitempty"         dynamodbav:"lambda_timeout_secs,omitempty"         yaml:"lambda_timeout_secs,omitempty"`         // zero for the default
+	SQSVisibilityTimeoutSecs int     `json:"sqs_visibility_timeout_secs,omitempty" dynamodbav:"sqs_visibility_timeout_secs,omitempty" yaml:"sqs_visibility_timeout_secs,omitempty"` // zero for the default
+	Profile                  string  `json:"profile,omitempty"                     dynamodbav:"profile,omitempty"                     yaml:"profile,omitempty"`                     // empty for no profile
+	Notify                   string  `json:"notify,omitempty"                      dynamodbav:"notify,omitempty"                      yaml:"notify,omitempty"`                      // empty for the environment's target
+	RatePerSecond            float64 `json:"rate_per_second,omitempty"             dynamodbav:"rate_per_second,omitempty"             yaml:"rate_per_second,omitempty"`             // zero for no rate limit
+	TargetRatePerSecond      float64 `json:"target_rate_per_second,omitempty"      dynamodbav:"target_rate_per_second,omitempty"      yaml:"target_rate_per_second,omitempty"`      // zero for a set concurrency
+	MinConcurrency           int     `json:"min_concurrency,omitempty"             dynamodbav:"min_concurrency,omitempty"             yaml:"min_concurrency,omitempty"`             // zero for the default
+	MaxConcurrency           int     `json:"max_concurrency,omitempty"             dynamodbav:"max_concurrency,omitempty"             yaml:"max_concurrency,omitempty"`             // zero for the default
+	AdaptiveConcurrency      *bool   `json:"adaptive_concurrency,omitempty"        dynamodbav:"adaptive_concurrency,omitempty"        yaml:"adaptive_concurrency,omitempty"`        // nil for the profile's, false for a set concurrency
+	ChangedBy                string  `json:"changed_by,omitempty"                  dynamodbav:"changed_by,omitempty"                  yaml:"-"`                                     // who wrote the item, empty when unknown
+	Version                  int64   `json:"version"                               dynamodbav:"version"                               yaml:"-"`                                     // incremented on every conditional write
 }
 
 // Identifier holds the resource identifiers for the pipeline.
@@ -29,71 +57,24 @@ type Identifier struct {
 	DeadLetterQueueARN string `json:"dead_letter_queue_arn" dynamodbav:"dead_letter_queue_arn"`
 	ConsumerName       string `json:"consumer_name"         dynamodbav:"consumer_name"`
 	ConsumerARN        string `json:"consumer_arn"          dynamodbav:"consumer_arn"`
+	Version            int64  `json:"version"               dynamodbav:"version"` // version of the Config last applied to the resources
 }
 
-// PutConfig puts a Config into the Dynamo DB table.
-func PutConfig(ctx context.Context, db *dynamodb.DynamoDB, tableName string, config Config) error {
-	c, err := dynamodbattribute.MarshalMap(config)
-	if err != nil {
-		return errors.Wrapf(err, "failed to marshal config %s", config.ID)
-	}
-	_, err = db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
-		Item:      c,
-		TableName: aws.String(tableName),
-	})
-	if err != nil {
-		return errors.Wrapf(err, "failed to config item into dynamo table %s", tableName)
-	}
-	return nil
-}
-
-// Put puts an Identifier into the DynamoDB table.
-func PutIdentifier(ctx context.Context, db *dynamodb.DynamoDB, tableName string, ident Identifier) error {
-	c, err := dynamodbattribute.MarshalMap(ident)
-	if err != nil {
-		return errors.Wrapf(err, "failed to marshal config %s", ident.ID)
-	}
-	_, err = db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
-		Item:      c,
-		TableName: aws.String(tableName),
-	})
-	if err != nil {
-		return errors.Wrapf(err, "failed to put identifier %s into dynamo table %s", ident.ID, tableName)
-	}
-	return nil
-}
-
-// GetIdentifier gets an Identifier from the DynamoDB table.
-func GetIdentifier(ctx context.Context, db *dynamodb.DynamoDB, tableName, id string) (Identifier, error) {
-	var ident Identifier
-	out, err := db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		Key:       makeKey(id),
-		TableName: aws.String(tableName),
-	})
-	if err != nil {
-		return ident, errors.Wrapf(err, "failed to get pipeline identifier %s from %s", id, tableName)
-	}
-	if err := dynamodbattribute.UnmarshalMap(out.Item, &ident); err != nil {
-		return ident, errors.Wrapf(err, "failed to get unmarshal identifier %s from %s", id, tableName)
-	}
-	return ident, nil
-}
-
-// DeleteItem takes an ID and a table name and deletes the item from the table.
-// Should be used to delete either a Config item or an Identifier item.
-func DeleteItem(ctx context.Context, db *dynamodb.DynamoDB, tableName, id string) error {
-	_, err := db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
-		Key:       makeKey(id),
-		TableName: aws.String(tableName),
-	})
-	if err != nil {
-		return errors.Wrapf(err, "failed to delete item %s from %s", id, tableName)
-	}
-	return nil
+// Tombstone takes the place of the Identifier of a removed pipeline. It records the stream record
+// which removed it, so that a delayed record from before the removal is not applied after it, while
+// the pipeline can still be added again, from version 1, by a later record.
+type Tombstone struct {
+	ID             string `json:"id"         dynamodbav:"id"`
+	SequenceNumber string `json:"deleted_by" dynamodbav:"deleted_by"` // stream record which removed the pipeline
+	Version        int64  `json:"version"    dynamodbav:"version"`    // version of the removed Config
 }
 
-func makeKey(id string) map[string]*dynamodb.AttributeValue {
-	return map[string]*dynamodb.AttributeValue{
-		"id": {S: aws.String(id)},
+// After reports whether the pipeline was removed by a stream record after the one with the given
+// sequence number. Sequence numbers are decimal strings of up to 40 digits, so they compare by
+// length before their digits.
+func (t Tombstone) After(sequenceNumber string) bool {
+	if len(t.SequenceNumber) != len(sequenceNumber) {
+		return len(t.SequenceNumber) > len(sequenceNumber)
 	}
+	return t.SequenceNumber > sequenceNumber
 }
@@ -0,0 +1,90 @@
+package plan
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/queue"
+	"github.com/pkg/errors"
+)
+
+// Live is the deployed state of the pipeline resources.
+type Live struct {
+	Observed             bool // false if the live state was not read, in which case plans are made from the old config
+	QueueExists          bool
+	DLQExists            bool
+	ConsumerExists       bool
+	VisibilityTimeout    int
+	DLQVisibilityTimeout int
+	Timeout              int
+	Concurrency          *int    // nil if the consumer has no reserved concurrency
+	RatePerSecond        float64 // zero if the consumer has no rate limit
+	Attached             bool    // whether the queue is attached to the consumer
+}
+
+// Observe reads the live state of the resources recorded on the identifier.
+func Observe(ctx context.Context, sqsSvc sqsiface.SQSAPI, lambdaSvc lambdaiface.LambdaAPI, ident pipeline.Identifier) (Live, error) {
+	live := Live{Observed: true}
+	var err error
+	live.VisibilityTimeout, live.QueueExists, err = observeQueue(ctx, sqsSvc, ident.QueueURL)
+	if err != nil {
+		return Live{}, err
+	}
+	live.DLQVisibilityTimeout, live.DLQExists, err = observeQueue(ctx, sqsSvc, ident.DeadLetterQueueURL)
+	if err != nil {
+		return Live{}, err
+	}
+	settings, err := consumer.GetSettings(ctx, lambdaSvc, ident.ConsumerName)
+	if pipeline.IsAWSErrCode(err, lambda.ErrCodeResourceNotFoundException) {
+		return live, nil
+	}
+	if err != nil {
+		return Live{}, errors.Wrap(err, "failed to observe consumer")
+	}
+	live.ConsumerExists = true
+	live.Timeout = int(settings.Timeout)
+	live.RatePerSecond = settings.RatePerSecond
+	if settings.Concurrency != nil {
+		c := int(*settings.Concurrency)
+		live.Concurrency = &c
+	}
+	if live.QueueExists {
+		if live.Attached, err = consumer.IsAttached(ctx, lambdaSvc, ident.ConsumerName, ident.QueueARN); err != nil {
+			return Live{}, errors.Wrap(err, "failed to observe event source mapping")
+		}
+	}
+	return live, nil
+}
+
+// missing returns the reasons the pipeline needs recreating, one for each missing resource.
+func (l Live) missing() []string {
+	var reasons []string
+	if !l.QueueExists {
+		reasons = append(reasons, "queue is missing")
+	}
+	if !l.DLQExists {
+		reasons = append(reasons, "dead letter queue is missing")
+	}
+	if !l.ConsumerExists {
+		reasons = append(reasons, "consumer is missing")
+	}
+	return reasons
+}
+
+func observeQueue(ctx context.Context, svc sqsiface.SQSAPI, url string) (int, bool, error) {
+	if url == "" {
+		return 0, false, nil
+	}
+	timeout, err := queue.GetVisibilityTimeout(ctx, svc, url)
+	if pipeline.IsAWSErrCode(err, sqs.ErrCodeQueueDoesNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, "failed to observe queue")
+	}
+	return timeout, true, nil
+}
@@ -0,0 +1,184 @@
+// Package plan works out what the pipeline manager needs to do to the pipeline resources to apply a
+// config change: which queue attributes, consumer settings and event source mappings change, and
+// whether the pipeline needs to be recreated. Plans can be printed for review before a change is
+// written, and are executed by the manager.
+package plan
+
+import (
+	"fmt"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"strconv"
+	"strings"
+)
+
+// Resource is a pipeline resource a Change applies to.
+type Resource string
+
+// Pipeline resources.
+const (
+	Queue           Resource = "queue"
+	DeadLetterQueue Resource = "dead letter queue"
+	Consumer        Resource = "consumer"
+	Mapping         Resource = "event source mapping"
+)
+
+// Settings that can change.
+const (
+	SettingVisibilityTimeout   = "VisibilityTimeout"
+	SettingTimeout             = "Timeout"
+	SettingReservedConcurrency = "ReservedConcurrency"
+	SettingRatePerSecond       = "RatePerSecond"
+	SettingAttached            = "Attached"
+)
+
+// Change is a single setting to change on a resource, From and To are empty when the setting is
+// not set, a consumer with no reserved concurrency for example.
+type Change struct {
+	Resource Resource
+	Setting  string
+	From     string
+	To       string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s: %s -> %s", c.Resource, c.Setting, orNone(c.From), orNone(c.To))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// Plan is the set of changes needed to bring a pipeline in line with its config.
+type Plan struct {
+	ID       string
+	Create   bool     // the pipeline does not exist yet and will be created
+	Recreate bool     // the pipeline resources are missing and need to be created again
+	Reasons  []string // why the pipeline needs to be recreated
+	Changes  []Change
+}
+
+// Empty reports whether the plan has nothing to do.
+func (p Plan) Empty() bool {
+	return !p.Create && !p.Recreate && len(p.Changes) == 0
+}
+
+// For returns the changes to the given resource.
+func (p Plan) For(resource Resource) []Change {
+	var changes []Change
+	for _, c := range p.Changes {
+		if c.Resource == resource {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// String formats the plan for review, one line per change.
+func (p Plan) String() string {
+	var b strings.Builder
+	switch {
+	case p.Create:
+		fmt.Fprintf(&b, "pipeline %s will be created", p.ID)
+	case p.Recreate:
+		fmt.Fprintf(&b, "pipeline %s must be recreated: %s", p.ID, strings.Join(p.Reasons, ", "))
+	case len(p.Changes) == 0:
+		fmt.Fprintf(&b, "pipeline %s is up to date", p.ID)
+	default:
+		fmt.Fprintf(&b, "pipeline %s will be updated", p.ID)
+	}
+	for _, c := range p.Changes {
+		fmt.Fprintf(&b, "\n  ~ %s", c)
+	}
+	return b.String()
+}
+
+// Make plans the changes to go from the old config to the new config. The pipeline is created if
+// it has no identifier. When the live state has been observed, settings are compared with what is
+// actually deployed rather than the old config, so a plan made after a partially applied change
+// only contains the changes still to do. Unset settings are planned as their defaults.
+//
+// The concurrency of a config with a target rate or adaptive concurrency is tuned rather than set,
+// it is only changed when it is outside the config's bounds, and planned as the bounds when there
+// is no live state.
+func Make(old, new pipeline.Config, ident pipeline.Identifier, live Live) Plan {
+	old, new = old.WithDefaults(), new.WithDefaults()
+	p := Plan{ID: new.ID}
+	if ident.ID == "" {
+		p.Create = true
+		old = pipeline.Config{}
+	}
+	if live.Observed {
+		p.Reasons = live.missing()
+		p.Recreate = len(p.Reasons) > 0
+	}
+
+	visibility, dlqVisibility := itoa(old.SQSVisibilityTimeoutSecs), itoa(old.SQSVisibilityTimeoutSecs)
+	timeout, concurrency, rate := itoa(old.LambdaTimeoutSes), concurrencyOf(old), ftoa(old.RatePerSecond)
+	newConcurrency := concurrencyOf(new)
+	attached := ""
+	if live.Observed && !p.Recreate {
+		visibility, dlqVisibility = itoa(live.VisibilityTimeout), itoa(live.DLQVisibilityTimeout)
+		timeout, concurrency, rate = itoa(live.Timeout), ptoa(live.Concurrency), ftoa(live.RatePerSecond)
+		attached = strconv.FormatBool(live.Attached)
+		if new.Controlled() {
+			newConcurrency = itoa(new.ClampConcurrency(live.Concurrency))
+		}
+	} else if p.Create && new.Controlled() {
+		newConcurrency = itoa(new.ClampConcurrency(nil))
+	}
+	p.add(Queue, SettingVisibilityTimeout, visibility, itoa(new.SQSVisibilityTimeoutSecs))
+	p.add(DeadLetterQueue, SettingVisibilityTimeout, dlqVisibility, itoa(new.SQSVisibilityTimeoutSecs))
+	p.add(Consumer, SettingTimeout, timeout, itoa(new.LambdaTimeoutSes))
+	p.add(Consumer, SettingReservedConcurrency, concurrency, newConcurrency)
+	p.add(Consumer, SettingRatePerSecond, rate, ftoa(new.RatePerSecond))
+	if attached != "" {
+		p.add(Mapping, SettingAttached, attached, strconv.FormatBool(true))
+	}
+	return p
+}
+
+// add adds a change if the setting differs, the set settings of a new pipeline are always added.
+func (p *Plan) add(resource Resource, setting, from, to string) {
+	if from == to && (!p.Create || to == "") {
+		return
+	}
+	if p.Create {
+		from = ""
+	}
+	p.Changes = append(p.Changes, Change{Resource: resource, Setting: setting, From: from, To: to})
+}
+
+func itoa(i int) string {
+	return strconv.Itoa(i)
+}
+
+// ptoa formats an optional setting, unset settings are empty.
+func ptoa(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return itoa(*i)
+}
+
+// concurrencyOf formats the concurrency a config sets, or the bounds it is tuned within.
+func concurrencyOf(c pipeline.Config) string {
+	min, max := c.ConcurrencyBounds()
+	if c.Tuned() {
+		return fmt.Sprintf("tuned %d-%d", min, max)
+	}
+	if c.Adaptive() {
+		return fmt.Sprintf("adaptive %d-%d", min, max)
+	}
+	return ptoa(c.LambdaConcurrencyLimit)
+}
+
+// ftoa formats a rate, no rate is empty.
+func ftoa(f float64) string {
+	if f == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,157 @@
+package plan_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/plan"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMake(t *testing.T) {
+	old := pipeline.Config{ID: "id", LambdaConcurrencyLimit: aws.Int(5), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15}
+	ident := pipeline.Identifier{ID: "id"}
+	five := 5
+	deployed := plan.Live{
+		Observed:             true,
+		QueueExists:          true,
+		DLQExists:            true,
+		ConsumerExists:       true,
+		VisibilityTimeout:    15,
+		DLQVisibilityTimeout: 15,
+		Timeout:              10,
+		Concurrency:          &five,
+		Attached:             true,
+	}
+	tests := []struct {
+		name  string
+		new   pipeline.Config
+		ident pipeline.Identifier
+		live  func(l *plan.Live)
+		want  string
+	}{
+		{
+			name: "create",
+			new:  old,
+			want: "pipeline id will be created\n" +
+				"  ~ queue VisibilityTimeout: (none) -> 15\n" +
+				"  ~ dead letter queue VisibilityTimeout: (none) -> 15\n" +
+				"  ~ consumer Timeout: (none) -> 10\n" +
+				"  ~ consumer ReservedConcurrency: (none) -> 5",
+		},
+		{
+			name:  "up to date",
+			new:   old,
+			ident: ident,
+			want:  "pipeline id is up to date",
+		},
+		{
+			name:  "update from old config",
+			new:   pipeline.Config{ID: "id", LambdaConcurrencyLimit: aws.Int(8), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 30},
+			ident: ident,
+			want: "pipeline id will be updated\n" +
+				"  ~ queue VisibilityTimeout: 15 -> 30\n" +
+				"  ~ dead letter queue VisibilityTimeout: 15 -> 30\n" +
+				"  ~ consumer ReservedConcurrency: 5 -> 8",
+		},
+		{
+			name:  "partially applied update",
+			new:   pipeline.Config{ID: "id", LambdaConcurrencyLimit: aws.Int(8), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 30},
+			ident: ident,
+			live: func(l *plan.Live) {
+				eight := 8
+				l.Concurrency = &eight
+				l.VisibilityTimeout = 30
+			},
+			want: "pipeline id will be updated\n" +
+				"  ~ dead letter queue VisibilityTimeout: 15 -> 30",
+		},
+		{
+			name:  "drift",
+			new:   old,
+			ident: ident,
+			live: func(l *plan.Live) {
+				l.Concurrency = nil
+				l.Attached = false
+			},
+			want: "pipeline id will be updated\n" +
+				"  ~ consumer ReservedConcurrency: (none) -> 5\n" +
+				"  ~ event source mapping Attached: false -> true",
+		},
+		{
+			name:  "rate limit",
+			new:   pipeline.Config{ID: "id", LambdaConcurrencyLimit: aws.Int(5), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, RatePerSecond: 2.5},
+			ident: ident,
+			live: func(l *plan.Live) {
+				l.RatePerSecond = 1
+			},
+			want: "pipeline id will be updated\n" +
+				"  ~ consumer RatePerSecond: 1 -> 2.5",
+		},
+		{
+			name: "create tuned",
+			new:  pipeline.Config{ID: "id", LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, TargetRatePerSecond: 4, MinConcurrency: 2},
+			want: "pipeline id will be created\n" +
+				"  ~ queue VisibilityTimeout: (none) -> 15\n" +
+				"  ~ dead letter queue VisibilityTimeout: (none) -> 15\n" +
+				"  ~ consumer Timeout: (none) -> 10\n" +
+				"  ~ consumer ReservedConcurrency: (none) -> 2",
+		},
+		{
+			name:  "switch to tuned",
+			new:   pipeline.Config{ID: "id", LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, TargetRatePerSecond: 4, MaxConcurrency: 3},
+			ident: ident,
+			want: "pipeline id will be updated\n" +
+				"  ~ consumer ReservedConcurrency: 5 -> tuned 1-3",
+		},
+		{
+			name:  "tuned concurrency is kept within bounds",
+			new:   pipeline.Config{ID: "id", LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, TargetRatePerSecond: 4, MaxConcurrency: 3},
+			ident: ident,
+			live:  func(l *plan.Live) {},
+			want: "pipeline id will be updated\n" +
+				"  ~ consumer ReservedConcurrency: 5 -> 3",
+		},
+		{
+			name:  "tuned concurrency within bounds is left alone",
+			new:   pipeline.Config{ID: "id", LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, TargetRatePerSecond: 4},
+			ident: ident,
+			live:  func(l *plan.Live) {},
+			want:  "pipeline id is up to date",
+		},
+		{
+			name:  "adaptive concurrency is left alone within the limit",
+			new:   pipeline.Config{ID: "id", LambdaConcurrencyLimit: aws.Int(8), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, AdaptiveConcurrency: aws.Bool(true)},
+			ident: ident,
+			live:  func(l *plan.Live) {},
+			want:  "pipeline id is up to date",
+		},
+		{
+			name:  "switch to adaptive",
+			new:   pipeline.Config{ID: "id", LambdaConcurrencyLimit: aws.Int(8), LambdaTimeoutSes: 10, SQSVisibilityTimeoutSecs: 15, AdaptiveConcurrency: aws.Bool(true)},
+			ident: ident,
+			want: "pipeline id will be updated\n" +
+				"  ~ consumer ReservedConcurrency: 5 -> adaptive 1-8",
+		},
+		{
+			name:  "missing resources",
+			new:   old,
+			ident: ident,
+			live: func(l *plan.Live) {
+				l.DLQExists = false
+				l.ConsumerExists = false
+			},
+			want: "pipeline id must be recreated: dead letter queue is missing, consumer is missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var live plan.Live
+			if tt.live != nil {
+				live = deployed
+				tt.live(&live)
+			}
+			assert.Equal(t, tt.want, plan.Make(old, tt.new, tt.ident, live).String())
+		})
+	}
+}
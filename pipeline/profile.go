@@ -0,0 +1,55 @@
+package pipeline
+
+import "github.com/aws/aws-sdk-go/aws"
+
+// Profile holds named defaults shared by pipeline Configs, a Config referencing a Profile takes
+// the Profile's value for every setting it leaves unset. Profile settings are optional in the same
+// way as Config settings, settings unset on both take the Config defaults.
+type Profile struct {
+	ID                       string  `json:"id"                                    dynamodbav:"id"                                    yaml:"id"`
+	LambdaConcurrencyLimit   *int    `json:"concurrency_limit,omitempty"           dynamodbav:"concurrency_limit,omitempty"           yaml:"concurrency_limit,omitempty"`
+	LambdaTimeoutSes         int     `json:"lambda_timeout_secs,omitempty"         dynamodbav:"lambda_timeout_secs,omitempty"         yaml:"lambda_timeout_secs,omitempty"`
+	SQSVisibilityTimeoutSecs int     `json:"sqs_visibility_timeout_secs,omitempty" dynamodbav:"sqs_visibility_timeout_secs,omitempty" yaml:"sqs_visibility_timeout_secs,omitempty"`
+	RatePerSecond            float64 `json:"rate_per_second,omitempty"             dynamodbav:"rate_per_second,omitempty"             yaml:"rate_per_second,omitempty"`
+	TargetRatePerSecond      float64 `json:"target_rate_per_second,omitempty"      dynamodbav:"target_rate_per_second,omitempty"      yaml:"target_rate_per_second,omitempty"`
+	MinConcurrency           int     `json:"min_concurrency,omitempty"             dynamodbav:"min_concurrency,omitempty"             yaml:"min_concurrency,omitempty"`
+	MaxConcurrency           int     `json:"max_concurrency,omitempty"             dynamodbav:"max_concurrency,omitempty"             yaml:"max_concurrency,omitempty"`
+	AdaptiveConcurrency      bool    `json:"adaptive_concurrency,omitempty"        dynamodbav:"adaptive_concurrency,omitempty"        yaml:"adaptive_concurrency,omitempty"`
+	Version                  int64   `json:"version"                               dynamodbav:"version"                               yaml:"-"` // incremented on every conditional write
+}
+
+// Resolve returns the effective Config, the settings left unset on the Config are taken from the
+// Profile. The Profile is expected to be the one the Config references. A target rate set on the
+// Config takes the place of the Profile's concurrency limit and adaptive concurrency, and a
+// concurrency limit or adaptive concurrency set on the Config takes the place of the Profile's
+// target rate, so that a Config can choose how its concurrency is set whatever its Profile's. The
+// concurrency bounds are only taken for the concurrency they bound.
+func (c Config) Resolve(p Profile) Config {
+	ownTarget := c.Tuned()
+	ownLimit := c.LambdaConcurrencyLimit != nil || c.Adaptive()
+	if c.LambdaConcurrencyLimit == nil && !ownTarget {
+		c.LambdaConcurrencyLimit = p.LambdaConcurrencyLimit
+	}
+	if c.LambdaTimeoutSes == 0 {
+		c.LambdaTimeoutSes = p.LambdaTimeoutSes
+	}
+	if c.SQSVisibilityTimeoutSecs == 0 {
+		c.SQSVisibilityTimeoutSecs = p.SQSVisibilityTimeoutSecs
+	}
+	if c.RatePerSecond == 0 {
+		c.RatePerSecond = p.RatePerSecond
+	}
+	if c.TargetRatePerSecond == 0 && !ownLimit {
+		c.TargetRatePerSecond = p.TargetRatePerSecond
+	}
+	if c.AdaptiveConcurrency == nil && !ownTarget && p.AdaptiveConcurrency {
+		c.AdaptiveConcurrency = aws.Bool(true)
+	}
+	if c.MinConcurrency == 0 && c.Controlled() {
+		c.MinConcurrency = p.MinConcurrency
+	}
+	if c.MaxConcurrency == 0 && c.Tuned() {
+		c.MaxConcurrency = p.MaxConcurrency
+	}
+	return c
+}
@@ -0,0 +1,49 @@
+package pipeline_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConfigResolve(t *testing.T) {
+	adaptive := pipeline.Profile{ID: "adaptive", LambdaConcurrencyLimit: aws.Int(8), AdaptiveConcurrency: true, LambdaTimeoutSes: 20}
+	tuned := pipeline.Profile{ID: "tuned", TargetRatePerSecond: 5, MinConcurrency: 2}
+	tests := []struct {
+		name    string
+		config  pipeline.Config
+		profile pipeline.Profile
+		want    pipeline.Config
+	}{
+		{
+			name:    "unset settings come from the profile",
+			config:  pipeline.Config{ID: "a", Profile: "adaptive", LambdaTimeoutSes: 10},
+			profile: adaptive,
+			want:    pipeline.Config{ID: "a", Profile: "adaptive", LambdaTimeoutSes: 10, LambdaConcurrencyLimit: aws.Int(8), AdaptiveConcurrency: aws.Bool(true)},
+		},
+		{
+			name:    "explicit false overrides the profile's adaptive concurrency",
+			config:  pipeline.Config{ID: "a", Profile: "adaptive", AdaptiveConcurrency: aws.Bool(false)},
+			profile: adaptive,
+			want:    pipeline.Config{ID: "a", Profile: "adaptive", LambdaTimeoutSes: 20, LambdaConcurrencyLimit: aws.Int(8), AdaptiveConcurrency: aws.Bool(false)},
+		},
+		{
+			name:    "a target rate takes the place of the profile's concurrency limit",
+			config:  pipeline.Config{ID: "a", Profile: "adaptive", TargetRatePerSecond: 10},
+			profile: adaptive,
+			want:    pipeline.Config{ID: "a", Profile: "adaptive", LambdaTimeoutSes: 20, TargetRatePerSecond: 10},
+		},
+		{
+			name:    "a concurrency limit takes the place of the profile's target rate",
+			config:  pipeline.Config{ID: "a", Profile: "tuned", LambdaConcurrencyLimit: aws.Int(3)},
+			profile: tuned,
+			want:    pipeline.Config{ID: "a", Profile: "tuned", LambdaConcurrencyLimit: aws.Int(3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.config.Resolve(tt.profile))
+		})
+	}
+}
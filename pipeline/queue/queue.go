@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/pkg/errors"
 	"strconv"
 )
@@ -35,7 +36,7 @@ type IdentifierPair struct {
 // CreateWithDLQ will create a queue along with another queue which will act as the
 // dead letter queue, the dead letter queue will be named as the original queue name with
 // "-dlq" suffix. The visibility timeout must also be provided.
-func CreateWithDLQ(ctx context.Context, svc *sqs.SQS, name string, timeout int) (IdentifierPair, error) {
+func CreateWithDLQ(ctx context.Context, svc sqsiface.SQSAPI, name string, timeout int) (IdentifierPair, error) {
 	dlqOutput, err := createQueue(ctx, svc, name+extensionDQL, nil)
 	if err != nil {
 		return IdentifierPair{}, errors.Wrapf(err, "creating dlq for %s", name)
@@ -64,33 +65,46 @@ func CreateWithDLQ(ctx context.Context, svc *sqs.SQS, name string, timeout int)
 }
 
 // UpdateVisibilityTimeout updates the visibility timeout for the given queue URL.
-func UpdateVisibilityTimeout(ctx context.Context, svc *sqs.SQS, queueURL string, timeout int) error {
+func UpdateVisibilityTimeout(ctx context.Context, svc sqsiface.SQSAPI, queueURL string, timeout int) error {
 	_, err := svc.SetQueueAttributesWithContext(ctx, &sqs.SetQueueAttributesInput{
 		Attributes: map[string]*string{attrNameVisibilityTimeout: aws.String(strconv.Itoa(timeout))},
 		QueueUrl:   aws.String(queueURL),
 	})
 	if err != nil {
-		return errors.Wrapf(err, "failed to set timeout %s attribute on queue %s", timeout, queueURL)
+		return errors.Wrapf(err, "failed to set timeout %d attribute on queue %s", timeout, queueURL)
 	}
 	return nil
 }
 
+// GetVisibilityTimeout gets the visibility timeout of the given queue URL.
+func GetVisibilityTimeout(ctx context.Context, svc sqsiface.SQSAPI, queueURL string) (int, error) {
+	attr, err := getAttribute(ctx, svc, queueURL, attrNameVisibilityTimeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get visibility timeout of queue %s", queueURL)
+	}
+	timeout, err := strconv.Atoi(attr)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid visibility timeout %q on queue %s", attr, queueURL)
+	}
+	return timeout, nil
+}
+
 // Delete takes a queue URL and removes it.
-func Delete(ctx context.Context, svc *sqs.SQS, url string) error {
+func Delete(ctx context.Context, svc sqsiface.SQSAPI, url string) error {
 	if _, err := svc.DeleteQueueWithContext(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(url)}); err != nil {
 		return errors.Wrapf(err, "failed to delete queue %s", url)
 	}
 	return nil
 }
 
-func createQueue(ctx context.Context, svc *sqs.SQS, name string, attributes map[string]*string) (*sqs.CreateQueueOutput, error) {
+func createQueue(ctx context.Context, svc sqsiface.SQSAPI, name string, attributes map[string]*string) (*sqs.CreateQueueOutput, error) {
 	return svc.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{
 		QueueName:  aws.String(name),
 		Attributes: attributes,
 	})
 }
 
-func getAttribute(ctx context.Context, svc *sqs.SQS, queueURL, attribute string) (string, error) {
+func getAttribute(ctx context.Context, svc sqsiface.SQSAPI, queueURL, attribute string) (string, error) {
 	out, err := svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
 		AttributeNames: []*string{aws.String(attribute)},
 		QueueUrl:       aws.String(queueURL),
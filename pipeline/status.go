@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+// State is the lifecycle state of a pipeline.
+type State string
+
+const (
+	// Available pipeline states.
+	StatePending  State = "PENDING"
+	StateCreating State = "CREATING"
+	StateActive   State = "ACTIVE"
+	StateUpdating State = "UPDATING"
+	StateDeleting State = "DELETING"
+	StateFailed   State = "FAILED"
+)
+
+// transitions holds the states each state is allowed to move to. The empty state represents a
+// pipeline with no status record, which is the case for new pipelines and for pipelines created
+// before statuses were recorded. In progress states are allowed to move to themselves as the
+// manager works through each step, and creations can move back to PENDING so that retried stream
+// records can start over where a failed invocation left off.
+var transitions = map[State][]State{
+	"":            {StatePending, StateUpdating, StateDeleting},
+	StatePending:  {StateCreating, StateFailed, StateDeleting},
+	StateCreating: {StatePending, StateCreating, StateActive, StateFailed, StateDeleting},
+	StateActive:   {StateUpdating, StateDeleting},
+	StateUpdating: {StateUpdating, StateActive, StateFailed, StateDeleting},
+	StateDeleting: {StateDeleting, StateFailed},
+	StateFailed:   {StatePending, StateUpdating, StateDeleting},
+}
+
+// CanTransition reports whether a pipeline is allowed to move from one state to another.
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Status holds the lifecycle status of a pipeline, there is at most one Status per pipeline ID.
+type Status struct {
+	ID             string                 `json:"id"                        dynamodbav:"id"`
+	State          State                  `json:"state"                     dynamodbav:"state"`
+	Step           string                 `json:"step,omitempty"            dynamodbav:"step,omitempty"`
+	LastError      string                 `json:"last_error,omitempty"      dynamodbav:"last_error,omitempty"`
+	ConfigVersion  int64                  `json:"config_version"            dynamodbav:"config_version"`
+	SequenceNumber string                 `json:"sequence_number,omitempty" dynamodbav:"sequence_number,omitempty"` // stream record the config version was applied from
+	CreatedAt      time.Time              `json:"created_at"                dynamodbav:"created_at"`
+	UpdatedAt      time.Time              `json:"updated_at"                dynamodbav:"updated_at"`
+	LastAdjustment *ConcurrencyAdjustment `json:"last_adjustment,omitempty" dynamodbav:"last_adjustment,omitempty"` // last change the tuner made to the consumer's concurrency
+}
+
+// ConcurrencyAdjustment is a change the tuner made to the reserved concurrency of a pipeline's
+// consumer, along with why.
+type ConcurrencyAdjustment struct {
+	From   *int64    `json:"from,omitempty" dynamodbav:"from,omitempty"` // nil if the consumer had none reserved
+	To     int64     `json:"to"             dynamodbav:"to"`
+	Reason string    `json:"reason"         dynamodbav:"reason"`
+	At     time.Time `json:"at"             dynamodbav:"at"`
+}
+
+// Transition returns a copy of the Status moved to the given state and step, it errors if the
+// transition is not allowed. The last error is only kept when moving to FAILED.
+func (s Status) Transition(to State, step string, at time.Time) (Status, error) {
+	if !CanTransition(s.State, to) {
+		return s, errors.Errorf("pipeline %s can not move from state %q to %q", s.ID, s.State, to)
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = at
+	}
+	s.State = to
+	s.Step = step
+	s.UpdatedAt = at
+	if to != StateFailed {
+		s.LastError = ""
+	}
+	return s, nil
+}
+
+// statusUnchanged returns a condition which matches a Status item in the same state, at the same
+// config version and last updated at the same time as the given Status, times are stored in the
+// RFC 3339 format dynamodbattribute writes them in.
+func statusUnchanged(status Status) *condition {
+	return &condition{
+		expression: "#state = :state AND #config_version = :config_version AND #updated_at = :updated_at",
+		names: map[string]*string{
+			"#state":          aws.String("state"),
+			"#config_version": aws.String("config_version"),
+			"#updated_at":     aws.String("updated_at"),
+		},
+		values: map[string]*dynamodb.AttributeValue{
+			":state":          {S: aws.String(string(status.State))},
+			":config_version": {N: aws.String(strconv.FormatInt(status.ConfigVersion, 10))},
+			":updated_at":     {S: aws.String(status.UpdatedAt.Format(time.RFC3339Nano))},
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package pipeline_test
+
+import (
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStatusTransition(t *testing.T) {
+	created := time.Date(2020, 5, 17, 13, 0, 0, 0, time.UTC)
+	later := created.Add(time.Minute)
+	tests := []struct {
+		name    string
+		status  pipeline.Status
+		to      pipeline.State
+		at      time.Time
+		want    pipeline.Status
+		wantErr bool
+	}{
+		{
+			name:   "new pipeline is pending",
+			status: pipeline.Status{ID: "id"},
+			to:     pipeline.StatePending,
+			at:     created,
+			want:   pipeline.Status{ID: "id", State: pipeline.StatePending, Step: "step", CreatedAt: created, UpdatedAt: created},
+		},
+		{
+			name:   "failed pipeline keeps its last error",
+			status: pipeline.Status{ID: "id", State: pipeline.StateCreating, CreatedAt: created, UpdatedAt: created},
+			to:     pipeline.StateFailed,
+			at:     later,
+			want:   pipeline.Status{ID: "id", State: pipeline.StateFailed, Step: "step", CreatedAt: created, UpdatedAt: later},
+		},
+		{
+			name:   "recovered pipeline clears its last error",
+			status: pipeline.Status{ID: "id", State: pipeline.StateFailed, LastError: "boom", CreatedAt: created, UpdatedAt: created},
+			to:     pipeline.StateUpdating,
+			at:     later,
+			want:   pipeline.Status{ID: "id", State: pipeline.StateUpdating, Step: "step", CreatedAt: created, UpdatedAt: later},
+		},
+		{
+			name:    "active pipeline can not be created",
+			status:  pipeline.Status{ID: "id", State: pipeline.StateActive},
+			to:      pipeline.StateCreating,
+			wantErr: true,
+		},
+		{
+			name:    "deleting pipeline can not be made active",
+			status:  pipeline.Status{ID: "id", State: pipeline.StateDeleting},
+			to:      pipeline.StateActive,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.status.Transition(tt.to, "step", tt.at)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected transition error: %v", err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the requested item does not exist.
+var ErrNotFound = errors.New("item not found")
+
+// IsNotFound reports whether the cause of the error is ErrNotFound.
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == ErrNotFound
+}
+
+// defaultListLimit is the page size used when a ListInput does not specify a limit.
+const defaultListLimit = 100
+
+// ListInput specifies the page of items to list. The order of the items is up to the Store, and
+// cursors are only valid for the Store that returned them.
+type ListInput struct {
+	Limit  int    // maximum number of items to return, defaults to 100
+	Cursor string // cursor returned with the previous page, empty for the first page
+}
+
+// ConfigPage is a page of Configs, NextCursor is empty when there are no more pages.
+type ConfigPage struct {
+	Configs    []Config
+	NextCursor string
+}
+
+// ProfilePage is a page of Profiles, NextCursor is empty when there are no more pages.
+type ProfilePage struct {
+	Profiles   []Profile
+	NextCursor string
+}
+
+// IdentifierPage is a page of Identifiers, NextCursor is empty when there are no more pages.
+type IdentifierPage struct {
+	Identifiers []Identifier
+	NextCursor  string
+}
+
+// HistoryPage is a page of HistoryEntries, NextCursor is empty when there are no more pages.
+type HistoryPage struct {
+	Entries    []HistoryEntry
+	NextCursor string
+}
+
+// StatusPage is a page of Statuses, NextCursor is empty when there are no more pages.
+type StatusPage struct {
+	Statuses   []Status
+	NextCursor string
+}
+
+// Store persists the pipeline Configs, Profiles, Identifiers, Statuses, operation Journals, Config
+// history, audit records and processed events, each through the narrower interface it embeds, which
+// is what the code using only some of them takes.
+// Get methods return ErrNotFound when the item does not exist, the conditional methods return a
+// *ConflictError when the stored version does not allow the write.
+type Store interface {
+	ConfigStore
+	ProfileStore
+	IdentifierStore
+	StatusStore
+	JournalStore
+	HistoryStore
+	AuditStore
+	EventStore
+}
+
+// ConfigStore persists the pipeline Configs.
+type ConfigStore interface {
+	GetConfig(ctx context.Context, id string) (Config, error)
+	ListConfigs(ctx context.Context, in ListInput) (ConfigPage, error)
+	ListConfigsByProfile(ctx context.Context, profile string, in ListInput) (ConfigPage, error)
+	PutConfig(ctx context.Context, config Config) error
+	PutConfigIfVersion(ctx context.Context, config Config) (Config, error)
+	DeleteConfig(ctx context.Context, id string) error
+	DeleteConfigIfVersion(ctx context.Context, id string, version int64) error
+}
+
+// ProfileStore persists the Profiles Configs reference.
+type ProfileStore interface {
+	GetProfile(ctx context.Context, id string) (Profile, error)
+	ListProfiles(ctx context.Context, in ListInput) (ProfilePage, error)
+	PutProfileIfVersion(ctx context.Context, profile Profile) (Profile, error)
+	DeleteProfileIfVersion(ctx context.Context, id string, version int64) error
+}
+
+// IdentifierStore persists the Identifiers of the created pipelines. DeleteIdentifierIfNotStale
+// leaves a Tombstone in place of the Identifier, which Get and List treat as not existing until an
+// Identifier is put again.
+type IdentifierStore interface {
+	GetIdentifier(ctx context.Context, id string) (Identifier, error)
+	ListIdentifiers(ctx context.Context, in ListInput) (IdentifierPage, error)
+	PutIdentifier(ctx context.Context, ident Identifier) error
+	PutIdentifierIfNotStale(ctx context.Context, ident Identifier) error
+	DeleteIdentifier(ctx context.Context, id string) error
+	DeleteIdentifierIfNotStale(ctx context.Context, tombstone Tombstone) error
+	GetTombstone(ctx context.Context, id string) (Tombstone, error)
+}
+
+// StatusStore persists the Statuses of the pipelines.
+type StatusStore interface {
+	GetStatus(ctx context.Context, id string) (Status, error)
+	ListStatuses(ctx context.Context, in ListInput) (StatusPage, error)
+	PutStatus(ctx context.Context, status Status) error
+	PutStatusIfUnchanged(ctx context.Context, status Status) error
+	DeleteStatus(ctx context.Context, id string) error
+}
+
+// JournalStore persists the Journals of the operations on the pipelines.
+type JournalStore interface {
+	GetJournal(ctx context.Context, id, sequenceNumber string) (Journal, error)
+	PutJournal(ctx context.Context, journal Journal) error
+}
+
+// HistoryStore persists the history of the Configs applied.
+type HistoryStore interface {
+	ListHistory(ctx context.Context, id string, in ListInput) (HistoryPage, error) // newest first
+	PutHistory(ctx context.Context, entry HistoryEntry) error
+}
+
+// AuditStore persists the audit records of the instructions handled.
+type AuditStore interface {
+	ListAudit(ctx context.Context, id string, in AuditInput) (AuditPage, error) // oldest first
+	PutAudit(ctx context.Context, record AuditRecord) error
+}
+
+// EventStore persists the stream events processed.
+type EventStore interface {
+	GetEvent(ctx context.Context, id string) (ProcessedEvent, error)
+	ClaimEvent(ctx context.Context, event ProcessedEvent, now time.Time) error
+	PutEvent(ctx context.Context, event ProcessedEvent) error
+	DeleteEvent(ctx context.Context, id string) error
+}
+
+func listLimit(in ListInput) int {
+	if in.Limit <= 0 {
+		return defaultListLimit
+	}
+	return in.Limit
+}
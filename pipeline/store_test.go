@@ -0,0 +1,209 @@
+package pipeline_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/awsfake"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// db adapts the DynamoDB fake to the DynamoDB API, the fake's CreateTable helper stops it
+// implementing the interface itself.
+type db struct {
+	dynamodbiface.DynamoDBAPI
+	fake *awsfake.DynamoDB
+}
+
+func newDynamoStore() *pipeline.DynamoStore {
+	fake := awsfake.NewDynamoDB()
+	fake.CreateTable("configs", "id")
+	fake.CreateTable("identifiers", "id")
+	fake.CreateTable("statuses", "id")
+	return pipeline.NewDynamoStore(&db{fake: fake}, pipeline.Tables{Configs: "configs", Identifiers: "identifiers", Statuses: "statuses"})
+}
+
+func (d *db) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return d.fake.GetItemWithContext(ctx, in, opts...)
+}
+
+func (d *db) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return d.fake.PutItemWithContext(ctx, in, opts...)
+}
+
+func (d *db) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	return d.fake.DeleteItemWithContext(ctx, in, opts...)
+}
+
+func (d *db) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return d.fake.QueryWithContext(ctx, in, opts...)
+}
+
+func (d *db) ScanWithContext(ctx aws.Context, in *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	return d.fake.ScanWithContext(ctx, in, opts...)
+}
+
+func stores() map[string]func() pipeline.Store {
+	return map[string]func() pipeline.Store{
+		"memory": func() pipeline.Store { return pipeline.NewMemoryStore() },
+		"dynamo": func() pipeline.Store { return newDynamoStore() },
+	}
+}
+
+func TestStoreConditionalWrites(t *testing.T) {
+	for name, newStore := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore()
+
+			written, err := store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id"})
+			if err != nil {
+				t.Fatalf("failed to put new config: %v", err)
+			}
+			assert.Equal(t, int64(1), written.Version)
+			_, err = store.PutConfigIfVersion(ctx, pipeline.Config{ID: "id"})
+			assert.True(t, pipeline.IsConflict(err), "stale config write should conflict")
+			err = store.DeleteConfigIfVersion(ctx, "id", 0)
+			assert.True(t, pipeline.IsConflict(err), "stale config delete should conflict")
+			assert.NoError(t, store.DeleteConfigIfVersion(ctx, "id", 1))
+
+			if err := store.PutIdentifierIfNotStale(ctx, pipeline.Identifier{ID: "id", Version: 2}); err != nil {
+				t.Fatalf("failed to put identifier: %v", err)
+			}
+			err = store.PutIdentifierIfNotStale(ctx, pipeline.Identifier{ID: "id", Version: 1})
+			assert.True(t, pipeline.IsConflict(err), "stale identifier write should conflict")
+			err = store.DeleteIdentifierIfNotStale(ctx, pipeline.Tombstone{ID: "id", SequenceNumber: "300", Version: 1})
+			assert.True(t, pipeline.IsConflict(err), "stale identifier delete should conflict")
+			_, err = store.GetTombstone(ctx, "id")
+			assert.True(t, pipeline.IsNotFound(err), "live identifier should have no tombstone")
+		})
+	}
+}
+
+func TestStorePutStatusIfUnchanged(t *testing.T) {
+	for name, newStore := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore()
+
+			err := store.PutStatusIfUnchanged(ctx, pipeline.Status{ID: "id", State: pipeline.StateActive})
+			assert.True(t, pipeline.IsConflict(err), "missing status write should conflict")
+
+			read := pipeline.Status{ID: "id", State: pipeline.StateActive, ConfigVersion: 1, UpdatedAt: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)}
+			if err := store.PutStatus(ctx, read); err != nil {
+				t.Fatalf("failed to put status: %v", err)
+			}
+			read.LastAdjustment = &pipeline.ConcurrencyAdjustment{To: 2}
+			assert.NoError(t, store.PutStatusIfUnchanged(ctx, read))
+
+			updating, err := read.Transition(pipeline.StateUpdating, "update consumer", read.UpdatedAt.Add(time.Second))
+			if err != nil {
+				t.Fatalf("failed to transition: %v", err)
+			}
+			if err := store.PutStatus(ctx, updating); err != nil {
+				t.Fatalf("failed to put status: %v", err)
+			}
+			read.LastAdjustment = &pipeline.ConcurrencyAdjustment{To: 3}
+			err = store.PutStatusIfUnchanged(ctx, read)
+			assert.True(t, pipeline.IsConflict(err), "stale status write should conflict")
+
+			stored, err := store.GetStatus(ctx, "id")
+			assert.NoError(t, err)
+			assert.Equal(t, pipeline.StateUpdating, stored.State)
+			assert.Equal(t, int64(2), stored.LastAdjustment.To)
+		})
+	}
+}
+
+func TestStoreTombstones(t *testing.T) {
+	for name, newStore := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore()
+
+			if err := store.PutIdentifierIfNotStale(ctx, pipeline.Identifier{ID: "id", QueueURL: "url", Version: 3}); err != nil {
+				t.Fatalf("failed to put identifier: %v", err)
+			}
+			tombstone := pipeline.Tombstone{ID: "id", SequenceNumber: "300", Version: 3}
+			if err := store.DeleteIdentifierIfNotStale(ctx, tombstone); err != nil {
+				t.Fatalf("failed to delete identifier: %v", err)
+			}
+			_, err := store.GetIdentifier(ctx, "id")
+			assert.True(t, pipeline.IsNotFound(err), "deleted identifier should not be found")
+			page, err := store.ListIdentifiers(ctx, pipeline.ListInput{})
+			if err != nil {
+				t.Fatalf("failed to list identifiers: %v", err)
+			}
+			assert.Empty(t, page.Identifiers)
+			got, err := store.GetTombstone(ctx, "id")
+			if err != nil {
+				t.Fatalf("failed to get tombstone: %v", err)
+			}
+			assert.Equal(t, tombstone, got)
+			assert.NoError(t, store.DeleteIdentifierIfNotStale(ctx, tombstone), "retried delete should not conflict")
+
+			// the pipeline is added again, its config versions starting over
+			if err := store.PutIdentifierIfNotStale(ctx, pipeline.Identifier{ID: "id", QueueURL: "new-url", Version: 1}); err != nil {
+				t.Fatalf("failed to put identifier over tombstone: %v", err)
+			}
+			ident, err := store.GetIdentifier(ctx, "id")
+			if err != nil {
+				t.Fatalf("failed to get identifier: %v", err)
+			}
+			assert.Equal(t, pipeline.Identifier{ID: "id", QueueURL: "new-url", Version: 1}, ident)
+			_, err = store.GetTombstone(ctx, "id")
+			assert.True(t, pipeline.IsNotFound(err), "tombstone should be replaced")
+		})
+	}
+}
+
+func TestStoreListConfigsByProfile(t *testing.T) {
+	for name, newStore := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore()
+			for _, c := range []pipeline.Config{
+				{ID: "a", Profile: "scraper"},
+				{ID: "b"},
+				{ID: "c", Profile: "scraper"},
+				{ID: "d", Profile: "other"},
+				{ID: "e", Profile: "scraper"},
+			} {
+				if err := store.PutConfig(ctx, c); err != nil {
+					t.Fatalf("failed to put config %s: %v", c.ID, err)
+				}
+			}
+
+			var ids []string
+			in := pipeline.ListInput{Limit: 2}
+			for {
+				page, err := store.ListConfigsByProfile(ctx, "scraper", in)
+				if err != nil {
+					t.Fatalf("failed to list configs: %v", err)
+				}
+				for _, c := range page.Configs {
+					ids = append(ids, c.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				in.Cursor = page.NextCursor
+			}
+			assert.ElementsMatch(t, []string{"a", "c", "e"}, ids)
+		})
+	}
+}
+
+func TestTombstoneAfter(t *testing.T) {
+	tombstone := pipeline.Tombstone{SequenceNumber: "300"}
+	assert.True(t, tombstone.After("299"))
+	assert.True(t, tombstone.After("99"))
+	assert.False(t, tombstone.After("300"), "the removing record is not before itself")
+	assert.False(t, tombstone.After("301"))
+	assert.False(t, tombstone.After("1000"))
+}
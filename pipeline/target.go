@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+// Tuned reports whether the Config's concurrency is tuned to its target rate rather than set.
+func (c Config) Tuned() bool {
+	return c.TargetRatePerSecond > 0
+}
+
+// Adaptive reports whether the Config's concurrency adapts to the downstream API throttling tasks,
+// up to its concurrency limit.
+func (c Config) Adaptive() bool {
+	return c.AdaptiveConcurrency != nil && *c.AdaptiveConcurrency
+}
+
+// Controlled reports whether the consumer's concurrency is set by the tuner rather than by the
+// Config, between the concurrency bounds.
+func (c Config) Controlled() bool {
+	return c.Tuned() || c.Adaptive()
+}
+
+// ConcurrencyBounds returns the least and most concurrency the tuner sets, with the defaults
+// applied. Adaptive concurrency is bounded above by the concurrency limit.
+func (c Config) ConcurrencyBounds() (min, max int) {
+	c = c.WithDefaults()
+	if c.Adaptive() && c.LambdaConcurrencyLimit != nil {
+		return c.MinConcurrency, *c.LambdaConcurrencyLimit
+	}
+	return c.MinConcurrency, c.MaxConcurrency
+}
+
+// TargetConcurrency returns the concurrency needed to handle the target rate when tasks take d on
+// average, by Little's law the rate times the duration rounded up, within the concurrency bounds.
+func (c Config) TargetConcurrency(d time.Duration) int {
+	n := int(math.Ceil(c.TargetRatePerSecond * d.Seconds()))
+	return c.ClampConcurrency(&n)
+}
+
+// ClampConcurrency returns the concurrency moved within the Config's concurrency bounds. No
+// concurrency, nil, is moved to where a new consumer starts: the lower bound of a target rate, as
+// the rate is worked up to once tasks are measured, and the limit of adaptive concurrency, which
+// only backs off once tasks are throttled.
+func (c Config) ClampConcurrency(concurrency *int) int {
+	min, max := c.ConcurrencyBounds()
+	if concurrency == nil {
+		if c.Adaptive() {
+			return max
+		}
+		return min
+	}
+	if *concurrency < min {
+		return min
+	}
+	if *concurrency > max {
+		return max
+	}
+	return *concurrency
+}
+
+// validateConcurrency checks the target rate, adaptive concurrency and their concurrency bounds.
+// The bounds are only settings of configs with either, a target rate takes the place of the
+// concurrency limit while adaptive concurrency needs one to grow up to.
+func (c Config) validateConcurrency() error {
+	if c.TargetRatePerSecond < 0 || math.IsNaN(c.TargetRatePerSecond) || math.IsInf(c.TargetRatePerSecond, 0) {
+		return errors.Errorf("target rate per second %v must be a positive number", c.TargetRatePerSecond)
+	}
+	switch {
+	case c.Tuned() && c.Adaptive():
+		return errors.New("adaptive concurrency can not be set along with a target rate per second")
+	case c.Tuned():
+		if c.LambdaConcurrencyLimit != nil {
+			return errors.New("concurrency limit can not be set along with a target rate per second, it is tuned")
+		}
+	case c.Adaptive():
+		if c.LambdaConcurrencyLimit == nil || *c.LambdaConcurrencyLimit < 1 {
+			return errors.New("adaptive concurrency needs a concurrency limit of at least 1 to grow up to")
+		}
+		if c.MaxConcurrency != 0 {
+			return errors.New("max concurrency can not be set along with adaptive concurrency, the concurrency limit is the max")
+		}
+	default:
+		if c.MinConcurrency != 0 || c.MaxConcurrency != 0 {
+			return errors.New("min and max concurrency can only be set along with a target rate per second or adaptive concurrency")
+		}
+		return nil
+	}
+	if min, max := c.ConcurrencyBounds(); min < 1 || max < min {
+		return errors.Errorf("concurrency bounds %d to %d must be at least 1 and in order", min, max)
+	}
+	return nil
+}
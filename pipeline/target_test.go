@@ -0,0 +1,52 @@
+package pipeline_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTargetConcurrency(t *testing.T) {
+	tests := []struct {
+		name   string
+		config pipeline.Config
+		d      time.Duration
+		want   int
+	}{
+		{"rate times duration", pipeline.Config{TargetRatePerSecond: 10}, 1500 * time.Millisecond, 15},
+		{"rounded up", pipeline.Config{TargetRatePerSecond: 3}, 100 * time.Millisecond, 1},
+		{"at least the min", pipeline.Config{TargetRatePerSecond: 1, MinConcurrency: 4}, time.Second, 4},
+		{"at most the max", pipeline.Config{TargetRatePerSecond: 10, MaxConcurrency: 5}, time.Second, 5},
+		{"at most the default max", pipeline.Config{TargetRatePerSecond: 1000}, time.Second, pipeline.DefaultMaxConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.config.TargetConcurrency(tt.d))
+		})
+	}
+}
+
+func TestClampConcurrency(t *testing.T) {
+	c := pipeline.Config{TargetRatePerSecond: 1, MinConcurrency: 2, MaxConcurrency: 8}
+	n := func(v int) *int { return &v }
+	assert.Equal(t, 2, c.ClampConcurrency(nil))
+	assert.Equal(t, 2, c.ClampConcurrency(n(1)))
+	assert.Equal(t, 5, c.ClampConcurrency(n(5)))
+	assert.Equal(t, 8, c.ClampConcurrency(n(20)))
+
+	adaptive := pipeline.Config{LambdaConcurrencyLimit: n(6), AdaptiveConcurrency: aws.Bool(true)}
+	assert.Equal(t, 6, adaptive.ClampConcurrency(nil), "adaptive concurrency starts at the limit")
+	assert.Equal(t, 1, adaptive.ClampConcurrency(n(0)))
+	assert.Equal(t, 6, adaptive.ClampConcurrency(n(9)))
+}
+
+func TestValidateAdaptiveConcurrency(t *testing.T) {
+	limit := 6
+	c := pipeline.Config{ID: "a", LambdaConcurrencyLimit: &limit, AdaptiveConcurrency: aws.Bool(true), MinConcurrency: 2}
+	assert.NoError(t, c.Validate())
+	min, max := c.ConcurrencyBounds()
+	assert.Equal(t, 2, min)
+	assert.Equal(t, 6, max)
+}
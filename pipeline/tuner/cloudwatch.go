@@ -0,0 +1,91 @@
+package tuner
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/taskrunner"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// IngestionDelay is how far behind now the window of a CloudWatchSource ends, the consumers'
+// metrics are written to their logs and can take a minute or two to be ingested by CloudWatch, a
+// window reaching up to now would miss the latest of them and the next run's would not cover them.
+const IngestionDelay = 2 * time.Minute
+
+var _ Source = (*CloudWatchSource)(nil)
+
+// CloudWatchSource is a Source reading the task metrics the consumers emit under the namespace,
+// over a trailing window ending IngestionDelay ago, on the minute.
+// The window should be the time between Tuner runs, so that each run sees the outcomes since the
+// last.
+type CloudWatchSource struct {
+	svc       cloudwatchiface.CloudWatchAPI
+	namespace string
+	window    time.Duration
+	now       func() time.Time
+}
+
+// NewCloudWatchSource returns a new instance of CloudWatchSource reading the consumers' metrics
+// from the namespace, over the given window.
+func NewCloudWatchSource(svc cloudwatchiface.CloudWatchAPI, namespace string, window time.Duration) *CloudWatchSource {
+	return &CloudWatchSource{svc: svc, namespace: namespace, window: window, now: time.Now}
+}
+
+// AverageDuration returns the average duration of the function's successful tasks over the window,
+// from the taskrunner.Metrics by function name, each minute weighted by its number of tasks. Failed
+// and deferred tasks, which return early, are left out. It reports false when there were none.
+func (s *CloudWatchSource) AverageDuration(ctx context.Context, functionName string) (time.Duration, bool, error) {
+	points, err := s.statistics(ctx, s.namespace, taskrunner.MetricSuccessDuration, functionName, cloudwatch.StatisticAverage, cloudwatch.StatisticSampleCount)
+	if err != nil {
+		return 0, false, err
+	}
+	var total, count float64
+	for _, p := range points {
+		n := aws.Float64Value(p.SampleCount)
+		total += aws.Float64Value(p.Average) * n
+		count += n
+	}
+	if count == 0 {
+		return 0, false, nil
+	}
+	return time.Duration(total / count * float64(time.Millisecond)), true, nil
+}
+
+// Outcomes returns the tasks the function handled over the window and how many were throttled,
+// from the taskrunner.Metrics by function name.
+func (s *CloudWatchSource) Outcomes(ctx context.Context, functionName string) (Outcomes, error) {
+	var o Outcomes
+	for metric, sum := range map[string]*float64{taskrunner.MetricTasks: &o.Tasks, taskrunner.MetricThrottled: &o.Throttled} {
+		points, err := s.statistics(ctx, s.namespace, metric, functionName, cloudwatch.StatisticSum)
+		if err != nil {
+			return Outcomes{}, err
+		}
+		for _, p := range points {
+			*sum += aws.Float64Value(p.Sum)
+		}
+	}
+	return o, nil
+}
+
+// statistics returns the minutely statistics of the function's metric over the window.
+func (s *CloudWatchSource) statistics(ctx context.Context, namespace, metric, functionName string, statistics ...string) ([]*cloudwatch.Datapoint, error) {
+	end := s.now().Add(-IngestionDelay).Truncate(time.Minute)
+	out, err := s.svc.GetMetricStatisticsWithContext(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String(namespace),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("FunctionName"), Value: aws.String(functionName)},
+		},
+		StartTime:  aws.Time(end.Add(-s.window)),
+		EndTime:    aws.Time(end),
+		Period:     aws.Int64(60),
+		Statistics: aws.StringSlice(statistics),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s of function %s", metric, functionName)
+	}
+	return out.Datapoints, nil
+}
@@ -0,0 +1,234 @@
+// Package tuner tunes the reserved concurrency of pipeline consumers whose concurrency is not set
+// by their config. The concurrency needed to start a target number of tasks a second is the rate
+// times how long a task takes, so it is worked out again from the consumer's measured task duration
+// on every run. Adaptive concurrency instead follows the downstream API: it is cut when tasks were
+// throttled since the last run, and grown a step at a time while tasks run without throttles, AIMD
+// as TCP does for congestion. Either way the concurrency is kept within the pipeline's bounds.
+package tuner
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+// Steps of adaptive concurrency, added while tasks run without throttles and multiplied by when
+// they are throttled.
+const (
+	AdditiveIncrease       = 1
+	MultiplicativeDecrease = 0.5
+)
+
+// DurationSource measures how long a consumer function takes to handle its tasks.
+type DurationSource interface {
+	// AverageDuration returns the recent average duration of the function's successful tasks, it
+	// reports false when there were none to measure.
+	AverageDuration(ctx context.Context, functionName string) (time.Duration, bool, error)
+}
+
+// Outcomes counts the tasks a consumer function handled since the last run, and how many of them
+// were throttled by the downstream API.
+type Outcomes struct {
+	Tasks     float64
+	Throttled float64
+}
+
+// OutcomeSource counts the outcomes of a consumer function's tasks.
+type OutcomeSource interface {
+	Outcomes(ctx context.Context, functionName string) (Outcomes, error)
+}
+
+// Source measures what the Tuner needs to know about consumer functions.
+type Source interface {
+	DurationSource
+	OutcomeSource
+}
+
+// Store is the store the Tuner reads the pipelines from and records its adjustments in.
+type Store interface {
+	pipeline.ConfigStore
+	pipeline.ProfileStore
+	pipeline.IdentifierStore
+	pipeline.StatusStore
+}
+
+// Adjustment is a change the Tuner made to a consumer's reserved concurrency.
+type Adjustment struct {
+	ID           string // pipeline ID
+	ConsumerName string // lambda function name
+	From         *int64 // reserved concurrency before, nil if there was none
+	To           int64  // reserved concurrency after
+	Reason       string // what the change was worked out from
+}
+
+func (a Adjustment) String() string {
+	from := "none"
+	if a.From != nil {
+		from = fmt.Sprint(*a.From)
+	}
+	return fmt.Sprintf("pipeline %s consumer concurrency %s -> %d, %s", a.ID, from, a.To, a.Reason)
+}
+
+// Tuner sets the reserved concurrency of the consumers of tuned and adaptive pipelines.
+type Tuner struct {
+	lambdaSvc lambdaiface.LambdaAPI
+	store     Store
+	source    Source
+	log       *logrus.Logger
+}
+
+// New returns a new instance of Tuner.
+func New(lambdaSvc lambdaiface.LambdaAPI, store Store, source Source, log *logrus.Logger) *Tuner {
+	return &Tuner{lambdaSvc: lambdaSvc, store: store, source: source, log: log}
+}
+
+// Tune sets the reserved concurrency of every active tuned or adaptive pipeline's consumer. A
+// target rate is turned into the concurrency it needs going by the consumer's measured task
+// duration, adaptive concurrency is stepped from the consumer's current concurrency going by its
+// task outcomes. Consumers with nothing measured, or already at the concurrency worked out, are
+// left alone, as are pipelines the manager is working on. Every change is logged and recorded as
+// the last adjustment of the pipeline's status.
+//
+// A pipeline failing to tune does not stop the rest, the first error is returned once all are done.
+func (t *Tuner) Tune(ctx context.Context) ([]Adjustment, error) {
+	configs, err := pipeline.ListAllConfigs(ctx, t.store)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list configs")
+	}
+	var adjustments []Adjustment
+	var first error
+	for _, c := range configs {
+		adj, ok, err := t.tune(ctx, c)
+		if err != nil {
+			t.log.Errorf("failed to tune pipeline %s: %v", c.ID, err)
+			if first == nil {
+				first = errors.Wrapf(err, "failed to tune pipeline %s", c.ID)
+			}
+			continue
+		}
+		if ok {
+			t.log.WithField("pipeline_id", adj.ID).Info(adj.String())
+			adjustments = append(adjustments, adj)
+		}
+	}
+	return adjustments, first
+}
+
+// tune tunes the consumer of a single pipeline, it reports false when nothing was changed.
+func (t *Tuner) tune(ctx context.Context, c pipeline.Config) (Adjustment, bool, error) {
+	if c.Profile != "" {
+		p, err := t.store.GetProfile(ctx, c.Profile)
+		if err != nil && !pipeline.IsNotFound(err) {
+			return Adjustment{}, false, errors.Wrapf(err, "failed to get profile %s", c.Profile)
+		}
+		c = c.Resolve(p)
+	}
+	if !c.Controlled() {
+		return Adjustment{}, false, nil
+	}
+	status, err := t.store.GetStatus(ctx, c.ID)
+	if err != nil && !pipeline.IsNotFound(err) {
+		return Adjustment{}, false, errors.Wrap(err, "failed to get status")
+	}
+	if status.State != pipeline.StateActive {
+		return Adjustment{}, false, nil
+	}
+	ident, err := t.store.GetIdentifier(ctx, c.ID)
+	if pipeline.IsNotFound(err) || ident.ConsumerName == "" {
+		return Adjustment{}, false, nil
+	}
+	if err != nil {
+		return Adjustment{}, false, errors.Wrap(err, "failed to get identifier")
+	}
+	settings, err := consumer.GetSettings(ctx, t.lambdaSvc, ident.ConsumerName)
+	if err != nil {
+		return Adjustment{}, false, err
+	}
+
+	adj := Adjustment{ID: c.ID, ConsumerName: ident.ConsumerName, From: settings.Concurrency}
+	var ok bool
+	if c.Tuned() {
+		adj.To, adj.Reason, ok, err = t.target(ctx, c, ident.ConsumerName)
+	} else {
+		adj.To, adj.Reason, ok, err = t.adapt(ctx, c, ident.ConsumerName, settings.Concurrency)
+	}
+	if err != nil || !ok || (adj.From != nil && *adj.From == adj.To) {
+		return Adjustment{}, false, err
+	}
+	// the manager may have started on the pipeline while it was measured, its consumer is then left to it.
+	current, err := t.store.GetStatus(ctx, c.ID)
+	if err != nil {
+		return Adjustment{}, false, errors.Wrap(err, "failed to get status")
+	}
+	if current.State != pipeline.StateActive || current.ConfigVersion != status.ConfigVersion {
+		return Adjustment{}, false, nil
+	}
+	if err := consumer.Update(ctx, t.lambdaSvc, consumer.UpdateParams{Name: ident.ConsumerName, Concurrency: aws.Int64(adj.To)}); err != nil {
+		return Adjustment{}, false, err
+	}
+	recorded := &pipeline.ConcurrencyAdjustment{From: adj.From, To: adj.To, Reason: adj.Reason, At: time.Now().UTC()}
+	if err := t.record(ctx, current, recorded); err != nil {
+		return Adjustment{}, false, err
+	}
+	return adj, true, nil
+}
+
+// recordAttempts is how many times the Tuner tries to record an adjustment before giving up.
+const recordAttempts = 3
+
+// record adds the adjustment made to the consumer to the pipeline's status. The status is not
+// written over a change the manager recorded since it was read, it is read again and the adjustment
+// added to it instead, the manager keeps the concurrency as it was adjusted. A status removed in
+// the meantime belongs to a deleted pipeline and is left alone.
+func (t *Tuner) record(ctx context.Context, status pipeline.Status, adj *pipeline.ConcurrencyAdjustment) error {
+	for attempt := 1; ; attempt++ {
+		status.LastAdjustment = adj
+		err := t.store.PutStatusIfUnchanged(ctx, status)
+		if !pipeline.IsConflict(err) || attempt == recordAttempts {
+			return errors.Wrap(err, "failed to record adjustment")
+		}
+		status, err = t.store.GetStatus(ctx, status.ID)
+		if pipeline.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to get status")
+		}
+	}
+}
+
+// target returns the concurrency the config's target rate needs, it reports false when the
+// consumer has no task duration measured.
+func (t *Tuner) target(ctx context.Context, c pipeline.Config, name string) (int64, string, bool, error) {
+	d, ok, err := t.source.AverageDuration(ctx, name)
+	if err != nil || !ok {
+		return 0, "", false, err
+	}
+	return int64(c.TargetConcurrency(d)), fmt.Sprintf("%v/s of tasks taking %s", c.TargetRatePerSecond, d), true, nil
+}
+
+// adapt returns the current concurrency, the limit if none is reserved, cut when tasks were
+// throttled and grown when tasks ran without throttles. It reports false when no tasks ran.
+func (t *Tuner) adapt(ctx context.Context, c pipeline.Config, name string, current *int64) (int64, string, bool, error) {
+	o, err := t.source.Outcomes(ctx, name)
+	if err != nil || o.Tasks == 0 {
+		return 0, "", false, err
+	}
+	n := c.ClampConcurrency(nil)
+	if current != nil {
+		n = int(*current)
+	}
+	if o.Throttled > 0 {
+		n = int(math.Floor(float64(n) * MultiplicativeDecrease))
+		return int64(c.ClampConcurrency(&n)), fmt.Sprintf("decrease, %v of %v tasks throttled", o.Throttled, o.Tasks), true, nil
+	}
+	n += AdditiveIncrease
+	return int64(c.ClampConcurrency(&n)), fmt.Sprintf("increase, %v tasks without throttles", o.Tasks), true, nil
+}
@@ -0,0 +1,327 @@
+package tuner_test
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/awsfake"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/consumer"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline/tuner"
+	"github.com/kinluek/serverless-controlled-batch-processing/taskrunner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// source is a Source of fixed durations and outcomes by function name, functions missing from it
+// have nothing measured. measuring, when set, is called as a function's duration is measured.
+type source struct {
+	durations map[string]time.Duration
+	outcomes  map[string]tuner.Outcomes
+	measuring func(functionName string)
+}
+
+func (s source) AverageDuration(ctx context.Context, functionName string) (time.Duration, bool, error) {
+	if functionName == "broken" {
+		return 0, false, errors.New("metrics unavailable")
+	}
+	if s.measuring != nil {
+		s.measuring(functionName)
+	}
+	v, ok := s.durations[functionName]
+	return v, ok, nil
+}
+
+func (s source) Outcomes(ctx context.Context, functionName string) (tuner.Outcomes, error) {
+	return s.outcomes[functionName], nil
+}
+
+func durations(d map[string]time.Duration) source {
+	return source{durations: d}
+}
+
+// addPipeline stores the config with an active status and a consumer with the given concurrency.
+func addPipeline(t *testing.T, store pipeline.Store, svc *awsfake.Lambda, config pipeline.Config, concurrency int64) {
+	ctx := context.Background()
+	name := config.ID + "-consumer"
+	if _, err := consumer.CreateFunction(ctx, svc, consumer.AddParams{Name: name, Timeout: 30}); err != nil {
+		t.Fatalf("failed to create function: %v", err)
+	}
+	if err := consumer.SetConcurrency(ctx, svc, name, concurrency); err != nil {
+		t.Fatalf("failed to set concurrency: %v", err)
+	}
+	assert.NoError(t, store.PutConfig(ctx, config))
+	assert.NoError(t, store.PutIdentifier(ctx, pipeline.Identifier{ID: config.ID, ConsumerName: name, Version: 1}))
+	assert.NoError(t, store.PutStatus(ctx, pipeline.Status{ID: config.ID, State: pipeline.StateActive}))
+}
+
+func concurrencyOf(t *testing.T, svc *awsfake.Lambda, name string) int64 {
+	f, ok := svc.Function(name)
+	if !ok || f.Concurrency == nil {
+		t.Fatalf("function %s has no concurrency", name)
+	}
+	return *f.Concurrency
+}
+
+func TestTune(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	svc := awsfake.NewLambda()
+	log, hook := test.NewNullLogger()
+
+	addPipeline(t, store, svc, pipeline.Config{ID: "tuned", TargetRatePerSecond: 10, Version: 1}, 1)
+	addPipeline(t, store, svc, pipeline.Config{ID: "bounded", TargetRatePerSecond: 10, MaxConcurrency: 5, Version: 1}, 1)
+	addPipeline(t, store, svc, pipeline.Config{ID: "steady", TargetRatePerSecond: 2, Version: 1}, 4)
+	addPipeline(t, store, svc, pipeline.Config{ID: "idle", TargetRatePerSecond: 2, Version: 1}, 3)
+	addPipeline(t, store, svc, pipeline.Config{ID: "fixed", LambdaConcurrencyLimit: aws.Int(2), Version: 1}, 2)
+	_, err := store.PutProfileIfVersion(ctx, pipeline.Profile{ID: "tuned", TargetRatePerSecond: 1, MinConcurrency: 3})
+	assert.NoError(t, err)
+	addPipeline(t, store, svc, pipeline.Config{ID: "profiled", Profile: "tuned", Version: 1}, 1)
+
+	measured := durations(map[string]time.Duration{
+		"tuned-consumer":    1500 * time.Millisecond,
+		"bounded-consumer":  time.Second,
+		"steady-consumer":   2 * time.Second,
+		"fixed-consumer":    time.Second,
+		"profiled-consumer": 100 * time.Millisecond,
+	})
+	adjustments, err := tuner.New(svc, store, measured, log).Tune(ctx)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(15), concurrencyOf(t, svc, "tuned-consumer"), "10/s of 1.5s tasks")
+	assert.Equal(t, int64(5), concurrencyOf(t, svc, "bounded-consumer"), "held to the max")
+	assert.Equal(t, int64(4), concurrencyOf(t, svc, "steady-consumer"))
+	assert.Equal(t, int64(3), concurrencyOf(t, svc, "idle-consumer"), "nothing measured")
+	assert.Equal(t, int64(2), concurrencyOf(t, svc, "fixed-consumer"), "not tuned")
+	assert.Equal(t, int64(3), concurrencyOf(t, svc, "profiled-consumer"), "held to the profile's min")
+
+	assert.Len(t, adjustments, 3)
+	for _, a := range adjustments {
+		if a.ID == "tuned" {
+			assert.Equal(t, int64(1), *a.From)
+			assert.Equal(t, int64(15), a.To)
+			assert.Equal(t, "10/s of tasks taking 1.5s", a.Reason)
+		}
+	}
+	assert.Len(t, hook.AllEntries(), 3, "every adjustment is logged")
+	status, _ := store.GetStatus(ctx, "tuned")
+	if assert.NotNil(t, status.LastAdjustment, "every adjustment is recorded in the status") {
+		assert.Equal(t, int64(15), status.LastAdjustment.To)
+		assert.Equal(t, pipeline.StateActive, status.State)
+	}
+}
+
+func TestTuneSkipsPipelinesNotActive(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	svc := awsfake.NewLambda()
+	log, _ := test.NewNullLogger()
+
+	addPipeline(t, store, svc, pipeline.Config{ID: "updating", TargetRatePerSecond: 10, Version: 1}, 1)
+	assert.NoError(t, store.PutStatus(ctx, pipeline.Status{ID: "updating", State: pipeline.StateUpdating}))
+
+	adjustments, err := tuner.New(svc, store, durations(map[string]time.Duration{"updating-consumer": time.Second}), log).Tune(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, adjustments)
+	assert.Equal(t, int64(1), concurrencyOf(t, svc, "updating-consumer"))
+}
+
+func TestTuneSkipsPipelinesChangedWhileMeasured(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	svc := awsfake.NewLambda()
+	log, _ := test.NewNullLogger()
+
+	addPipeline(t, store, svc, pipeline.Config{ID: "updating", TargetRatePerSecond: 10, Version: 1}, 1)
+	addPipeline(t, store, svc, pipeline.Config{ID: "reapplied", TargetRatePerSecond: 10, Version: 1}, 1)
+	measured := durations(map[string]time.Duration{"updating-consumer": time.Second, "reapplied-consumer": time.Second})
+	measured.measuring = func(functionName string) {
+		switch functionName {
+		case "updating-consumer":
+			assert.NoError(t, store.PutStatus(ctx, pipeline.Status{ID: "updating", State: pipeline.StateUpdating}))
+		case "reapplied-consumer":
+			assert.NoError(t, store.PutStatus(ctx, pipeline.Status{ID: "reapplied", State: pipeline.StateActive, ConfigVersion: 2}))
+		}
+	}
+
+	adjustments, err := tuner.New(svc, store, measured, log).Tune(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, adjustments)
+	assert.Equal(t, int64(1), concurrencyOf(t, svc, "updating-consumer"))
+	assert.Equal(t, int64(1), concurrencyOf(t, svc, "reapplied-consumer"))
+}
+
+// racingStore has the manager record a new state of the pipeline just before the tuner's first
+// write of its status.
+type racingStore struct {
+	*pipeline.MemoryStore
+	raced bool
+}
+
+func (s *racingStore) PutStatusIfUnchanged(ctx context.Context, status pipeline.Status) error {
+	if !s.raced {
+		s.raced = true
+		updating, err := status.Transition(pipeline.StateUpdating, "update consumer", time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		updating.LastAdjustment = nil
+		if err := s.PutStatus(ctx, updating); err != nil {
+			return err
+		}
+	}
+	return s.MemoryStore.PutStatusIfUnchanged(ctx, status)
+}
+
+func TestTuneRecordsAdjustmentsOverConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{MemoryStore: pipeline.NewMemoryStore()}
+	svc := awsfake.NewLambda()
+	log, _ := test.NewNullLogger()
+
+	addPipeline(t, store, svc, pipeline.Config{ID: "tuned", TargetRatePerSecond: 10, Version: 1}, 1)
+	measured := durations(map[string]time.Duration{"tuned-consumer": time.Second})
+	adjustments, err := tuner.New(svc, store, measured, log).Tune(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, adjustments, 1)
+	assert.True(t, store.raced)
+
+	status, err := store.GetStatus(ctx, "tuned")
+	assert.NoError(t, err)
+	assert.Equal(t, pipeline.StateUpdating, status.State, "the manager's change should be kept")
+	if assert.NotNil(t, status.LastAdjustment, "the adjustment should still be recorded") {
+		assert.Equal(t, int64(10), status.LastAdjustment.To)
+	}
+}
+
+func TestTuneContinuesPastFailures(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	svc := awsfake.NewLambda()
+	log, hook := test.NewNullLogger()
+
+	addPipeline(t, store, svc, pipeline.Config{ID: "a", TargetRatePerSecond: 4, Version: 1}, 1)
+	assert.NoError(t, store.PutConfig(ctx, pipeline.Config{ID: "b", TargetRatePerSecond: 4, Version: 1}))
+	assert.NoError(t, store.PutIdentifier(ctx, pipeline.Identifier{ID: "b", ConsumerName: "broken", Version: 1}))
+	assert.NoError(t, store.PutStatus(ctx, pipeline.Status{ID: "b", State: pipeline.StateActive}))
+
+	adjustments, err := tuner.New(svc, store, durations(map[string]time.Duration{"a-consumer": time.Second}), log).Tune(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "pipeline b")
+	assert.Len(t, adjustments, 1)
+	assert.Equal(t, int64(4), concurrencyOf(t, svc, "a-consumer"))
+	var levels []logrus.Level
+	for _, e := range hook.AllEntries() {
+		levels = append(levels, e.Level)
+	}
+	assert.ElementsMatch(t, []logrus.Level{logrus.InfoLevel, logrus.ErrorLevel}, levels)
+}
+
+// metrics stubs the CloudWatch API with fixed datapoints by metric name.
+type metrics struct {
+	cloudwatchiface.CloudWatchAPI
+	in         *cloudwatch.GetMetricStatisticsInput
+	datapoints map[string][]*cloudwatch.Datapoint
+}
+
+func (m *metrics) GetMetricStatisticsWithContext(ctx aws.Context, in *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	m.in = in
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: m.datapoints[aws.StringValue(in.MetricName)]}, nil
+}
+
+func TestCloudWatchSourceWeightsByInvocations(t *testing.T) {
+	svc := &metrics{datapoints: map[string][]*cloudwatch.Datapoint{
+		taskrunner.MetricSuccessDuration: {
+			{Average: aws.Float64(1000), SampleCount: aws.Float64(3)},
+			{Average: aws.Float64(2000), SampleCount: aws.Float64(1)},
+		},
+	}}
+	cw := tuner.NewCloudWatchSource(svc, "Test", 5*time.Minute)
+
+	d, ok, err := cw.AverageDuration(context.Background(), "fn")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1250*time.Millisecond, d)
+	assert.Equal(t, "Test", aws.StringValue(svc.in.Namespace))
+	assert.Equal(t, "fn", aws.StringValue(svc.in.Dimensions[0].Value))
+	assert.Equal(t, 5*time.Minute, svc.in.EndTime.Sub(*svc.in.StartTime))
+	assert.True(t, svc.in.EndTime.Before(time.Now().Add(-tuner.IngestionDelay)), "the window should leave time for metrics to be ingested")
+	assert.Equal(t, svc.in.EndTime.Truncate(time.Minute), *svc.in.EndTime, "the window should end on the minute")
+
+	svc.datapoints = nil
+	_, ok, err = cw.AverageDuration(context.Background(), "fn")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCloudWatchSourceSumsOutcomes(t *testing.T) {
+	svc := &metrics{datapoints: map[string][]*cloudwatch.Datapoint{
+		taskrunner.MetricTasks:     {{Sum: aws.Float64(3)}, {Sum: aws.Float64(4)}},
+		taskrunner.MetricThrottled: {{Sum: aws.Float64(2)}},
+	}}
+	cw := tuner.NewCloudWatchSource(svc, "Test", 5*time.Minute)
+
+	o, err := cw.Outcomes(context.Background(), "fn")
+	assert.NoError(t, err)
+	assert.Equal(t, tuner.Outcomes{Tasks: 7, Throttled: 2}, o)
+	assert.Equal(t, "Test", aws.StringValue(svc.in.Namespace))
+	assert.Equal(t, []string{cloudwatch.StatisticSum}, aws.StringValueSlice(svc.in.Statistics))
+}
+
+func TestTuneAdaptive(t *testing.T) {
+	ctx := context.Background()
+	store := pipeline.NewMemoryStore()
+	svc := awsfake.NewLambda()
+	log, hook := test.NewNullLogger()
+	adaptive := func(id string, limit int) pipeline.Config {
+		return pipeline.Config{ID: id, LambdaConcurrencyLimit: aws.Int(limit), AdaptiveConcurrency: aws.Bool(true), Version: 1}
+	}
+
+	addPipeline(t, store, svc, adaptive("throttled", 10), 10)
+	addPipeline(t, store, svc, adaptive("floored", 10), 1)
+	addPipeline(t, store, svc, adaptive("recovering", 10), 4)
+	addPipeline(t, store, svc, adaptive("limited", 10), 10)
+	addPipeline(t, store, svc, adaptive("idle", 10), 4)
+	m := adaptive("min", 10)
+	m.MinConcurrency = 3
+	addPipeline(t, store, svc, m, 5)
+
+	outcomes := source{outcomes: map[string]tuner.Outcomes{
+		"throttled-consumer":  {Tasks: 40, Throttled: 3},
+		"floored-consumer":    {Tasks: 5, Throttled: 5},
+		"recovering-consumer": {Tasks: 20},
+		"limited-consumer":    {Tasks: 20},
+		"min-consumer":        {Tasks: 20, Throttled: 1},
+	}}
+	adjustments, err := tuner.New(svc, store, outcomes, log).Tune(ctx)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(5), concurrencyOf(t, svc, "throttled-consumer"), "halved")
+	assert.Equal(t, int64(1), concurrencyOf(t, svc, "floored-consumer"), "never below 1")
+	assert.Equal(t, int64(5), concurrencyOf(t, svc, "recovering-consumer"), "one more")
+	assert.Equal(t, int64(10), concurrencyOf(t, svc, "limited-consumer"), "never above the limit")
+	assert.Equal(t, int64(4), concurrencyOf(t, svc, "idle-consumer"), "no tasks, nothing learnt")
+	assert.Equal(t, int64(3), concurrencyOf(t, svc, "min-consumer"), "halved to the min")
+
+	assert.Len(t, adjustments, 3)
+	assert.Len(t, hook.AllEntries(), 3)
+	status, _ := store.GetStatus(ctx, "throttled")
+	if assert.NotNil(t, status.LastAdjustment) {
+		assert.Equal(t, int64(10), *status.LastAdjustment.From)
+		assert.Equal(t, int64(5), status.LastAdjustment.To)
+		assert.Equal(t, "decrease, 3 of 40 tasks throttled", status.LastAdjustment.Reason)
+		assert.False(t, status.LastAdjustment.At.IsZero())
+	}
+	status, _ = store.GetStatus(ctx, "recovering")
+	if assert.NotNil(t, status.LastAdjustment) {
+		assert.Equal(t, "increase, 20 tasks without throttles", status.LastAdjustment.Reason)
+	}
+	status, _ = store.GetStatus(ctx, "limited")
+	assert.Nil(t, status.LastAdjustment, "nothing changed, nothing recorded")
+}
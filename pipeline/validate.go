@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"net/url"
+	"strings"
+)
+
+// Limits on the configurable values, set by the limits of Lambda and SQS.
+const (
+	MaxLambdaTimeoutSecs        = 900
+	MaxSQSVisibilityTimeoutSecs = 43200
+)
+
+// Defaults of the optional settings, the same defaults Lambda and SQS give new resources.
+const (
+	DefaultLambdaTimeoutSecs        = 3
+	DefaultSQSVisibilityTimeoutSecs = 30
+	DefaultMinConcurrency           = 1   // of configs with a target rate or adaptive concurrency
+	DefaultMaxConcurrency           = 100 // of configs with a target rate
+)
+
+// WithDefaults returns the Config with the unset timeouts, and the unset concurrency bounds of a
+// target rate or adaptive concurrency, set to their defaults. A zero timeout is never valid, the
+// visibility timeout must be at least the consumer timeout, so zero means unset.
+func (c Config) WithDefaults() Config {
+	if c.LambdaTimeoutSes == 0 {
+		c.LambdaTimeoutSes = DefaultLambdaTimeoutSecs
+	}
+	if c.SQSVisibilityTimeoutSecs == 0 {
+		c.SQSVisibilityTimeoutSecs = DefaultSQSVisibilityTimeoutSecs
+	}
+	if c.Controlled() && c.MinConcurrency == 0 {
+		c.MinConcurrency = DefaultMinConcurrency
+	}
+	if c.Tuned() && c.MaxConcurrency == 0 {
+		c.MaxConcurrency = DefaultMaxConcurrency
+	}
+	return c
+}
+
+// Validate checks the Config, with the defaults applied, against the rules the pipeline manager
+// applies before creating the pipeline resources. Configs referencing a Profile should be resolved
+// against it first.
+func (c Config) Validate() error {
+	if c.ID == "" {
+		return errors.New("invalid config: missing id")
+	}
+	c = c.WithDefaults()
+	if c.LambdaConcurrencyLimit != nil {
+		if err := ValidateConcurrencyLimit(*c.LambdaConcurrencyLimit); err != nil {
+			return errors.Wrapf(err, "invalid config %s", c.ID)
+		}
+	}
+	if err := ValidateLambdaTimeout(c.LambdaTimeoutSes); err != nil {
+		return errors.Wrapf(err, "invalid config %s", c.ID)
+	}
+	if err := ValidateVisibilityTimeout(c.SQSVisibilityTimeoutSecs); err != nil {
+		return errors.Wrapf(err, "invalid config %s", c.ID)
+	}
+	if err := ValidateTimeouts(c.LambdaTimeoutSes, c.SQSVisibilityTimeoutSecs); err != nil {
+		return errors.Wrapf(err, "invalid config %s", c.ID)
+	}
+	if err := ValidateRate(c.RatePerSecond); err != nil {
+		return errors.Wrapf(err, "invalid config %s", c.ID)
+	}
+	if err := c.validateConcurrency(); err != nil {
+		return errors.Wrapf(err, "invalid config %s", c.ID)
+	}
+	if c.Notify != "" {
+		if err := ValidateNotifyTarget(c.Notify); err != nil {
+			return errors.Wrapf(err, "invalid config %s", c.ID)
+		}
+	}
+	return nil
+}
+
+// ValidateConcurrencyLimit checks the reserved concurrency of the consumer, zero is allowed and
+// throttles the pipeline completely.
+func ValidateConcurrencyLimit(limit int) error {
+	if limit < 0 {
+		return errors.Errorf("concurrency limit %d must not be negative", limit)
+	}
+	return nil
+}
+
+// ValidateLambdaTimeout checks the timeout of the consumer.
+func ValidateLambdaTimeout(secs int) error {
+	if secs < 1 || secs > MaxLambdaTimeoutSecs {
+		return errors.Errorf("lambda timeout %d must be between 1 and %d seconds", secs, MaxLambdaTimeoutSecs)
+	}
+	return nil
+}
+
+// ValidateVisibilityTimeout checks the visibility timeout of the queue.
+func ValidateVisibilityTimeout(secs int) error {
+	if secs < 0 || secs > MaxSQSVisibilityTimeoutSecs {
+		return errors.Errorf("sqs visibility timeout %d must be between 0 and %d seconds", secs, MaxSQSVisibilityTimeoutSecs)
+	}
+	return nil
+}
+
+// ValidateTimeouts checks the queue visibility timeout is at least the consumer timeout, Lambda
+// refuses to attach a queue whose messages could become visible again mid invocation.
+func ValidateTimeouts(lambdaSecs, visibilitySecs int) error {
+	if visibilitySecs < lambdaSecs {
+		return errors.Errorf("sqs visibility timeout %d must be at least the lambda timeout %d", visibilitySecs, lambdaSecs)
+	}
+	return nil
+}
+
+// ValidateRate checks the rate limit of the consumer, zero means no limit.
+func ValidateRate(perSecond float64) error {
+	if perSecond < 0 || math.IsNaN(perSecond) || math.IsInf(perSecond, 0) {
+		return errors.Errorf("rate per second %v must be a positive number, or zero for no limit", perSecond)
+	}
+	return nil
+}
+
+// Notification target schemes, besides http and https URLs for webhooks.
+const (
+	NotifySNS         = "sns:"    // followed by the topic ARN
+	NotifyEventBridge = "events:" // followed by the event bus name or ARN
+)
+
+// ValidateNotifyTarget checks a notification target is an SNS topic ARN prefixed with "sns:", an
+// EventBridge event bus prefixed with "events:", or an http or https webhook URL.
+func ValidateNotifyTarget(target string) error {
+	switch {
+	case strings.HasPrefix(target, NotifySNS+"arn:"):
+		return nil
+	case strings.HasPrefix(target, NotifyEventBridge) && len(target) > len(NotifyEventBridge):
+		return nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			return nil
+		}
+	}
+	return errors.Errorf("notify target %q must be sns:<topic arn>, events:<event bus> or an http(s) URL", target)
+}
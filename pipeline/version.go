@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+const (
+	attrNameVersion   = "version"
+	attrNameDeletedBy = "deleted_by"
+)
+
+// ConflictError is returned by the conditional writes when the stored item has a version that
+// does not allow the write, meaning another writer got there first.
+type ConflictError struct {
+	TableName string
+	ID        string
+	Version   int64 // version the write was conditioned on
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("version conflict writing %s to %s at version %d", e.ID, e.TableName, e.Version)
+}
+
+// IsConflict reports whether the cause of the error is a ConflictError.
+func IsConflict(err error) bool {
+	_, ok := errors.Cause(err).(*ConflictError)
+	return ok
+}
+
+// versionEquals returns a condition which matches an item at exactly the given version, items
+// written before versions were introduced are treated as being at version 0.
+func versionEquals(version int64) *condition {
+	expr := "#version = :version"
+	if version == 0 {
+		expr = "attribute_not_exists(#version) OR #version = :version"
+	}
+	return versionCondition(expr, version)
+}
+
+// versionNotNewer returns a condition which matches a missing item or an item at a version no
+// newer than the given version.
+func versionNotNewer(version int64) *condition {
+	return versionCondition("attribute_not_exists(#version) OR #version <= :version", version)
+}
+
+func versionCondition(expr string, version int64) *condition {
+	return &condition{
+		expression: expr,
+		names:      map[string]*string{"#version": aws.String(attrNameVersion)},
+		values: map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatInt(version, 10))},
+		},
+	}
+}
+
+// conditionalErr converts failed condition checks into a ConflictError.
+func conditionalErr(err error, tableName, id string, version int64) error {
+	if IsAWSErrCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return &ConflictError{TableName: tableName, ID: id, Version: version}
+	}
+	return errors.Wrapf(err, "failed conditional write of %s to %s", id, tableName)
+}
+
+// IsAWSErrCode reports whether the cause of the error is an AWS error with the given code.
+func IsAWSErrCode(err error, code string) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		return aerr.Code() == code
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxTakeAttempts is how many times a take is tried when other callers keep writing the bucket
+	// in between the read and the write.
+	maxTakeAttempts = 5
+
+	// bucketTTL is how long a bucket is kept after it was last written, a bucket idle that long
+	// would be full again anyway.
+	bucketTTL = time.Hour
+)
+
+// item is a bucket as stored in the table.
+type item struct {
+	ID        string  `dynamodbav:"id"`
+	Tokens    float64 `dynamodbav:"tokens"`
+	UpdatedAt int64   `dynamodbav:"updated_at"` // unix milliseconds
+	Version   int64   `dynamodbav:"version"`    // incremented on every write
+	ExpiresAt int64   `dynamodbav:"expires_at"` // unix seconds, the table's TTL attribute
+}
+
+var _ Limiter = (*DynamoLimiter)(nil)
+
+// DynamoLimiter is a Limiter keeping its buckets in a DynamoDB table keyed by "id", shared by every
+// caller using the table. A take reads the bucket and writes it back on condition that nobody else
+// wrote it since, trying again if they did.
+type DynamoLimiter struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+	now   func() time.Time
+}
+
+// NewDynamoLimiter returns a new instance of DynamoLimiter using the given table.
+func NewDynamoLimiter(db dynamodbiface.DynamoDBAPI, table string) *DynamoLimiter {
+	return &DynamoLimiter{db: db, table: table, now: time.Now}
+}
+
+// Take takes a token from the bucket of the key, a rate of zero or less is not limited. A bucket
+// still contended after a few attempts is treated as empty, the caller is told to wait for one
+// token's worth of time rather than failing.
+func (l *DynamoLimiter) Take(ctx context.Context, key string, rate float64) (time.Duration, error) {
+	if rate <= 0 {
+		return 0, nil
+	}
+	for attempt := 0; attempt < maxTakeAttempts; attempt++ {
+		wait, err := l.take(ctx, key, rate)
+		if isConditionFailed(err) {
+			continue
+		}
+		return wait, err
+	}
+	return time.Duration(float64(time.Second) / rate), nil
+}
+
+func (l *DynamoLimiter) take(ctx context.Context, key string, rate float64) (time.Duration, error) {
+	res, err := l.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(key)}},
+		TableName:      aws.String(l.table),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get bucket %s from %s", key, l.table)
+	}
+	stored := item{ID: key}
+	if res.Item != nil {
+		if err := dynamodbattribute.UnmarshalMap(res.Item, &stored); err != nil {
+			return 0, errors.Wrapf(err, "failed to unmarshal bucket %s", key)
+		}
+	}
+	b := bucket{Tokens: stored.Tokens}
+	if stored.UpdatedAt != 0 {
+		b.UpdatedAt = time.Unix(0, stored.UpdatedAt*int64(time.Millisecond))
+	}
+	now := l.now()
+	b, wait := b.take(now, rate)
+	if wait > 0 {
+		return wait, nil
+	}
+
+	next := item{
+		ID:        key,
+		Tokens:    b.Tokens,
+		UpdatedAt: now.UnixNano() / int64(time.Millisecond),
+		Version:   stored.Version + 1,
+		ExpiresAt: now.Add(bucketTTL).Unix(),
+	}
+	av, err := dynamodbattribute.MarshalMap(next)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to marshal bucket %s", key)
+	}
+	in := &dynamodb.PutItemInput{
+		Item:                     av,
+		TableName:                aws.String(l.table),
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("id")},
+	}
+	if res.Item != nil {
+		in.ConditionExpression = aws.String("#version = :version")
+		in.ExpressionAttributeNames = map[string]*string{"#version": aws.String("version")}
+		in.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatInt(stored.Version, 10))},
+		}
+	}
+	if _, err := l.db.PutItemWithContext(ctx, in); err != nil {
+		if isConditionFailed(err) {
+			return 0, err
+		}
+		return 0, errors.Wrapf(err, "failed to put bucket %s to %s", key, l.table)
+	}
+	return 0, nil
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
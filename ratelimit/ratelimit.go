@@ -0,0 +1,72 @@
+// Package ratelimit limits the rate tasks are handled at with token buckets, one per key, so that a
+// pipeline can be held to a number of tasks per second however long each task takes. A bucket holds
+// at most a second's worth of tokens, at least one, and refills continuously at the rate.
+//
+// The DynamoLimiter keeps the buckets in a DynamoDB table so that every instance of a consumer
+// function shares them, the MemoryLimiter keeps them in process for local runs and tests.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter takes tokens from rate limited buckets.
+type Limiter interface {
+	// Take takes a token from the bucket of the key, refilling at rate tokens per second. It
+	// returns zero when a token was taken, otherwise how long until one can be, in which case
+	// nothing was taken.
+	Take(ctx context.Context, key string, rate float64) (time.Duration, error)
+}
+
+// bucket is the state of a token bucket, a bucket never updated is full.
+type bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// take refills the bucket up to now and takes a token from it, it returns the bucket after the
+// take and zero, or the refilled bucket and how long until a token can be taken.
+func (b bucket) take(now time.Time, rate float64) (bucket, time.Duration) {
+	capacity := math.Max(1, rate)
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = capacity
+	} else if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+	}
+	b.UpdatedAt = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return b, 0
+	}
+	return b, time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+}
+
+var _ Limiter = (*MemoryLimiter)(nil)
+
+// MemoryLimiter is a Limiter keeping its buckets in memory, it only limits the callers sharing it.
+type MemoryLimiter struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]bucket
+}
+
+// NewMemoryLimiter returns a new instance of MemoryLimiter with every bucket full.
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{now: time.Now, buckets: make(map[string]bucket)}
+}
+
+// Take takes a token from the bucket of the key, a rate of zero or less is not limited.
+func (l *MemoryLimiter) Take(ctx context.Context, key string, rate float64) (time.Duration, error) {
+	if rate <= 0 {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, wait := l.buckets[key].take(l.now(), rate)
+	l.buckets[key] = b
+	return wait, nil
+}
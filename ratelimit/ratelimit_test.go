@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/awsfake"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// table adapts the DynamoDB fake to the DynamoDB API, the fake's CreateTable helper stops it
+// implementing the interface itself.
+type table struct {
+	dynamodbiface.DynamoDBAPI
+	fake *awsfake.DynamoDB
+}
+
+func newTable() *table {
+	fake := awsfake.NewDynamoDB()
+	fake.CreateTable("rate-limits", "id")
+	return &table{fake: fake}
+}
+
+func (t *table) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return t.fake.GetItemWithContext(ctx, in, opts...)
+}
+
+func (t *table) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return t.fake.PutItemWithContext(ctx, in, opts...)
+}
+
+func newClock() *clock {
+	return &clock{t: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func TestLimiters(t *testing.T) {
+	limiters := map[string]func(c *clock) Limiter{
+		"memory": func(c *clock) Limiter {
+			l := NewMemoryLimiter()
+			l.now = c.now
+			return l
+		},
+		"dynamo": func(c *clock) Limiter {
+			l := NewDynamoLimiter(newTable(), "rate-limits")
+			l.now = c.now
+			return l
+		},
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			t.Run("burst of a second then the rate", func(t *testing.T) {
+				c := newClock()
+				l := newLimiter(c)
+				for i := 0; i < 4; i++ {
+					wait, err := l.Take(ctx, "pipeline-a", 4)
+					assert.NoError(t, err)
+					assert.Zero(t, wait, "take %d", i)
+				}
+				wait, err := l.Take(ctx, "pipeline-a", 4)
+				assert.NoError(t, err)
+				assert.Equal(t, 250*time.Millisecond, wait)
+
+				c.advance(100 * time.Millisecond)
+				wait, _ = l.Take(ctx, "pipeline-a", 4)
+				assert.Equal(t, 150*time.Millisecond, wait, "nothing is taken while waiting")
+
+				c.advance(150 * time.Millisecond)
+				wait, _ = l.Take(ctx, "pipeline-a", 4)
+				assert.Zero(t, wait)
+			})
+
+			t.Run("rates below one a second", func(t *testing.T) {
+				c := newClock()
+				l := newLimiter(c)
+				wait, _ := l.Take(ctx, "pipeline-a", 0.5)
+				assert.Zero(t, wait)
+				wait, _ = l.Take(ctx, "pipeline-a", 0.5)
+				assert.Equal(t, 2*time.Second, wait)
+			})
+
+			t.Run("keys have their own buckets", func(t *testing.T) {
+				c := newClock()
+				l := newLimiter(c)
+				wait, _ := l.Take(ctx, "pipeline-a", 1)
+				assert.Zero(t, wait)
+				wait, _ = l.Take(ctx, "pipeline-b", 1)
+				assert.Zero(t, wait)
+				wait, _ = l.Take(ctx, "pipeline-a", 1)
+				assert.Equal(t, time.Second, wait)
+			})
+
+			t.Run("no rate is not limited", func(t *testing.T) {
+				c := newClock()
+				l := newLimiter(c)
+				for i := 0; i < 10; i++ {
+					wait, err := l.Take(ctx, "pipeline-a", 0)
+					assert.NoError(t, err)
+					assert.Zero(t, wait)
+				}
+			})
+		})
+	}
+}
+
+func TestDynamoLimiterSharesBucketsAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	c := newClock()
+	db := newTable()
+	var limiters []*DynamoLimiter
+	for i := 0; i < 3; i++ {
+		l := NewDynamoLimiter(db, "rate-limits")
+		l.now = c.now
+		limiters = append(limiters, l)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	taken := 0
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(l *DynamoLimiter) {
+			defer wg.Done()
+			wait, err := l.Take(ctx, "pipeline-a", 10)
+			assert.NoError(t, err)
+			if wait == 0 {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}(limiters[i%len(limiters)])
+	}
+	wg.Wait()
+	assert.True(t, taken <= 10, "took %d tokens from a bucket of 10", taken)
+	assert.True(t, taken > 0)
+}
@@ -0,0 +1,178 @@
+// Package simulate runs discrete-event simulations of a task workload through the two architectures
+// the README compares: a single queue shared by all task groups with a fixed number of consumers, and
+// a pipeline per task group with the consumer concurrency set by the group's pipeline config.
+// The reports show per group throughput, queue latency and rate limit violations, which can be used
+// to size concurrency_limit before the pipelines are created.
+package simulate
+
+import (
+	"container/heap"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+)
+
+// Architectures that are simulated.
+const (
+	SharedQueue = "shared-queue"
+	PerGroup    = "per-group"
+)
+
+// rateWindowSecs is the window the rate limits apply to.
+const rateWindowSecs = 1.0
+
+// Report is the result of simulating the workload through one architecture.
+type Report struct {
+	Architecture string
+	MakespanSecs float64 // time the last task completed
+	Groups       []GroupReport
+}
+
+// GroupReport is the result for a single task group.
+type GroupReport struct {
+	ID               string
+	RateLimit        int
+	Concurrency      int     // consumers available to the group, shared with other groups in the shared queue architecture
+	Tasks            int     // tasks processed
+	Throughput       float64 // tasks per second, from the first arrival to the last completion of the group
+	MeanLatencySecs  float64 // mean time from arrival to start of processing
+	P95LatencySecs   float64
+	MaxLatencySecs   float64
+	PeakStartsPerSec int // most tasks started in any 1 second window
+	Violations       int // tasks started while the group was over its rate limit
+}
+
+// Run simulates the workload through both architectures, every group of the workload needs a
+// pipeline config with the same ID.
+func Run(workload Workload, configs []pipeline.Config) ([]Report, error) {
+	if err := workload.Validate(); err != nil {
+		return nil, err
+	}
+	limits := make(map[string]*int)
+	for _, c := range configs {
+		limits[c.ID] = c.LambdaConcurrencyLimit
+	}
+	concurrency := make(map[string]int)
+	for _, g := range workload.Groups {
+		limit, ok := limits[g.ID]
+		if !ok {
+			return nil, errors.Errorf("no pipeline config for group %s", g.ID)
+		}
+		if limit == nil || *limit < 1 {
+			return nil, errors.Errorf("pipeline config %s: concurrency_limit must be set to at least 1 to simulate", g.ID)
+		}
+		concurrency[g.ID] = *limit
+	}
+
+	tasks := workload.tasks()
+	shared := report(SharedQueue, workload, tasks, schedule(tasks, workload.SharedConsumers), func(string) int {
+		return workload.SharedConsumers
+	})
+
+	starts := make([]float64, len(tasks))
+	byGroup := make(map[string][]int)
+	for i, t := range tasks {
+		byGroup[t.group] = append(byGroup[t.group], i)
+	}
+	for group, idxs := range byGroup {
+		groupTasks := make([]task, len(idxs))
+		for i, idx := range idxs {
+			groupTasks[i] = tasks[idx]
+		}
+		for i, start := range schedule(groupTasks, concurrency[group]) {
+			starts[idxs[i]] = start
+		}
+	}
+	perGroup := report(PerGroup, workload, tasks, starts, func(id string) int {
+		return concurrency[id]
+	})
+	return []Report{shared, perGroup}, nil
+}
+
+// schedule returns the start times of the tasks, taken in order from a FIFO queue by the given
+// number of consumers, each task is started by the first consumer to become free.
+func schedule(tasks []task, consumers int) []float64 {
+	free := make(freeTimes, consumers)
+	starts := make([]float64, len(tasks))
+	for i, t := range tasks {
+		start := math.Max(free[0], t.arrival)
+		starts[i] = start
+		free[0] = start + t.processing
+		heap.Fix(&free, 0)
+	}
+	return starts
+}
+
+func report(architecture string, workload Workload, tasks []task, starts []float64, concurrency func(string) int) Report {
+	r := Report{Architecture: architecture}
+	for _, g := range workload.Groups {
+		var groupStarts, latencies []float64
+		first, last := math.Inf(1), 0.0
+		for i, t := range tasks {
+			if t.group != g.ID {
+				continue
+			}
+			groupStarts = append(groupStarts, starts[i])
+			latencies = append(latencies, starts[i]-t.arrival)
+			first = math.Min(first, t.arrival)
+			last = math.Max(last, starts[i]+t.processing)
+		}
+		gr := GroupReport{ID: g.ID, RateLimit: g.RateLimit, Concurrency: concurrency(g.ID), Tasks: len(groupStarts)}
+		if gr.Tasks > 0 {
+			if last > first {
+				gr.Throughput = float64(gr.Tasks) / (last - first)
+			}
+			gr.MeanLatencySecs, gr.P95LatencySecs, gr.MaxLatencySecs = latencyStats(latencies)
+			gr.PeakStartsPerSec, gr.Violations = rateStats(groupStarts, g.RateLimit)
+		}
+		r.MakespanSecs = math.Max(r.MakespanSecs, last)
+		r.Groups = append(r.Groups, gr)
+	}
+	return r
+}
+
+func latencyStats(latencies []float64) (mean, p95, max float64) {
+	sort.Float64s(latencies)
+	var sum float64
+	for _, l := range latencies {
+		sum += l
+	}
+	p95Idx := int(math.Ceil(0.95*float64(len(latencies)))) - 1
+	return sum / float64(len(latencies)), latencies[p95Idx], latencies[len(latencies)-1]
+}
+
+// rateStats returns the most tasks started in any window, and the number of tasks started when
+// the window ending at their start already held limit starts.
+func rateStats(starts []float64, limit int) (peak, violations int) {
+	const epsilon = 1e-9
+	sort.Float64s(starts)
+	j := 0
+	for i, s := range starts {
+		for starts[j] <= s-rateWindowSecs+epsilon {
+			j++
+		}
+		n := i - j + 1
+		if n > peak {
+			peak = n
+		}
+		if limit > 0 && n > limit {
+			violations++
+		}
+	}
+	return peak, violations
+}
+
+// freeTimes is a min heap of the times consumers become free.
+type freeTimes []float64
+
+func (f freeTimes) Len() int            { return len(f) }
+func (f freeTimes) Less(i, j int) bool  { return f[i] < f[j] }
+func (f freeTimes) Swap(i, j int)       { f[i], f[j] = f[j], f[i] }
+func (f *freeTimes) Push(x interface{}) { *f = append(*f, x.(float64)) }
+func (f *freeTimes) Pop() interface{} {
+	old := *f
+	x := old[len(old)-1]
+	*f = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,65 @@
+package simulate_test
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kinluek/serverless-controlled-batch-processing/pipeline"
+	"github.com/kinluek/serverless-controlled-batch-processing/simulate"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// The example from the README: 9 tasks queued with the head of the queue first, processed by 4
+// shared consumers, or by per group pipelines with concurrency equal to the rate limits.
+func TestRunREADMEExample(t *testing.T) {
+	fixed := simulate.Processing{Type: simulate.ProcessingFixed, MeanSecs: 1}
+	workload := simulate.Workload{
+		SharedConsumers: 4,
+		InitialQueue:    []string{"B", "A", "A", "C", "C", "C", "C", "B", "A"},
+		Groups: []simulate.Group{
+			{ID: "A", RateLimit: 2, Processing: fixed},
+			{ID: "B", RateLimit: 1, Processing: fixed},
+			{ID: "C", RateLimit: 2, Processing: fixed},
+		},
+	}
+	configs := []pipeline.Config{
+		{ID: "A", LambdaConcurrencyLimit: aws.Int(2)},
+		{ID: "B", LambdaConcurrencyLimit: aws.Int(1)},
+		{ID: "C", LambdaConcurrencyLimit: aws.Int(2)},
+	}
+
+	reports, err := simulate.Run(workload, configs)
+	if err != nil {
+		t.Fatalf("failed to run simulation: %v", err)
+	}
+	shared, perGroup := reports[0], reports[1]
+	assert.Equal(t, simulate.SharedQueue, shared.Architecture)
+	assert.Equal(t, simulate.PerGroup, perGroup.Architecture)
+
+	// the second batch pulls 3 C tasks off the shared queue at once.
+	assert.Equal(t, 3, shared.Groups[2].PeakStartsPerSec)
+	assert.Equal(t, 1, shared.Groups[2].Violations)
+	for _, g := range perGroup.Groups {
+		assert.Equal(t, 0, g.Violations, "group %s", g.ID)
+		assert.LessOrEqual(t, g.PeakStartsPerSec, g.RateLimit, "group %s", g.ID)
+	}
+	assert.Equal(t, simulate.GroupReport{
+		ID:               "C",
+		RateLimit:        2,
+		Concurrency:      2,
+		Tasks:            4,
+		Throughput:       2,
+		MeanLatencySecs:  0.5,
+		P95LatencySecs:   1,
+		MaxLatencySecs:   1,
+		PeakStartsPerSec: 2,
+	}, perGroup.Groups[2])
+}
+
+func TestRunRequiresConfigForEachGroup(t *testing.T) {
+	workload := simulate.Workload{
+		SharedConsumers: 1,
+		Groups:          []simulate.Group{{ID: "A", Processing: simulate.Processing{Type: simulate.ProcessingFixed, MeanSecs: 1}}},
+	}
+	_, err := simulate.Run(workload, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,184 @@
+package simulate
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"sort"
+)
+
+// Arrival patterns.
+const (
+	ArrivalConstant = "constant" // evenly spaced at RatePerSec
+	ArrivalPoisson  = "poisson"  // exponentially distributed gaps with mean 1/RatePerSec
+	ArrivalBurst    = "burst"    // BurstSize tasks at once every BurstEverySecs
+)
+
+// Processing time distributions.
+const (
+	ProcessingFixed       = "fixed"       // always MeanSecs
+	ProcessingUniform     = "uniform"     // uniform between MinSecs and MaxSecs
+	ProcessingExponential = "exponential" // exponential with mean MeanSecs
+)
+
+// Workload describes the tasks to simulate.
+type Workload struct {
+	DurationSecs    float64  `json:"duration_secs"`    // tasks arrive over this period, the queues are then drained
+	SharedConsumers int      `json:"shared_consumers"` // consumer concurrency of the shared queue architecture
+	InitialQueue    []string `json:"initial_queue"`    // group IDs of tasks already queued at the start, in queue order
+	Groups          []Group  `json:"groups"`
+	Seed            int64    `json:"seed"`
+}
+
+// Group describes the tasks of a single task group.
+type Group struct {
+	ID         string     `json:"id"`
+	RateLimit  int        `json:"rate_limit"` // most tasks that may be started in any 1 second window, 0 for no limit
+	Arrival    Arrival    `json:"arrival"`
+	Processing Processing `json:"processing"`
+}
+
+// Arrival describes how tasks of a group arrive, a group with no arrival type only has the tasks of the initial queue.
+type Arrival struct {
+	Type           string  `json:"type"`
+	RatePerSec     float64 `json:"rate_per_sec"`
+	BurstSize      int     `json:"burst_size"`
+	BurstEverySecs float64 `json:"burst_every_secs"`
+}
+
+// Processing describes how long tasks of a group take to process.
+type Processing struct {
+	Type     string  `json:"type"`
+	MeanSecs float64 `json:"mean_secs"`
+	MinSecs  float64 `json:"min_secs"`
+	MaxSecs  float64 `json:"max_secs"`
+}
+
+// task is a single simulated task, both architectures process the same tasks.
+type task struct {
+	group      string
+	arrival    float64
+	processing float64
+}
+
+// Validate checks the workload can be simulated.
+func (w Workload) Validate() error {
+	if w.SharedConsumers < 1 {
+		return errors.New("invalid workload: shared_consumers must be at least 1")
+	}
+	if len(w.Groups) == 0 {
+		return errors.New("invalid workload: no groups")
+	}
+	ids := make(map[string]bool)
+	for _, g := range w.Groups {
+		if g.ID == "" {
+			return errors.New("invalid workload: group with no id")
+		}
+		if ids[g.ID] {
+			return errors.Errorf("invalid workload: duplicate group %s", g.ID)
+		}
+		ids[g.ID] = true
+		if err := g.Arrival.validate(w.DurationSecs); err != nil {
+			return errors.Wrapf(err, "invalid workload: group %s", g.ID)
+		}
+		if err := g.Processing.validate(); err != nil {
+			return errors.Wrapf(err, "invalid workload: group %s", g.ID)
+		}
+	}
+	for _, id := range w.InitialQueue {
+		if !ids[id] {
+			return errors.Errorf("invalid workload: initial queue task for unknown group %s", id)
+		}
+	}
+	return nil
+}
+
+func (a Arrival) validate(duration float64) error {
+	switch a.Type {
+	case "":
+		return nil
+	case ArrivalConstant, ArrivalPoisson:
+		if a.RatePerSec <= 0 {
+			return errors.Errorf("%s arrival needs a positive rate_per_sec", a.Type)
+		}
+	case ArrivalBurst:
+		if a.BurstSize < 1 || a.BurstEverySecs <= 0 {
+			return errors.New("burst arrival needs a positive burst_size and burst_every_secs")
+		}
+	default:
+		return errors.Errorf("unknown arrival type %q", a.Type)
+	}
+	if duration <= 0 {
+		return errors.New("arrivals need a positive duration_secs")
+	}
+	return nil
+}
+
+func (p Processing) validate() error {
+	switch p.Type {
+	case ProcessingFixed, ProcessingExponential:
+		if p.MeanSecs <= 0 {
+			return errors.Errorf("%s processing needs a positive mean_secs", p.Type)
+		}
+	case ProcessingUniform:
+		if p.MinSecs < 0 || p.MaxSecs < p.MinSecs {
+			return errors.New("uniform processing needs 0 <= min_secs <= max_secs")
+		}
+	default:
+		return errors.Errorf("unknown processing type %q", p.Type)
+	}
+	return nil
+}
+
+// tasks generates the tasks of the workload in queue order, which is arrival order with ties
+// kept in the order they were generated: the initial queue first, then group by group.
+func (w Workload) tasks() []task {
+	rng := rand.New(rand.NewSource(w.Seed))
+	groups := make(map[string]Group)
+	for _, g := range w.Groups {
+		groups[g.ID] = g
+	}
+	var tasks []task
+	for _, id := range w.InitialQueue {
+		tasks = append(tasks, task{group: id, processing: groups[id].Processing.sample(rng)})
+	}
+	for _, g := range w.Groups {
+		for _, at := range g.Arrival.times(w.DurationSecs, rng) {
+			tasks = append(tasks, task{group: g.ID, arrival: at, processing: g.Processing.sample(rng)})
+		}
+	}
+	sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].arrival < tasks[j].arrival })
+	return tasks
+}
+
+// times returns the arrival times of the tasks within the duration.
+func (a Arrival) times(duration float64, rng *rand.Rand) []float64 {
+	var times []float64
+	switch a.Type {
+	case ArrivalConstant:
+		for t := 0.0; t < duration; t += 1 / a.RatePerSec {
+			times = append(times, t)
+		}
+	case ArrivalPoisson:
+		for t := rng.ExpFloat64() / a.RatePerSec; t < duration; t += rng.ExpFloat64() / a.RatePerSec {
+			times = append(times, t)
+		}
+	case ArrivalBurst:
+		for t := 0.0; t < duration; t += a.BurstEverySecs {
+			for i := 0; i < a.BurstSize; i++ {
+				times = append(times, t)
+			}
+		}
+	}
+	return times
+}
+
+func (p Processing) sample(rng *rand.Rand) float64 {
+	switch p.Type {
+	case ProcessingUniform:
+		return p.MinSecs + rng.Float64()*(p.MaxSecs-p.MinSecs)
+	case ProcessingExponential:
+		return rng.ExpFloat64() * p.MeanSecs
+	default:
+		return p.MeanSecs
+	}
+}
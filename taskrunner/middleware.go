@@ -0,0 +1,186 @@
+package taskrunner
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Metric names emitted by the Metrics middleware.
+const (
+	MetricTasks      = "Tasks"
+	MetricErrors     = "Errors"
+	MetricThrottled  = "Throttled"
+	MetricDuration   = "Duration"
+	MetricMessageAge = "MessageAge"
+	MetricAttempt    = "Attempt"
+
+	MetricSuccessDuration = "SuccessDuration"
+)
+
+// Metric names emitted by MeasureBatch.
+const (
+	MetricBatches          = "Batches"
+	MetricBatchSize        = "BatchSize"
+	MetricBatchFailures    = "BatchFailures"
+	MetricBatchDuration    = "BatchDuration"
+	MetricOldestMessageAge = "OldestMessageAge"
+)
+
+// Log takes a logger and returns a middleware which logs the outcome of every task, with the
+// task's type, ID and attempt and the Lambda request ID. Tasks deferred by the rate limit are not
+// logged as failures, and tasks throttled by the downstream API are logged as warnings.
+func Log(log *logrus.Logger) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, task Task) error {
+			start := time.Now()
+			err := before(ctx, task)
+			fields := getLogFields(ctx, task)
+			fields["duration_ms"] = time.Since(start).Milliseconds()
+			if IsDeferred(err) {
+				log.WithFields(fields).Infof("deferred - handling %s task %s: %v", task.Type, task.ID, err)
+				return err
+			}
+			if IsThrottled(err) {
+				log.WithFields(fields).Warnf("throttled - handling %s task %s: %v", task.Type, task.ID, err)
+				return err
+			}
+			if err != nil {
+				log.WithFields(fields).Errorf("fail - handling %s task %s: %v", task.Type, task.ID, err)
+				return err
+			}
+			log.WithFields(fields).Infof("success - handling %s task %s", task.Type, task.ID)
+			return nil
+		}
+	}
+}
+
+// Recover takes a logger and returns a middleware which stops panics in handlers from bubbling up
+// and returns them as an error, so that one bad task does not take the rest of the batch down.
+func Recover(log *logrus.Logger) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, task Task) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic occurred: %v", r)
+					if er, ok := r.(error); ok {
+						err = errors.Wrap(er, "panic occurred")
+					}
+					log.WithFields(getLogFields(ctx, task)).Errorf("%s: stacktrace: \n%s", err, debug.Stack())
+				}
+			}()
+			return before(ctx, task)
+		}
+	}
+}
+
+// Metrics takes an emitter and returns a middleware which emits the metrics of every task by
+// function name and task type, and by function name alone: a count of tasks, errors and of the
+// errors which were throttles by the downstream API, how long the task took, also as the success
+// duration when it succeeded, the attempt it was handled on and how long its message waited on the
+// queue. The function name is the consumer's, so each pipeline gets its own metrics, which the
+// tuner reads the success durations and throttles from. A failure to emit the metrics does not
+// fail the task.
+func Metrics(emitter *metrics.Emitter) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, task Task) error {
+			start := time.Now()
+			err := before(ctx, task)
+			errCount, throttledCount := 0.0, 0.0
+			if err != nil {
+				errCount = 1
+			}
+			if IsThrottled(err) {
+				throttledCount = 1
+			}
+			age := 0.0
+			if !task.SentAt.IsZero() {
+				age = metrics.Millis(start.Sub(task.SentAt))
+			}
+			duration := metrics.Since(start)
+			measured := []metrics.Metric{
+				{Name: MetricTasks, Unit: metrics.Count, Value: 1},
+				{Name: MetricErrors, Unit: metrics.Count, Value: errCount},
+				{Name: MetricThrottled, Unit: metrics.Count, Value: throttledCount},
+				{Name: MetricDuration, Unit: metrics.Milliseconds, Value: duration},
+				{Name: MetricMessageAge, Unit: metrics.Milliseconds, Value: age},
+				{Name: MetricAttempt, Unit: metrics.Count, Value: float64(task.Attempt)},
+			}
+			if err == nil {
+				measured = append(measured, metrics.Metric{Name: MetricSuccessDuration, Unit: metrics.Milliseconds, Value: duration})
+			}
+			_ = emitter.Emit(metrics.Entry{
+				Dimensions: map[string]string{"FunctionName": lambdacontext.FunctionName, "TaskType": task.Type},
+				Rollups:    [][]string{{"FunctionName"}},
+				Metrics:    measured,
+				Properties: map[string]interface{}{"task_id": task.ID, "message_id": task.MessageID},
+			})
+			return err
+		}
+	}
+}
+
+// MeasureBatch emits the metrics of a batch handled by the consumer function, which started at
+// start, by function name: a count of batches, of the messages in the batch and of those which
+// failed, how long the batch took and the age of its oldest message. A failure to emit the
+// metrics is ignored, it must not fail the batch.
+func MeasureBatch(emitter *metrics.Emitter, event events.SQSEvent, failures int, start time.Time) {
+	_ = emitter.Emit(metrics.Entry{
+		Dimensions: map[string]string{"FunctionName": lambdacontext.FunctionName},
+		Metrics: []metrics.Metric{
+			{Name: MetricBatches, Unit: metrics.Count, Value: 1},
+			{Name: MetricBatchSize, Unit: metrics.Count, Value: float64(len(event.Records))},
+			{Name: MetricBatchFailures, Unit: metrics.Count, Value: float64(failures)},
+			{Name: MetricBatchDuration, Unit: metrics.Milliseconds, Value: metrics.Since(start)},
+			{Name: MetricOldestMessageAge, Unit: metrics.Milliseconds, Value: oldestMessageAge(event, start)},
+		},
+	})
+}
+
+// oldestMessageAge returns the milliseconds between the oldest message in the batch being sent and
+// now, zero when the messages carry no sent timestamp.
+func oldestMessageAge(event events.SQSEvent, now time.Time) float64 {
+	var age time.Duration
+	for _, record := range event.Records {
+		sent, err := strconv.ParseInt(record.Attributes["SentTimestamp"], 10, 64)
+		if err != nil {
+			continue
+		}
+		if d := now.Sub(time.Unix(0, sent*int64(time.Millisecond))); d > age {
+			age = d
+		}
+	}
+	return metrics.Millis(age)
+}
+
+func getLogFields(ctx context.Context, task Task) logrus.Fields {
+	fields := logrus.Fields{
+		"task_type":  task.Type,
+		"task_id":    task.ID,
+		"message_id": task.MessageID,
+		"attempt":    task.Attempt,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		fields["request_id"] = lc.AwsRequestID
+	}
+	return fields
+}
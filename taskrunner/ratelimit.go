@@ -0,0 +1,203 @@
+package taskrunner
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/ratelimit"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// MaxRateLimitWait is the longest a task waits in process for the rate limit, tasks which would
+// wait longer are deferred instead so that the function is not paid for waiting.
+const MaxRateLimitWait = time.Second
+
+// RateFunc returns the rate limit bucket a task is taken from and its rate, a rate of zero or less
+// is not limited.
+type RateFunc func(task Task) (key string, perSecond float64)
+
+// FixedRate returns a RateFunc taking every task from the same bucket at the same rate.
+func FixedRate(key string, perSecond float64) RateFunc {
+	return func(task Task) (string, float64) {
+		return key, perSecond
+	}
+}
+
+// MaxDeferral is the longest a task can be deferred for, the most SQS can delay a message by.
+const MaxDeferral = 15 * time.Minute
+
+// Deferrer puts the message of a task back on its queue, to be received again after a delay.
+type Deferrer interface {
+	Defer(ctx context.Context, task Task, delay time.Duration) error
+}
+
+// DeferrerFunc is a function that can be used as a Deferrer.
+type DeferrerFunc func(ctx context.Context, task Task, delay time.Duration) error
+
+// Defer calls f(ctx, task, delay).
+func (f DeferrerFunc) Defer(ctx context.Context, task Task, delay time.Duration) error {
+	return f(ctx, task, delay)
+}
+
+// DeferredError is returned for tasks deferred by the rate limit or after being throttled, their
+// message is received again once the delay is over. A deferred task is handled as far as the batch
+// is concerned, its message no longer needs to be retried.
+type DeferredError struct {
+	Delay time.Duration
+	Err   error // throttle the task was deferred after, nil when deferred by the rate limit
+}
+
+func (e *DeferredError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("task deferred for %s after being throttled: %v", e.Delay, e.Err)
+	}
+	return fmt.Sprintf("task deferred for %s by the rate limit", e.Delay)
+}
+
+// IsDeferred reports whether the error is a DeferredError.
+func IsDeferred(err error) bool {
+	_, ok := errors.Cause(err).(*DeferredError)
+	return ok
+}
+
+// RateLimit takes a limiter, the rate of each task and a deferrer and returns a middleware which
+// takes a token from the task's bucket before handling it. A task waits in process when a token is
+// due within MaxRateLimitWait and the context's deadline, otherwise its message is deferred until
+// a token is due, up to MaxDeferral, and the task returns a *DeferredError, rather than being
+// handled over the rate.
+func RateLimit(limiter ratelimit.Limiter, rate RateFunc, deferrer Deferrer) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, task Task) error {
+			key, perSecond := rate(task)
+			if perSecond <= 0 {
+				return before(ctx, task)
+			}
+			for {
+				wait, err := limiter.Take(ctx, key, perSecond)
+				if err != nil {
+					return errors.Wrapf(err, "failed to take rate limit token for task %s", task.ID)
+				}
+				if wait == 0 {
+					return before(ctx, task)
+				}
+				if wait > MaxRateLimitWait || !hasTime(ctx, wait) {
+					delay := time.Duration(math.Ceil(wait.Seconds())) * time.Second
+					if delay > MaxDeferral {
+						delay = MaxDeferral
+					}
+					if err := deferrer.Defer(ctx, task, delay); err != nil {
+						return errors.Wrapf(err, "failed to defer task %s", task.ID)
+					}
+					return &DeferredError{Delay: delay}
+				}
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+// hasTime reports whether the context's deadline, if any, is more than d away.
+func hasTime(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > d
+}
+
+var _ Deferrer = (*SQSDeferrer)(nil)
+
+// SQSDeferrer defers tasks by sending their message to the queue again, delayed, and deleting the
+// message received. Changing the visibility of the message received would be a single call, but
+// every receive of it counts towards the queue's maxReceiveCount, so tasks would be dead lettered
+// for waiting on the rate limit or being throttled. The queue URL is looked up from the task's
+// source ARN once per queue.
+type SQSDeferrer struct {
+	svc sqsiface.SQSAPI
+
+	mu   sync.Mutex
+	urls map[string]string
+}
+
+// NewSQSDeferrer returns a new instance of SQSDeferrer.
+func NewSQSDeferrer(svc sqsiface.SQSAPI) *SQSDeferrer {
+	return &SQSDeferrer{svc: svc, urls: make(map[string]string)}
+}
+
+// Defer sends the task's message again delayed by the delay, in whole seconds up to MaxDeferral,
+// and deletes the message received. A failure to delete it leaves the task to be handled twice.
+func (d *SQSDeferrer) Defer(ctx context.Context, task Task, delay time.Duration) error {
+	url, err := d.queueURL(ctx, task.Source)
+	if err != nil {
+		return err
+	}
+	if delay > MaxDeferral {
+		delay = MaxDeferral
+	}
+	_, err = d.svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(url),
+		MessageBody:       aws.String(task.Body),
+		MessageAttributes: messageAttributes(task.MessageAttributes),
+		DelaySeconds:      aws.Int64(int64(math.Ceil(delay.Seconds()))),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to send message %s again", task.MessageID)
+	}
+	_, err = d.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(url),
+		ReceiptHandle: aws.String(task.ReceiptHandle),
+	})
+	return errors.Wrapf(err, "failed to delete deferred message %s", task.MessageID)
+}
+
+// messageAttributes returns the attributes of a received message as the attributes to send it with.
+func messageAttributes(attributes map[string]events.SQSMessageAttribute) map[string]*sqs.MessageAttributeValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+	values := make(map[string]*sqs.MessageAttributeValue, len(attributes))
+	for name, a := range attributes {
+		values[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String(a.DataType),
+			StringValue: a.StringValue,
+			BinaryValue: a.BinaryValue,
+		}
+	}
+	return values
+}
+
+func (d *SQSDeferrer) queueURL(ctx context.Context, queueArn string) (string, error) {
+	d.mu.Lock()
+	url, ok := d.urls[queueArn]
+	d.mu.Unlock()
+	if ok {
+		return url, nil
+	}
+	parsed, err := arn.Parse(queueArn)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid queue arn %s", queueArn)
+	}
+	out, err := d.svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(parsed.Resource),
+		QueueOwnerAWSAccountId: aws.String(parsed.AccountID),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get url of queue %s", queueArn)
+	}
+	d.mu.Lock()
+	d.urls[queueArn] = aws.StringValue(out.QueueUrl)
+	d.mu.Unlock()
+	return aws.StringValue(out.QueueUrl), nil
+}
@@ -0,0 +1,220 @@
+package taskrunner
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/kinluek/serverless-controlled-batch-processing/consumerenv"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/pkg/errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandlerFunc handles a task.
+type HandlerFunc func(ctx context.Context, task Task) error
+
+// Middleware is a function that wraps a HandlerFunc to enhance its capabilities.
+type Middleware func(h HandlerFunc) HandlerFunc
+
+// UnknownTaskError is returned for tasks of a type with no handler registered.
+type UnknownTaskError struct {
+	Type string
+}
+
+func (e *UnknownTaskError) Error() string {
+	return fmt.Sprintf("no handler registered for task type %q", e.Type)
+}
+
+// Registry maps task types to their handlers, it is safe for concurrent use once the handlers and
+// middleware have been registered.
+type Registry struct {
+	mu         sync.RWMutex
+	handlers   map[string]HandlerFunc
+	middleware []Middleware
+	emitter    *metrics.Emitter // emits the metrics of each batch, nil for none
+}
+
+// NewRegistry returns a new instance of Registry with no handlers.
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]HandlerFunc)}
+}
+
+// Use adds middleware run around every handler, in the order they are provided.
+func (r *Registry) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle registers the handler for tasks of the type, each type can only be registered once.
+func (r *Registry) Handle(taskType string, handler HandlerFunc) error {
+	if taskType == "" {
+		return errors.New("task type is required")
+	}
+	if handler == nil {
+		return errors.Errorf("nil handler for task type %q", taskType)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[taskType]; ok {
+		return errors.Errorf("task type %q is already registered", taskType)
+	}
+	r.handlers[taskType] = handler
+	return nil
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register registers a typed handler for tasks of the type. The handler must be a function of the
+// form func(context.Context, T) error, the task's payload is decoded as JSON into a new T, or the
+// value T points to, before each call. The task itself can be read with TaskFromContext.
+func (r *Registry) Register(taskType string, handler interface{}) error {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 ||
+		!t.In(0).Implements(contextType) || t.Out(0) != errorType {
+		return errors.Errorf("handler of task type %q must be a func(context.Context, T) error, not %s", taskType, t)
+	}
+	payload := t.In(1)
+	return r.Handle(taskType, func(ctx context.Context, task Task) error {
+		arg := reflect.New(payload)
+		if payload.Kind() == reflect.Ptr {
+			arg.Elem().Set(reflect.New(payload.Elem()))
+			if err := task.Decode(arg.Elem().Interface()); err != nil {
+				return err
+			}
+		} else if err := task.Decode(arg.Interface()); err != nil {
+			return err
+		}
+		out := fn.Call([]reflect.Value{reflect.ValueOf(ctx), arg.Elem()})
+		err, _ := out[0].Interface().(error)
+		return err
+	})
+}
+
+// MustRegister is like Register but panics if the handler can not be registered, for use when
+// the handlers are set up at start up.
+func (r *Registry) MustRegister(taskType string, handler interface{}) {
+	if err := r.Register(taskType, handler); err != nil {
+		panic(err)
+	}
+}
+
+// MeasureBatches makes the registry emit the metrics of every batch handled by HandleSQS and
+// HandleSQSBatch with the emitter, see MeasureBatch.
+func (r *Registry) MeasureBatches(emitter *metrics.Emitter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emitter = emitter
+}
+
+// Types returns the registered task types.
+func (r *Registry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.handlers))
+	for t := range r.handlers {
+		types = append(types, t)
+	}
+	return types
+}
+
+// Dispatch runs the handler registered for the task's type through the middleware, tasks of an
+// unknown type fail with an *UnknownTaskError.
+func (r *Registry) Dispatch(ctx context.Context, task Task) error {
+	r.mu.RLock()
+	handler, ok := r.handlers[task.Type]
+	middleware := r.middleware
+	r.mu.RUnlock()
+	if !ok {
+		handler = func(ctx context.Context, task Task) error {
+			return &UnknownTaskError{Type: task.Type}
+		}
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i] != nil {
+			handler = middleware[i](handler)
+		}
+	}
+	return handler(WithTask(ctx, task), task)
+}
+
+// HandleSQS handles a batch of messages from the queue, it has the signature of the consumer
+// function handler. Every message is handled, and the batch fails if any of them do, so that the
+// failed messages are retried and eventually moved to the dead letter queue. Deferred tasks have
+// been put back on the queue, they do not fail the batch.
+func (r *Registry) HandleSQS(ctx context.Context, event events.SQSEvent) error {
+	var failures []string
+	for _, failure := range r.handleBatch(ctx, event) {
+		failures = append(failures, failure.err.Error())
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("%d of %d tasks failed: %s", len(failures), len(event.Records), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// HandleSQSBatch handles a batch of messages from the queue, reporting the messages which failed
+// rather than failing the batch, so that only those are retried, deferred tasks are not reported.
+// The event source mapping must have ReportBatchItemFailures in its FunctionResponseTypes,
+// otherwise the failed messages are deleted along with the rest.
+func (r *Registry) HandleSQSBatch(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	res := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, failure := range r.handleBatch(ctx, event) {
+		res.BatchItemFailures = append(res.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: failure.messageID})
+	}
+	return res, nil
+}
+
+// messageFailure is the error a message of a batch failed with.
+type messageFailure struct {
+	messageID string
+	err       error
+}
+
+// handleBatch handles every message of the batch, returning the ones which failed other than by
+// being deferred, and measures the batch when the registry has an emitter.
+func (r *Registry) handleBatch(ctx context.Context, event events.SQSEvent) []messageFailure {
+	start := time.Now()
+	var failures []messageFailure
+	for _, message := range event.Records {
+		if err := r.handleMessage(ctx, message); err != nil && !IsDeferred(err) {
+			failures = append(failures, messageFailure{messageID: message.MessageId, err: err})
+		}
+	}
+	r.mu.RLock()
+	emitter := r.emitter
+	r.mu.RUnlock()
+	if emitter != nil {
+		MeasureBatch(emitter, event, len(failures), start)
+	}
+	return failures
+}
+
+// handleMessage parses the task out of the message and dispatches it.
+func (r *Registry) handleMessage(ctx context.Context, message events.SQSMessage) error {
+	task, err := ParseTask(message)
+	if err != nil {
+		return err
+	}
+	return r.Dispatch(ctx, task)
+}
+
+// Start starts the consumer function, handling the messages of the queue with the registry. Failed
+// messages are reported with HandleSQSBatch when the consumerenv.ReportBatchItemFailures envar is "true",
+// functions created before the mapping could read them fail the whole batch with HandleSQS.
+func Start(r *Registry) {
+	if os.Getenv(consumerenv.ReportBatchItemFailures) == "true" {
+		lambda.Start(r.HandleSQSBatch)
+		return
+	}
+	lambda.Start(r.HandleSQS)
+}
@@ -0,0 +1,122 @@
+// Package taskrunner is the runtime of the consumer functions. Messages on a pipeline's queue are
+// task envelopes, naming the type of the task and carrying its payload, and each type is handled by
+// the Go function registered for it on a Registry. Teams plug their business logic into every
+// pipeline by registering their handlers and calling Start from their consume binary:
+//
+//	registry := taskrunner.NewRegistry()
+//	registry.Use(taskrunner.Log(log), taskrunner.Recover(log))
+//	registry.MustRegister("resize-image", func(ctx context.Context, p ResizeImage) error { ... })
+//	taskrunner.Start(registry)
+package taskrunner
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+// Envelope is the format of the messages sent to a pipeline's queue.
+type Envelope struct {
+	Type    string          `json:"type"`              // task type, the key of the handler in the registry
+	ID      string          `json:"id"`                // ID of the task, chosen by the sender
+	Payload json.RawMessage `json:"payload,omitempty"` // decoded into the handler's argument
+}
+
+// NewEnvelope returns an envelope for a task of the given type with the payload marshalled as JSON.
+func NewEnvelope(taskType, id string, payload interface{}) (Envelope, error) {
+	if taskType == "" {
+		return Envelope{}, errors.New("task type is required")
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, errors.Wrapf(err, "failed to marshal payload of task %s", id)
+	}
+	return Envelope{Type: taskType, ID: id, Payload: raw}, nil
+}
+
+// Encode returns the message body of a task of the given type, for sending to a pipeline's queue.
+func Encode(taskType, id string, payload interface{}) (string, error) {
+	envelope, err := NewEnvelope(taskType, id, payload)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal task %s", id)
+	}
+	return string(body), nil
+}
+
+// Task is a task received from the queue, the envelope along with the delivery of its message.
+type Task struct {
+	Envelope
+	MessageID       string    `json:"message_id"`
+	Attempt         int       `json:"attempt"`           // times the message has been received, 1 on the first delivery
+	SentAt          time.Time `json:"sent_at"`           // when the message was sent to the queue
+	FirstReceivedAt time.Time `json:"first_received_at"` // when the message was first received, zero if unknown
+	Source          string    `json:"source"`            // ARN of the queue
+	ReceiptHandle   string    `json:"-"`                 // handle of this receive of the message
+
+	Body              string                                `json:"-"` // body of the message, sent again when the task is deferred
+	MessageAttributes map[string]events.SQSMessageAttribute `json:"-"` // attributes of the message, sent again along with the body
+}
+
+// Decode unmarshals the task's payload into v.
+func (t Task) Decode(v interface{}) error {
+	if len(t.Payload) == 0 {
+		return nil
+	}
+	return errors.Wrapf(json.Unmarshal(t.Payload, v), "failed to decode payload of %s task %s", t.Type, t.ID)
+}
+
+// ParseTask returns the task carried by the SQS message.
+func ParseTask(message events.SQSMessage) (Task, error) {
+	task := Task{
+		MessageID:       message.MessageId,
+		Attempt:         attributeInt(message, "ApproximateReceiveCount"),
+		SentAt:          attributeTime(message, "SentTimestamp"),
+		FirstReceivedAt: attributeTime(message, "ApproximateFirstReceiveTimestamp"),
+		Source:          message.EventSourceARN,
+		ReceiptHandle:   message.ReceiptHandle,
+
+		Body:              message.Body,
+		MessageAttributes: message.MessageAttributes,
+	}
+	if err := json.Unmarshal([]byte(message.Body), &task.Envelope); err != nil {
+		return task, errors.Wrapf(err, "message %s is not a task envelope", message.MessageId)
+	}
+	if task.Type == "" {
+		return task, errors.Errorf("message %s is not a task envelope: no task type", message.MessageId)
+	}
+	return task, nil
+}
+
+type taskKey struct{}
+
+// WithTask returns a context carrying the task.
+func WithTask(ctx context.Context, task Task) context.Context {
+	return context.WithValue(ctx, taskKey{}, task)
+}
+
+// TaskFromContext returns the task being handled, so that typed handlers can read its ID and
+// delivery, and whether there is one.
+func TaskFromContext(ctx context.Context) (Task, bool) {
+	task, ok := ctx.Value(taskKey{}).(Task)
+	return task, ok
+}
+
+func attributeInt(message events.SQSMessage, name string) int {
+	i, _ := strconv.Atoi(message.Attributes[name])
+	return i
+}
+
+func attributeTime(message events.SQSMessage, name string) time.Time {
+	millis, err := strconv.ParseInt(message.Attributes[name], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,399 @@
+package taskrunner_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/kinluek/serverless-controlled-batch-processing/metrics"
+	"github.com/kinluek/serverless-controlled-batch-processing/ratelimit"
+	"github.com/kinluek/serverless-controlled-batch-processing/taskrunner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type resize struct {
+	URL   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+func message(t *testing.T, id, taskType string, payload interface{}) events.SQSMessage {
+	body, err := taskrunner.Encode(taskType, id, payload)
+	if err != nil {
+		t.Fatalf("failed to encode task: %v", err)
+	}
+	return events.SQSMessage{
+		MessageId: "message-" + id,
+		Body:      body,
+		Attributes: map[string]string{
+			"ApproximateReceiveCount": "2",
+			"SentTimestamp":           "1588334400000",
+		},
+		EventSourceARN: "arn:aws:sqs:eu-west-2:000000000000:queue",
+	}
+}
+
+func TestRegistryRoutesTypedTasks(t *testing.T) {
+	r := taskrunner.NewRegistry()
+	var got []resize
+	var tasks []taskrunner.Task
+	r.MustRegister("resize", func(ctx context.Context, p resize) error {
+		task, _ := taskrunner.TaskFromContext(ctx)
+		got, tasks = append(got, p), append(tasks, task)
+		return nil
+	})
+	var pointers []*resize
+	r.MustRegister("resize-ptr", func(ctx context.Context, p *resize) error {
+		pointers = append(pointers, p)
+		return nil
+	})
+
+	err := r.HandleSQS(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		message(t, "1", "resize", resize{URL: "a.png", Width: 100}),
+		message(t, "2", "resize-ptr", resize{URL: "b.png", Width: 200}),
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []resize{{URL: "a.png", Width: 100}}, got)
+	if assert.Len(t, pointers, 1) {
+		assert.Equal(t, resize{URL: "b.png", Width: 200}, *pointers[0])
+	}
+	if assert.Len(t, tasks, 1) {
+		assert.Equal(t, "1", tasks[0].ID)
+		assert.Equal(t, "message-1", tasks[0].MessageID)
+		assert.Equal(t, 2, tasks[0].Attempt)
+		assert.Equal(t, time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC), tasks[0].SentAt)
+		assert.Equal(t, "arn:aws:sqs:eu-west-2:000000000000:queue", tasks[0].Source)
+	}
+}
+
+func TestRegistryRejectsInvalidHandlers(t *testing.T) {
+	r := taskrunner.NewRegistry()
+	assert.Error(t, r.Register("bad", func(p resize) error { return nil }))
+	assert.Error(t, r.Register("bad", func(ctx context.Context, p resize) {}))
+	assert.Error(t, r.Register("bad", "not a func"))
+	assert.Error(t, r.Register("", func(ctx context.Context, p resize) error { return nil }))
+	assert.NoError(t, r.Register("ok", func(ctx context.Context, p resize) error { return nil }))
+	assert.Error(t, r.Register("ok", func(ctx context.Context, p resize) error { return nil }))
+	assert.Equal(t, []string{"ok"}, r.Types())
+}
+
+func TestHandleSQSFailsBatchOnAnyFailure(t *testing.T) {
+	r := taskrunner.NewRegistry()
+	handled := 0
+	r.MustRegister("resize", func(ctx context.Context, p resize) error {
+		handled++
+		if p.Width == 0 {
+			return errors.New("no width")
+		}
+		return nil
+	})
+
+	err := r.HandleSQS(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		message(t, "1", "resize", resize{Width: 0}),
+		message(t, "2", "unknown", nil),
+		{MessageId: "message-3", Body: "not json"},
+		message(t, "4", "resize", resize{Width: 10}),
+	}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "3 of 4 tasks failed")
+		assert.Contains(t, err.Error(), "no width")
+		assert.Contains(t, err.Error(), `no handler registered for task type "unknown"`)
+		assert.Contains(t, err.Error(), "message-3 is not a task envelope")
+	}
+	assert.Equal(t, 2, handled)
+}
+
+func TestMiddlewareLogsRecoversAndMeasures(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	var buf bytes.Buffer
+	r := taskrunner.NewRegistry()
+	r.Use(taskrunner.Log(log), taskrunner.Metrics(metrics.New(&buf, "Test")), taskrunner.Recover(log))
+	r.MustRegister("panics", func(ctx context.Context, p resize) error {
+		panic("boom")
+	})
+
+	err := r.HandleSQS(context.Background(), events.SQSEvent{Records: []events.SQSMessage{message(t, "1", "panics", resize{})}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "panic occurred: boom")
+	}
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, "panics", entry.Data["task_type"])
+		assert.Equal(t, "1", entry.Data["task_id"])
+		assert.Contains(t, entry.Message, "fail - handling panics task 1")
+	}
+	assert.Contains(t, buf.String(), `"TaskType":"panics"`)
+	assert.Contains(t, buf.String(), `"Errors":1`)
+}
+
+func TestThrottledTasksAreCountedAndLogged(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	var buf bytes.Buffer
+	r := taskrunner.NewRegistry()
+	r.Use(taskrunner.Log(log), taskrunner.Metrics(metrics.New(&buf, "Test")))
+	r.MustRegister("resize", func(ctx context.Context, p resize) error {
+		res := &http.Response{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}
+		return errors.Wrap(taskrunner.CheckResponse(res), "failed to resize "+p.URL)
+	})
+
+	task, err := taskrunner.ParseTask(message(t, "1", "resize", resize{URL: "a.png"}))
+	if err != nil {
+		t.Fatalf("failed to parse task: %v", err)
+	}
+	err = r.Dispatch(context.Background(), task)
+	assert.True(t, taskrunner.IsThrottled(err))
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.WarnLevel, entry.Level)
+		assert.Contains(t, entry.Message, "throttled - handling resize task 1")
+	}
+	assert.Contains(t, buf.String(), `"Throttled":1`)
+	assert.Contains(t, buf.String(), `"Errors":1`)
+	assert.Contains(t, buf.String(), `["FunctionName"]`, "throttles can be read by function")
+
+	assert.NoError(t, taskrunner.CheckResponse(&http.Response{StatusCode: http.StatusOK}))
+	err = taskrunner.CheckResponse(&http.Response{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error"})
+	assert.Error(t, err)
+	assert.False(t, taskrunner.IsThrottled(err))
+	assert.Nil(t, taskrunner.Throttled(nil))
+}
+
+func TestHandleSQSBatchReportsFailedMessages(t *testing.T) {
+	r := taskrunner.NewRegistry()
+	r.MustRegister("resize", func(ctx context.Context, p resize) error {
+		if p.Width == 0 {
+			return errors.New("no width")
+		}
+		return nil
+	})
+
+	res, err := r.HandleSQSBatch(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		message(t, "1", "resize", resize{Width: 0}),
+		message(t, "2", "resize", resize{Width: 10}),
+		message(t, "3", "unknown", nil),
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{
+		{ItemIdentifier: "message-1"},
+		{ItemIdentifier: "message-3"},
+	}}, res)
+
+	res, err = r.HandleSQSBatch(context.Background(), events.SQSEvent{Records: []events.SQSMessage{message(t, "4", "resize", resize{Width: 10})}})
+	assert.NoError(t, err)
+	buf, _ := json.Marshal(res)
+	assert.JSONEq(t, `{"batchItemFailures": []}`, string(buf))
+}
+
+func TestMeasureBatches(t *testing.T) {
+	var buf bytes.Buffer
+	r := taskrunner.NewRegistry()
+	r.MeasureBatches(metrics.New(&buf, "Test"))
+	r.MustRegister("resize", func(ctx context.Context, p resize) error {
+		if p.Width == 0 {
+			return errors.New("no width")
+		}
+		return nil
+	})
+
+	oldest := message(t, "1", "resize", resize{Width: 0})
+	newest := message(t, "2", "resize", resize{Width: 10})
+	sent := time.Now().Add(-time.Minute)
+	oldest.Attributes["SentTimestamp"] = strconv.FormatInt(sent.UnixNano()/int64(time.Millisecond), 10)
+	newest.Attributes["SentTimestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	if _, err := r.HandleSQSBatch(context.Background(), events.SQSEvent{Records: []events.SQSMessage{oldest, newest}}); err != nil {
+		t.Fatalf("failed to handle batch: %v", err)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed to decode metrics line %q: %v", buf.String(), err)
+	}
+	assert.Equal(t, 1.0, line[taskrunner.MetricBatches])
+	assert.Equal(t, 2.0, line[taskrunner.MetricBatchSize])
+	assert.Equal(t, 1.0, line[taskrunner.MetricBatchFailures])
+	assert.Contains(t, line, taskrunner.MetricBatchDuration)
+	age, _ := line[taskrunner.MetricOldestMessageAge].(float64)
+	assert.InDelta(t, time.Minute.Seconds()*1000, age, 5000, "the age should be the oldest message's")
+
+	buf.Reset()
+	unsent := message(t, "3", "resize", resize{Width: 10})
+	delete(unsent.Attributes, "SentTimestamp")
+	assert.NoError(t, r.HandleSQS(context.Background(), events.SQSEvent{Records: []events.SQSMessage{unsent}}))
+	assert.Contains(t, buf.String(), `"OldestMessageAge":0`, "messages without a sent timestamp have no age")
+}
+
+func TestRateLimitWaitsOrDefers(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	var deferred []time.Duration
+	deferrer := taskrunner.DeferrerFunc(func(ctx context.Context, task taskrunner.Task, delay time.Duration) error {
+		assert.Equal(t, "receipt-"+task.ID, task.ReceiptHandle)
+		deferred = append(deferred, delay)
+		return nil
+	})
+	rates := func(task taskrunner.Task) (string, float64) {
+		if task.Type == "unlimited" {
+			return "", 0
+		}
+		return "pipeline", 4
+	}
+	r := taskrunner.NewRegistry()
+	r.Use(taskrunner.Log(log), taskrunner.RateLimit(ratelimit.NewMemoryLimiter(), rates, deferrer))
+	handled := 0
+	handler := func(ctx context.Context, p resize) error {
+		handled++
+		return nil
+	}
+	r.MustRegister("resize", handler)
+	r.MustRegister("unlimited", handler)
+
+	batch := func(taskType string, ids ...string) events.SQSEvent {
+		var event events.SQSEvent
+		for _, id := range ids {
+			m := message(t, id, taskType, resize{})
+			m.ReceiptHandle = "receipt-" + id
+			event.Records = append(event.Records, m)
+		}
+		return event
+	}
+
+	// a second's worth of tasks go straight through, the next waits a quarter of a second for its token.
+	start := time.Now()
+	res, err := r.HandleSQSBatch(context.Background(), batch("resize", "1", "2", "3", "4", "5"))
+	assert.NoError(t, err)
+	assert.Empty(t, res.BatchItemFailures)
+	assert.Equal(t, 5, handled)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "the fifth task should wait for its token")
+	assert.Empty(t, deferred)
+
+	// tasks which can not wait until their token is due are deferred.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res, err = r.HandleSQSBatch(ctx, batch("resize", "6"))
+	assert.NoError(t, err)
+	assert.Empty(t, res.BatchItemFailures, "deferred messages are back on the queue and should not be retried")
+	assert.Equal(t, []time.Duration{time.Second}, deferred)
+	assert.Equal(t, 5, handled)
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.InfoLevel, entry.Level)
+		assert.Contains(t, entry.Message, "deferred - handling resize task 6")
+	}
+
+	assert.NoError(t, r.HandleSQS(ctx, batch("resize", "7")), "a deferred task should not fail the batch")
+	assert.Len(t, deferred, 2)
+
+	_, err = r.HandleSQSBatch(ctx, batch("unlimited", "8", "9"))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, handled, "tasks without a rate are not limited")
+}
+
+func TestDeferThrottledBacksOff(t *testing.T) {
+	var delays []time.Duration
+	var throttles []string
+	failDefer := false
+	deferrer := taskrunner.DeferrerFunc(func(ctx context.Context, task taskrunner.Task, delay time.Duration) error {
+		if failDefer {
+			return errors.New("queue unavailable")
+		}
+		delays = append(delays, delay)
+		throttles = append(throttles, *task.MessageAttributes[taskrunner.AttributeThrottles].StringValue)
+		return nil
+	})
+	var buf bytes.Buffer
+	r := taskrunner.NewRegistry()
+	r.Use(taskrunner.DeferThrottled(deferrer), taskrunner.Metrics(metrics.New(&buf, "Test")))
+	r.MustRegister("resize", func(ctx context.Context, p resize) error {
+		if p.Width == 0 {
+			return errors.New("no width")
+		}
+		return taskrunner.Throttled(errors.New("downstream responded 429 Too Many Requests"))
+	})
+
+	throttled := func(id string, throttles int) events.SQSMessage {
+		m := message(t, id, "resize", resize{Width: 100})
+		if throttles > 0 {
+			n := strconv.Itoa(throttles)
+			m.MessageAttributes = map[string]events.SQSMessageAttribute{taskrunner.AttributeThrottles: {DataType: "Number", StringValue: &n}}
+		}
+		return m
+	}
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		throttled("1", 0),
+		throttled("2", 2),
+		throttled("3", 7),
+		throttled("4", taskrunner.MaxThrottleDeferrals),
+		message(t, "5", "resize", resize{}),
+	}}
+	res, err := r.HandleSQSBatch(context.Background(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{10 * time.Second, 40 * time.Second, taskrunner.MaxDeferral}, delays)
+	assert.Equal(t, []string{"1", "3", "8"}, throttles)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "message-4"}, {ItemIdentifier: "message-5"}}, res.BatchItemFailures,
+		"tasks throttled too many times in a row and other failures should be retried")
+	assert.Equal(t, 4, strings.Count(buf.String(), `"Throttled":1`), "throttles should be counted before being deferred")
+
+	failDefer = true
+	task, err := taskrunner.ParseTask(throttled("6", 0))
+	if err != nil {
+		t.Fatalf("failed to parse task: %v", err)
+	}
+	err = r.Dispatch(context.Background(), task)
+	assert.True(t, taskrunner.IsThrottled(err), "a throttle which can not be deferred should fail the task")
+}
+
+// deferSQS records the messages sent and deleted by the SQSDeferrer.
+type deferSQS struct {
+	sqsiface.SQSAPI
+	sent    []*sqs.SendMessageInput
+	deleted []string
+}
+
+func (s *deferSQS) GetQueueUrlWithContext(ctx aws.Context, in *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.eu-west-2.amazonaws.com/000000000000/" + *in.QueueName)}, nil
+}
+
+func (s *deferSQS) SendMessageWithContext(ctx aws.Context, in *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	s.sent = append(s.sent, in)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (s *deferSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	s.deleted = append(s.deleted, *in.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestSQSDeferrerSendsMessageAgain(t *testing.T) {
+	svc := &deferSQS{}
+	m := message(t, "1", "resize", resize{Width: 10})
+	m.ReceiptHandle = "receipt-1"
+	m.MessageAttributes = map[string]events.SQSMessageAttribute{"team": {DataType: "String", StringValue: aws.String("a")}}
+	task, err := taskrunner.ParseTask(m)
+	if err != nil {
+		t.Fatalf("failed to parse task: %v", err)
+	}
+
+	d := taskrunner.NewSQSDeferrer(svc)
+	assert.NoError(t, d.Defer(context.Background(), task, 1500*time.Millisecond))
+	assert.NoError(t, d.Defer(context.Background(), task, time.Hour))
+	if assert.Len(t, svc.sent, 2) {
+		sent := svc.sent[0]
+		assert.Equal(t, "https://sqs.eu-west-2.amazonaws.com/000000000000/queue", aws.StringValue(sent.QueueUrl))
+		assert.Equal(t, m.Body, aws.StringValue(sent.MessageBody))
+		assert.Equal(t, int64(2), aws.Int64Value(sent.DelaySeconds), "delays are rounded up to whole seconds")
+		if assert.Contains(t, sent.MessageAttributes, "team") {
+			assert.Equal(t, "a", aws.StringValue(sent.MessageAttributes["team"].StringValue))
+		}
+		assert.Equal(t, int64(900), aws.Int64Value(svc.sent[1].DelaySeconds), "SQS delays messages by 15 minutes at most")
+	}
+	assert.Equal(t, []string{"receipt-1", "receipt-1"}, svc.deleted)
+}
@@ -0,0 +1,117 @@
+package taskrunner
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// ThrottleBackoff is how long a throttled task is first deferred for, the delay doubles with
+	// each throttle in a row up to MaxDeferral.
+	ThrottleBackoff = 10 * time.Second
+
+	// MaxThrottleDeferrals is how many times in a row a throttled task is deferred, after which it
+	// fails so that a task the downstream API keeps turning away still reaches the dead letter queue.
+	MaxThrottleDeferrals = 8
+
+	// AttributeThrottles is the message attribute counting the throttles in a row of a deferred task.
+	AttributeThrottles = "Throttles"
+)
+
+// ThrottledError is returned by handlers whose task was turned away by the downstream API for
+// going over its rate limit, such as an HTTP 429. Throttled tasks are told apart so that the
+// Metrics middleware can count them and adaptive concurrency back off, and so that DeferThrottled
+// can defer them rather than fail them.
+type ThrottledError struct {
+	Err error
+}
+
+func (e *ThrottledError) Error() string {
+	return "throttled: " + e.Err.Error()
+}
+
+// Throttled marks the error as a throttling of the task by the downstream API, nil stays nil.
+func Throttled(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ThrottledError{Err: err}
+}
+
+// IsThrottled reports whether the cause of the error is a ThrottledError.
+func IsThrottled(err error) bool {
+	_, ok := errors.Cause(err).(*ThrottledError)
+	return ok
+}
+
+// CheckResponse returns nil for a successful HTTP response, a ThrottledError for a 429 Too Many
+// Requests and an error with the status for any other response.
+func CheckResponse(res *http.Response) error {
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusTooManyRequests:
+		return Throttled(errors.Errorf("downstream responded %s", res.Status))
+	default:
+		return errors.Errorf("downstream responded %s", res.Status)
+	}
+}
+
+// DeferThrottled takes a deferrer and returns a middleware which defers the message of throttled
+// tasks, backing off from ThrottleBackoff, and returns a *DeferredError in place of the throttle,
+// so that throttles do not count towards the queue's maxReceiveCount. The throttles in a row are
+// counted in the AttributeThrottles message attribute, once a task has been deferred
+// MaxThrottleDeferrals times, or can not be deferred, the throttle fails it as any other error.
+// Middlewares after it still see the throttle, the Metrics middleware should come after it.
+func DeferThrottled(deferrer Deferrer) Middleware {
+
+	// Middleware to return.
+	return func(before HandlerFunc) HandlerFunc {
+
+		// Handler to return.
+		return func(ctx context.Context, task Task) error {
+			err := before(ctx, task)
+			if !IsThrottled(err) {
+				return err
+			}
+			throttles := throttlesOf(task)
+			if throttles >= MaxThrottleDeferrals {
+				return err
+			}
+			delay := ThrottleBackoff << uint(throttles)
+			if delay > MaxDeferral {
+				delay = MaxDeferral
+			}
+			task.MessageAttributes = withThrottles(task.MessageAttributes, throttles+1)
+			if deferErr := deferrer.Defer(ctx, task, delay); deferErr != nil {
+				return errors.Wrapf(err, "failed to defer throttled task %s (%v)", task.ID, deferErr)
+			}
+			return &DeferredError{Delay: delay, Err: err}
+		}
+	}
+}
+
+// throttlesOf returns the throttles in a row the task was deferred for, zero if it never was.
+func throttlesOf(task Task) int {
+	a, ok := task.MessageAttributes[AttributeThrottles]
+	if !ok || a.StringValue == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(*a.StringValue)
+	return n
+}
+
+// withThrottles returns a copy of the message attributes with the throttles count set.
+func withThrottles(attributes map[string]events.SQSMessageAttribute, throttles int) map[string]events.SQSMessageAttribute {
+	copied := make(map[string]events.SQSMessageAttribute, len(attributes)+1)
+	for name, a := range attributes {
+		copied[name] = a
+	}
+	n := strconv.Itoa(throttles)
+	copied[AttributeThrottles] = events.SQSMessageAttribute{DataType: "Number", StringValue: &n}
+	return copied
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Instrument adds handlers which log every AWS call made with the handlers, failures as warnings
+// and the rest at debug level, along with the correlation ID carried by the context the call was
+// made with, and record it as a span of the span in the context. Calls are only tied to the work they are part of when made WithContext.
+//
+// A nil logger only records spans.
+func Instrument(handlers *request.Handlers, log *logrus.Logger) {
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "tracing.Instrument",
+		Fn: func(r *request.Request) {
+			ctx := r.Context()
+			end := time.Now()
+			attributes := map[string]string{
+				"service":    r.ClientInfo.ServiceName,
+				"operation":  r.Operation.Name,
+				"request_id": r.RequestID,
+			}
+			Record(ctx, fmt.Sprintf("%s.%s", r.ClientInfo.ServiceName, r.Operation.Name), r.Time, end, attributes, r.Error)
+			if log == nil {
+				return
+			}
+			fields := logrus.Fields{
+				"correlation_id": CorrelationID(ctx),
+				"service":        r.ClientInfo.ServiceName,
+				"operation":      r.Operation.Name,
+				"aws_request_id": r.RequestID,
+				"retry_count":    r.RetryCount,
+				"duration_ms":    end.Sub(r.Time).Milliseconds(),
+			}
+			if r.HTTPResponse != nil {
+				fields["status_code"] = r.HTTPResponse.StatusCode
+			}
+			if r.Error != nil {
+				log.WithFields(fields).Warnf("aws call failed: %v", r.Error)
+				return
+			}
+			log.WithFields(fields).Debug("aws call")
+		},
+	})
+}
@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net"
+	"regexp"
+	"sync"
+)
+
+// DefaultXRayDaemonAddress is the address the X-Ray daemon listens on, Lambda sets the
+// AWS_XRAY_DAEMON_ADDRESS envar to the address of its own when active tracing is on.
+const DefaultXRayDaemonAddress = "127.0.0.1:2000"
+
+var _ Exporter = (*Recorder)(nil)
+
+// Recorder is an Exporter which keeps the spans in memory, for use in tests and local runs.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// Export records the span.
+func (r *Recorder) Export(span Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+	return nil
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (r *Recorder) Spans() []Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Span(nil), r.spans...)
+}
+
+// XRayExporter sends spans to an X-Ray daemon over UDP. Spans in a trace started by Lambda are
+// sent as subsegments of the function's segment, and root spans of traces started here as segments.
+type XRayExporter struct {
+	conn net.Conn
+}
+
+// NewXRayExporter returns a new instance of XRayExporter sending to the daemon at the address, an
+// empty address uses DefaultXRayDaemonAddress.
+func NewXRayExporter(address string) (*XRayExporter, error) {
+	if address == "" {
+		address = DefaultXRayDaemonAddress
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial X-Ray daemon at %s", address)
+	}
+	return &XRayExporter{conn: conn}, nil
+}
+
+// xrayHeader is sent ahead of each document.
+const xrayHeader = `{"format": "json", "version": 1}` + "\n"
+
+type (
+	xrayDocument struct {
+		Name        string            `json:"name"`
+		ID          string            `json:"id"`
+		TraceID     string            `json:"trace_id"`
+		ParentID    string            `json:"parent_id,omitempty"`
+		Type        string            `json:"type,omitempty"`
+		StartTime   float64           `json:"start_time"`
+		EndTime     float64           `json:"end_time"`
+		Fault       bool              `json:"fault,omitempty"`
+		Cause       *xrayCause        `json:"cause,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	xrayCause struct {
+		Exceptions []xrayException `json:"exceptions"`
+	}
+	xrayException struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+)
+
+// Export sends the span to the daemon.
+func (e *XRayExporter) Export(span Span) error {
+	doc := xrayDocument{
+		Name:      xraySanitizer.ReplaceAllString(span.Name, "_"),
+		ID:        span.ID,
+		TraceID:   span.TraceID,
+		ParentID:  span.ParentID,
+		StartTime: float64(span.Start.UnixNano()) / 1e9,
+		EndTime:   float64(span.End.UnixNano()) / 1e9,
+	}
+	if span.ParentID != "" {
+		doc.Type = "subsegment"
+	}
+	if span.Error != "" {
+		doc.Fault = true
+		doc.Cause = &xrayCause{Exceptions: []xrayException{{ID: randomHex(8), Message: span.Error}}}
+	}
+	if len(span.Attributes) > 0 {
+		doc.Annotations = make(map[string]string, len(span.Attributes))
+		for k, v := range span.Attributes {
+			doc.Annotations[xrayAnnotationKey.ReplaceAllString(k, "_")] = v
+		}
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal segment")
+	}
+	_, err = e.conn.Write(append([]byte(xrayHeader), body...))
+	return errors.Wrapf(err, "failed to send segment %s", span.Name)
+}
+
+// Close closes the connection to the daemon.
+func (e *XRayExporter) Close() error {
+	return e.conn.Close()
+}
+
+var (
+	// xraySanitizer matches the characters X-Ray does not allow in segment names.
+	xraySanitizer = regexp.MustCompile(`[^\p{L}\p{N}\s_.:/%&#=+\-@]`)
+
+	// xrayAnnotationKey matches the characters X-Ray does not allow in annotation keys.
+	xrayAnnotationKey = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
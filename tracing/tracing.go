@@ -0,0 +1,222 @@
+// Package tracing ties the work done for a stream record together. A correlation ID carried by
+// the context is added to the log fields of everything done for the record, down to the AWS calls,
+// and optional spans time each part of the work, exported to X-Ray or kept in memory for tests.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	correlationKey struct{}
+	tracerKey      struct{}
+	spanKey        struct{}
+)
+
+// NewCorrelationID returns the correlation ID of the work done by the Lambda request for the
+// stream event, either may be empty. A random ID is returned when both are.
+func NewCorrelationID(eventID, requestID string) string {
+	switch {
+	case eventID != "" && requestID != "":
+		return requestID + "/" + eventID
+	case eventID != "":
+		return eventID
+	case requestID != "":
+		return requestID
+	}
+	return randomHex(16)
+}
+
+// WithCorrelationID returns a context carrying the correlation ID.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, empty if there is none.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Span is a timed part of the work, spans share the trace ID of the work they are part of and
+// point at the span they were started in.
+type Span struct {
+	TraceID    string
+	ID         string
+	ParentID   string // empty for the root span of a trace started here
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// Exporter sends finished spans to a collector.
+type Exporter interface {
+	Export(span Span) error
+}
+
+// Tracer starts spans and exports them once they end. A failure to export is logged, tracing
+// never fails the work being traced.
+type Tracer struct {
+	exporter Exporter
+	log      *logrus.Logger
+}
+
+// NewTracer returns a new instance of Tracer exporting to the exporter.
+func NewTracer(exporter Exporter, log *logrus.Logger) *Tracer {
+	return &Tracer{exporter: exporter, log: log}
+}
+
+// WithTracer returns a context carrying the tracer, spans are only started in contexts carrying one.
+func WithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// ActiveSpan is a span which has been started and not yet ended. The methods of a nil ActiveSpan
+// do nothing, so that code can be traced whether or not tracing is on.
+type ActiveSpan struct {
+	tracer  *Tracer
+	sampled bool
+	mu      sync.Mutex
+	span    Span
+	ended   bool
+}
+
+// Start starts a span named name as a child of the span in the context, or as the root of a new
+// trace when there is none. The returned context carries the new span. Without a tracer in the
+// context no span is started and the returned span is nil.
+func Start(ctx context.Context, name string) (context.Context, *ActiveSpan) {
+	tracer, ok := ctx.Value(tracerKey{}).(*Tracer)
+	if !ok || tracer == nil {
+		return ctx, nil
+	}
+	span := &ActiveSpan{
+		tracer:  tracer,
+		sampled: true,
+		span: Span{
+			ID:         randomHex(8),
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: make(map[string]string),
+		},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*ActiveSpan); ok {
+		span.span.TraceID, span.span.ParentID, span.sampled = parent.span.TraceID, parent.span.ID, parent.sampled
+	} else if header, ok := lambdaTraceHeader(ctx); ok {
+		span.span.TraceID, span.span.ParentID, span.sampled = header.root, header.parent, header.sampled
+	} else {
+		span.span.TraceID = newTraceID(span.span.Start)
+	}
+	if id := CorrelationID(ctx); id != "" {
+		span.span.Attributes["correlation_id"] = id
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Record exports a span of work which has already finished, as a child of the span in the context.
+func Record(ctx context.Context, name string, start, end time.Time, attributes map[string]string, err error) {
+	_, span := Start(ctx, name)
+	if span == nil {
+		return
+	}
+	span.span.Start = start
+	for k, v := range attributes {
+		span.span.Attributes[k] = v
+	}
+	span.end(end, err)
+}
+
+// SetAttribute sets an attribute on the span.
+func (s *ActiveSpan) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.span.Attributes[key] = value
+}
+
+// End ends the span with the error the work ended with, if any, and exports it. Spans can only
+// be ended once, later calls do nothing.
+func (s *ActiveSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end(time.Now(), err)
+}
+
+func (s *ActiveSpan) end(at time.Time, err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = at
+	if err != nil {
+		s.span.Error = err.Error()
+	}
+	span := s.span
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	if eerr := s.tracer.exporter.Export(span); eerr != nil && s.tracer.log != nil {
+		s.tracer.log.WithField("correlation_id", span.Attributes["correlation_id"]).Warnf("failed to export span %s: %v", span.Name, eerr)
+	}
+}
+
+// traceHeader holds the fields of an X-Ray trace header, see
+// https://docs.aws.amazon.com/xray/latest/devguide/xray-concepts.html#xray-concepts-tracingheader
+type traceHeader struct {
+	root    string
+	parent  string
+	sampled bool
+}
+
+// lambdaTraceHeader returns the trace header the Lambda runtime put in the context, so that spans
+// are part of the trace of the invocation.
+func lambdaTraceHeader(ctx context.Context) (traceHeader, bool) {
+	raw, _ := ctx.Value("x-amzn-trace-id").(string)
+	return parseTraceHeader(raw)
+}
+
+func parseTraceHeader(raw string) (traceHeader, bool) {
+	header := traceHeader{sampled: true}
+	for _, part := range strings.Split(raw, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			header.root = kv[1]
+		case "Parent":
+			header.parent = kv[1]
+		case "Sampled":
+			header.sampled = kv[1] != "0"
+		}
+	}
+	return header, header.root != ""
+}
+
+// newTraceID returns a new X-Ray trace ID, the version, the start time in hex seconds and 96 random bits.
+func newTraceID(start time.Time) string {
+	return fmt.Sprintf("1-%08x-%s", start.Unix(), randomHex(12))
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,173 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/kinluek/serverless-controlled-batch-processing/localaws"
+	"github.com/kinluek/serverless-controlled-batch-processing/tracing"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCorrelationID(t *testing.T) {
+	assert.Equal(t, "request-1/event-1", tracing.NewCorrelationID("event-1", "request-1"))
+	assert.Equal(t, "event-1", tracing.NewCorrelationID("event-1", ""))
+	assert.Equal(t, "request-1", tracing.NewCorrelationID("", "request-1"))
+	assert.Len(t, tracing.NewCorrelationID("", ""), 32)
+
+	ctx := tracing.WithCorrelationID(context.Background(), "request-1/event-1")
+	assert.Equal(t, "request-1/event-1", tracing.CorrelationID(ctx))
+	assert.Equal(t, "", tracing.CorrelationID(context.Background()))
+}
+
+func TestStartNestsSpans(t *testing.T) {
+	rec := &tracing.Recorder{}
+	ctx := tracing.WithTracer(context.Background(), tracing.NewTracer(rec, nil))
+	ctx = tracing.WithCorrelationID(ctx, "corr-1")
+
+	ctx, root := tracing.Start(ctx, "root")
+	_, child := tracing.Start(ctx, "child")
+	child.SetAttribute("step", "create queue")
+	child.End(errors.New("boom"))
+	child.End(nil)
+	root.End(nil)
+
+	spans := rec.Spans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	c, r := spans[0], spans[1]
+	assert.Equal(t, "child", c.Name)
+	assert.Equal(t, r.TraceID, c.TraceID)
+	assert.Equal(t, r.ID, c.ParentID)
+	assert.Equal(t, "boom", c.Error)
+	assert.Equal(t, "create queue", c.Attributes["step"])
+	assert.Equal(t, "corr-1", c.Attributes["correlation_id"])
+	assert.Equal(t, "", r.ParentID)
+	assert.True(t, strings.HasPrefix(r.TraceID, "1-"))
+}
+
+func TestStartJoinsLambdaTrace(t *testing.T) {
+	rec := &tracing.Recorder{}
+	ctx := tracing.WithTracer(context.Background(), tracing.NewTracer(rec, nil))
+	ctx = context.WithValue(ctx, "x-amzn-trace-id", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	_, span := tracing.Start(ctx, "root")
+	span.End(nil)
+
+	unsampled := context.WithValue(ctx, "x-amzn-trace-id", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0")
+	_, span = tracing.Start(unsampled, "dropped")
+	span.End(nil)
+
+	spans := rec.Spans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", spans[0].TraceID)
+		assert.Equal(t, "53995c3f42cd8ad8", spans[0].ParentID)
+	}
+}
+
+func TestStartWithoutTracer(t *testing.T) {
+	ctx, span := tracing.Start(context.Background(), "nothing")
+	assert.Nil(t, span)
+	span.SetAttribute("key", "value")
+	span.End(nil)
+	assert.Equal(t, context.Background(), ctx)
+}
+
+func TestXRayExporterSendsToDaemon(t *testing.T) {
+	daemon, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer daemon.Close()
+	exporter, err := tracing.NewXRayExporter(daemon.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to create exporter: %v", err)
+	}
+	defer exporter.Close()
+
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	err = exporter.Export(tracing.Span{
+		TraceID:    "1-5eac0f40-000000000000000000000001",
+		ID:         "0000000000000002",
+		ParentID:   "0000000000000001",
+		Name:       "create queue",
+		Start:      start,
+		End:        start.Add(1500 * time.Millisecond),
+		Attributes: map[string]string{"correlation_id": "corr-1", "pipeline-id": "group-a"},
+		Error:      "boom",
+	})
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	daemon.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := daemon.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	parts := strings.SplitN(string(buf[:n]), "\n", 2)
+	if !assert.Len(t, parts, 2) {
+		return
+	}
+	assert.JSONEq(t, `{"format": "json", "version": 1}`, parts[0])
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(parts[1]), &doc); err != nil {
+		t.Fatalf("failed to unmarshal segment: %v", err)
+	}
+	assert.Equal(t, "create queue", doc["name"])
+	assert.Equal(t, "subsegment", doc["type"])
+	assert.Equal(t, "0000000000000001", doc["parent_id"])
+	assert.Equal(t, 1588334400.0, doc["start_time"])
+	assert.Equal(t, 1588334401.5, doc["end_time"])
+	assert.Equal(t, true, doc["fault"])
+	assert.Equal(t, map[string]interface{}{"correlation_id": "corr-1", "pipeline_id": "group-a"}, doc["annotations"])
+}
+
+func TestInstrumentTiesAWSCallsToCorrelationID(t *testing.T) {
+	ts := httptest.NewServer(localaws.New())
+	defer ts.Close()
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(ts.URL).
+		WithRegion("eu-west-2").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.DebugLevel)
+	tracing.Instrument(&sess.Handlers, log)
+	svc := sqs.New(sess)
+
+	rec := &tracing.Recorder{}
+	ctx := tracing.WithCorrelationID(context.Background(), "corr-1")
+	ctx, root := tracing.Start(tracing.WithTracer(ctx, tracing.NewTracer(rec, nil)), "root")
+	if _, err := svc.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{QueueName: aws.String("queue")}); err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	root.End(nil)
+
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.DebugLevel, entry.Level, "successful calls should only be logged at debug level")
+		assert.Equal(t, "corr-1", entry.Data["correlation_id"])
+		assert.Equal(t, "sqs", entry.Data["service"])
+		assert.Equal(t, "CreateQueue", entry.Data["operation"])
+	}
+	spans := rec.Spans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "sqs.CreateQueue", spans[0].Name)
+		assert.Equal(t, spans[1].ID, spans[0].ParentID)
+	}
+}